@@ -0,0 +1,173 @@
+package gokave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gkstore"
+	"io"
+	"path/filepath"
+)
+
+// backupStoreFile - the file in a store's backup holding its StoreConfig
+const backupStoreFile = "STORE"
+
+// Backup - write a backup of the store to w as a tar stream while the store stays in use. It holds
+// the store's settings along with its segments, or with a base what was added to them since the
+// base backup. See gkstore.KvStore.Backup
+func (store *Store) Backup(ctx context.Context, w io.Writer, base *gkstore.BackupInfo) (info gkstore.BackupInfo, err error) {
+	tarBackup := gkstore.NewTarBackup(w)
+	if info, err = store.backup(ctx, tarBackup, base); err != nil {
+		return
+	}
+	return info, newError("backup", store.name, "", tarBackup.Close())
+}
+
+// BackupToDirectory - as Backup but copying the files into directory, which mustn't hold anything
+// already. A full backup directory can be restored from as it is
+func (store *Store) BackupToDirectory(ctx context.Context, directory string, base *gkstore.BackupInfo) (info gkstore.BackupInfo, err error) {
+	fsys := store.db.options.fs
+	fileInfos, err := fsys.ReadDir(directory)
+	if err == nil && len(fileInfos) > 0 {
+		err = fmt.Errorf("Backup directory %s isn't empty", directory)
+	}
+	if err != nil && !gkfs.IsNotExist(err) {
+		return info, newError("backup", store.name, "", err)
+	}
+	return store.backup(ctx, gkstore.DirectoryBackup{FS: fsys, Directory: directory}, base)
+}
+
+// CheckBackupBase - whether an incremental backup of the store can be taken on from base. See
+// gkstore.KvStore.CheckBackupBase
+func (store *Store) CheckBackupBase(base gkstore.BackupInfo) (err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return newError("backup", store.name, "", store.kv.CheckBackupBase(base))
+}
+
+// ReadBackupInfo - what the backup in directory holds, e.g. as the base of an incremental backup
+func (db *DB) ReadBackupInfo(directory string) (info gkstore.BackupInfo, err error) {
+	info, err = gkstore.ReadBackupInfo(db.options.fs, directory)
+	return info, newError("backup", info.Store, "", err)
+}
+
+func (store *Store) backup(ctx context.Context, w gkstore.BackupWriter, base *gkstore.BackupInfo) (info gkstore.BackupInfo, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	// Keeps the settings and the data in step, as migrating the key case replaces both
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if info, err = store.kv.Backup(w, base); err != nil {
+		return info, newError("backup", store.name, "", err)
+	}
+	configBytes, err := json.MarshalIndent(store.config, "", "\t")
+	if err != nil {
+		return
+	}
+	err = w.WriteFile(backupStoreFile, int64(len(configBytes)), bytes.NewReader(configBytes))
+	return info, newError("backup", store.name, "", err)
+}
+
+// RestoreStore - create storeName from backups made by Store.Backup, replaying the changes in them up
+// to until (the zero RestorePoint for all of them). r is a full backup, followed by any incremental
+// backups taken on from it in order. The store gets the backed up store's settings, from the last
+// backup, but needn't have its name. See gkstore.Restore
+func (db *DB) RestoreStore(ctx context.Context, storeName string, r io.Reader, until gkstore.RestorePoint) (stats gkstore.RestoreStats, err error) {
+	if err = db.checkRestore(ctx, storeName); err != nil {
+		return
+	}
+	// Unpacked next to the store directories. Store names can't start with '_' so it can't clash
+	staging := filepath.Join(db.options.dataDirectory, "_restore-"+storeName)
+	fsys := db.options.fs
+	if err = gkfs.RemoveAll(fsys, staging); err != nil {
+		return stats, newError("restore", storeName, "", err)
+	}
+	defer gkfs.RemoveAll(fsys, staging)
+	directories, err := gkstore.ExtractBackups(fsys, r, staging)
+	if err != nil {
+		return stats, newError("restore", storeName, "", err)
+	}
+	return db.restoreStore(ctx, storeName, directories, until)
+}
+
+// RestoreStoreFromDirectories - as RestoreStore from backups made by Store.BackupToDirectory, a full
+// backup followed by any incremental backups taken on from it
+func (db *DB) RestoreStoreFromDirectories(ctx context.Context, storeName string, directories []string, until gkstore.RestorePoint) (stats gkstore.RestoreStats, err error) {
+	if err = db.checkRestore(ctx, storeName); err != nil {
+		return
+	}
+	return db.restoreStore(ctx, storeName, directories, until)
+}
+
+// checkRestore - fail early, before a backup is unpacked, if storeName can't be restored to
+func (db *DB) checkRestore(ctx context.Context, storeName string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = ValidateStoreName(storeName); err != nil {
+		return newError("restore", storeName, "", err)
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	switch {
+	case db.IsReplica():
+		err = ErrReplica
+	case db.nameTaken(storeName):
+		err = ErrStoreExists
+	default:
+		err = db.writable()
+	}
+	return newError("restore", storeName, "", err)
+}
+
+// restoreStore - the store is rebuilt in its directory before it is added to the config, so until
+// it is ready it isn't there at all
+func (db *DB) restoreStore(ctx context.Context, storeName string, backupDirectories []string, until gkstore.RestorePoint) (stats gkstore.RestoreStats, err error) {
+	if len(backupDirectories) == 0 {
+		return stats, newError("restore", storeName, "", fmt.Errorf("%w: no backups", gkstore.ErrBadBackup))
+	}
+	storeConfig := StoreConfig{KeyCase: KeyCasePreserve}
+	lastBackup := backupDirectories[len(backupDirectories)-1]
+	configBytes, err := gkfs.ReadFile(db.options.fs, filepath.Join(lastBackup, backupStoreFile))
+	if err == nil {
+		err = json.Unmarshal(configBytes, &storeConfig)
+	}
+	if err != nil && !gkfs.IsNotExist(err) {
+		return stats, newError("restore", storeName, "", fmt.Errorf("Bad store settings in backup: %w", err))
+	}
+	storeConfig.Name = storeName
+	codec, err := lookupCodec(storeConfig.Codec)
+	if err != nil {
+		return stats, newError("restore", storeName, "", err)
+	}
+
+	fmt.Printf("Restoring store %s from %d backups ending with %s\n", storeName, len(backupDirectories), lastBackup)
+	if stats, err = gkstore.Restore(backupDirectories, storeName, db.storeConfig(storeName), until); err != nil {
+		return stats, newError("restore", storeName, "", err)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err = db.writable(); err == nil && db.nameTaken(storeName) {
+		err = ErrStoreExists
+	}
+	var kv *gkstore.KvStore
+	if err == nil {
+		kv, err = gkstore.OpenWith(storeName, db.storeConfig(storeName))
+	}
+	if err == nil {
+		_, err = db.addStore(storeConfig, kv, codec)
+	}
+	if err != nil {
+		// A store created with the same name in the meantime has opened the directory itself
+		if err != ErrStoreExists {
+			gkfs.RemoveAll(db.options.fs, db.storeDirectory(storeName))
+		}
+		return stats, newError("restore", storeName, "", err)
+	}
+	fmt.Printf("Restored store %s: %d changes up to seq %d\n", storeName, stats.Records, stats.LastSeq)
+	return
+}
@@ -0,0 +1,119 @@
+package gokave
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave/gkstore"
+	"io"
+	"sort"
+)
+
+// BulkLoadOptions - how BulkLoad reads its input
+type BulkLoadOptions struct {
+	// Sort the input in memory before loading it, the last of any duplicate keys winning. Otherwise
+	// the input must already be in key order without duplicates, as Export writes it
+	Sort bool
+}
+
+// BulkLoadStats - what a bulk load added to a store
+type BulkLoadStats struct {
+	Store    string
+	Loaded   int
+	Segments []string // the new segment files
+	Bytes    int64
+}
+
+// BulkLoad - add the keys and values read from r, JSON lines of ExportRecord as written by Export,
+// to a store much faster than Import by writing them straight into new segment files which are then
+// attached to the store all at once. It works on the store's files without opening the DB, so the
+// store must not be open anywhere else (e.g. by a running server) or it fails with
+// ErrStoreLocked. The store has to exist already. Each value is written with its meta, if
+// any, and gets a new version, replacing any value the store already has. Unless loadOpts.Sort is set a
+// key that isn't after the one before it fails with ErrBadImport. A load that fails adds nothing
+func BulkLoad(ctx context.Context, storeName string, r io.Reader, loadOpts BulkLoadOptions, opts ...Option) (stats BulkLoadStats, err error) {
+	stats.Store = storeName
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.readOnly {
+		return stats, newError("bulk load", storeName, "", ErrReadOnly)
+	}
+	if o.replica {
+		return stats, newError("bulk load", storeName, "", ErrReplica)
+	}
+	config, err := readConfig(o.fs, o.configFile)
+	if err != nil {
+		return stats, newError("bulk load", storeName, "", err)
+	}
+	storeConfig := config.store(storeName)
+	if storeConfig == nil {
+		return stats, newError("bulk load", storeName, "", ErrStoreNotFound)
+	}
+
+	db := &DB{options: o}
+	bulkLoader, err := gkstore.NewBulkLoader(storeName, db.storeConfig(storeName))
+	if err != nil {
+		return stats, newError("bulk load", storeName, "", err)
+	}
+	defer bulkLoader.Abort()
+
+	add := func(line int, record ExportRecord) error {
+		if err := ValidateKey(record.Key); err != nil {
+			return newError("bulk load", storeName, record.Key, err)
+		}
+		err := bulkLoader.Add(storeConfig.StoreKey(record.Key), record.Value, record.Meta)
+		if errors.Is(err, gkstore.ErrBulkLoadUnsorted) {
+			err = fmt.Errorf("%w: line %d: %s", ErrBadImport, line, err)
+		}
+		return newError("bulk load", storeName, record.Key, err)
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var records []ExportRecord
+	for line := 1; ; line++ {
+		if line%exportBatch == 0 {
+			if err = ctx.Err(); err != nil {
+				return stats, newError("bulk load", storeName, "", err)
+			}
+		}
+		var record ExportRecord
+		if err = decoder.Decode(&record); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, newError("bulk load", storeName, "", fmt.Errorf("%w: line %d: %s", ErrBadImport, line, err))
+		}
+		if loadOpts.Sort {
+			record.Key = storeConfig.StoreKey(record.Key)
+			records = append(records, record)
+			continue
+		}
+		if err = add(line, record); err != nil {
+			return
+		}
+	}
+
+	if loadOpts.Sort {
+		// Stable so the last of any duplicates is still last
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+		for i, record := range records {
+			if i+1 < len(records) && records[i+1].Key == record.Key {
+				continue
+			}
+			if err = add(i+1, record); err != nil {
+				return
+			}
+		}
+	}
+
+	loaded, err := bulkLoader.Commit()
+	if err != nil {
+		return stats, newError("bulk load", storeName, "", err)
+	}
+	stats.Loaded, stats.Segments, stats.Bytes = loaded.Keys, loaded.Segments, loaded.Bytes
+	return stats, nil
+}
@@ -0,0 +1,175 @@
+// gkvdump prints the records held in a .gkv segment file
+//
+// Usage:
+//
+//	gkvdump [-json] [-values] [-key k] [-from offset] [-to offset] file.gkv
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gokave/gklogfile"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dumpRecord - the printable form of a gklogfile.Record
+type dumpRecord struct {
+	Offset      int64          `json:"offset"`
+	Version     int            `json:"version"`
+	Type        string         `json:"type"`
+	Key         string         `json:"key"`
+	Seq         uint64         `json:"seq,omitempty"`
+	Time        *time.Time     `json:"time,omitempty"`
+	ValueLength int            `json:"valueLength"`
+	Checksum    string         `json:"checksum"`
+	Value       []byte         `json:"value,omitempty"`
+	Meta        gklogfile.Meta `json:"meta,omitempty"`
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "output one JSON object per record")
+	showValues := flag.Bool("values", false, "include the value of each record")
+	key := flag.String("key", "", "only show records for this key")
+	from := flag.Int64("from", 0, "only show records starting at or after this offset")
+	to := flag.Int64("to", -1, "only show records starting before this offset (-1 for end of file)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file.gkv\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := dump(flag.Arg(0), *jsonOutput, *showValues, *key, *from, *to); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func dump(fileName string, jsonOutput bool, showValues bool, key string, from int64, to int64) (err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	header, _, err := gklogfile.ReadHeader(file, fileStat.Size())
+	if err != nil {
+		return
+	}
+
+	var encoder *json.Encoder
+	var table *tabwriter.Writer
+	if jsonOutput {
+		encoder = json.NewEncoder(os.Stdout)
+		if header != nil {
+			encoder.Encode(struct {
+				Header *gklogfile.Header `json:"header"`
+			}{header})
+		}
+	} else {
+		printHeader(header)
+		table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		defer table.Flush()
+		if showValues {
+			fmt.Fprintln(table, "OFFSET\tVSN\tTYPE\tKEY\tSEQ\tVALUE LEN\tCHECKSUM\tVALUE\tMETA")
+		} else {
+			fmt.Fprintln(table, "OFFSET\tVSN\tTYPE\tKEY\tSEQ\tVALUE LEN\tCHECKSUM")
+		}
+	}
+
+	errStop := errors.New("stop")
+	err = gklogfile.Scan(file, fileStat.Size(), showValues, func(record gklogfile.Record) error {
+		if to >= 0 && record.Offset >= to {
+			return errStop
+		}
+		if record.Offset < from || (key != "" && record.Key != key) {
+			return nil
+		}
+
+		d := dumpRecord{
+			Offset:      record.Offset,
+			Version:     record.Version,
+			Type:        entryTypeName(record.EntryType),
+			Key:         record.Key,
+			ValueLength: record.ValueLength,
+			Checksum:    checksumName(record.Checksum),
+			Value:       record.Value,
+			Meta:        record.Meta,
+			Seq:         record.Seq,
+		}
+		if !record.Time.IsZero() {
+			d.Time = &record.Time
+		}
+		if encoder != nil {
+			return encoder.Encode(d)
+		}
+		if showValues {
+			fmt.Fprintf(table, "%d\t%d\t%s\t%q\t%d\t%d\t%s\t%q\t%s\n", d.Offset, d.Version, d.Type, d.Key, d.Seq, d.ValueLength, d.Checksum, d.Value, formatMeta(d.Meta))
+		} else {
+			fmt.Fprintf(table, "%d\t%d\t%s\t%q\t%d\t%d\t%s\n", d.Offset, d.Version, d.Type, d.Key, d.Seq, d.ValueLength, d.Checksum)
+		}
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	return
+}
+
+// formatMeta - name=value pairs in name order
+func formatMeta(meta gklogfile.Meta) string {
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, meta[name])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func printHeader(header *gklogfile.Header) {
+	if header == nil {
+		fmt.Println("No header (legacy segment)")
+		return
+	}
+	fmt.Printf("Header: version %d, %d bytes, store %q, sequence %d, created %s, flags %#04x\n\n",
+		header.Version, header.Length, header.StoreName, header.Sequence, header.Created.Format(time.RFC3339Nano), header.Flags)
+}
+
+func entryTypeName(entryType int) string {
+	switch entryType {
+	case gklogfile.KeyWritten:
+		return "write"
+	case gklogfile.KeyDeleted:
+		return "delete"
+	}
+	return fmt.Sprintf("unknown(%d)", entryType)
+}
+
+func checksumName(checksum int) string {
+	switch checksum {
+	case gklogfile.ChecksumValid:
+		return "ok"
+	case gklogfile.ChecksumInvalid:
+		return "FAILED"
+	}
+	return "none"
+}
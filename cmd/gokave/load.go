@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gokave"
+	"gokave/gkstore"
+	"io"
+	"os"
+)
+
+// runLoad - the load subcommand. Bulk loads the JSON lines of an export into an existing store
+// offline (see gokave.BulkLoad) so the server must not have it open. Returns the process exit code
+//
+//	gokave load [-f file] [-sort] [-json] [-data dir] [-config file] store
+func runLoad(args []string) int {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	inFile := flags.String("f", "", "read from this file instead of stdin")
+	sortInput := flags.Bool("sort", false, "sort the input in memory first, the last of any duplicate keys winning")
+	jsonOutput := flags.Bool("json", false, "output the stats as JSON")
+	dataDirectory := flags.String("data", gkstore.DataDirectory, "directory holding the store directories")
+	configFile := flags.String("config", gokave.DefaultConfigFile, "file listing the stores")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gokave load [flags] store")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	storeName := flags.Arg(0)
+
+	var r io.Reader = os.Stdin
+	if *inFile != "" {
+		file, err := os.Open(*inFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		r = file
+	}
+	stats, err := gokave.BulkLoad(context.Background(), storeName, r, gokave.BulkLoadOptions{Sort: *sortInput},
+		gokave.WithDataDirectory(*dataDirectory), gokave.WithConfigFile(*configFile))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", storeName, err)
+		return 1
+	}
+
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(stats)
+		return 0
+	}
+	fmt.Printf("Loaded %d keys into %s: %d segments, %d bytes\n", stats.Loaded, storeName, len(stats.Segments), stats.Bytes)
+	return 0
+}
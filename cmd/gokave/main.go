@@ -0,0 +1,213 @@
+// gokave runs the HTTP server for a gokave.DB
+//
+//	gokave [-addr :8080] [-data dir] [-config file] [-replicate-from http://primary:8080]
+//	gokave [-addr :8080] [-data dir] [-config file] -raft-id n1 [-raft-peers n1=http://host1:8080,n2=...] [-raft-dir dir]
+//	gokave [-addr :8080] [-data dir] [-config file] -shard-id n1 -shard-config file
+//	gokave verify [-repair] [-json] [-data dir] store...
+//	gokave load [-f file] [-sort] [-json] [-data dir] [-config file] store
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gokave"
+	"gokave/gkfs"
+	"gokave/gkraft"
+	"gokave/gkreplica"
+	"gokave/gkserver"
+	"gokave/gkshard"
+	"gokave/gkstore"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout - how long in-flight requests get to finish when the server is stopped
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+
+	// MVP:
+	// 1) We want a gkstore package that contains the following: (done - see gokave.DB)
+	// - CreateStore()
+	// - OpenStore()
+	// - DeleteStore() -> ? If each store lives at the folder level can the user just delete the folder
+	// - Write()
+	// - Read()
+	// - Delete()
+
+	// 2) Shift everything else out of the package (reclassify API & storemanager as test harness?) (done - gkserver and cmd/gokave)
+	// 4) Sit a gkstore on top of multiple gk files (create multiple when limit reached etc - purging blah)
+	// 5) Add  validation around what can be used as store names, keys, validate JSON values etc?? Actually probably don't
+	// 7) Add readme and sort out the comments for all of the public values
+	// 9) Add tests
+
+	// Bugs:
+	// - After deleting a store for the 2nd time got a load of random bytes turn up at the beginning of data.json (fixed - the config is now replaced atomically)
+
+	// Future:
+	// 1) Replication to multiple nodes (done - gkreplica for a replica following a primary, gkraft for a cluster, gkshard to split stores across nodes)
+
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "load" {
+		os.Exit(runLoad(os.Args[2:]))
+	}
+
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dataDirectory := flag.String("data", gkstore.DataDirectory, "directory holding the store directories")
+	configFile := flag.String("config", gokave.DefaultConfigFile, "file listing the stores")
+	primary := flag.String("replicate-from", "", "run as a read only replica of the server at this URL")
+	raftID := flag.String("raft-id", "", "run as this member of a Raft cluster")
+	raftPeers := flag.String("raft-peers", "", "the members of a new cluster as id=url,... Leave out to join an existing cluster")
+	raftDirectory := flag.String("raft-dir", "", "directory holding the Raft log and snapshot (default the _raft directory in -data)")
+	shardID := flag.String("shard-id", "", "run as this node of a sharded deployment")
+	shardConfig := flag.String("shard-config", "", "file listing the shard nodes (see gkshard.Config). Needed with -shard-id")
+	peers := flag.String("peers", "", "the servers anti-entropy may compare with and repair from, as url,...")
+	backupDirectory := flag.String("backup-dir", "", "directory that backups to and restores from directories on the server are kept in")
+	flag.Parse()
+
+	if *raftID != "" && *primary != "" {
+		log.Fatal("A Raft cluster member can't also be a replica")
+	}
+	if *shardID != "" && (*raftID != "" || *primary != "") {
+		log.Fatal("A shard node can't also be a Raft cluster member or a replica")
+	}
+	if *shardID != "" && *shardConfig == "" {
+		log.Fatal("-shard-id needs -shard-config")
+	}
+	bootstrap, err := parsePeers(*raftPeers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []gokave.Option{gokave.WithDataDirectory(*dataDirectory), gokave.WithConfigFile(*configFile)}
+	if *primary != "" {
+		opts = append(opts, gokave.WithReplica())
+	}
+	db, err := gokave.Open(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var serverOpts []gkserver.Option
+	if *peers != "" {
+		serverOpts = append(serverOpts, gkserver.WithPeers(strings.Split(*peers, ",")...))
+	}
+	if *backupDirectory != "" {
+		serverOpts = append(serverOpts, gkserver.WithBackupDirectory(*backupDirectory))
+	}
+	var node *gkraft.Node
+	var raftStorage *gkraft.FileStorage
+	if *raftID != "" {
+		if *raftDirectory == "" {
+			*raftDirectory = filepath.Join(*dataDirectory, "_raft")
+		}
+		if raftStorage, err = gkraft.OpenFileStorage(gkfs.OS, *raftDirectory); err != nil {
+			log.Fatal(err)
+		}
+		if tornAt := raftStorage.TornAt(); tornAt >= 0 {
+			fmt.Printf("Raft log %s: dropped a half written entry at offset %d\n", *raftDirectory, tornAt)
+		}
+		node, err = gkraft.NewNode(gkraft.Config{
+			ID:        *raftID,
+			Storage:   raftStorage,
+			Transport: &gkraft.HTTPTransport{},
+			Machine:   gkraft.NewDBMachine(db),
+			Bootstrap: bootstrap,
+			Logger:    log.New(os.Stdout, "", 0),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverOpts = append(serverOpts, gkserver.WithCluster(node))
+	}
+	var sharder *gkshard.Sharder
+	if *shardID != "" {
+		if sharder, err = gkshard.New(db, *shardID, gkfs.OS, *shardConfig); err != nil {
+			log.Fatal(err)
+		}
+		sharder.Start()
+		serverOpts = append(serverOpts, gkserver.WithShards(sharder))
+	}
+	var follower *gkreplica.Follower
+	if *primary != "" {
+		if follower, err = gkreplica.New(db, *primary); err != nil {
+			log.Fatal(err)
+		}
+		follower.Start()
+		serverOpts = append(serverOpts, gkserver.WithFollower(follower))
+	}
+	handler := gkserver.New(db, serverOpts...)
+	server := &http.Server{Addr: *addr, Handler: handler}
+	server.RegisterOnShutdown(handler.Shutdown)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Server started")
+
+	// On SIGINT/SIGTERM stop accepting requests, let the in-flight ones finish and then close the
+	// stores so that nothing is left half written
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	if err = serve(server, listener, stop); err != nil {
+		fmt.Println("Server failed:", err)
+	}
+
+	if follower != nil {
+		follower.Stop()
+	}
+	if sharder != nil {
+		sharder.Stop()
+	}
+	if node != nil {
+		node.Stop()
+		raftStorage.Close()
+	}
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Server stopped")
+}
+
+// serve - serve HTTP on listener until the server fails or a signal arrives on stop. Once stopped
+// no new requests are accepted and those in flight get shutdownTimeout to finish
+func serve(server *http.Server, listener net.Listener, stop <-chan os.Signal) (err error) {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err = <-serverErr:
+		return
+	case sig := <-stop:
+		fmt.Println("Shutting down:", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
+
+// parsePeers - the members of a new cluster from -raft-peers: id=url,id=url,...
+func parsePeers(peers string) (members []gkraft.Member, err error) {
+	if peers == "" {
+		return
+	}
+	for _, peer := range strings.Split(peers, ",") {
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Bad -raft-peers entry: %q (want id=url)", peer)
+		}
+		members = append(members, gkraft.Member{ID: parts[0], Addr: parts[1]})
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gkstore"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// runVerify - the verify subcommand. Checks (and optionally repairs) stores offline so the server
+// must not have them open. Returns the process exit code
+//
+//	gokave verify [-repair] [-json] [-data dir] store...
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "salvage readable records from damaged segments and quarantine the rest")
+	jsonOutput := flags.Bool("json", false, "output the reports as JSON")
+	dataDirectory := flags.String("data", gkstore.DataDirectory, "directory holding the store directories")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gokave verify [flags] store...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	exitCode := 0
+	for _, storeName := range flags.Args() {
+		directory := filepath.Join(*dataDirectory, storeName)
+		var report *gkstore.VerifyReport
+		var err error
+		if *repair {
+			report, err = gkstore.Repair(gkfs.OS, directory)
+		} else {
+			report, err = gkstore.Verify(gkfs.OS, directory)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", storeName, err)
+			exitCode = 1
+			continue
+		}
+		if !report.OK && !*repair {
+			exitCode = 1
+		}
+
+		if *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(report)
+			continue
+		}
+		printVerifyReport(report)
+	}
+	return exitCode
+}
+
+func printVerifyReport(report *gkstore.VerifyReport) {
+	status := "OK"
+	if !report.OK {
+		status = "PROBLEMS FOUND"
+	}
+	fmt.Printf("%s: %s\n", report.Directory, status)
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "FILE\tSIZE\tRECORDS\tOFFSET\tEND\tPROBLEM")
+	for _, file := range report.Files {
+		fmt.Fprintf(table, "%s\t%d\t%d\t\t\t\n", file.Name, file.Size, file.Records)
+		for _, problem := range file.Problems {
+			if problem.Offset < 0 {
+				fmt.Fprintf(table, "\t\t\t-\t-\t%s\n", problem.Message)
+				continue
+			}
+			fmt.Fprintf(table, "\t\t\t%d\t%d\t%s\n", problem.Offset, problem.End, problem.Message)
+		}
+		if file.Repaired {
+			fmt.Fprintf(table, "\t\t\t\t\trepaired, bad ranges moved to %s\n", gkstore.QuarantineDirectory)
+		}
+		if file.Quarantined {
+			fmt.Fprintf(table, "\t\t\t\t\tmoved to %s\n", gkstore.QuarantineDirectory)
+		}
+	}
+	for _, orphan := range report.Orphans {
+		fmt.Fprintf(table, "%s\t\t\t\t\torphaned file\n", orphan)
+	}
+	table.Flush()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"gokave/gkclient"
+)
+
+// runCompare - compare the server's stores with those on another server
+func runCompare(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("compare", "compare [-store s] url")
+	storeName := flags.String("store", "", "only compare this store")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	report, err := client.CompareWith(ctx, flags.Arg(0), *storeName)
+	if err != nil {
+		return
+	}
+	printSyncReport(out, report)
+	return
+}
+
+// runRepair - make the server's stores match those on another server
+func runRepair(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("repair", "repair [-store s] url")
+	storeName := flags.String("store", "", "only repair this store")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	report, err := client.RepairFrom(ctx, flags.Arg(0), *storeName)
+	if err != nil {
+		return
+	}
+	printSyncReport(out, report)
+	return
+}
+
+func printSyncReport(out *output, report gkclient.SyncReport) {
+	rows := [][]interface{}{}
+	for _, store := range report.Stores {
+		rows = append(rows, []interface{}{store.Store, store.InSync, store.MissingHere, store.MissingThere, store.Differing, store.Repaired, store.Error})
+	}
+	out.table(report, "STORE\tIN SYNC\tMISSING HERE\tMISSING THERE\tDIFFERING\tREPAIRED\tERROR", rows)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"gokave/gkstore"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// listFlag - a flag that may be repeated, in order
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// runBackup - back a store up to a tar file, or into a directory on the server. -base or -basedir
+// make it an incremental backup of what was added after that backup
+func runBackup(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("backup", "backup [-o file | -dir d] [-base file | -basedir d] store")
+	outFile := flags.String("o", "", "write the backup to this file instead of stdout")
+	directory := flags.String("dir", "", "back up into this directory, relative to the server's backup directory, instead")
+	baseFile := flags.String("base", "", "an earlier backup file of the store to back up what was added after")
+	baseDirectory := flags.String("basedir", "", "an earlier backup directory of the store, relative to the server's backup directory, to back up what was added after")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	storeName := flags.Arg(0)
+
+	if *directory != "" {
+		if *baseFile != "" {
+			return fmt.Errorf("-base is for a backup file, use -basedir with -dir")
+		}
+		info, err := client.BackupToDirectory(ctx, storeName, *directory, *baseDirectory)
+		if err != nil {
+			return err
+		}
+		out.message(info, fmt.Sprintf("Backed up %s to %s: %d files, %d bytes up to seq %d", storeName, *directory, len(info.Files), info.Bytes, info.LastSeq))
+		return nil
+	}
+	if *baseDirectory != "" {
+		return fmt.Errorf("-basedir is for a backup directory, use -base with -o")
+	}
+
+	var base *gkstore.BackupInfo
+	if *baseFile != "" {
+		file, err := os.Open(*baseFile)
+		if err != nil {
+			return err
+		}
+		info, err := gkstore.ReadTarBackupInfo(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", *baseFile, err)
+		}
+		base = &info
+	}
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	written, err := client.Backup(ctx, storeName, w, base)
+	if err != nil {
+		// Don't leave a partial backup that could be mistaken for a good one
+		if *outFile != "" {
+			os.Remove(*outFile)
+		}
+		return
+	}
+	// Keep stdout clean for the data
+	if *outFile != "" {
+		out.message(map[string]interface{}{"store": storeName, "bytes": written}, fmt.Sprintf("Backed up %s to %s: %d bytes", storeName, *outFile, written))
+	} else {
+		fmt.Fprintf(os.Stderr, "Backed up %s: %d bytes\n", storeName, written)
+	}
+	return
+}
+
+// runRestore - create a store from backup tar files, or backup directories on the server: a full
+// backup followed by any incremental backups taken on from it, in order
+func runRestore(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("restore", "restore [-f file ... | -dir d ...] [-seq n] [-time t] store")
+	var inFiles, directories listFlag
+	flags.Var(&inFiles, "f", "read the backup from this file instead of stdin. May be repeated for incremental backups")
+	flags.Var(&directories, "dir", "restore from this backup directory, relative to the server's backup directory, instead. May be repeated for incremental backups")
+	seq := flags.Uint64("seq", 0, "stop after the change with this sequence number")
+	at := flags.String("time", "", "stop after the last change at or before this time (RFC 3339)")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	storeName := flags.Arg(0)
+	until := gkstore.RestorePoint{Seq: *seq}
+	if *at != "" {
+		if until.Time, err = time.Parse(time.RFC3339Nano, *at); err != nil {
+			return fmt.Errorf("Bad time: %s", *at)
+		}
+	}
+
+	var stats gkstore.RestoreStats
+	if len(directories) > 0 {
+		stats, err = client.RestoreFromDirectories(ctx, storeName, directories, until)
+	} else {
+		readers := []io.Reader{os.Stdin}
+		if len(inFiles) > 0 {
+			readers = nil
+			for _, inFile := range inFiles {
+				file, err := os.Open(inFile)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				readers = append(readers, file)
+			}
+		}
+		stats, err = client.Restore(ctx, storeName, io.MultiReader(readers...), until)
+	}
+	if err != nil {
+		return
+	}
+	out.message(stats, fmt.Sprintf("Restored %s from %d backups: %d changes up to seq %d, %d later changes left out", storeName, stats.Backups, stats.Records, stats.LastSeq, stats.Skipped))
+	return
+}
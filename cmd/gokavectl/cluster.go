@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"os"
+)
+
+// runCluster - show or change the members of the server's Raft cluster
+func runCluster(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if len(args) == 0 {
+		status, err := client.ClusterStatus(ctx)
+		if err != nil {
+			return err
+		}
+		printClusterStatus(out, status)
+		return nil
+	}
+
+	var status gkclient.ClusterStatus
+	switch args[0] {
+	case "add":
+		if err = parseArgs(newFlags("cluster add", "cluster add id url"), args[1:], 2, 2); err != nil {
+			return
+		}
+		status, err = client.AddMember(ctx, gkclient.ClusterMember{ID: args[1], Addr: args[2]})
+	case "rm", "remove":
+		if err = parseArgs(newFlags("cluster rm", "cluster rm id"), args[1:], 1, 1); err != nil {
+			return
+		}
+		status, err = client.RemoveMember(ctx, args[1])
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: gokavectl cluster [add id url|rm id]")
+		return errUsage
+	}
+	if err != nil {
+		return
+	}
+	printClusterStatus(out, status)
+	return
+}
+
+func printClusterStatus(out *output, status gkclient.ClusterStatus) {
+	if !out.json {
+		fmt.Printf("Member: %s (%s, term %d)\n", status.ID, status.State, status.Term)
+		if status.Leader != "" {
+			fmt.Printf("Leader: %s %s\n", status.Leader, status.LeaderAddr)
+		}
+		fmt.Printf("Log: committed %d, applied %d, last %d, snapshot %d\n", status.CommitIndex, status.LastApplied, status.LastIndex, status.SnapshotIndex)
+	}
+	rows := [][]interface{}{}
+	for _, member := range status.Members {
+		match := ""
+		if peer, ok := status.Peers[member.ID]; ok {
+			match = fmt.Sprint(peer.MatchIndex)
+		} else if member.ID == status.ID {
+			match = fmt.Sprint(status.LastIndex)
+		}
+		rows = append(rows, []interface{}{member.ID, member.Addr, match})
+	}
+	out.table(status, "ID\tADDR\tMATCH INDEX", rows)
+}
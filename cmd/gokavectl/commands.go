@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runStore - the store create/list/describe/rm commands
+func runStore(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gokavectl store create|list|describe|migrate|rm ...")
+		return errUsage
+	}
+
+	switch args[0] {
+	case "create":
+		flags := newFlags("store create", "store create [-codec name] store")
+		codec := flags.String("codec", "", "value encoding for the store: raw, json, gob or a registered codec")
+		keyCase := flags.String("keycase", "", "preserve (the default) for case sensitive keys or fold to lower case them")
+		if err = parseArgs(flags, args[1:], 1, 1); err != nil {
+			return
+		}
+		if err = client.CreateStoreWith(ctx, gkclient.StoreConfig{Name: flags.Arg(0), Codec: *codec, KeyCase: *keyCase}); err != nil {
+			return
+		}
+		out.message(map[string]string{"created": flags.Arg(0)}, "Created store "+flags.Arg(0))
+
+	case "list", "ls":
+		if err = parseArgs(newFlags("store list", "store list"), args[1:], 0, 0); err != nil {
+			return
+		}
+		storeNames, err := client.ListStores(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]interface{}, 0, len(storeNames))
+		for _, storeName := range storeNames {
+			rows = append(rows, []interface{}{storeName})
+		}
+		out.table(storeNames, "STORE", rows)
+
+	case "describe":
+		flags := newFlags("store describe", "store describe store")
+		if err = parseArgs(flags, args[1:], 1, 1); err != nil {
+			return
+		}
+		storeConfig, err := client.DescribeStore(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		codec := storeConfig.Codec
+		if codec == "" {
+			codec = "raw"
+		}
+		keyCase := storeConfig.KeyCase
+		if keyCase == "" {
+			keyCase = "fold (legacy)"
+		}
+		out.table(storeConfig, "STORE\tCODEC\tKEY CASE", [][]interface{}{{storeConfig.Name, codec, keyCase}})
+
+	case "migrate":
+		flags := newFlags("store migrate", "store migrate -keycase preserve|fold store")
+		keyCase := flags.String("keycase", "", "preserve or fold")
+		if err = parseArgs(flags, args[1:], 1, 1); err != nil {
+			return
+		}
+		rewritten, err := client.MigrateKeyCase(ctx, flags.Arg(0), *keyCase)
+		if err != nil {
+			return err
+		}
+		out.message(map[string]interface{}{"store": flags.Arg(0), "keyCase": *keyCase, "keysRewritten": rewritten},
+			fmt.Sprintf("Store %s key case now %s (%d keys rewritten)", flags.Arg(0), *keyCase, rewritten))
+
+	case "rm", "delete":
+		flags := newFlags("store rm", "store rm store")
+		if err = parseArgs(flags, args[1:], 1, 1); err != nil {
+			return
+		}
+		if err = client.DeleteStore(ctx, flags.Arg(0)); err != nil {
+			return
+		}
+		out.message(map[string]string{"deleted": flags.Arg(0)}, "Deleted store "+flags.Arg(0))
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown store command: %s\n", args[0])
+		return errUsage
+	}
+	return
+}
+
+// runKeys - list the keys in a store
+func runKeys(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("keys", "keys [-prefix p] [-snapshot token] store")
+	prefix := flags.String("prefix", "", "only list keys starting with this")
+	token := flags.String("snapshot", "", "list the keys at a snapshot made with the snapshot command")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	var keys []string
+	if *token != "" {
+		keys, err = client.ListKeysAt(ctx, gkclient.Snapshot{Store: flags.Arg(0), Token: *token}, *prefix)
+	} else {
+		keys, err = client.ListKeys(ctx, flags.Arg(0), *prefix)
+	}
+	if err != nil {
+		return
+	}
+	rows := make([][]interface{}, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, []interface{}{key})
+	}
+	out.table(keys, "KEY", rows)
+	return
+}
+
+// runGet - write a value to stdout or a file. The value is written as is, even with -json
+func runGet(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("get", "get [-o file] store key")
+	outFile := flags.String("o", "", "write the value to this file instead of stdout")
+	if err = parseArgs(flags, args, 2, 2); err != nil {
+		return
+	}
+	value, err := client.Get(ctx, flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return
+	}
+	if *outFile != "" {
+		return ioutil.WriteFile(*outFile, value, 0644)
+	}
+	_, err = out.writer.Write(value)
+	return
+}
+
+// metaFlag - a repeatable name=value flag
+type metaFlag map[string]string
+
+func (meta metaFlag) String() string {
+	return fmt.Sprint(map[string]string(meta))
+}
+
+func (meta metaFlag) Set(pair string) error {
+	equals := strings.Index(pair, "=")
+	if equals <= 0 {
+		return fmt.Errorf("Expected name=value: %s", pair)
+	}
+	meta[pair[:equals]] = pair[equals+1:]
+	return nil
+}
+
+// runPut - write a value given on the command line, in a file or on stdin
+func runPut(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("put", "put [-f file] [-type content-type] [-meta name=value]... store key [value]")
+	inFile := flags.String("f", "", "read the value from this file")
+	contentType := flags.String("type", "", "content type to store with the value")
+	meta := make(metaFlag)
+	flags.Var(meta, "meta", "name=value to store with the value. May be repeated")
+	if err = parseArgs(flags, args, 2, 3); err != nil {
+		return
+	}
+
+	var value []byte
+	switch {
+	case flags.NArg() == 3 && *inFile != "":
+		fmt.Fprintln(os.Stderr, "Give the value either on the command line or with -f, not both")
+		return errUsage
+	case flags.NArg() == 3:
+		value = []byte(flags.Arg(2))
+	case *inFile != "":
+		value, err = ioutil.ReadFile(*inFile)
+	default:
+		value, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return
+	}
+
+	if err = client.PutItem(ctx, flags.Arg(0), flags.Arg(1), gkclient.Item{Value: value, ContentType: *contentType, Meta: meta}); err != nil {
+		return
+	}
+	out.message(map[string]interface{}{"store": flags.Arg(0), "key": flags.Arg(1), "bytes": len(value)},
+		fmt.Sprintf("Wrote %d bytes to %s/%s", len(value), flags.Arg(0), flags.Arg(1)))
+	return
+}
+
+// runMGet - read several keys at once
+func runMGet(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("mget", "mget [-snapshot token] store key...")
+	token := flags.String("snapshot", "", "read the values at a snapshot made with the snapshot command")
+	if err = parseArgs(flags, args, 2, 1+1000); err != nil {
+		return
+	}
+	storeName, keys := flags.Arg(0), flags.Args()[1:]
+	var results map[string]gkclient.ManyResult
+	if *token != "" {
+		results, err = client.GetManyAt(ctx, gkclient.Snapshot{Store: storeName, Token: *token}, keys)
+	} else {
+		results, err = client.GetMany(ctx, storeName, keys)
+	}
+	if err != nil {
+		return
+	}
+	rows := make([][]interface{}, 0, len(results))
+	for _, key := range keys {
+		result := results[key]
+		value := fmt.Sprintf("%q", result.Value)
+		if result.Status == gkclient.ResultError {
+			value = result.Error
+		}
+		rows = append(rows, []interface{}{key, result.Status, result.Length, result.ContentType, value})
+	}
+	out.table(results, "KEY\tSTATUS\tLENGTH\tCONTENT TYPE\tVALUE", rows)
+	return
+}
+
+// runHead - the content type, meta and length of a value
+func runHead(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if err = parseArgs(newFlags("head", "head store key"), args, 2, 2); err != nil {
+		return
+	}
+	item, err := client.Head(ctx, args[0], args[1])
+	if err != nil {
+		return
+	}
+	rows := [][]interface{}{{"Length", item.Length}, {"Content-Type", item.ContentType}}
+	names := make([]string, 0, len(item.Meta))
+	for name := range item.Meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rows = append(rows, []interface{}{name, item.Meta[name]})
+	}
+	out.table(item, "NAME\tVALUE", rows)
+	return
+}
+
+// runDel - delete a key
+func runDel(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if err = parseArgs(newFlags("del", "del store key"), args, 2, 2); err != nil {
+		return
+	}
+	if err = client.Delete(ctx, args[0], args[1]); err != nil {
+		return
+	}
+	out.message(map[string]string{"store": args[0], "deleted": args[1]}, fmt.Sprintf("Deleted %s/%s", args[0], args[1]))
+	return
+}
+
+// runCompact - compact a store on the server
+func runCompact(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if err = parseArgs(newFlags("compact", "compact store"), args, 1, 1); err != nil {
+		return
+	}
+	stats, err := client.CompactStore(ctx, args[0])
+	if err != nil {
+		return
+	}
+	out.table(stats, "STORE\tSEGMENTS MERGED\tKEYS\tBYTES BEFORE\tBYTES AFTER\tGENERATION",
+		[][]interface{}{{args[0], len(stats.SegmentsRemoved), stats.KeysWritten, stats.BytesBefore, stats.BytesAfter, stats.Generation}})
+	return
+}
+
+// runVerify - verify a store on the server. Exits non-zero if problems were found
+func runVerify(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if err = parseArgs(newFlags("verify", "verify store"), args, 1, 1); err != nil {
+		return
+	}
+	report, err := client.VerifyStore(ctx, args[0])
+	if err != nil {
+		return
+	}
+
+	rows := [][]interface{}{}
+	for _, file := range report.Files {
+		status := "ok"
+		if len(file.Problems) > 0 {
+			status = fmt.Sprintf("%d problem(s)", len(file.Problems))
+		}
+		rows = append(rows, []interface{}{file.Name, file.Size, file.Records, status})
+		for _, problem := range file.Problems {
+			rows = append(rows, []interface{}{"", "", "", fmt.Sprintf("%d-%d: %s", problem.Offset, problem.End, problem.Message)})
+		}
+	}
+	for _, orphan := range report.Orphans {
+		rows = append(rows, []interface{}{orphan, "", "", "orphaned"})
+	}
+	out.table(report, "FILE\tSIZE\tRECORDS\tSTATUS", rows)
+
+	if !report.OK {
+		return fmt.Errorf("%s: problems found", args[0])
+	}
+	return
+}
+
+// runWatch - print changes as they are made until interrupted. -timeout doesn't apply
+func runWatch(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("watch", "watch [-since seq] [-prefix p] store")
+	since := flags.Uint64("since", 0, "start after the change with this sequence number (0 replays every change still held)")
+	prefix := flags.String("prefix", "", "only watch keys starting with this")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	return client.Watch(ctx, flags.Arg(0), *since, *prefix, func(change gkclient.Change) error {
+		if out.json {
+			out.print(change)
+			return nil
+		}
+		changeType := "put"
+		if change.Deleted {
+			changeType = "delete"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", change.Seq, change.Time.Format(time.RFC3339Nano), changeType, change.Key)
+		return nil
+	})
+}
@@ -0,0 +1,240 @@
+// gokavectl drives a running gokave server
+//
+//	gokavectl [-server url] [-json] [-timeout d] command [flags] args...
+//
+// Commands:
+//
+//	store create [-codec name] [-keycase preserve|fold] store
+//	store list
+//	store describe store
+//	store migrate -keycase preserve|fold store
+//	store rm store
+//	keys [-prefix p] [-snapshot token] store
+//	get [-o file] store key
+//	mget [-snapshot token] store key...
+//	head store key
+//	put [-f file] [-type content-type] [-meta name=value]... store key [value]
+//	    (the value is read from stdin if neither -f nor value is given)
+//	del store key
+//	compact store
+//	verify store
+//	snapshot [-ttl d] store
+//	snapshot release store token
+//	    (keys and mget read the store as it was when the snapshot was made with -snapshot token,
+//	    until -ttl is up or it is released)
+//	watch [-since seq] [-prefix p] store
+//	    (prints changes until interrupted. -timeout doesn't apply)
+//	export [-o file] [-prefix p] [-meta] [-versions] store
+//	    (JSON lines with base64 values. -meta and -versions add each value's meta and version)
+//	import [-f file] [-mode overwrite|skip|fail] [-create [-codec name] [-keycase preserve|fold]] store
+//	    (-mode decides what happens to keys the store already has)
+//	backup [-o file | -dir d] [-base file | -basedir d] store
+//	    (the tar stream goes to stdout without -o. -dir backs up into a directory on the server,
+//	    relative to its -backup-dir. -base or -basedir backs up only what was added after that
+//	    earlier backup)
+//	restore [-f file ... | -dir d ...] [-seq n] [-time t] store
+//	    (creates the store, replaying the changes in a full backup and the incremental backups
+//	    after it up to -seq or -time if given. -dir is relative to the server's -backup-dir. Not
+//	    supported by a Raft cluster member or shard node)
+//	replication
+//	promote
+//	cluster [add id url|rm id]
+//	shards [set id=url...|rebalance]
+//	compare [-store s] url
+//	    (compares the server's stores with those on the server at url, which has to be one of
+//	    the server's -peers or the primary it replicates)
+//	repair [-store s] url
+//	    (makes the server's stores match those on the server at url, as for compare. Not
+//	    supported by a Raft cluster member or shard node)
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gokave/gkclient"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage - the command line was wrong. The usage has already been printed
+var errUsage = errors.New("Usage")
+
+// command - a gokavectl command. args are the arguments following the command name
+type command func(ctx context.Context, client *gkclient.Client, out *output, args []string) error
+
+var commands = map[string]command{
+	"store":    runStore,
+	"keys":     runKeys,
+	"get":      runGet,
+	"mget":     runMGet,
+	"head":     runHead,
+	"put":      runPut,
+	"del":      runDel,
+	"compact":  runCompact,
+	"verify":   runVerify,
+	"snapshot": runSnapshot,
+	"watch":    runWatch,
+	"export":   runExport,
+	"import":   runImport,
+	"backup":   runBackup,
+	"restore":  runRestore,
+
+	"replication": runReplication,
+	"promote":     runPromote,
+	"cluster":     runCluster,
+	"shards":      runShards,
+	"compare":     runCompare,
+	"repair":      runRepair,
+}
+
+func main() {
+	server := flag.String("server", serverDefault(), "base URL of the gokave server (or set GOKAVE_SERVER)")
+	jsonOutput := flag.Bool("json", false, "print results as JSON instead of tables")
+	timeout := flag.Duration("timeout", 30*time.Second, "give up on a command after this long (0 for no limit)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	run, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	client, err := gkclient.New(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 && flag.Arg(0) != "watch" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	err = run(ctx, client, &output{json: *jsonOutput, writer: os.Stdout}, flag.Args()[1:])
+	switch {
+	case err == errUsage:
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func serverDefault() string {
+	if server := os.Getenv("GOKAVE_SERVER"); server != "" {
+		return server
+	}
+	return "http://localhost:8080"
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] command [flags] args...
+
+Commands:
+  store create [-codec name] [-keycase preserve|fold] store
+  store list
+  store describe store
+  store migrate -keycase preserve|fold store
+  store rm store
+  keys [-prefix p] [-snapshot token] store
+  get [-o file] store key
+  mget [-snapshot token] store key...
+  head store key
+  put [-f file] [-type content-type] [-meta name=value]... store key [value]
+  del store key
+  compact store
+  verify store
+  snapshot [-ttl d] store
+  snapshot release store token
+  watch [-since seq] [-prefix p] store
+  export [-o file] [-prefix p] [-meta] [-versions] store
+  import [-f file] [-mode overwrite|skip|fail] [-create [-codec name] [-keycase preserve|fold]] store
+  backup [-o file | -dir d] [-base file | -basedir d] store
+  restore [-f file ... | -dir d ...] [-seq n] [-time t] store
+  replication
+  promote
+  cluster [add id url|rm id]
+  shards [set id=url...|rebalance]
+  compare [-store s] url
+  repair [-store s] url
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// newFlags - a flag set for a command that reports mistakes through errUsage rather than exiting
+func newFlags(name string, synopsis string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gokavectl %s\n", synopsis)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs - parse args into flags and check the right number of arguments are left
+func parseArgs(flags *flag.FlagSet, args []string, min int, max int) (err error) {
+	if err = flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		flags.Usage()
+		return errUsage
+	}
+	return
+}
+
+// output - prints results to writer either as aligned columns or as JSON
+type output struct {
+	json   bool
+	writer io.Writer
+}
+
+// table - print rows under header, or v as JSON
+func (out *output) table(v interface{}, header string, rows [][]interface{}) {
+	if out.json {
+		out.print(v)
+		return
+	}
+	table := tabwriter.NewWriter(out.writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, header)
+	for _, row := range rows {
+		for i, column := range row {
+			if i > 0 {
+				fmt.Fprint(table, "\t")
+			}
+			fmt.Fprint(table, column)
+		}
+		fmt.Fprintln(table)
+	}
+	table.Flush()
+}
+
+// message - print a line of text, or v as JSON
+func (out *output) message(v interface{}, text string) {
+	if out.json {
+		out.print(v)
+		return
+	}
+	fmt.Fprintln(out.writer, text)
+}
+
+func (out *output) print(v interface{}) {
+	encoder := json.NewEncoder(out.writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gokave"
+	"gokave/gkclient"
+	"gokave/gkfs"
+	"gokave/gkserver"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startTestServer - a server over a DB on an in memory file system, and a client for it. stop shuts
+// both down
+func startTestServer(t *testing.T) (client *gkclient.Client, stop func()) {
+	t.Helper()
+	db, err := gokave.Open(gokave.WithFS(gkfs.NewMem()), gokave.WithDataDirectory("/data"), gokave.WithConfigFile("/config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(gkserver.New(db))
+	stop = func() {
+		httpServer.Close()
+		db.Close()
+	}
+	if client, err = gkclient.New(httpServer.URL); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return
+}
+
+// runCommand - run a gokavectl command line (without the global flags), returning what it printed
+func runCommand(t *testing.T, client *gkclient.Client, jsonOutput bool, commandLine ...string) (printed string, err error) {
+	t.Helper()
+	run, ok := commands[commandLine[0]]
+	if !ok {
+		t.Fatalf("Unknown command: %s", commandLine[0])
+	}
+	var buffer bytes.Buffer
+	err = run(context.Background(), client, &output{json: jsonOutput, writer: &buffer}, commandLine[1:])
+	return buffer.String(), err
+}
+
+// mustRun - runCommand failing the test on an error
+func mustRun(t *testing.T, client *gkclient.Client, commandLine ...string) (printed string) {
+	t.Helper()
+	printed, err := runCommand(t, client, false, commandLine...)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(commandLine, " "), err)
+	}
+	return
+}
+
+func TestUsageErrors(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	for _, commandLine := range [][]string{
+		{"store"},
+		{"store", "bogus"},
+		{"store", "list", "extra"},
+		{"store", "describe"},
+		{"store", "describe", "a", "b"},
+		{"store", "create", "-codec"},
+		{"store", "create", "-nope", "s"},
+		{"keys"},
+		{"keys", "-prefix"},
+		{"keys", "s", "t"},
+		{"compact"},
+		{"compact", "a", "b"},
+	} {
+		if _, err := runCommand(t, client, false, commandLine...); err != errUsage {
+			t.Errorf("%s: %v, expected errUsage", strings.Join(commandLine, " "), err)
+		}
+	}
+}
+
+func TestStoreCommands(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+
+	if printed := mustRun(t, client, "store", "create", "s"); printed != "Created store s\n" {
+		t.Errorf("store create: %q", printed)
+	}
+	mustRun(t, client, "store", "create", "-codec", "json", "orders")
+
+	if printed := mustRun(t, client, "store", "list"); printed != "STORE\norders\ns\n" {
+		t.Errorf("store list: %q", printed)
+	}
+	expected := "STORE   CODEC  KEY CASE\n" +
+		"orders  json   preserve\n"
+	if printed := mustRun(t, client, "store", "describe", "orders"); printed != expected {
+		t.Errorf("store describe: %q, expected %q", printed, expected)
+	}
+	// A store that didn't choose a codec holds raw values
+	if printed := mustRun(t, client, "store", "describe", "s"); printed != "STORE  CODEC  KEY CASE\ns      raw    preserve\n" {
+		t.Errorf("store describe of a raw store: %q", printed)
+	}
+
+	printed, err := runCommand(t, client, true, "store", "list")
+	var storeNames []string
+	if err != nil || json.Unmarshal([]byte(printed), &storeNames) != nil || strings.Join(storeNames, ",") != "orders,s" {
+		t.Errorf("store list -json: %q, err %v", printed, err)
+	}
+	printed, err = runCommand(t, client, true, "store", "describe", "orders")
+	var storeConfig gkclient.StoreConfig
+	if err != nil || json.Unmarshal([]byte(printed), &storeConfig) != nil || storeConfig.Name != "orders" || storeConfig.Codec != "json" {
+		t.Errorf("store describe -json: %q, err %v", printed, err)
+	}
+
+	if _, err = runCommand(t, client, false, "store", "describe", "missing"); err == nil {
+		t.Error("store describe of a missing store succeeded")
+	}
+	mustRun(t, client, "store", "rm", "orders")
+	if printed := mustRun(t, client, "store", "list"); printed != "STORE\ns\n" {
+		t.Errorf("store list after rm: %q", printed)
+	}
+}
+
+func TestKeysCommand(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	mustRun(t, client, "store", "create", "s")
+	for _, key := range []string{"user1", "user2", "order1"} {
+		mustRun(t, client, "put", "s", key, "value")
+	}
+	mustRun(t, client, "del", "s", "user2")
+
+	if printed := mustRun(t, client, "keys", "s"); printed != "KEY\norder1\nuser1\n" {
+		t.Errorf("keys: %q", printed)
+	}
+	if printed := mustRun(t, client, "keys", "-prefix", "user", "s"); printed != "KEY\nuser1\n" {
+		t.Errorf("keys -prefix: %q", printed)
+	}
+	printed, err := runCommand(t, client, true, "keys", "-prefix", "nothing", "s")
+	var keys []string
+	if err != nil || json.Unmarshal([]byte(printed), &keys) != nil || keys == nil || len(keys) != 0 {
+		t.Errorf("keys -json with no matches: %q, err %v", printed, err)
+	}
+}
+
+func TestCompactCommand(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	mustRun(t, client, "store", "create", "s")
+	mustRun(t, client, "put", "s", "a", "value")
+
+	// Everything is still in the active segment so there is nothing to merge
+	expected := "STORE  SEGMENTS MERGED  KEYS  BYTES BEFORE  BYTES AFTER  GENERATION\n" +
+		"s      0                0     0             0            0\n"
+	if printed := mustRun(t, client, "compact", "s"); printed != expected {
+		t.Errorf("compact: %q, expected %q", printed, expected)
+	}
+	printed, err := runCommand(t, client, true, "compact", "s")
+	var stats map[string]interface{}
+	if err != nil || json.Unmarshal([]byte(printed), &stats) != nil || stats["KeysWritten"] != float64(0) {
+		t.Errorf("compact -json: %q, err %v", printed, err)
+	}
+	if _, err = runCommand(t, client, false, "compact", "missing"); err == nil {
+		t.Error("compact of a missing store succeeded")
+	}
+	if printed := mustRun(t, client, "get", "s", "a"); printed != "value" {
+		t.Errorf("get after compact: %q", printed)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"sort"
+	"time"
+)
+
+// runReplication - show whether the server is a primary or a replica and how far behind a replica is
+func runReplication(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if err = parseArgs(newFlags("replication", "replication"), args, 0, 0); err != nil {
+		return
+	}
+	status, err := client.ReplicationStatus(ctx)
+	if err != nil {
+		return
+	}
+	printReplicationStatus(out, status)
+	return
+}
+
+// runPromote - turn a replica into a primary that accepts writes
+func runPromote(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if err = parseArgs(newFlags("promote", "promote"), args, 0, 0); err != nil {
+		return
+	}
+	status, err := client.Promote(ctx)
+	if err != nil {
+		return
+	}
+	printReplicationStatus(out, status)
+	return
+}
+
+func printReplicationStatus(out *output, status gkclient.ReplicationStatus) {
+	if !out.json {
+		fmt.Printf("Role: %s\n", status.Role)
+		if status.Primary != "" {
+			fmt.Printf("Primary: %s\n", status.Primary)
+		}
+		if status.Error != "" {
+			fmt.Printf("Error: %s\n", status.Error)
+		}
+	}
+
+	storeNames := make([]string, 0, len(status.Stores))
+	for storeName := range status.Stores {
+		storeNames = append(storeNames, storeName)
+	}
+	sort.Strings(storeNames)
+	rows := [][]interface{}{}
+	if status.Role != "replica" {
+		for _, storeName := range storeNames {
+			rows = append(rows, []interface{}{storeName, status.Stores[storeName].LastSeq})
+		}
+		out.table(status, "STORE\tLAST SEQ", rows)
+		return
+	}
+	for _, storeName := range storeNames {
+		store := status.Stores[storeName]
+		lastContact := ""
+		if store.LastContact != nil {
+			lastContact = store.LastContact.Format(time.RFC3339)
+		}
+		rows = append(rows, []interface{}{storeName, store.LastSeq, store.PrimaryLastSeq, store.Lag, store.Segment, store.Offset, lastContact, store.Error})
+	}
+	out.table(status, "STORE\tLAST SEQ\tPRIMARY SEQ\tLAG\tSEGMENT\tOFFSET\tLAST CONTACT\tERROR", rows)
+}
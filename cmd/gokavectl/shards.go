@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"os"
+	"strings"
+)
+
+// runShards - show or change the nodes of the server's sharded deployment
+func runShards(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	var status gkclient.ShardStatus
+	switch {
+	case len(args) == 0:
+		status, err = client.ShardStatus(ctx)
+	case args[0] == "set":
+		if err = parseArgs(newFlags("shards set", "shards set id=url..."), args[1:], 1, len(args)); err != nil {
+			return
+		}
+		var nodes []gkclient.ShardNode
+		for _, arg := range args[1:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("Bad node: %q (want id=url)", arg)
+			}
+			nodes = append(nodes, gkclient.ShardNode{ID: parts[0], Addr: parts[1]})
+		}
+		status, err = client.SetShardNodes(ctx, nodes)
+	case args[0] == "rebalance":
+		if err = parseArgs(newFlags("shards rebalance", "shards rebalance"), args[1:], 0, 0); err != nil {
+			return
+		}
+		status, err = client.Rebalance(ctx)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: gokavectl shards [set id=url...|rebalance]")
+		return errUsage
+	}
+	if err != nil {
+		return
+	}
+	printShardStatus(out, status)
+	return
+}
+
+func printShardStatus(out *output, status gkclient.ShardStatus) {
+	if !out.json {
+		fmt.Printf("Node: %s, config version %d, %d partitions\n", status.Self, status.Config.Version, status.Config.Partitions)
+		rebalance := status.Rebalance
+		switch {
+		case rebalance.Running:
+			fmt.Printf("Rebalance: running since %s\n", rebalance.Started.Format("15:04:05"))
+		case rebalance.Error != "":
+			fmt.Printf("Rebalance: failed at %s: %s\n", rebalance.Finished.Format("15:04:05"), rebalance.Error)
+		case !rebalance.Finished.IsZero():
+			fmt.Printf("Rebalance: sent %d partitions, %d keys, finished %s\n", rebalance.Partitions, rebalance.Keys, rebalance.Finished.Format("15:04:05"))
+		}
+	}
+	rows := [][]interface{}{}
+	for _, node := range status.Config.Nodes {
+		owned := ""
+		if node.ID == status.Self {
+			owned = fmt.Sprint(len(status.Owned))
+		}
+		rows = append(rows, []interface{}{node.ID, node.Addr, owned})
+	}
+	out.table(status, "ID\tADDR\tPARTITIONS HERE", rows)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"time"
+)
+
+// runSnapshot - pin a view of a store on the server, or release one. The token printed can be
+// passed to keys and mget with -snapshot until it expires
+func runSnapshot(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	if len(args) > 0 && args[0] == "release" {
+		if err = parseArgs(newFlags("snapshot release", "snapshot release store token"), args[1:], 2, 2); err != nil {
+			return
+		}
+		if err = client.ReleaseSnapshot(ctx, gkclient.Snapshot{Store: args[1], Token: args[2]}); err != nil {
+			return
+		}
+		out.message(map[string]string{"store": args[1], "released": args[2]}, fmt.Sprintf("Released snapshot %s of %s", args[2], args[1]))
+		return
+	}
+
+	flags := newFlags("snapshot", "snapshot [-ttl d] store | snapshot release store token")
+	ttl := flags.Duration("ttl", 0, "how long the snapshot can be used for (default the server's, 1m)")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	snapshot, err := client.CreateSnapshot(ctx, flags.Arg(0), *ttl)
+	if err != nil {
+		return
+	}
+	out.table(snapshot, "STORE\tTOKEN\tSEQ\tEXPIRES",
+		[][]interface{}{{snapshot.Store, snapshot.Token, snapshot.Seq, snapshot.Expires.Local().Format(time.RFC3339)}})
+	return
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkclient"
+	"io"
+	"os"
+)
+
+// runExport - write every key/value in a store as JSON lines. Values are base64 encoded so binary
+// data survives the trip
+func runExport(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("export", "export [-o file] [-prefix p] [-meta] [-versions] store")
+	outFile := flags.String("o", "", "write to this file instead of stdout")
+	prefix := flags.String("prefix", "", "only export keys starting with this")
+	meta := flags.Bool("meta", false, "include each value's meta")
+	versions := flags.Bool("versions", false, "include each value's version and the time it was written")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	storeName := flags.Arg(0)
+
+	w := out.writer
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	written, err := client.Export(ctx, storeName, w, gkclient.ExportOptions{Prefix: *prefix, Meta: *meta, Versions: *versions})
+	if err != nil {
+		// Don't leave a partial export that could be mistaken for a whole one
+		if *outFile != "" {
+			os.Remove(*outFile)
+		}
+		return
+	}
+
+	// Keep stdout clean for the data
+	if *outFile != "" {
+		out.message(map[string]interface{}{"store": storeName, "bytes": written}, fmt.Sprintf("Exported %s to %s: %d bytes", storeName, *outFile, written))
+	} else {
+		fmt.Fprintf(os.Stderr, "Exported %s: %d bytes\n", storeName, written)
+	}
+	return
+}
+
+// runImport - write every key/value from an export into a store
+func runImport(ctx context.Context, client *gkclient.Client, out *output, args []string) (err error) {
+	flags := newFlags("import", "import [-f file] [-mode overwrite|skip|fail] [-create [-codec name] [-keycase preserve|fold]] store")
+	inFile := flags.String("f", "", "read from this file instead of stdin")
+	mode := flags.String("mode", "overwrite", "what to do with keys the store already has: overwrite, skip or fail")
+	create := flags.Bool("create", false, "create the store if it doesn't exist")
+	codec := flags.String("codec", "", "the codec of a store created with -create")
+	keyCase := flags.String("keycase", "", "the key case of a store created with -create")
+	if err = parseArgs(flags, args, 1, 1); err != nil {
+		return
+	}
+	storeName := flags.Arg(0)
+
+	var r io.Reader = os.Stdin
+	if *inFile != "" {
+		file, err := os.Open(*inFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	stats, err := client.Import(ctx, storeName, r, gkclient.ImportOptions{Mode: *mode, Create: *create, Codec: *codec, KeyCase: *keyCase})
+	if err != nil {
+		return
+	}
+	out.message(stats, fmt.Sprintf("Imported %d keys into %s, %d skipped", stats.Imported, storeName, stats.Skipped))
+	return nil
+}
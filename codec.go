@@ -0,0 +1,182 @@
+package gokave
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownCodec means a store was configured with a codec that hasn't been registered
+var ErrUnknownCodec = errors.New("Unknown codec")
+
+// ErrCodecMismatch means a value was put or got with a codec other than the one the store uses
+var ErrCodecMismatch = errors.New("Store uses a different codec")
+
+// ErrUnsupportedType means the raw codec was given something other than []byte or string
+var ErrUnsupportedType = errors.New("Raw codec only supports []byte and string")
+
+// Codec - turns Go values into the bytes held in a store and back again. The codec is part of a
+// store's config so every client of the store encodes values the same way
+type Codec interface {
+	// Name is what the store config records. It must be unique
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The built in codecs. RawCodec is used by stores that don't choose one
+var (
+	RawCodec  Codec = rawCodec{}
+	JSONCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+)
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{
+		RawCodec.Name():  RawCodec,
+		JSONCodec.Name(): JSONCodec,
+		GobCodec.Name():  GobCodec,
+	}
+)
+
+// RegisterCodec - make a user supplied codec available to stores. Codecs have to be registered
+// before a DB using them is opened. Registering a name twice replaces the earlier codec
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// lookupCodec - an empty name is the raw codec for stores created before codecs existed
+func lookupCodec(name string) (Codec, error) {
+	if name == "" {
+		return RawCodec, nil
+	}
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	return codec, nil
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch value := v.(type) {
+	case *[]byte:
+		*value = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*value = string(data)
+		return nil
+	}
+	return ErrUnsupportedType
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Codec - the codec the store's values are encoded with
+func (store *Store) Codec() Codec {
+	return store.codec
+}
+
+// Put - encode v with the store's codec and write it
+func (store *Store) Put(ctx context.Context, key string, v interface{}) (err error) {
+	value, err := store.codec.Marshal(v)
+	if err != nil {
+		return newError("put", store.name, key, err)
+	}
+	return store.Write(ctx, key, value)
+}
+
+// Get - read the value for key and decode it into v with the store's codec
+func (store *Store) Get(ctx context.Context, key string, v interface{}) (err error) {
+	value, err := store.Read(ctx, key)
+	if err != nil {
+		return
+	}
+	return newError("get", store.name, key, store.codec.Unmarshal(value, v))
+}
+
+// PutJSON - write v as JSON. Only allowed on stores using the json or raw codec
+func (store *Store) PutJSON(ctx context.Context, key string, v interface{}) (err error) {
+	if err = store.allowJSON(); err != nil {
+		return newError("put", store.name, key, err)
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return newError("put", store.name, key, err)
+	}
+	return store.Write(ctx, key, value)
+}
+
+// GetJSON - read the value for key as JSON into v. Only allowed on stores using the json or raw codec
+func (store *Store) GetJSON(ctx context.Context, key string, v interface{}) (err error) {
+	if err = store.allowJSON(); err != nil {
+		return newError("get", store.name, key, err)
+	}
+	value, err := store.Read(ctx, key)
+	if err != nil {
+		return
+	}
+	return newError("get", store.name, key, json.Unmarshal(value, v))
+}
+
+// allowJSON - raw stores hold whatever they are given so JSON is as good as anything else
+func (store *Store) allowJSON() error {
+	if store.codec != JSONCodec && store.codec != RawCodec {
+		return ErrCodecMismatch
+	}
+	return nil
+}
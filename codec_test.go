@@ -0,0 +1,179 @@
+package gokave
+
+import (
+	"context"
+	"errors"
+	"gokave/gkfs"
+	"strings"
+	"testing"
+)
+
+type testValue struct {
+	Name  string
+	Count int
+}
+
+// upperCodec - a user codec storing strings upper cased
+type upperCodec struct{}
+
+func (upperCodec) Name() string {
+	return "upper"
+}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	expected := testValue{Name: "a", Count: 2}
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		store, err := db.CreateStore(ctx, codec.Name(), WithCodec(codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Put(ctx, "k", expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, err := db.CreateStore(ctx, "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Put(ctx, "string", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Put(ctx, "bytes", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Put(ctx, "struct", expected); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Raw put of a struct: %v, expected ErrUnsupportedType", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The codec is kept in the config so the stores decode the same way once reopened
+	db = openTestDB(t, fsys)
+	defer db.Close()
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		store, err := db.OpenStore(ctx, codec.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.Codec() != codec || store.Config().Codec != codec.Name() {
+			t.Errorf("Codec after reopen: %s, config %+v", store.Codec().Name(), store.Config())
+		}
+		var got testValue
+		if err = store.Get(ctx, "k", &got); err != nil || got != expected {
+			t.Errorf("%s get: %+v, err %v", codec.Name(), got, err)
+		}
+	}
+	if raw, err = db.OpenStore(ctx, "raw"); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Codec() != RawCodec || raw.Config().Codec != "" {
+		t.Errorf("Codec of a store that didn't choose one: %s, config %+v", raw.Codec().Name(), raw.Config())
+	}
+	var gotString string
+	if err = raw.Get(ctx, "string", &gotString); err != nil || gotString != "value" {
+		t.Errorf("Raw get string: %q, err %v", gotString, err)
+	}
+	var gotBytes []byte
+	if err = raw.Get(ctx, "bytes", &gotBytes); err != nil || string(gotBytes) != "value" {
+		t.Errorf("Raw get bytes: %q, err %v", gotBytes, err)
+	}
+	if err = raw.Get(ctx, "missing", &gotString); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get of a missing key: %v, expected ErrKeyNotFound", err)
+	}
+}
+
+func TestPutJSONGetJSON(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	expected := testValue{Name: "a", Count: 2}
+	for storeName, opts := range map[string][]StoreOption{"raw": nil, "json": {WithCodec(JSONCodec)}} {
+		store, err := db.CreateStore(ctx, storeName, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.PutJSON(ctx, "k", expected); err != nil {
+			t.Fatal(err)
+		}
+		var got testValue
+		if err = store.GetJSON(ctx, "k", &got); err != nil || got != expected {
+			t.Errorf("%s GetJSON: %+v, err %v", store.Codec().Name(), got, err)
+		}
+		// Whatever the codec, the value is held as plain JSON
+		if value, err := store.Read(ctx, "k"); err != nil || string(value) != `{"Name":"a","Count":2}` {
+			t.Errorf("%s value: %s, err %v", store.Codec().Name(), value, err)
+		}
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	store, err := db.CreateStore(ctx, "s", WithCodec(GobCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.PutJSON(ctx, "k", testValue{}); !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("PutJSON on a gob store: %v, expected ErrCodecMismatch", err)
+	}
+	if err = store.Put(ctx, "k", testValue{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	var got testValue
+	if err = store.GetJSON(ctx, "k", &got); !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("GetJSON on a gob store: %v, expected ErrCodecMismatch", err)
+	}
+	var dbErr *Error
+	if !errors.As(err, &dbErr) || dbErr.Op != "get" || dbErr.Store != "s" || dbErr.Key != "k" {
+		t.Errorf("Error: %#v", dbErr)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	if _, err := db.CreateStore(ctx, "s", WithCodecName("nope")); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Create with an unknown codec: %v, expected ErrUnknownCodec", err)
+	}
+	if _, err := db.OpenStore(ctx, "s"); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("Store created with an unknown codec: %v", err)
+	}
+
+	RegisterCodec(upperCodec{})
+	store, err := db.CreateStore(ctx, "s", WithCodecName("upper"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Put(ctx, "k", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Read(ctx, "k"); err != nil || string(value) != "VALUE" {
+		t.Errorf("Value written by a registered codec: %q, err %v", value, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A config naming a codec that isn't registered can't be opened
+	codecsMutex.Lock()
+	delete(codecs, "upper")
+	codecsMutex.Unlock()
+	if _, err = Open(WithFS(fsys), WithDataDirectory("/data"), WithConfigFile("/config.json")); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Open with an unregistered codec: %v, expected ErrUnknownCodec", err)
+	}
+}
@@ -0,0 +1,86 @@
+package gokave
+
+import (
+	"encoding/json"
+	"gokave/gkfs"
+	"path/filepath"
+)
+
+// StoreConfig - the Config per store
+type StoreConfig struct {
+	Name string
+	// Codec is the name of the codec values are encoded with. Empty means raw bytes
+	Codec string `json:",omitempty"`
+	// KeyCase is KeyCaseFold or KeyCasePreserve. Empty for stores created before it existed, which fold
+	KeyCase string `json:",omitempty"`
+}
+
+// StoreOption - a setting for a new store
+type StoreOption func(*StoreConfig)
+
+// WithCodec - encode the store's values with codec. The codec must be registered (see RegisterCodec)
+func WithCodec(codec Codec) StoreOption {
+	return func(storeConfig *StoreConfig) {
+		storeConfig.Codec = codec.Name()
+	}
+}
+
+// WithCodecName - as WithCodec but naming a registered codec
+func WithCodecName(name string) StoreOption {
+	return func(storeConfig *StoreConfig) {
+		storeConfig.Codec = name
+	}
+}
+
+// Config - the store config
+// todo: rename this it's more about the current running stance
+type Config struct {
+	Stores []StoreConfig
+}
+
+// readConfig - a missing config file means there are no stores yet
+func readConfig(fsys gkfs.FS, fileName string) (config *Config, err error) {
+	config = new(Config)
+	byteValue, err := gkfs.ReadFile(fsys, fileName)
+	if gkfs.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(byteValue) == 0 {
+		return config, nil
+	}
+	if err = json.Unmarshal(byteValue, config); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// writeConfig - write to a temporary file and rename it over the old config so a crash can't
+// leave a half written file behind
+func writeConfig(fsys gkfs.FS, fileName string, config *Config) (err error) {
+	configString, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return
+	}
+	if err = fsys.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return
+	}
+	if err = gkfs.WriteFile(fsys, fileName+".tmp", configString); err != nil {
+		return
+	}
+	if err = fsys.Rename(fileName+".tmp", fileName); err != nil {
+		return
+	}
+	return fsys.SyncDir(filepath.Dir(fileName))
+}
+
+func (config *Config) store(storeName string) *StoreConfig {
+	for i := range config.Stores {
+		if config.Stores[i].Name == storeName {
+			return &config.Stores[i]
+		}
+	}
+	return nil
+}
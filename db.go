@@ -0,0 +1,364 @@
+// Package gokave is an embeddable key value database. A DB holds any number of named stores, each
+// of which is an append only log of key/value pairs on disk (see gkstore and gklogfile)
+package gokave
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gkstore"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxKeyLength matches what a gklogfile record can hold
+const maxKeyLength = 255
+
+var storeNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// ValidateStoreName - ErrInvalidStoreName unless the name is 1-64 letters, digits, '_' or '-' and
+// starts with a letter or digit
+func ValidateStoreName(storeName string) error {
+	if !storeNamePattern.MatchString(storeName) {
+		return ErrInvalidStoreName
+	}
+	return nil
+}
+
+// ValidateKey - ErrInvalidKey if the key is empty or longer than a record can hold
+func ValidateKey(key string) error {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// DB - a set of named stores
+// Sharing a DB between goroutines is safe
+type DB struct {
+	options options
+	mutex   sync.RWMutex // guards stores and config. Held exclusively when stores are created or deleted
+	stores  map[string]*Store
+	config  *Config
+	closed  bool
+	replica int32 // 1 while the DB is a replica. See WithReplica
+}
+
+// Open - open the DB and every store listed in its config file
+func Open(opts ...Option) (db *DB, err error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	config, err := readConfig(o.fs, o.configFile)
+	if err != nil {
+		return nil, newError("open", "", "", err)
+	}
+
+	db = &DB{
+		options: o,
+		stores:  make(map[string]*Store),
+		config:  config,
+	}
+	if o.replica {
+		db.replica = 1
+	}
+	for _, storeConfig := range config.Stores {
+		// Each store lives in its own directory
+		fmt.Println("Initialising:", storeConfig.Name)
+		codec, err := lookupCodec(storeConfig.Codec)
+		if err != nil {
+			db.Close()
+			return nil, newError("open", storeConfig.Name, "", err)
+		}
+		kv, err := gkstore.OpenWith(storeConfig.Name, db.storeConfig(storeConfig.Name))
+		// todo: decide how we want to handle a single store failure
+		if err != nil {
+			db.Close()
+			return nil, newError("open", storeConfig.Name, "", err)
+		}
+		db.stores[storeConfig.Name] = &Store{db: db, name: storeConfig.Name, kv: kv, config: storeConfig, codec: codec}
+	}
+	return
+}
+
+// Close - close every store, flushing their files and releasing their locks
+func (db *DB) Close() (err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return
+	}
+	db.closed = true
+	for storeName, s := range db.stores {
+		fmt.Println("Closing:", storeName)
+		if closeErr := s.kv.Close(); closeErr != nil && err == nil {
+			err = newError("close", storeName, "", closeErr)
+		}
+	}
+	return
+}
+
+// CreateStore - create a new empty store
+func (db *DB) CreateStore(ctx context.Context, storeName string, opts ...StoreOption) (store *Store, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = ValidateStoreName(storeName); err != nil {
+		return nil, newError("create store", storeName, "", err)
+	}
+	storeConfig := StoreConfig{Name: storeName, KeyCase: KeyCasePreserve}
+	for _, opt := range opts {
+		opt(&storeConfig)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.IsReplica() {
+		return nil, newError("create store", storeName, "", ErrReplica)
+	}
+	return db.createStore(storeConfig)
+}
+
+// createStore - must be called holding the mutex
+func (db *DB) createStore(storeConfig StoreConfig) (store *Store, err error) {
+	storeName := storeConfig.Name
+	codec, err := lookupCodec(storeConfig.Codec)
+	if err != nil {
+		return nil, newError("create store", storeName, "", err)
+	}
+	if err = validateKeyCase(storeConfig.KeyCase); err != nil {
+		return nil, newError("create store", storeName, "", err)
+	}
+	if err = db.writable(); err != nil {
+		return nil, newError("create store", storeName, "", err)
+	}
+	if db.nameTaken(storeName) {
+		return nil, newError("create store", storeName, "", ErrStoreExists)
+	}
+
+	fmt.Printf("Creating store: %s\n", storeName)
+	kv, err := gkstore.CreateWith(storeName, db.storeConfig(storeName))
+	if err != nil {
+		return nil, newError("create store", storeName, "", err)
+	}
+	if store, err = db.addStore(storeConfig, kv, codec); err != nil {
+		return nil, newError("create store", storeName, "", err)
+	}
+	return
+}
+
+// addStore - record a store whose directory is ready in the config. kv is closed if that fails. Must
+// be called holding the mutex
+func (db *DB) addStore(storeConfig StoreConfig, kv *gkstore.KvStore, codec Codec) (store *Store, err error) {
+	updated := *db.config
+	updated.Stores = append(append([]StoreConfig(nil), db.config.Stores...), storeConfig)
+	if err = writeConfig(db.options.fs, db.options.configFile, &updated); err != nil {
+		kv.Close()
+		return
+	}
+	db.config = &updated
+
+	store = &Store{db: db, name: storeConfig.Name, kv: kv, config: storeConfig, codec: codec}
+	db.stores[storeConfig.Name] = store
+	return
+}
+
+// nameTaken - whether a store has storeName, or a name differing only by case as the two would
+// share a directory on a case insensitive file system. Must be called holding the mutex
+func (db *DB) nameTaken(storeName string) bool {
+	for existing := range db.stores {
+		if strings.EqualFold(existing, storeName) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenStore - get the named store
+func (db *DB) OpenStore(ctx context.Context, storeName string) (store *Store, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if store, err = db.lookup(storeName); err != nil {
+		return nil, newError("open store", storeName, "", err)
+	}
+	return
+}
+
+// lookup - find a store by name. Stores that fold their keys also match their name in any case, as
+// their names were always folded on the way in from the HTTP API. Must be called holding the mutex
+func (db *DB) lookup(storeName string) (store *Store, err error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if store = db.stores[storeName]; store != nil {
+		return
+	}
+	for _, storeConfig := range db.config.Stores {
+		if storeConfig.folds() && strings.EqualFold(storeConfig.Name, storeName) {
+			if store = db.stores[storeConfig.Name]; store != nil {
+				return
+			}
+		}
+	}
+	return nil, ErrStoreNotFound
+}
+
+// DeleteStore - remove a store and all of its data
+// The store is taken out of the config before its files are removed so a failure part way
+// through leaves files behind rather than a store with missing data
+func (db *DB) DeleteStore(ctx context.Context, storeName string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.IsReplica() {
+		return newError("delete store", storeName, "", ErrReplica)
+	}
+	return db.deleteStore(storeName)
+}
+
+// deleteStore - must be called holding the mutex
+func (db *DB) deleteStore(storeName string) (err error) {
+	if err = db.writable(); err != nil {
+		return newError("delete store", storeName, "", err)
+	}
+	// The same lookup as OpenStore, so a folding store can be removed by its name in any case
+	store, err := db.lookup(storeName)
+	if err != nil {
+		return newError("delete store", storeName, "", err)
+	}
+	storeName = store.name
+
+	fmt.Printf("Removing store: %s\n", storeName)
+	updated := Config{}
+	for _, storeConfig := range db.config.Stores {
+		if storeConfig.Name != storeName {
+			updated.Stores = append(updated.Stores, storeConfig)
+		}
+	}
+	if err = writeConfig(db.options.fs, db.options.configFile, &updated); err != nil {
+		return newError("delete store", storeName, "", err)
+	}
+	db.config = &updated
+	delete(db.stores, storeName)
+
+	if err = store.kv.Close(); err != nil {
+		return newError("delete store", storeName, "", err)
+	}
+	return newError("delete store", storeName, "", gkfs.RemoveAll(db.options.fs, db.storeDirectory(storeName)))
+}
+
+// ListStores - the names of every store, sorted
+func (db *DB) ListStores(ctx context.Context) (storeNames []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return nil, newError("list stores", "", "", ErrClosed)
+	}
+	storeNames = make([]string, 0, len(db.stores))
+	for storeName := range db.stores {
+		storeNames = append(storeNames, storeName)
+	}
+	sort.Strings(storeNames)
+	return
+}
+
+// Write - write a value to a store. See Store.Write
+func (db *DB) Write(ctx context.Context, storeName string, key string, value []byte) error {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return err
+	}
+	return store.Write(ctx, key, value)
+}
+
+// Read - read a value from a store. See Store.Read
+func (db *DB) Read(ctx context.Context, storeName string, key string) ([]byte, error) {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return nil, err
+	}
+	return store.Read(ctx, key)
+}
+
+// WriteMeta - write a value and its meta to a store. See Store.WriteMeta
+func (db *DB) WriteMeta(ctx context.Context, storeName string, key string, value []byte, meta Meta) error {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return err
+	}
+	return store.WriteMeta(ctx, key, value, meta)
+}
+
+// ReadMeta - read a value and its meta from a store. See Store.ReadMeta
+func (db *DB) ReadMeta(ctx context.Context, storeName string, key string) ([]byte, Meta, error) {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.ReadMeta(ctx, key)
+}
+
+// ReadMany - read several values from a store. See Store.ReadMany
+func (db *DB) ReadMany(ctx context.Context, storeName string, keys []string) (map[string]ReadResult, error) {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return nil, err
+	}
+	return store.ReadMany(ctx, keys)
+}
+
+// Head - the meta and value length for a key in a store. See Store.Head
+func (db *DB) Head(ctx context.Context, storeName string, key string) (Meta, int, error) {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return store.Head(ctx, key)
+}
+
+// Delete - delete a value from a store. See Store.Delete
+func (db *DB) Delete(ctx context.Context, storeName string, key string) error {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// writable - must be called holding the mutex
+func (db *DB) writable() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.options.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (db *DB) storeDirectory(storeName string) string {
+	return filepath.Join(db.options.dataDirectory, storeName)
+}
+
+func (db *DB) storeConfig(storeName string) gkstore.Config {
+	return gkstore.Config{
+		FS:        db.options.fs,
+		Directory: db.storeDirectory(storeName),
+		ReadOnly:  db.options.readOnly,
+	}
+}
@@ -0,0 +1,263 @@
+package gokave
+
+import (
+	"context"
+	"errors"
+	"gokave/gkfs"
+	"strings"
+	"testing"
+)
+
+// openTestDB - a DB on fsys with its stores under /data
+func openTestDB(t *testing.T, fsys gkfs.FS, opts ...Option) (db *DB) {
+	t.Helper()
+	opts = append([]Option{WithFS(fsys), WithDataDirectory("/data"), WithConfigFile("/config.json")}, opts...)
+	db, err := Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	for _, storeName := range []string{"b", "a"} {
+		if _, err := db.CreateStore(ctx, storeName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Write(ctx, "a", "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything went where the options said
+	if _, err := gkfs.ReadFile(fsys, "/config.json"); err != nil {
+		t.Errorf("Config file: %v", err)
+	}
+	if fileInfos, err := fsys.ReadDir("/data"); err != nil || len(fileInfos) != 2 {
+		t.Errorf("Data directory: %d entries, err %v", len(fileInfos), err)
+	}
+
+	db = openTestDB(t, fsys)
+	defer db.Close()
+	storeNames, err := db.ListStores(ctx)
+	if err != nil || strings.Join(storeNames, ",") != "a,b" {
+		t.Errorf("Stores after reopen: %v, err %v", storeNames, err)
+	}
+	if value, err := db.Read(ctx, "a", "k"); err != nil || string(value) != "v" {
+		t.Errorf("Read after reopen: %q, err %v", value, err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	if _, err := db.CreateStore(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(ctx, "s", "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer holds the store's lock
+	if _, err := Open(WithFS(fsys), WithDataDirectory("/data"), WithConfigFile("/config.json"), WithReadOnly()); !errors.Is(err, ErrStoreLocked) {
+		t.Errorf("Read only open while open for writing: %v, expected ErrStoreLocked", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := []*DB{openTestDB(t, fsys, WithReadOnly()), openTestDB(t, fsys, WithReadOnly())}
+	for _, reader := range readers {
+		defer reader.Close()
+		if value, err := reader.Read(ctx, "s", "k"); err != nil || string(value) != "v" {
+			t.Errorf("Read only read: %q, err %v", value, err)
+		}
+	}
+	if err := readers[0].Write(ctx, "s", "k", []byte("w")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Write: %v, expected ErrReadOnly", err)
+	}
+	if _, err := readers[0].CreateStore(ctx, "t"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Create store: %v, expected ErrReadOnly", err)
+	}
+	if err := readers[0].DeleteStore(ctx, "s"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete store: %v, expected ErrReadOnly", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	store, err := db.CreateStore(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Write(ctx, "gone", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Delete(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, createErr := db.CreateStore(ctx, "s")
+	_, invalidNameErr := db.CreateStore(ctx, "../s")
+	_, missingStoreErr := db.OpenStore(ctx, "t")
+	_, missingKeyErr := store.Read(ctx, "missing")
+	_, deletedKeyErr := store.Read(ctx, "gone")
+	for _, test := range []struct {
+		err      error
+		expected error
+	}{
+		{createErr, ErrStoreExists},
+		{invalidNameErr, ErrInvalidStoreName},
+		{missingStoreErr, ErrStoreNotFound},
+		{missingKeyErr, ErrKeyNotFound},
+		{deletedKeyErr, ErrKeyDeleted},
+		// A deleted key is also not found
+		{deletedKeyErr, ErrKeyNotFound},
+		{store.Write(ctx, "", []byte("v")), ErrInvalidKey},
+		{store.Write(ctx, strings.Repeat("k", maxKeyLength+1), []byte("v")), ErrInvalidKey},
+		{db.DeleteStore(ctx, "t"), ErrStoreNotFound},
+	} {
+		if !errors.Is(test.err, test.expected) {
+			t.Errorf("%v doesn't match %v", test.err, test.expected)
+		}
+	}
+	if errors.Is(missingKeyErr, ErrKeyDeleted) {
+		t.Error("A key that was never written matches ErrKeyDeleted")
+	}
+
+	var dbErr *Error
+	if !errors.As(deletedKeyErr, &dbErr) || dbErr.Op != "read" || dbErr.Store != "s" || dbErr.Key != "gone" {
+		t.Errorf("Error: %#v", dbErr)
+	}
+	if deletedKeyErr.Error() != "read s/gone: Key has been deleted" {
+		t.Errorf("Error message: %s", deletedKeyErr)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Second close: %v", err)
+	}
+	if err = db.Write(ctx, "s", "k", []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after close: %v, expected ErrClosed", err)
+	}
+	if err = store.Write(ctx, "k", []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write to a store after close: %v, expected ErrClosed", err)
+	}
+	if _, err = db.ListStores(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("List after close: %v, expected ErrClosed", err)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	store, err := db.CreateStore(context.Background(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = store.Write(ctx, "k", []byte("v")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write: %v, expected context.Canceled", err)
+	}
+	if _, err = store.Read(ctx, "k"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read: %v, expected context.Canceled", err)
+	}
+	if _, err = db.CreateStore(ctx, "t"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Create store: %v, expected context.Canceled", err)
+	}
+	if err = db.DeleteStore(ctx, "s"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Delete store: %v, expected context.Canceled", err)
+	}
+
+	// Nothing was done
+	if _, err = store.Read(context.Background(), "k"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Read of the cancelled write: %v, expected ErrKeyNotFound", err)
+	}
+	if storeNames, _ := db.ListStores(context.Background()); len(storeNames) != 1 {
+		t.Errorf("Stores: %v", storeNames)
+	}
+}
+
+func TestDeleteStore(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	defer db.Close()
+	if _, err := db.CreateStore(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(ctx, "s", "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteStore(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.ReadDir("/data/s"); !gkfs.IsNotExist(err) {
+		t.Errorf("Store directory after delete: %v", err)
+	}
+
+	// The name can be used again, for an empty store
+	if _, err := db.CreateStore(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Read(ctx, "s", "k"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Read from the recreated store: %v, expected ErrKeyNotFound", err)
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	store, err := db.CreateStore(ctx, "s", WithKeyCase(KeyCaseFold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeValues(t, store, "a", "one", "gone", "two")
+	if err = store.Delete(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A folding store answers each spelling of a key it was asked for
+	results, err := db.ReadMany(ctx, "s", []string{"a", "A", "gone", "missing", "a", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Errorf("Results: %v, expected one per distinct key", results)
+	}
+	for _, key := range []string{"a", "A"} {
+		if result := results[key]; result.Err != nil || string(result.Value) != "one" {
+			t.Errorf("ReadMany %s: %q, err %v", key, result.Value, result.Err)
+		}
+	}
+	for key, expected := range map[string]error{"gone": ErrKeyDeleted, "missing": ErrKeyNotFound, "": ErrInvalidKey} {
+		if result := results[key]; !errors.Is(result.Err, expected) || result.Value != nil {
+			t.Errorf("ReadMany %q: %q, err %v, expected %v", key, result.Value, result.Err, expected)
+		}
+	}
+	if errors.Is(results["missing"].Err, ErrKeyDeleted) {
+		t.Error("A key that was never written matches ErrKeyDeleted")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = store.ReadMany(cancelled, []string{"a"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadMany: %v, expected context.Canceled", err)
+	}
+	if _, err = db.ReadMany(ctx, "t", []string{"a"}); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("ReadMany of a missing store: %v, expected ErrStoreNotFound", err)
+	}
+}
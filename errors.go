@@ -0,0 +1,100 @@
+package gokave
+
+import (
+	"errors"
+	"fmt"
+	"gokave/gklogfile"
+	"gokave/gkstore"
+)
+
+// Errors returned (wrapped in an *Error) by DB and Store operations. Check for them with errors.Is
+var (
+	// ErrStoreNotFound means there is no store with the given name
+	ErrStoreNotFound = errors.New("Store not found")
+	// ErrStoreExists means a store with the given name has already been created
+	ErrStoreExists = errors.New("Store already exists")
+	// ErrInvalidStoreName means the name can't be used for a store
+	ErrInvalidStoreName = errors.New("Invalid store name")
+	// ErrKeyNotFound means the key has never been written to the store. errors.Is also matches
+	// ErrKeyDeleted against it as both mean there is no value
+	ErrKeyNotFound = errors.New("Key not found")
+	// ErrKeyDeleted means the key has been deleted from the store
+	ErrKeyDeleted error = keyDeletedError{}
+	// ErrKeyExists means an import found a key the store already has a value for (see ImportFail)
+	ErrKeyExists = errors.New("Key already exists")
+	// ErrBadImport means an import was given something other than the JSON lines of an export
+	ErrBadImport = errors.New("Bad import")
+	// ErrInvalidKey means the key is empty or too long
+	ErrInvalidKey = errors.New("Invalid key")
+	// ErrInvalidKeyCase means a KeyCase setting other than KeyCaseFold or KeyCasePreserve
+	ErrInvalidKeyCase = errors.New("Invalid key case")
+	// ErrKeyCaseConflict means folding a store's keys to lower case would merge keys with different values
+	ErrKeyCaseConflict = errors.New("Keys differ only by case")
+	// ErrMetaTooLarge means a value's Meta doesn't fit alongside it
+	ErrMetaTooLarge = gklogfile.ErrMetaTooLarge
+	// ErrClosed means the DB (or store) has been closed
+	ErrClosed = gkstore.ErrClosed
+	// ErrReadOnly means a write was attempted on a DB (or store) opened read only
+	ErrReadOnly = gkstore.ErrReadOnly
+	// ErrReplica means a write was made to a replica. Writes go to its primary
+	ErrReplica = errors.New("DB is a replica")
+	// ErrStoreLocked means another process has the store open
+	ErrStoreLocked = gkstore.ErrStoreLocked
+	// ErrHistoryCompacted means changes can't be replayed from the sequence number asked for as
+	// compaction has dropped some of them. Watching from 0 replays the current value of every key
+	ErrHistoryCompacted = gkstore.ErrHistoryCompacted
+	// ErrSegmentNotFound means a replica asked for records from a segment the primary no longer has
+	ErrSegmentNotFound = gkstore.ErrSegmentNotFound
+	// ErrWatchTooSlow means a watch fell too far behind the writes to the store and was stopped
+	ErrWatchTooSlow = gkstore.ErrWatchTooSlow
+	// ErrBadMerklePath means a node of a store's Merkle tree was asked for that isn't in the tree
+	ErrBadMerklePath = gkstore.ErrBadMerklePath
+	// ErrBadBackup means a restore was given something that isn't a backup, or is a damaged one
+	ErrBadBackup = gkstore.ErrBadBackup
+	// ErrBackupBaseTooOld means an incremental backup was asked for on from a backup taken before the
+	// store was last compacted
+	ErrBackupBaseTooOld = gkstore.ErrBackupBaseTooOld
+	// ErrSnapshotClosed means a snapshot was read from after it was closed
+	ErrSnapshotClosed = gkstore.ErrSnapshotClosed
+)
+
+type keyDeletedError struct{}
+
+func (keyDeletedError) Error() string {
+	return "Key has been deleted"
+}
+
+func (keyDeletedError) Is(target error) bool {
+	return target == ErrKeyNotFound
+}
+
+// Error - the error returned by DB and Store operations. Err is either one of the errors above or
+// whatever went wrong underneath (e.g. a file system error)
+type Error struct {
+	Op    string
+	Store string
+	Key   string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Key != "":
+		return fmt.Sprintf("%s %s/%s: %s", e.Op, e.Store, e.Key, e.Err.Error())
+	case e.Store != "":
+		return fmt.Sprintf("%s %s: %s", e.Op, e.Store, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", e.Op, e.Err.Error())
+}
+
+// Unwrap - allow errors.Is / errors.As to see the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(op string, store string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Store: store, Key: key, Err: err}
+}
@@ -0,0 +1,186 @@
+package gokave
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gokave/gklogfile"
+	"io"
+	"time"
+)
+
+// exportBatch - how many keys an export reads, or an import writes, at a time
+const exportBatch = 1000
+
+// ExportRecord - one line of an export, as JSON. Values are base64 encoded by encoding/json so binary
+// values survive the trip. Meta, Version (the sequence number of the write) and Time are only
+// exported when asked for, and an import doesn't need them
+type ExportRecord struct {
+	Key     string     `json:"key"`
+	Value   []byte     `json:"value"`
+	Meta    Meta       `json:"meta,omitempty"`
+	Version uint64     `json:"version,omitempty"`
+	Time    *time.Time `json:"time,omitempty"`
+}
+
+// ExportOptions - what Store.Export writes
+type ExportOptions struct {
+	Prefix   string // only keys starting with this
+	Meta     bool   // each value's meta
+	Versions bool   // each value's version and the time it was written
+}
+
+// ExportStats - what an export wrote
+type ExportStats struct {
+	Store    string
+	Exported int
+}
+
+// Export - write every live key and value in the store to w as JSON lines of ExportRecord, in key
+// order. The store stays in use and the export isn't a snapshot: a change made while it runs may or
+// may not be in it. A key deleted before its value is read is left out
+func (store *Store) Export(ctx context.Context, w io.Writer, opts ExportOptions) (stats ExportStats, err error) {
+	stats.Store = store.name
+	keys, err := store.Keys(ctx, opts.Prefix)
+	if err != nil {
+		return
+	}
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for start := 0; start < len(keys); start += exportBatch {
+		end := start + exportBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err = ctx.Err(); err != nil {
+			return stats, newError("export", store.name, "", err)
+		}
+		results, err := store.kvStore().ReadMany(keys[start:end])
+		if err != nil {
+			return stats, newError("export", store.name, "", err)
+		}
+		for _, key := range keys[start:end] {
+			result := results[key]
+			if result.Err != nil {
+				return stats, newError("export", store.name, key, result.Err)
+			}
+			if result.Flag != gklogfile.KeyWritten {
+				continue
+			}
+			record := ExportRecord{Key: key, Value: result.Value}
+			if opts.Meta {
+				record.Meta = result.Meta
+			}
+			if opts.Versions && result.Seq != 0 {
+				written := result.Time
+				record.Version, record.Time = result.Seq, &written
+			}
+			if err = encoder.Encode(record); err != nil {
+				return stats, newError("export", store.name, "", err)
+			}
+			stats.Exported++
+		}
+	}
+	return stats, newError("export", store.name, "", buffered.Flush())
+}
+
+// ImportMode - what an import does with a key the store already has a value for
+type ImportMode string
+
+// The import modes. ImportOverwrite is used when none is given
+const (
+	ImportOverwrite ImportMode = "overwrite" // replace the value
+	ImportSkip      ImportMode = "skip"      // keep the store's value
+	ImportFail      ImportMode = "fail"      // stop the import with ErrKeyExists
+)
+
+// ImportStats - what an import wrote
+type ImportStats struct {
+	Store    string
+	Imported int
+	Skipped  int // keys the store had already, with ImportSkip
+}
+
+// Import - write the keys and values read from r, JSON lines of ExportRecord as written by Export,
+// to the store. Each value is written with its meta, if any, and gets a new version. mode decides
+// what happens to keys the store already has, including ones earlier in r. Lines are written in
+// batches and with ImportFail a batch is checked before any of it is written, but the batches
+// before one that fails stay written. A line that can't be read fails with ErrBadImport
+func (store *Store) Import(ctx context.Context, r io.Reader, mode ImportMode) (stats ImportStats, err error) {
+	stats.Store = store.name
+	if mode == "" {
+		mode = ImportOverwrite
+	}
+	if mode != ImportOverwrite && mode != ImportSkip && mode != ImportFail {
+		return stats, newError("import", store.name, "", fmt.Errorf("%w: unknown mode %q", ErrBadImport, mode))
+	}
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	line := 0
+	batch := make([]ExportRecord, 0, exportBatch)
+	for done := false; !done; {
+		batch = batch[:0]
+		for len(batch) < exportBatch {
+			var record ExportRecord
+			if err = decoder.Decode(&record); err == io.EOF {
+				done = true
+				break
+			}
+			line++
+			if err != nil {
+				return stats, newError("import", store.name, "", fmt.Errorf("%w: line %d: %s", ErrBadImport, line, err))
+			}
+			batch = append(batch, record)
+		}
+		if err = store.importBatch(ctx, batch, mode, &stats); err != nil {
+			return
+		}
+	}
+	return stats, nil
+}
+
+// importBatch - write a batch of an import, checking every key in it first
+func (store *Store) importBatch(ctx context.Context, batch []ExportRecord, mode ImportMode, stats *ImportStats) (err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	storeKeys := make([]string, len(batch))
+	for i, record := range batch {
+		if err = store.checkWrite(ctx, record.Key); err != nil {
+			return newError("import", store.name, record.Key, err)
+		}
+		storeKeys[i] = store.storeKey(record.Key)
+	}
+
+	// Keys earlier in the batch count as already there for a later one
+	exists := make(map[string]bool, len(batch))
+	if mode != ImportOverwrite {
+		found, err := store.kv.ReadMany(storeKeys)
+		if err != nil {
+			return newError("import", store.name, "", err)
+		}
+		for key, result := range found {
+			exists[key] = result.Flag == gklogfile.KeyWritten
+		}
+	}
+	if mode == ImportFail {
+		seen := make(map[string]bool, len(batch))
+		for i, record := range batch {
+			if exists[storeKeys[i]] || seen[storeKeys[i]] {
+				return newError("import", store.name, record.Key, ErrKeyExists)
+			}
+			seen[storeKeys[i]] = true
+		}
+	}
+	for i, record := range batch {
+		if exists[storeKeys[i]] {
+			stats.Skipped++
+			continue
+		}
+		if err = store.kv.WriteMeta(storeKeys[i], record.Value, record.Meta); err != nil {
+			return newError("import", store.name, record.Key, err)
+		}
+		exists[storeKeys[i]] = mode == ImportSkip
+		stats.Imported++
+	}
+	return nil
+}
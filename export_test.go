@@ -0,0 +1,161 @@
+package gokave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"gokave/gkfs"
+	"strings"
+	"testing"
+)
+
+// createTestStore - a store in db holding the keys and values given
+func createTestStore(t *testing.T, db *DB, storeName string, values map[string]string) (store *Store) {
+	t.Helper()
+	ctx := context.Background()
+	store, err := db.CreateStore(ctx, storeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range values {
+		if err = store.Write(ctx, key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+// expectValues - check the store holds each key's value, or doesn't hold the key if its value is ""
+func expectValues(t *testing.T, store *Store, values map[string]string) {
+	t.Helper()
+	for key, value := range values {
+		got, err := store.Read(context.Background(), key)
+		if value == "" {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("%s in %s: %q %v, expected not found", key, store.Name(), got, err)
+			}
+		} else if err != nil || string(got) != value {
+			t.Errorf("%s in %s: %q %v, expected %q", key, store.Name(), got, err, value)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	store := createTestStore(t, db, "s", map[string]string{"a/1": "1", "a/2": "2", "b": "3"})
+	if err := store.WriteMeta(ctx, "a/1", []byte{0, 0xff}, Meta{MetaContentType: "application/octet-stream"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	stats, err := store.Export(ctx, &exported, ExportOptions{Prefix: "a/", Meta: true, Versions: true})
+	if err != nil || stats.Exported != 2 {
+		t.Fatalf("Export: %+v %v", stats, err)
+	}
+	var records []ExportRecord
+	decoder := json.NewDecoder(&exported)
+	for decoder.More() {
+		var record ExportRecord
+		if err = decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Key != "a/1" || records[1].Key != "a/2" {
+		t.Fatalf("Exported: %+v", records)
+	}
+	first := records[0]
+	if !bytes.Equal(first.Value, []byte{0, 0xff}) || first.Meta[MetaContentType] != "application/octet-stream" || first.Version == 0 || first.Time == nil {
+		t.Errorf("Exported %+v", first)
+	}
+
+	// Without the options there is only the key and value
+	exported.Reset()
+	if _, err = store.Export(ctx, &exported, ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(exported.String()), "\n"); len(lines) != 2 || strings.Contains(exported.String(), "version") || strings.Contains(exported.String(), "meta") {
+		t.Errorf("Exported without meta or versions: %q", exported.String())
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	source := createTestStore(t, db, "source", map[string]string{"a": "new a", "b": "new b"})
+	if err := source.WriteMeta(ctx, "c", []byte("new c"), Meta{"colour": "red"}); err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if _, err := source.Export(ctx, &exported, ExportOptions{Meta: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		store    string
+		mode     ImportMode
+		imported int
+		skipped  int
+		err      error
+		values   map[string]string
+	}{
+		{"default", "", 3, 0, nil, map[string]string{"a": "new a", "b": "new b", "c": "new c"}},
+		{"overwrite", ImportOverwrite, 3, 0, nil, map[string]string{"a": "new a", "b": "new b", "c": "new c"}},
+		{"skip", ImportSkip, 2, 1, nil, map[string]string{"a": "new a", "b": "old b", "c": "new c"}},
+		// The batch is checked before any of it is written
+		{"fail", ImportFail, 0, 0, ErrKeyExists, map[string]string{"a": "", "b": "old b", "c": ""}},
+	} {
+		store := createTestStore(t, db, test.store, map[string]string{"b": "old b"})
+		stats, err := store.Import(ctx, bytes.NewReader(exported.Bytes()), test.mode)
+		if !errors.Is(err, test.err) || stats.Imported != test.imported || stats.Skipped != test.skipped {
+			t.Errorf("Import %q: %+v %v", test.mode, stats, err)
+		}
+		expectValues(t, store, test.values)
+		if test.err == nil {
+			if _, meta, err := store.ReadMeta(ctx, "c"); err != nil || meta["colour"] != "red" {
+				t.Errorf("Import %q: meta of c %v %v", test.mode, meta, err)
+			}
+		}
+	}
+}
+
+func TestImportRepeatedKeys(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	lines := `{"key":"a","value":"MQ=="}` + "\n" + `{"key":"a","value":"Mg=="}` + "\n"
+
+	// A key earlier in the import counts as one the store already has
+	for mode, value := range map[ImportMode]string{ImportOverwrite: "2", ImportSkip: "1", ImportFail: ""} {
+		store := createTestStore(t, db, "repeated-"+string(mode), nil)
+		_, err := store.Import(ctx, strings.NewReader(lines), mode)
+		if (mode == ImportFail) != errors.Is(err, ErrKeyExists) {
+			t.Errorf("Import %q: %v", mode, err)
+		}
+		expectValues(t, store, map[string]string{"a": value})
+	}
+}
+
+func TestImportBadInput(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	store := createTestStore(t, db, "s", nil)
+	if _, err := store.Import(ctx, strings.NewReader(""), "replace"); !errors.Is(err, ErrBadImport) {
+		t.Errorf("Unknown mode: %v, expected ErrBadImport", err)
+	}
+	stats, err := store.Import(ctx, strings.NewReader(`{"key":"a","value":"MQ=="}`+"\nnot json\n"), ImportOverwrite)
+	if !errors.Is(err, ErrBadImport) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Bad line: %+v %v, expected ErrBadImport on line 2", stats, err)
+	}
+	if _, err = store.Import(ctx, strings.NewReader(`{"key":"","value":"MQ=="}`), ImportOverwrite); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Empty key: %v, expected ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,117 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"gokave/gkstore"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backup - write a backup of the store to w as a tar stream, returning how many bytes it was. With
+// the info of an earlier backup of the store as base, e.g. from gkstore.ReadTarBackupInfo, it is an
+// incremental backup of what was added after that one. It isn't retried as part of it may already
+// have been written. A backup cut short by the server fails rather than leaving a short tar stream
+// looking whole
+func (client *Client) Backup(ctx context.Context, storeName string, w io.Writer, base *gkstore.BackupInfo) (written int64, err error) {
+	response, err := client.stream(ctx, http.MethodGet, storePath(storeName)+"/_backup", backupQuery(base), nil)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	return io.Copy(w, response.Body)
+}
+
+// BackupToDirectory - back the store up into directory on the server, relative to its backup
+// directory. With baseDirectory, an earlier backup directory of the store there, it is an incremental
+// backup of what was added after that one. Fails with ErrForbidden if the server has no backup
+// directory and ErrBadRequest if directory is absolute or reaches outside it
+func (client *Client) BackupToDirectory(ctx context.Context, storeName string, directory string, baseDirectory string) (info gkstore.BackupInfo, err error) {
+	query := url.Values{"dir": {directory}}
+	if baseDirectory != "" {
+		query.Set("basedir", baseDirectory)
+	}
+	body, err := client.do(ctx, http.MethodPost, storePath(storeName)+"/_backup", query, nil, false)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &info)
+	return
+}
+
+// Restore - create the store from the backup tar streams read from r, stopping at until. r holds a
+// full backup followed by any incremental backups taken on from it, in order, e.g. an
+// io.MultiReader of their files. It isn't retried as r can only be read once
+func (client *Client) Restore(ctx context.Context, storeName string, r io.Reader, until gkstore.RestorePoint) (stats gkstore.RestoreStats, err error) {
+	response, err := client.stream(ctx, http.MethodPost, storePath(storeName)+"/_restore", restoreQuery(until), r)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	err = json.NewDecoder(response.Body).Decode(&stats)
+	return
+}
+
+// RestoreFromDirectories - create the store from the backup directories on the server, relative to
+// its backup directory, a full backup followed by any incremental backups taken on from it, stopping
+// at until
+func (client *Client) RestoreFromDirectories(ctx context.Context, storeName string, directories []string, until gkstore.RestorePoint) (stats gkstore.RestoreStats, err error) {
+	query := restoreQuery(until)
+	query["dir"] = directories
+	body, err := client.do(ctx, http.MethodPost, storePath(storeName)+"/_restore", query, nil, false)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &stats)
+	return
+}
+
+func backupQuery(base *gkstore.BackupInfo) url.Values {
+	query := url.Values{}
+	if base != nil {
+		query.Set("base", base.ID)
+		query.Set("generation", strconv.FormatUint(base.Cursor.Generation, 10))
+		query.Set("segment", base.Cursor.Segment)
+		query.Set("offset", strconv.FormatInt(base.Cursor.Offset, 10))
+	}
+	return query
+}
+
+func restoreQuery(until gkstore.RestorePoint) url.Values {
+	query := url.Values{}
+	if until.Seq != 0 {
+		query.Set("seq", strconv.FormatUint(until.Seq, 10))
+	}
+	if !until.Time.IsZero() {
+		query.Set("time", until.Time.Format(time.RFC3339Nano))
+	}
+	return query
+}
+
+// stream - send a single request with body streamed from r, leaving the caller to read and close
+// the response body. An error status is returned as a *StatusError
+func (client *Client) stream(ctx context.Context, method string, path string, query url.Values, r io.Reader) (response *http.Response, err error) {
+	requestURL := *client.baseURL
+	requestURL.RawPath = requestURL.Path + path
+	requestURL.Path, _ = url.PathUnescape(requestURL.RawPath)
+	requestURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequest(method, requestURL.String(), r)
+	if err != nil {
+		return
+	}
+	if response, err = client.httpClient.Do(request.WithContext(ctx)); err != nil {
+		return
+	}
+	if response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return nil, &StatusError{Method: method, URL: requestURL.String(), StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return
+}
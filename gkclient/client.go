@@ -0,0 +1,528 @@
+// Package gkclient is a Go client for the gokave HTTP API (see gkserver)
+package gkclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave/gkstore"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors that a *StatusError matches with errors.Is depending on its status code
+var (
+	// ErrNotFound - 404. The store or key doesn't exist (or the key has been deleted)
+	ErrNotFound = errors.New("Not found")
+	// ErrBadRequest - 400. e.g. an invalid store name or key
+	ErrBadRequest = errors.New("Bad request")
+	// ErrConflict - 409. e.g. the store already exists
+	ErrConflict = errors.New("Conflict")
+	// ErrForbidden - 403. The server is read only
+	ErrForbidden = errors.New("Forbidden")
+	// ErrMethodNotAllowed - 405
+	ErrMethodNotAllowed = errors.New("Method not allowed")
+	// ErrGone - 410. The changes asked for by Poll or Watch have been compacted away
+	ErrGone = errors.New("Gone")
+	// ErrUnavailable - 502, 503 or 504. The server is shutting down or overloaded. These are retried
+	ErrUnavailable = errors.New("Unavailable")
+	// ErrServer - any other 5xx
+	ErrServer = errors.New("Server error")
+)
+
+// StatusError - the server answered with an error status
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+// Unwrap - the Err... value matching the status code
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusBadRequest:
+		return ErrBadRequest
+	case e.StatusCode == http.StatusConflict:
+		return ErrConflict
+	case e.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case e.StatusCode == http.StatusMethodNotAllowed:
+		return ErrMethodNotAllowed
+	case e.StatusCode == http.StatusGone:
+		return ErrGone
+	case retryableStatus(e.StatusCode):
+		return ErrUnavailable
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return nil
+}
+
+// StoreConfig - a store's settings as returned by DescribeStore
+type StoreConfig struct {
+	Name    string
+	Codec   string `json:",omitempty"`
+	KeyCase string `json:",omitempty"` // "preserve" or "fold". Empty for a store from before the setting, which folds
+}
+
+// VerifyJob states
+const (
+	VerifyRunning = "running"
+	VerifyDone    = "done"
+	VerifyFailed  = "failed"
+)
+
+// verifyPollInterval - how often VerifyStore asks whether a verify has finished
+const verifyPollInterval = 200 * time.Millisecond
+
+// VerifyJob - a verify of a store's files running on the server. Report is filled in once State is
+// VerifyDone, Error if it is VerifyFailed
+type VerifyJob struct {
+	ID       string
+	Store    string
+	State    string
+	Started  time.Time
+	Finished time.Time
+	Report   *gkstore.VerifyReport
+	Error    string
+}
+
+// Client - talks to a single gokave server. Safe for concurrent use; connections are pooled and
+// reused between requests
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option - a setting for New
+type Option func(*Client)
+
+// WithHTTPClient - use httpClient instead of the client's own pooled one
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// WithRetries - how many times a failed request is retried. 0 turns retries off
+func WithRetries(maxRetries int) Option {
+	return func(client *Client) {
+		client.maxRetries = maxRetries
+	}
+}
+
+// WithBackoff - the wait before the first retry, doubling (with jitter) up to max
+func WithBackoff(min time.Duration, max time.Duration) Option {
+	return func(client *Client) {
+		client.minBackoff = min
+		client.maxBackoff = max
+	}
+}
+
+// New - a client for the server at baseURL, e.g. http://localhost:8080
+func New(baseURL string, opts ...Option) (client *Client, err error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported URL scheme: %s", baseURL)
+	}
+
+	client = &Client{
+		baseURL: parsed,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		maxRetries: 3,
+		minBackoff: 50 * time.Millisecond,
+		maxBackoff: 2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return
+}
+
+// Get - the value for key
+func (client *Client) Get(ctx context.Context, storeName string, key string) (value []byte, err error) {
+	return client.do(ctx, http.MethodGet, keyPath(storeName, key), nil, nil, true)
+}
+
+// Put - write value for key
+func (client *Client) Put(ctx context.Context, storeName string, key string, value []byte) (err error) {
+	_, err = client.do(ctx, http.MethodPut, keyPath(storeName, key), nil, value, true)
+	return
+}
+
+// Item - a value along with the content type and meta stored with it
+type Item struct {
+	Value       []byte
+	ContentType string
+	// Meta is sent as X-Gokave-Meta-{Name} headers so names come back in canonical header form,
+	// e.g. "author" is returned as "Author"
+	Meta map[string]string
+	// Length of the value. The only part of the item filled in by Head other than the meta
+	Length int
+}
+
+// PutItem - write a value along with its content type and meta
+func (client *Client) PutItem(ctx context.Context, storeName string, key string, item Item) (err error) {
+	header := make(http.Header)
+	if item.ContentType != "" {
+		header.Set("Content-Type", item.ContentType)
+	}
+	for name, value := range item.Meta {
+		header.Set(MetaHeaderPrefix+name, value)
+	}
+	_, _, err = client.exchange(ctx, http.MethodPut, keyPath(storeName, key), nil, header, item.Value, true)
+	return
+}
+
+// GetItem - the value for key along with its content type and meta
+func (client *Client) GetItem(ctx context.Context, storeName string, key string) (item Item, err error) {
+	body, header, err := client.exchange(ctx, http.MethodGet, keyPath(storeName, key), nil, nil, nil, true)
+	if err != nil {
+		return
+	}
+	item = itemFromHeader(header)
+	item.Value, item.Length = body, len(body)
+	return
+}
+
+// Head - the content type, meta and length of the value for key without fetching the value
+func (client *Client) Head(ctx context.Context, storeName string, key string) (item Item, err error) {
+	_, header, err := client.exchange(ctx, http.MethodHead, keyPath(storeName, key), nil, nil, nil, true)
+	if err != nil {
+		return
+	}
+	item = itemFromHeader(header)
+	item.Length, err = strconv.Atoi(header.Get("Content-Length"))
+	return
+}
+
+// Statuses of the keys returned by GetMany
+const (
+	ResultFound   = "found"
+	ResultMissing = "missing"
+	ResultDeleted = "deleted"
+	ResultError   = "error"
+)
+
+// ManyResult - one key returned by GetMany. Only a found key has an Item
+type ManyResult struct {
+	Item
+	Status string // one of the Result... values
+	Error  string // why the key couldn't be read when Status is ResultError
+}
+
+// GetMany - read many keys in a single request. There is a result for every distinct key. The
+// server limits how many keys can be asked for at once
+func (client *Client) GetMany(ctx context.Context, storeName string, keys []string) (results map[string]ManyResult, err error) {
+	return client.getMany(ctx, storeName, nil, keys)
+}
+
+func (client *Client) getMany(ctx context.Context, storeName string, query url.Values, keys []string) (results map[string]ManyResult, err error) {
+	requestBody, err := json.Marshal(struct {
+		Keys []string `json:"keys"`
+	}{keys})
+	if err != nil {
+		return
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	body, _, err := client.exchange(ctx, http.MethodPost, storePath(storeName)+"/_mget", query, header, requestBody, true)
+	if err != nil {
+		return
+	}
+
+	var response map[string]struct {
+		Status      string            `json:"status"`
+		Value       []byte            `json:"value"`
+		ContentType string            `json:"contentType"`
+		Meta        map[string]string `json:"meta"`
+		Error       string            `json:"error"`
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return
+	}
+	results = make(map[string]ManyResult, len(response))
+	for key, r := range response {
+		results[key] = ManyResult{
+			Item:   Item{Value: r.Value, ContentType: r.ContentType, Meta: r.Meta, Length: len(r.Value)},
+			Status: r.Status,
+			Error:  r.Error,
+		}
+	}
+	return
+}
+
+// MetaHeaderPrefix - the headers carrying an item's meta
+const MetaHeaderPrefix = "X-Gokave-Meta-"
+
+func itemFromHeader(header http.Header) (item Item) {
+	item.ContentType = header.Get("Content-Type")
+	for name := range header {
+		if strings.HasPrefix(name, MetaHeaderPrefix) {
+			if item.Meta == nil {
+				item.Meta = make(map[string]string)
+			}
+			item.Meta[name[len(MetaHeaderPrefix):]] = header.Get(name)
+		}
+	}
+	return
+}
+
+// Delete - delete key
+func (client *Client) Delete(ctx context.Context, storeName string, key string) (err error) {
+	_, err = client.do(ctx, http.MethodDelete, keyPath(storeName, key), nil, nil, true)
+	return
+}
+
+// ListKeys - the keys in a store starting with prefix, in order. An empty prefix lists every key
+func (client *Client) ListKeys(ctx context.Context, storeName string, prefix string) (keys []string, err error) {
+	return client.listKeys(ctx, storeName, url.Values{}, prefix)
+}
+
+func (client *Client) listKeys(ctx context.Context, storeName string, query url.Values, prefix string) (keys []string, err error) {
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	err = client.getJSON(ctx, storePath(storeName)+"/keys", query, &keys)
+	return
+}
+
+// CreateStore - create a store. codec may be empty for raw values
+func (client *Client) CreateStore(ctx context.Context, storeName string, codec string) (err error) {
+	return client.CreateStoreWith(ctx, StoreConfig{Name: storeName, Codec: codec})
+}
+
+// CreateStoreWith - create a store with the given settings. Empty settings take the server's defaults
+func (client *Client) CreateStoreWith(ctx context.Context, storeConfig StoreConfig) (err error) {
+	query := url.Values{}
+	if storeConfig.Codec != "" {
+		query.Set("codec", storeConfig.Codec)
+	}
+	if storeConfig.KeyCase != "" {
+		query.Set("keycase", storeConfig.KeyCase)
+	}
+	// Not retried on a lost response as a retry of a create that worked would fail with ErrConflict
+	_, err = client.do(ctx, http.MethodPost, storePath(storeConfig.Name), query, nil, false)
+	return
+}
+
+// MigrateKeyCase - switch a store to "preserve" or "fold" keys. Returns the number of keys the server
+// rewrote. Fails with ErrConflict if folding would merge keys holding different values
+func (client *Client) MigrateKeyCase(ctx context.Context, storeName string, keyCase string) (rewritten int, err error) {
+	body, err := client.do(ctx, http.MethodPost, storePath(storeName)+"/_migrate", url.Values{"keycase": {keyCase}}, nil, true)
+	if err != nil {
+		return
+	}
+	var result struct{ KeysRewritten int }
+	err = json.Unmarshal(body, &result)
+	return result.KeysRewritten, err
+}
+
+// ListStores - the names of every store
+func (client *Client) ListStores(ctx context.Context) (storeNames []string, err error) {
+	err = client.getJSON(ctx, "/v1/stores", nil, &storeNames)
+	return
+}
+
+// DescribeStore - the settings of a store
+func (client *Client) DescribeStore(ctx context.Context, storeName string) (storeConfig StoreConfig, err error) {
+	err = client.getJSON(ctx, storePath(storeName), nil, &storeConfig)
+	return
+}
+
+// DeleteStore - remove a store and all of its data
+func (client *Client) DeleteStore(ctx context.Context, storeName string) (err error) {
+	_, err = client.do(ctx, http.MethodDelete, storePath(storeName), nil, nil, true)
+	return
+}
+
+// VerifyStore - check the integrity of a store's files on the server, waiting for the verify to finish
+func (client *Client) VerifyStore(ctx context.Context, storeName string) (report *gkstore.VerifyReport, err error) {
+	job, err := client.StartVerify(ctx, storeName)
+	for err == nil && job.State == VerifyRunning {
+		if err = sleep(ctx, verifyPollInterval); err != nil {
+			return
+		}
+		job, err = client.VerifyJob(ctx, storeName, job.ID)
+	}
+	if err != nil {
+		return
+	}
+	if job.State == VerifyFailed {
+		return nil, fmt.Errorf("Verify of %s failed: %s", storeName, job.Error)
+	}
+	return job.Report, nil
+}
+
+// StartVerify - start checking the integrity of a store's files on the server. Poll the job with
+// VerifyJob. If a verify of the store is already running that job is returned
+func (client *Client) StartVerify(ctx context.Context, storeName string) (job VerifyJob, err error) {
+	body, err := client.do(ctx, http.MethodPost, storePath(storeName)+"/_verify", nil, nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &job)
+	return
+}
+
+// VerifyJob - the state of a verify started with StartVerify, with its report once it is done
+func (client *Client) VerifyJob(ctx context.Context, storeName string, id string) (job VerifyJob, err error) {
+	err = client.getJSON(ctx, storePath(storeName)+"/_verify/"+url.PathEscape(id), nil, &job)
+	return
+}
+
+// CompactStore - merge a store's sealed segments on the server, dropping overwritten and deleted values
+func (client *Client) CompactStore(ctx context.Context, storeName string) (stats gkstore.CompactStats, err error) {
+	body, err := client.do(ctx, http.MethodPost, storePath(storeName)+"/_compact", nil, nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &stats)
+	return
+}
+
+func (client *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) (err error) {
+	body, err := client.do(ctx, http.MethodGet, path, query, nil, true)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(body, v)
+}
+
+func keyPath(storeName string, key string) string {
+	return storePath(storeName) + "/keys/" + url.PathEscape(key)
+}
+
+func storePath(storeName string) string {
+	return "/v1/stores/" + url.PathEscape(storeName)
+}
+
+// do - send a request, retrying with backoff on connection failures and 502/503/504s. A request
+// that isn't idempotent is only retried when the server is known not to have acted on it
+func (client *Client) do(ctx context.Context, method string, path string, query url.Values, body []byte, idempotent bool) (responseBody []byte, err error) {
+	responseBody, _, err = client.exchange(ctx, method, path, query, nil, body, idempotent)
+	return
+}
+
+// exchange - as do but also sending header and returning the response's headers
+func (client *Client) exchange(ctx context.Context, method string, path string, query url.Values, header http.Header, body []byte, idempotent bool) (responseBody []byte, responseHeader http.Header, err error) {
+	requestURL := *client.baseURL
+	requestURL.RawPath = requestURL.Path + path
+	requestURL.Path, _ = url.PathUnescape(requestURL.RawPath)
+	if query != nil {
+		requestURL.RawQuery = query.Encode()
+	}
+
+	backoff := client.minBackoff
+	for attempt := 0; ; attempt++ {
+		var statusCode int
+		responseBody, responseHeader, statusCode, err = client.send(ctx, method, requestURL.String(), header, body)
+		if err == nil && statusCode < 300 {
+			return responseBody, responseHeader, nil
+		}
+		if err == nil {
+			err = &StatusError{Method: method, URL: requestURL.String(), StatusCode: statusCode, Message: strings.TrimSpace(string(responseBody))}
+		}
+
+		if attempt >= client.maxRetries || !retryable(err, statusCode, idempotent) {
+			return nil, nil, err
+		}
+		if waitErr := sleep(ctx, jitter(backoff)); waitErr != nil {
+			return nil, nil, waitErr
+		}
+		if backoff *= 2; backoff > client.maxBackoff {
+			backoff = client.maxBackoff
+		}
+	}
+}
+
+func (client *Client) send(ctx context.Context, method string, requestURL string, header http.Header, body []byte) (responseBody []byte, responseHeader http.Header, statusCode int, err error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, requestURL, bodyReader)
+	if err != nil {
+		return
+	}
+	request = request.WithContext(ctx)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	// Reading to the end before closing lets the connection be reused
+	defer response.Body.Close()
+	responseBody, err = ioutil.ReadAll(response.Body)
+	return responseBody, response.Header, response.StatusCode, err
+}
+
+func retryable(err error, statusCode int, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if statusCode != 0 {
+		// The server answered so it either refused the request or is temporarily unable to take it
+		return retryableStatus(statusCode) && (idempotent || statusCode == http.StatusServiceUnavailable)
+	}
+	// A connection that couldn't be made can always be retried. Anything else may have reached the server
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return idempotent
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
+
+// jitter - somewhere between half and all of d so retrying clients don't stay in step
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
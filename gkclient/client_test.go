@@ -0,0 +1,241 @@
+package gkclient_test
+
+import (
+	"context"
+	"errors"
+	"gokave"
+	"gokave/gkclient"
+	"gokave/gkfs"
+	"gokave/gkserver"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer - a server over a DB on an in memory file system, and a client for it. stop shuts
+// both down
+func startTestServer(t *testing.T) (client *gkclient.Client, stop func()) {
+	t.Helper()
+	db, err := gokave.Open(gokave.WithFS(gkfs.NewMem()), gokave.WithDataDirectory("/data"), gokave.WithConfigFile("/config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := gkserver.New(db)
+	httpServer := httptest.NewServer(server)
+	stop = func() {
+		httpServer.Close()
+		db.Close()
+	}
+	if client, err = gkclient.New(httpServer.URL, gkclient.WithBackoff(time.Millisecond, 10*time.Millisecond)); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestKeys(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+	if err := client.CreateStore(ctx, "s", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := client.Put(ctx, "s", key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := client.Get(ctx, "s", "c"); err != nil || string(value) != "value of c" {
+		t.Errorf("Get: %q %v", value, err)
+	}
+	if err := client.Delete(ctx, "s", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "s", "b"); !errors.Is(err, gkclient.ErrNotFound) {
+		t.Errorf("Get of a deleted key: %v, expected ErrNotFound", err)
+	}
+	if value, err := client.Get(ctx, "s", "a"); err != nil || string(value) != "value of a" {
+		t.Errorf("Get after a delete: %q %v", value, err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+
+	if err := client.CreateStore(ctx, "s", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateStore(ctx, "t", "json"); err != nil {
+		t.Fatal(err)
+	}
+	storeNames, err := client.ListStores(ctx)
+	sort.Strings(storeNames)
+	if err != nil || strings.Join(storeNames, ",") != "s,t" {
+		t.Errorf("ListStores: %v %v", storeNames, err)
+	}
+	storeConfig, err := client.DescribeStore(ctx, "t")
+	if err != nil || storeConfig.Name != "t" || storeConfig.Codec != "json" {
+		t.Errorf("DescribeStore: %+v %v", storeConfig, err)
+	}
+	if err = client.DeleteStore(ctx, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.DescribeStore(ctx, "t"); !errors.Is(err, gkclient.ErrNotFound) {
+		t.Errorf("DescribeStore of a deleted store: %v, expected ErrNotFound", err)
+	}
+}
+
+func TestVerifyStore(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+	if err := client.CreateStore(ctx, "s", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(ctx, "s", "a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := client.VerifyStore(ctx, "s")
+	if err != nil || report == nil || !report.OK || len(report.Files) == 0 {
+		t.Fatalf("VerifyStore: %+v %v", report, err)
+	}
+	job, err := client.StartVerify(ctx, "s")
+	if err != nil || job.ID == "" || job.Store != "s" {
+		t.Fatalf("StartVerify: %+v %v", job, err)
+	}
+	if polled, err := client.VerifyJob(ctx, "s", job.ID); err != nil || polled.ID != job.ID {
+		t.Errorf("VerifyJob: %+v %v", polled, err)
+	}
+	if _, err = client.VerifyJob(ctx, "s", "unknown"); !errors.Is(err, gkclient.ErrNotFound) {
+		t.Errorf("VerifyJob of an unknown job: %v, expected ErrNotFound", err)
+	}
+	if _, err = client.VerifyStore(ctx, "missing"); !errors.Is(err, gkclient.ErrNotFound) {
+		t.Errorf("VerifyStore of a missing store: %v, expected ErrNotFound", err)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	client, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+	if err := client.CreateStore(ctx, "s", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.CreateStore(ctx, "s", "")
+	var statusErr *gkclient.StatusError
+	if !errors.Is(err, gkclient.ErrConflict) || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusConflict {
+		t.Errorf("Create of an existing store: %v, expected ErrConflict", err)
+	}
+	if _, err = client.Get(ctx, "s", "missing"); !errors.Is(err, gkclient.ErrNotFound) {
+		t.Errorf("Get of a missing key: %v, expected ErrNotFound", err)
+	}
+	if _, err = client.Get(ctx, "missing", "a"); !errors.Is(err, gkclient.ErrNotFound) {
+		t.Errorf("Get from a missing store: %v, expected ErrNotFound", err)
+	}
+	if err = client.CreateStore(ctx, "t", "nonsense"); !errors.Is(err, gkclient.ErrBadRequest) {
+		t.Errorf("Create with an unknown codec: %v, expected ErrBadRequest", err)
+	}
+	if err = client.Put(ctx, "s", strings.Repeat("k", 256), []byte("value")); !errors.Is(err, gkclient.ErrBadRequest) {
+		t.Errorf("Put of a key that is too long: %v, expected ErrBadRequest", err)
+	}
+}
+
+func TestRetryOnUnavailable(t *testing.T) {
+	var attempts, failures int32 = 0, 2
+	httpServer := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= atomic.LoadInt32(&failures) {
+			http.Error(responseWriter, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		responseWriter.Write([]byte("value"))
+	}))
+	defer httpServer.Close()
+	client, err := gkclient.New(httpServer.URL, gkclient.WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := client.Get(context.Background(), "s", "a"); err != nil || string(value) != "value" {
+		t.Errorf("Get: %q %v", value, err)
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 3 {
+		t.Errorf("Attempts: %d, expected 3", attempts)
+	}
+
+	// Out of retries the last error is returned
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&failures, 100)
+	if _, err = client.Get(context.Background(), "s", "a"); !errors.Is(err, gkclient.ErrUnavailable) {
+		t.Errorf("Get once out of retries: %v, expected ErrUnavailable", err)
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 4 {
+		t.Errorf("Attempts: %d, expected 4", attempts)
+	}
+}
+
+func TestLostResponseNotRetried(t *testing.T) {
+	var attempts int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		// The request arrived but the connection goes before there is an answer
+		conn, _, err := responseWriter.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer httpServer.Close()
+	client, err := gkclient.New(httpServer.URL, gkclient.WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.CreateStore(context.Background(), "s", ""); err == nil {
+		t.Fatal("Create succeeded without a response")
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 1 {
+		t.Errorf("Create attempts: %d, a create the server may have acted on mustn't be retried", attempts)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	if _, err = client.Get(context.Background(), "s", "a"); err == nil {
+		t.Fatal("Get succeeded without a response")
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 4 {
+		t.Errorf("Get attempts: %d, expected 4", attempts)
+	}
+}
+
+func TestCancelDuringBackoff(t *testing.T) {
+	var attempts int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(responseWriter, "Shutting down", http.StatusServiceUnavailable)
+	}))
+	defer httpServer.Close()
+	client, err := gkclient.New(httpServer.URL, gkclient.WithBackoff(time.Minute, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	if _, err = client.Get(ctx, "s", "a"); err != context.Canceled {
+		t.Errorf("Get: %v, expected context.Canceled", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Get took %v to notice the cancel", elapsed)
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 1 {
+		t.Errorf("Attempts: %d, expected 1", attempts)
+	}
+}
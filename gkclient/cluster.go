@@ -0,0 +1,64 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// ClusterStatus - a cluster member's view of its Raft cluster. See gkraft.Status
+type ClusterStatus struct {
+	ID            string
+	State         string
+	Term          uint64
+	Leader        string
+	LeaderAddr    string
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	Members       []ClusterMember
+	Peers         map[string]ClusterPeer
+}
+
+// ClusterMember - a member of a cluster and the URL of its server
+type ClusterMember struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// ClusterPeer - how far the leader has got replicating to a member. See gkraft.PeerStatus
+type ClusterPeer struct {
+	MatchIndex uint64
+	NextIndex  uint64
+}
+
+// ClusterStatus - the server's view of its cluster. Fails with ErrNotFound if it isn't in one
+func (client *Client) ClusterStatus(ctx context.Context) (status ClusterStatus, err error) {
+	err = client.getJSON(ctx, "/v1/cluster", nil, &status)
+	return
+}
+
+// AddMember - add a server to the cluster, or change its URL. Followers pass the request on to the leader
+func (client *Client) AddMember(ctx context.Context, member ClusterMember) (status ClusterStatus, err error) {
+	body, err := json.Marshal(member)
+	if err != nil {
+		return
+	}
+	if body, err = client.do(ctx, http.MethodPost, "/v1/cluster/members", nil, body, false); err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	return
+}
+
+// RemoveMember - take a server out of the cluster
+func (client *Client) RemoveMember(ctx context.Context, id string) (status ClusterStatus, err error) {
+	body, err := client.do(ctx, http.MethodDelete, "/v1/cluster/members/"+url.PathEscape(id), nil, nil, false)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	return
+}
@@ -0,0 +1,64 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"gokave/gkstore"
+	"net/http"
+	"net/url"
+)
+
+// SyncReport - how a server's stores compare with another server's. See gkmerkle.Report
+type SyncReport struct {
+	With   string
+	InSync bool
+	Stores []StoreSyncReport
+}
+
+// StoreSyncReport - how a store compares with its copy on another server. See gkmerkle.StoreReport
+type StoreSyncReport struct {
+	Store        string
+	InSync       bool
+	LocalSeq     uint64
+	RemoteSeq    uint64
+	Buckets      int
+	MissingHere  int
+	MissingThere int
+	Differing    int
+	Keys         []string
+	Repaired     int
+	Skipped      int
+	Error        string
+}
+
+// MerkleNode - a node of the Merkle tree over a store's keys and values. "" is the root
+func (client *Client) MerkleNode(ctx context.Context, storeName string, path string) (node gkstore.MerkleNode, err error) {
+	err = client.getJSON(ctx, storePath(storeName)+"/_merkle", url.Values{"path": {path}}, &node)
+	return
+}
+
+// CompareWith - compare the server's stores with those on the server at with. An empty storeName
+// compares every store
+func (client *Client) CompareWith(ctx context.Context, with string, storeName string) (report SyncReport, err error) {
+	err = client.getJSON(ctx, "/v1/antientropy", syncQuery("with", with, storeName), &report)
+	return
+}
+
+// RepairFrom - make the server's stores match those on the server at from. An empty storeName
+// repairs every store
+func (client *Client) RepairFrom(ctx context.Context, from string, storeName string) (report SyncReport, err error) {
+	body, err := client.do(ctx, http.MethodPost, "/v1/antientropy/_repair", syncQuery("from", from, storeName), nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &report)
+	return
+}
+
+func syncQuery(name string, server string, storeName string) url.Values {
+	query := url.Values{name: {server}}
+	if storeName != "" {
+		query.Set("store", storeName)
+	}
+	return query
+}
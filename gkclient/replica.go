@@ -0,0 +1,81 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"gokave/gkstore"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ReplicationStatus - how replication stands on a server. See gkreplica.Status
+type ReplicationStatus struct {
+	Role    string
+	Primary string
+	Error   string
+	Stores  map[string]ReplicaStoreStatus
+}
+
+// ReplicaStoreStatus - how far a replica store has got. See gkreplica.StoreStatus
+type ReplicaStoreStatus struct {
+	LastSeq        uint64
+	PrimaryLastSeq uint64
+	Lag            uint64
+	Segment        string
+	Offset         int64
+	LastContact    *time.Time
+	Error          string
+}
+
+// ReadRecords - the raw records appended to a segment of a store on the server from offset. An empty
+// segment means the oldest. If there are none yet the server waits up to wait for some. Fails with
+// ErrGone if the segment has been compacted away
+func (client *Client) ReadRecords(ctx context.Context, storeName string, segment string, offset int64, wait time.Duration) (records gkstore.SegmentRecords, err error) {
+	query := url.Values{"offset": {strconv.FormatInt(offset, 10)}}
+	if segment != "" {
+		query.Set("segment", segment)
+	}
+	if wait > 0 {
+		query.Set("wait", wait.String())
+	}
+	body, header, err := client.exchange(ctx, http.MethodGet, storePath(storeName)+"/_records", query, nil, nil, true)
+	if err != nil {
+		return
+	}
+	records = gkstore.SegmentRecords{
+		Segment:     header.Get("X-Gokave-Segment"),
+		Data:        body,
+		NextSegment: header.Get("X-Gokave-Next-Segment"),
+	}
+	if records.Offset, err = strconv.ParseInt(header.Get("X-Gokave-Offset"), 10, 64); err != nil {
+		return
+	}
+	if records.Next, err = strconv.ParseInt(header.Get("X-Gokave-Next-Offset"), 10, 64); err != nil {
+		return
+	}
+	if records.LastSeq, err = strconv.ParseUint(header.Get("X-Gokave-Last-Seq"), 10, 64); err != nil {
+		return
+	}
+	records.CompactedSeq, err = strconv.ParseUint(header.Get("X-Gokave-Compacted-Seq"), 10, 64)
+	return
+}
+
+// ReplicationStatus - whether the server is a primary or a replica and, for a replica, how far
+// behind its primary each store is
+func (client *Client) ReplicationStatus(ctx context.Context) (status ReplicationStatus, err error) {
+	err = client.getJSON(ctx, "/v1/replication", nil, &status)
+	return
+}
+
+// Promote - make a replica server stop following its primary and accept writes. Fails with
+// ErrConflict if the server isn't a replica
+func (client *Client) Promote(ctx context.Context) (status ReplicationStatus, err error) {
+	body, err := client.do(ctx, http.MethodPost, "/v1/replication/_promote", nil, nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	return
+}
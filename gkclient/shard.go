@@ -0,0 +1,70 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ShardStatus - a shard node's view of its deployment. See gkshard.Status
+type ShardStatus struct {
+	Self      string          `json:"self"`
+	Config    ShardConfig     `json:"config"`
+	Owned     []int           `json:"owned"`
+	Rebalance RebalanceStatus `json:"rebalance"`
+}
+
+// ShardConfig - the nodes of a sharded deployment. See gkshard.Config
+type ShardConfig struct {
+	Version      uint64
+	Partitions   int `json:",omitempty"`
+	VirtualNodes int `json:",omitempty"`
+	Nodes        []ShardNode
+}
+
+// ShardNode - a node of a sharded deployment and the URL of its server
+type ShardNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// RebalanceStatus - how a node's last rebalance went. See gkshard.RebalanceStatus
+type RebalanceStatus struct {
+	Running    bool      `json:"running"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Partitions int       `json:"partitions"`
+	Keys       int       `json:"keys"`
+	Error      string    `json:"error"`
+}
+
+// ShardStatus - the server's view of its deployment. Fails with ErrNotFound if it isn't sharded
+func (client *Client) ShardStatus(ctx context.Context) (status ShardStatus, err error) {
+	err = client.getJSON(ctx, "/v1/shards", nil, &status)
+	return
+}
+
+// SetShardNodes - change the nodes of the deployment. Every node is told and moves the partitions
+// it no longer owns to their new owners
+func (client *Client) SetShardNodes(ctx context.Context, nodes []ShardNode) (status ShardStatus, err error) {
+	body, err := json.Marshal(ShardConfig{Nodes: nodes})
+	if err != nil {
+		return
+	}
+	if body, err = client.do(ctx, http.MethodPut, "/v1/shards", nil, body, false); err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	return
+}
+
+// Rebalance - have the server move the partitions it doesn't own to their owners
+func (client *Client) Rebalance(ctx context.Context) (status ShardStatus, err error) {
+	body, err := client.do(ctx, http.MethodPost, "/v1/shards/_rebalance", nil, nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	return
+}
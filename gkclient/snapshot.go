@@ -0,0 +1,48 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Snapshot - a view of a store pinned on the server, for GetManyAt and ListKeysAt
+type Snapshot struct {
+	Token   string
+	Store   string
+	Seq     uint64 // the sequence number of the last change the snapshot sees
+	Expires time.Time
+}
+
+// CreateSnapshot - pin a view of the store as it is now on the server for ttl, or the server's
+// default if 0. Release it with ReleaseSnapshot once finished with
+func (client *Client) CreateSnapshot(ctx context.Context, storeName string, ttl time.Duration) (snapshot Snapshot, err error) {
+	query := url.Values{}
+	if ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	body, err := client.do(ctx, http.MethodPost, storePath(storeName)+"/_snapshot", query, nil, false)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &snapshot)
+	return
+}
+
+// ReleaseSnapshot - let go of a snapshot before it expires
+func (client *Client) ReleaseSnapshot(ctx context.Context, snapshot Snapshot) (err error) {
+	_, err = client.do(ctx, http.MethodDelete, storePath(snapshot.Store)+"/_snapshot/"+url.PathEscape(snapshot.Token), nil, nil, true)
+	return
+}
+
+// GetManyAt - GetMany at a snapshot
+func (client *Client) GetManyAt(ctx context.Context, snapshot Snapshot, keys []string) (results map[string]ManyResult, err error) {
+	return client.getMany(ctx, snapshot.Store, url.Values{"snapshot": {snapshot.Token}}, keys)
+}
+
+// ListKeysAt - ListKeys at a snapshot
+func (client *Client) ListKeysAt(ctx context.Context, snapshot Snapshot, prefix string) (keys []string, err error) {
+	return client.listKeys(ctx, snapshot.Store, url.Values{"snapshot": {snapshot.Token}}, prefix)
+}
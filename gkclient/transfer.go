@@ -0,0 +1,79 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ExportOptions - what Export writes
+type ExportOptions struct {
+	Prefix   string // only keys starting with this
+	Meta     bool   // each value's meta
+	Versions bool   // each value's version and the time it was written
+}
+
+// ImportOptions - how Import writes. Mode is "overwrite" (the default), "skip" or "fail" for keys
+// the store already has. With Create a store that doesn't exist is created with Codec and KeyCase
+type ImportOptions struct {
+	Mode    string
+	Create  bool
+	Codec   string
+	KeyCase string
+}
+
+// ImportStats - what an import wrote
+type ImportStats struct {
+	Store    string
+	Imported int
+	Skipped  int
+}
+
+// Export - write every live key and value in the store to w as JSON lines, one
+// {"key": ..., "value": base64, ...} object each, returning how many bytes they were. It isn't
+// retried as part of it may already have been written
+func (client *Client) Export(ctx context.Context, storeName string, w io.Writer, opts ExportOptions) (written int64, err error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Meta {
+		query.Set("meta", "true")
+	}
+	if opts.Versions {
+		query.Set("versions", "true")
+	}
+	response, err := client.stream(ctx, http.MethodGet, storePath(storeName)+"/_export", query, nil)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	return io.Copy(w, response.Body)
+}
+
+// Import - write the JSON lines of an export read from r to the store. It isn't retried as r can
+// only be read once. A failure part way through leaves the lines before it written
+func (client *Client) Import(ctx context.Context, storeName string, r io.Reader, opts ImportOptions) (stats ImportStats, err error) {
+	query := url.Values{}
+	if opts.Mode != "" {
+		query.Set("mode", opts.Mode)
+	}
+	if opts.Create {
+		query.Set("create", "true")
+	}
+	if opts.Codec != "" {
+		query.Set("codec", opts.Codec)
+	}
+	if opts.KeyCase != "" {
+		query.Set("keycase", opts.KeyCase)
+	}
+	response, err := client.stream(ctx, http.MethodPost, storePath(storeName)+"/_import", query, r)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	err = json.NewDecoder(response.Body).Decode(&stats)
+	return
+}
@@ -0,0 +1,80 @@
+package gkclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Change - a write or delete made to a store. Seq numbers the changes to a store in order. Only
+// writes have an Item
+type Change struct {
+	Seq     uint64
+	Time    time.Time
+	Key     string
+	Deleted bool
+	Item
+}
+
+// Poll - the changes to keys starting with prefix made after the change numbered since. If there
+// are none yet the server waits up to timeout (0 for its default) for one. last is the since to
+// ask for next time. Fails with ErrGone if changes after since have been compacted away
+func (client *Client) Poll(ctx context.Context, storeName string, since uint64, prefix string, timeout time.Duration) (changes []Change, last uint64, err error) {
+	query := url.Values{"since": {strconv.FormatUint(since, 10)}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if timeout > 0 {
+		query.Set("timeout", timeout.String())
+	}
+	body, _, err := client.exchange(ctx, http.MethodGet, storePath(storeName)+"/_watch", query, nil, nil, true)
+	if err != nil {
+		return
+	}
+
+	var response struct {
+		Changes []struct {
+			Seq         uint64            `json:"seq"`
+			Time        time.Time         `json:"time"`
+			Key         string            `json:"key"`
+			Type        string            `json:"type"`
+			Value       []byte            `json:"value"`
+			ContentType string            `json:"contentType"`
+			Meta        map[string]string `json:"meta"`
+		} `json:"changes"`
+		Last uint64 `json:"last"`
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return
+	}
+	changes = make([]Change, 0, len(response.Changes))
+	for _, c := range response.Changes {
+		change := Change{Seq: c.Seq, Time: c.Time, Key: c.Key, Deleted: c.Type == "delete"}
+		if !change.Deleted {
+			change.Item = Item{Value: c.Value, ContentType: c.ContentType, Meta: c.Meta, Length: len(c.Value)}
+		}
+		changes = append(changes, change)
+	}
+	return changes, response.Last, nil
+}
+
+// Watch - call fn for each change to keys starting with prefix made after the change numbered
+// since and then for every new change, polling the server until ctx is done or fn fails. A watch
+// the server drops for falling behind carries on from the last change seen
+func (client *Client) Watch(ctx context.Context, storeName string, since uint64, prefix string, fn func(change Change) error) (err error) {
+	for {
+		changes, last, err := client.Poll(ctx, storeName, since, prefix, 0)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err = fn(change); err != nil {
+				return err
+			}
+		}
+		since = last
+	}
+}
@@ -0,0 +1,224 @@
+package gkfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrCrashed means the FaultyFS has simulated a crash and no longer does anything
+var ErrCrashed = errors.New("Simulated crash")
+
+// ErrInjected is a stock error to hand to FailSync
+var ErrInjected = errors.New("Injected fault")
+
+// FaultyFS wraps another FS and injects failures into it. Byte positions count every byte written
+// through the FaultyFS, across all files, from when it was created:
+//   - ShortWriteAt cuts the write that crosses the position short once, later writes carry on as normal
+//   - CrashAt writes up to the position and then fails everything with ErrCrashed, as if the
+//     process had died mid write. Pair it with MemFS.Crash to also lose unsynced data
+//   - FailSync makes every Sync fail until it is cleared
+type FaultyFS struct {
+	FS
+	mutex        sync.Mutex
+	written      int64
+	shortWriteAt int64
+	crashAt      int64
+	syncErr      error
+	crashed      bool
+}
+
+type faultyFile struct {
+	File
+	fs *FaultyFS
+}
+
+// NewFaulty - wrap fsys. No faults are injected until asked for
+func NewFaulty(fsys FS) *FaultyFS {
+	return &FaultyFS{FS: fsys, shortWriteAt: -1, crashAt: -1}
+}
+
+// ShortWriteAt - the write that reaches position only writes the bytes before it and returns io.ErrShortWrite
+func (fsys *FaultyFS) ShortWriteAt(position int64) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	fsys.shortWriteAt = position
+}
+
+// CrashAt - crash once position bytes have been written
+func (fsys *FaultyFS) CrashAt(position int64) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	fsys.crashAt = position
+}
+
+// Crash - crash now
+func (fsys *FaultyFS) Crash() {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	fsys.crashed = true
+}
+
+// FailSync - make Sync (on files and directories) return err. nil stops the failures
+func (fsys *FaultyFS) FailSync(err error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	fsys.syncErr = err
+}
+
+// Crashed - whether a crash has happened
+func (fsys *FaultyFS) Crashed() bool {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	return fsys.crashed
+}
+
+// Written - the number of bytes written so far
+func (fsys *FaultyFS) Written() int64 {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	return fsys.written
+}
+
+func (fsys *FaultyFS) check() error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if fsys.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// OpenFile - see FS
+func (fsys *FaultyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := fsys.check(); err != nil {
+		return nil, err
+	}
+	file, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: fsys}, nil
+}
+
+// Remove - see FS
+func (fsys *FaultyFS) Remove(name string) error {
+	if err := fsys.check(); err != nil {
+		return err
+	}
+	return fsys.FS.Remove(name)
+}
+
+// Rename - see FS
+func (fsys *FaultyFS) Rename(oldName string, newName string) error {
+	if err := fsys.check(); err != nil {
+		return err
+	}
+	return fsys.FS.Rename(oldName, newName)
+}
+
+// MkdirAll - see FS
+func (fsys *FaultyFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fsys.check(); err != nil {
+		return err
+	}
+	return fsys.FS.MkdirAll(path, perm)
+}
+
+// ReadDir - see FS
+func (fsys *FaultyFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	if err := fsys.check(); err != nil {
+		return nil, err
+	}
+	return fsys.FS.ReadDir(dir)
+}
+
+// SyncDir - see FS
+func (fsys *FaultyFS) SyncDir(dir string) error {
+	if err := fsys.syncError(); err != nil {
+		return err
+	}
+	return fsys.FS.SyncDir(dir)
+}
+
+// Lock - see FS
+func (fsys *FaultyFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	if err := fsys.check(); err != nil {
+		return nil, err
+	}
+	return fsys.FS.Lock(name, exclusive)
+}
+
+func (fsys *FaultyFS) syncError() error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if fsys.crashed {
+		return ErrCrashed
+	}
+	return fsys.syncErr
+}
+
+// allow - how many of n bytes about to be written may go through, and the error to return if not all of them
+func (fsys *FaultyFS) allow(n int) (allowed int, err error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	if fsys.crashed {
+		return 0, ErrCrashed
+	}
+	allowed = n
+	if fsys.crashAt >= 0 && fsys.written+int64(n) >= fsys.crashAt {
+		allowed = int(fsys.crashAt - fsys.written)
+		fsys.crashed = true
+		err = ErrCrashed
+	} else if fsys.shortWriteAt >= 0 && fsys.written+int64(n) > fsys.shortWriteAt {
+		allowed = int(fsys.shortWriteAt - fsys.written)
+		fsys.shortWriteAt = -1
+		err = io.ErrShortWrite
+	}
+	if allowed < 0 {
+		allowed = 0
+	}
+	fsys.written += int64(allowed)
+	return
+}
+
+func (file *faultyFile) Write(p []byte) (n int, err error) {
+	allowed, faultErr := file.fs.allow(len(p))
+	if allowed > 0 {
+		if n, err = file.File.Write(p[:allowed]); err != nil {
+			return
+		}
+	}
+	if faultErr != nil {
+		return n, faultErr
+	}
+	return
+}
+
+func (file *faultyFile) Sync() error {
+	if err := file.fs.syncError(); err != nil {
+		return err
+	}
+	return file.File.Sync()
+}
+
+func (file *faultyFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := file.fs.check(); err != nil {
+		return 0, err
+	}
+	return file.File.ReadAt(p, off)
+}
+
+func (file *faultyFile) Truncate(size int64) error {
+	if err := file.fs.check(); err != nil {
+		return err
+	}
+	return file.File.Truncate(size)
+}
+
+func (file *faultyFile) Close() error {
+	// Closing is always allowed so that handles aren't leaked after a crash
+	return file.File.Close()
+}
@@ -0,0 +1,119 @@
+// Package gkfs is the small slice of a file system that gklogfile and gkstore need. Keeping it
+// behind an interface lets the stores run on something other than the OS (in memory for fast
+// tests, or with faults injected to check crash recovery)
+package gkfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrLocked means a lock is already held (exclusively, or shared when an exclusive lock was wanted)
+var ErrLocked = errors.New("Lock is held by someone else")
+
+// File - an open file. Writes go to the end of the file when it was opened with os.O_APPEND
+type File interface {
+	io.ReaderAt
+	io.Writer
+	Sync() error
+	Close() error
+	Size() (int64, error)
+	Truncate(size int64) error
+}
+
+// FS - the file system operations used by gokave. Names are paths in the form used by path/filepath
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldName string, newName string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns the entries of a directory sorted by name
+	ReadDir(dir string) ([]os.FileInfo, error)
+	// SyncDir makes renames and new files in the directory durable where the platform allows it
+	SyncDir(dir string) error
+	// Lock takes an advisory lock on the named file, creating it if needed. Exclusive locks can't
+	// be shared, shared locks can be held by any number of holders. Fails with ErrLocked rather
+	// than waiting
+	Lock(name string, exclusive bool) (io.Closer, error)
+}
+
+// Open - open an existing file for reading only
+func Open(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create - create or truncate a file for writing
+func Create(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// ReadFile - read the whole of the named file
+func ReadFile(fsys FS, name string) (data []byte, err error) {
+	file, err := Open(fsys, name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	size, err := file.Size()
+	if err != nil {
+		return
+	}
+	data = make([]byte, size)
+	if _, err = file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile - write data to the named file, replacing anything already there, and sync it
+func WriteFile(fsys FS, name string, data []byte) (err error) {
+	file, err := Create(fsys, name)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return
+	}
+	return file.Close()
+}
+
+// IsNotExist - whether err means a file or directory doesn't exist, for any FS implementation
+func IsNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, os.ErrNotExist)
+}
+
+func sortFileInfos(fileInfos []os.FileInfo) {
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
+}
+
+// RemoveAll - remove path and everything below it. A path that doesn't exist isn't an error
+func RemoveAll(fsys FS, path string) (err error) {
+	fileInfos, err := fsys.ReadDir(path)
+	if err != nil && !IsNotExist(err) {
+		// Not a directory so just a file to remove
+		err = fsys.Remove(path)
+		if IsNotExist(err) {
+			return nil
+		}
+		return
+	}
+	for _, fileInfo := range fileInfos {
+		if err = RemoveAll(fsys, filepath.Join(path, fileInfo.Name())); err != nil {
+			return
+		}
+	}
+	err = fsys.Remove(path)
+	if IsNotExist(err) {
+		return nil
+	}
+	return
+}
@@ -0,0 +1,209 @@
+package gkfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFS - the behaviour every FS has to share, under directory
+func testFS(t *testing.T, fsys FS, directory string) {
+	dir := filepath.Join(directory, "a", "b")
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "file")
+	if _, err := Open(fsys, name); !IsNotExist(err) {
+		t.Errorf("Open of a missing file: %v", err)
+	}
+
+	if err := WriteFile(fsys, name, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fsys.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := file.Size(); err != nil || size != 11 {
+		t.Errorf("Size: %d %v", size, err)
+	}
+	buffer := make([]byte, 5)
+	if _, err = file.ReadAt(buffer, 6); err != nil || string(buffer) != "world" {
+		t.Errorf("ReadAt: %q %v", buffer, err)
+	}
+	if n, err := file.ReadAt(make([]byte, 10), 6); n != 5 || err != io.EOF {
+		t.Errorf("ReadAt past the end: %d %v, expected 5 and EOF", n, err)
+	}
+	if err = file.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fsys, name); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile after truncate: %q %v", data, err)
+	}
+
+	if _, err = fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Errorf("Exclusive create of an existing file: %v", err)
+	}
+	renamed := filepath.Join(directory, "a", "renamed")
+	if err = fsys.Rename(name, renamed); err != nil {
+		t.Fatal(err)
+	}
+	fileInfos, err := fsys.ReadDir(filepath.Join(directory, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileInfos) != 2 || fileInfos[0].Name() != "b" || !fileInfos[0].IsDir() || fileInfos[1].Name() != "renamed" || fileInfos[1].Size() != 5 {
+		t.Errorf("ReadDir: %v", fileInfos)
+	}
+
+	if err = RemoveAll(fsys, filepath.Join(directory, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fsys.ReadDir(filepath.Join(directory, "a")); !IsNotExist(err) {
+		t.Errorf("ReadDir of a removed directory: %v", err)
+	}
+}
+
+func TestOS(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gkfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	testFS(t, OS, directory)
+}
+
+func TestMem(t *testing.T) {
+	testFS(t, NewMem(), "/data")
+}
+
+func TestMemLock(t *testing.T) {
+	fsys := NewMem()
+	if err := fsys.MkdirAll("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	testLockMatrix(t, fsys, "/data/LOCK")
+}
+
+func TestMemCrash(t *testing.T) {
+	fsys := NewMem()
+	if err := fsys.MkdirAll("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := Create(fsys, "/data/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("synced"))
+	if err = file.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(" lost"))
+	if _, err = fsys.Lock("/data/LOCK", true); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.Crash()
+	if data, err := ReadFile(fsys, "/data/file"); err != nil || string(data) != "synced" {
+		t.Errorf("After crash: %q %v", data, err)
+	}
+	// Locks don't survive a crash
+	if _, err = fsys.Lock("/data/LOCK", true); err != nil {
+		t.Errorf("Lock after crash: %v", err)
+	}
+}
+
+// newFaultyFile - a FaultyFS over memory with a file open for appending
+func newFaultyFile(t *testing.T) (mem *MemFS, faulty *FaultyFS, file File) {
+	t.Helper()
+	mem = NewMem()
+	if err := mem.MkdirAll("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	faulty = NewFaulty(mem)
+	file, err := faulty.OpenFile("/data/file", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestFaultyShortWrite(t *testing.T) {
+	mem, faulty, file := newFaultyFile(t)
+	defer file.Close()
+	file.Write([]byte("0123"))
+	faulty.ShortWriteAt(6)
+	if n, err := file.Write([]byte("4567")); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("Short write: %d %v, expected 2 and io.ErrShortWrite", n, err)
+	}
+	// Only the one write is cut short
+	if n, err := file.Write([]byte("89")); n != 2 || err != nil {
+		t.Errorf("Write after the short write: %d %v", n, err)
+	}
+	if data, _ := ReadFile(mem, "/data/file"); string(data) != "01234589" {
+		t.Errorf("Data: %q", data)
+	}
+	if faulty.Written() != 8 {
+		t.Errorf("Written: %d", faulty.Written())
+	}
+}
+
+func TestFaultyCrash(t *testing.T) {
+	mem, faulty, file := newFaultyFile(t)
+	defer file.Close()
+	file.Write([]byte("0123"))
+	file.Sync()
+	faulty.CrashAt(6)
+	if n, err := file.Write([]byte("4567")); n != 2 || err != ErrCrashed {
+		t.Errorf("Write at the crash: %d %v, expected 2 and ErrCrashed", n, err)
+	}
+	if !faulty.Crashed() {
+		t.Fatal("Not crashed")
+	}
+	// Nothing works after the crash
+	if _, err := file.Write([]byte("x")); err != ErrCrashed {
+		t.Errorf("Write after the crash: %v", err)
+	}
+	if _, err := faulty.OpenFile("/data/file", os.O_RDONLY, 0); err != ErrCrashed {
+		t.Errorf("Open after the crash: %v", err)
+	}
+	if err := faulty.Rename("/data/file", "/data/other"); err != ErrCrashed {
+		t.Errorf("Rename after the crash: %v", err)
+	}
+	// The bytes before the crash reached the file but weren't synced
+	if data, _ := ReadFile(mem, "/data/file"); string(data) != "012345" {
+		t.Errorf("Data before the machine goes down: %q", data)
+	}
+	mem.Crash()
+	if data, _ := ReadFile(mem, "/data/file"); !bytes.Equal(data, []byte("0123")) {
+		t.Errorf("Data after the machine goes down: %q", data)
+	}
+}
+
+func TestFaultySync(t *testing.T) {
+	_, faulty, file := newFaultyFile(t)
+	defer file.Close()
+	faulty.FailSync(ErrInjected)
+	if err := file.Sync(); err != ErrInjected {
+		t.Errorf("Sync: %v, expected ErrInjected", err)
+	}
+	if err := faulty.SyncDir("/data"); err != ErrInjected {
+		t.Errorf("SyncDir: %v, expected ErrInjected", err)
+	}
+	faulty.FailSync(nil)
+	if err := file.Sync(); err != nil {
+		t.Errorf("Sync once cleared: %v", err)
+	}
+}
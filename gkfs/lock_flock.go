@@ -0,0 +1,42 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package gkfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock - a flock held on the lock file. The kernel drops it if the process dies
+type fileLock struct {
+	file *os.File
+}
+
+func lockFile(fileName string, exclusive bool) (lock *fileLock, err error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (lock *fileLock) Close() (err error) {
+	if err = syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN); err != nil {
+		lock.file.Close()
+		return
+	}
+	return lock.file.Close()
+}
@@ -0,0 +1,126 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package gkfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// fileLock - without flock or LockFileEx the lock is held by files holding the owner's process id.
+// The exclusive holder creates the lock file itself and each shared holder creates its own
+// {lock file}.shared.{pid}.{n}. Each side creates its file before looking for the other's, so two
+// can't both get in. A file left behind by a process that died is noticed as the process is no
+// longer running and is removed
+type fileLock struct {
+	fileName string
+}
+
+// sharedLocks - numbers the shared lock files of this process
+var sharedLocks uint64
+
+func lockFile(fileName string, exclusive bool) (lock *fileLock, err error) {
+	if exclusive {
+		if err = createOwned(fileName); err != nil {
+			return
+		}
+		if shared, err := liveShared(fileName); err != nil || shared {
+			os.Remove(fileName)
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrLocked
+		}
+		return &fileLock{fileName: fileName}, nil
+	}
+
+	sharedName := fmt.Sprintf("%s.shared.%d.%d", fileName, os.Getpid(), atomic.AddUint64(&sharedLocks, 1))
+	if err = createOwned(sharedName); err != nil {
+		return
+	}
+	if held, err := ownerAlive(fileName); err != nil || held {
+		os.Remove(sharedName)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrLocked
+	}
+	return &fileLock{fileName: sharedName}, nil
+}
+
+func (lock *fileLock) Close() (err error) {
+	return os.Remove(lock.fileName)
+}
+
+// createOwned - create fileName holding our process id. If it is already there but its owner has
+// died it is taken over
+func createOwned(fileName string) (err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(fileName)
+			}
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if alive, err := ownerAlive(fileName); err != nil || alive {
+			if err != nil {
+				return err
+			}
+			return ErrLocked
+		}
+	}
+	return ErrLocked
+}
+
+// ownerAlive - whether fileName exists and the process that created it is still running. A file
+// whose owner has died is removed
+func ownerAlive(fileName string) (alive bool, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		// Part written by a process that is still creating it, or not ours. Either way it's held
+		return true, nil
+	}
+	if processAlive(pid) {
+		return true, nil
+	}
+	fmt.Printf("Removing stale lock of process %d: %s\n", pid, fileName)
+	if err = os.Remove(fileName); os.IsNotExist(err) {
+		err = nil
+	}
+	return false, err
+}
+
+// liveShared - whether any shared lock on fileName is held by a running process
+func liveShared(fileName string) (shared bool, err error) {
+	matches, err := filepath.Glob(fileName + ".shared.*")
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		if alive, err := ownerAlive(match); err != nil || alive {
+			return alive, err
+		}
+	}
+	return false, nil
+}
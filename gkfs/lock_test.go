@@ -0,0 +1,49 @@
+package gkfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLockMatrix - an exclusive lock excludes every other lock, shared locks only exclude
+// exclusive ones, and closing a lock lets the next one in
+func testLockMatrix(t *testing.T, fsys FS, name string) {
+	for _, held := range []bool{true, false} {
+		for _, wanted := range []bool{true, false} {
+			first, err := fsys.Lock(name, held)
+			if err != nil {
+				t.Fatalf("Lock exclusive=%v: %v", held, err)
+			}
+			second, err := fsys.Lock(name, wanted)
+			if held || wanted {
+				if err != ErrLocked {
+					t.Errorf("Lock exclusive=%v while exclusive=%v held: %v, expected ErrLocked", wanted, held, err)
+				}
+			} else if err != nil {
+				t.Errorf("Shared lock while shared held: %v", err)
+			} else {
+				second.Close()
+			}
+			if err = first.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Everything has been let go of
+	lock, err := fsys.Lock(name, true)
+	if err != nil {
+		t.Fatalf("Exclusive lock once all closed: %v", err)
+	}
+	lock.Close()
+}
+
+func TestOSLock(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gkfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	testLockMatrix(t, OS, filepath.Join(directory, "LOCK"))
+}
@@ -0,0 +1,63 @@
+//go:build windows
+// +build windows
+
+package gkfs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fileLock - a LockFileEx lock on the lock file. Windows drops it if the process dies
+type fileLock struct {
+	file *os.File
+}
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	// The whole range a lock can cover, so every lock on the file overlaps every other
+	lockRangeLow  = 0xffffffff
+	lockRangeHigh = 0xffffffff
+
+	errorLockViolation syscall.Errno = 33
+)
+
+func lockFile(fileName string, exclusive bool) (lock *fileLock, err error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	flags := uintptr(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	overlapped := new(syscall.Overlapped)
+	ok, _, callErr := procLockFileEx.Call(file.Fd(), flags, 0, lockRangeLow, lockRangeHigh, uintptr(unsafe.Pointer(overlapped)))
+	if ok == 0 {
+		file.Close()
+		if callErr == errorLockViolation {
+			return nil, ErrLocked
+		}
+		return nil, callErr
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (lock *fileLock) Close() (err error) {
+	overlapped := new(syscall.Overlapped)
+	ok, _, callErr := procUnlockFileEx.Call(lock.file.Fd(), 0, lockRangeLow, lockRangeHigh, uintptr(unsafe.Pointer(overlapped)))
+	if ok == 0 {
+		lock.file.Close()
+		return callErr
+	}
+	return lock.file.Close()
+}
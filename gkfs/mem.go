@@ -0,0 +1,347 @@
+package gkfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrClosedFile means a file was used after it was closed
+var ErrClosedFile = errors.New("File is closed")
+
+// ErrReadOnlyFile means a file opened without write access was written to
+var ErrReadOnlyFile = errors.New("File is open read only")
+
+// MemFS - an FS held entirely in memory. Alongside the current contents of each file it keeps
+// what had been synced, so Crash can throw away anything that wouldn't have survived a power cut
+type MemFS struct {
+	mutex sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+	locks map[string]int // -1 exclusive, otherwise the number of shared holders
+}
+
+type memData struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+type memFile struct {
+	fs       *MemFS
+	name     string
+	data     *memData
+	offset   int64
+	append   bool
+	writable bool
+	closed   bool
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+type memLock struct {
+	fs        *MemFS
+	name      string
+	exclusive bool
+	once      sync.Once
+}
+
+// NewMem - an empty in memory FS
+func NewMem() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  make(map[string]bool),
+		locks: make(map[string]int),
+	}
+}
+
+// Crash - simulate the machine going down. Every file goes back to its contents as of its last Sync
+// and all locks are dropped. Open handles keep working against the reverted data
+func (fsys *MemFS) Crash() {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	for _, data := range fsys.files {
+		data.data = append([]byte(nil), data.synced...)
+	}
+	fsys.locks = make(map[string]int)
+}
+
+// OpenFile - supports os.O_RDONLY, O_WRONLY, O_RDWR, O_APPEND, O_CREATE, O_EXCL and O_TRUNC
+func (fsys *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	data, exists := fsys.files[name]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !exists:
+		if !fsys.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		data = &memData{modTime: time.Now()}
+		fsys.files[name] = data
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		data.data = nil
+		data.modTime = time.Now()
+	}
+	return &memFile{
+		fs:       fsys,
+		name:     name,
+		data:     data,
+		append:   flag&os.O_APPEND != 0,
+		writable: writable,
+	}, nil
+}
+
+// Remove - remove a file or an empty directory
+func (fsys *MemFS) Remove(name string) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if _, exists := fsys.files[name]; exists {
+		delete(fsys.files, name)
+		return nil
+	}
+	if fsys.dirs[name] {
+		for other := range fsys.files {
+			if filepath.Dir(other) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		delete(fsys.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+// Rename - rename a file, replacing any file already called newName
+func (fsys *MemFS) Rename(oldName string, newName string) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	data, exists := fsys.files[oldName]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if !fsys.dirs[filepath.Dir(newName)] {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(fsys.files, oldName)
+	fsys.files[newName] = data
+	return nil
+}
+
+// MkdirAll - create a directory and any missing parents
+func (fsys *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	for dir := filepath.Clean(path); !fsys.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, exists := fsys.files[dir]; exists {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		fsys.dirs[dir] = true
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return nil
+}
+
+// ReadDir - the files and directories directly inside dir, sorted by name
+func (fsys *MemFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !fsys.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+
+	var fileInfos []os.FileInfo
+	for name, data := range fsys.files {
+		if filepath.Dir(name) == dir {
+			fileInfos = append(fileInfos, memFileInfo{name: filepath.Base(name), size: int64(len(data.data)), modTime: data.modTime})
+		}
+	}
+	for name := range fsys.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			fileInfos = append(fileInfos, memFileInfo{name: filepath.Base(name), dir: true})
+		}
+	}
+	sortFileInfos(fileInfos)
+	return fileInfos, nil
+}
+
+// SyncDir - directory entries are always durable in memory
+func (fsys *MemFS) SyncDir(dir string) error {
+	return nil
+}
+
+// Lock - locks only last until Close or Crash
+func (fsys *MemFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if !fsys.dirs[filepath.Dir(name)] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if _, exists := fsys.files[name]; !exists {
+		fsys.files[name] = &memData{modTime: time.Now()}
+	}
+
+	holders := fsys.locks[name]
+	if holders < 0 || (exclusive && holders > 0) {
+		return nil, ErrLocked
+	}
+	if exclusive {
+		fsys.locks[name] = -1
+	} else {
+		fsys.locks[name] = holders + 1
+	}
+	return &memLock{fs: fsys, name: name, exclusive: exclusive}, nil
+}
+
+func (lock *memLock) Close() error {
+	lock.once.Do(func() {
+		lock.fs.mutex.Lock()
+		defer lock.fs.mutex.Unlock()
+
+		switch {
+		case lock.exclusive && lock.fs.locks[lock.name] < 0:
+			delete(lock.fs.locks, lock.name)
+		case !lock.exclusive && lock.fs.locks[lock.name] > 1:
+			lock.fs.locks[lock.name]--
+		case !lock.exclusive && lock.fs.locks[lock.name] == 1:
+			delete(lock.fs.locks, lock.name)
+		}
+	})
+	return nil
+}
+
+func (file *memFile) ReadAt(p []byte, off int64) (n int, err error) {
+	file.fs.mutex.Lock()
+	defer file.fs.mutex.Unlock()
+
+	if file.closed {
+		return 0, ErrClosedFile
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: file.name, Err: errors.New("negative offset")}
+	}
+	if off >= int64(len(file.data.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, file.data.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (file *memFile) Write(p []byte) (n int, err error) {
+	file.fs.mutex.Lock()
+	defer file.fs.mutex.Unlock()
+
+	if file.closed {
+		return 0, ErrClosedFile
+	}
+	if !file.writable {
+		return 0, ErrReadOnlyFile
+	}
+	if file.append {
+		file.offset = int64(len(file.data.data))
+	}
+	end := file.offset + int64(len(p))
+	if end > int64(len(file.data.data)) {
+		grown := make([]byte, end)
+		copy(grown, file.data.data)
+		file.data.data = grown
+	}
+	copy(file.data.data[file.offset:], p)
+	file.offset = end
+	file.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (file *memFile) Sync() error {
+	file.fs.mutex.Lock()
+	defer file.fs.mutex.Unlock()
+
+	if file.closed {
+		return ErrClosedFile
+	}
+	file.data.synced = append([]byte(nil), file.data.data...)
+	return nil
+}
+
+func (file *memFile) Close() error {
+	file.fs.mutex.Lock()
+	defer file.fs.mutex.Unlock()
+
+	if file.closed {
+		return ErrClosedFile
+	}
+	file.closed = true
+	return nil
+}
+
+func (file *memFile) Size() (int64, error) {
+	file.fs.mutex.Lock()
+	defer file.fs.mutex.Unlock()
+
+	if file.closed {
+		return 0, ErrClosedFile
+	}
+	return int64(len(file.data.data)), nil
+}
+
+func (file *memFile) Truncate(size int64) error {
+	file.fs.mutex.Lock()
+	defer file.fs.mutex.Unlock()
+
+	if file.closed {
+		return ErrClosedFile
+	}
+	if !file.writable {
+		return ErrReadOnlyFile
+	}
+	if size < int64(len(file.data.data)) {
+		file.data.data = file.data.data[:size]
+	} else {
+		file.data.data = append(file.data.data, make([]byte, size-int64(len(file.data.data)))...)
+	}
+	return nil
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) ModTime() time.Time { return info.modTime }
+func (info memFileInfo) IsDir() bool        { return info.dir }
+func (info memFileInfo) Sys() interface{}   { return nil }
+
+func (info memFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,67 @@
+package gkfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// OS is the FS backed by the real file system
+var OS FS = osFS{}
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	// ReadDir returns files sorted by filename
+	return ioutil.ReadDir(dir)
+}
+
+// SyncDir - not possible on every platform (e.g. windows) so errors are ignored
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	d.Sync()
+	return d.Close()
+}
+
+func (osFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	lock, err := lockFile(name, exclusive)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (file osFile) Size() (int64, error) {
+	fileStat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileStat.Size(), nil
+}
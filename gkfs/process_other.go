@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows && !plan9
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows,!plan9
+
+package gkfs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// processAlive - whether the process pid is running. Where that can't be told it is assumed to be
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || !(err == syscall.ESRCH || strings.Contains(err.Error(), "process already finished"))
+}
@@ -2,11 +2,17 @@ package gklogfile
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"gokave/gkfs"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 // todo(?):
@@ -37,8 +43,24 @@ var ErrUnrecognisedMetadataVsn = errors.New("Unrecognised metadata version")
 // ErrUnrecognisedLogType means an invalid log type was encountered
 var ErrUnrecognisedLogType = errors.New("Unrecognised log entry type")
 
-// ErrChecksumFailre means the key/value pair was not the same as expected
-var ErrChecksumFailure = errors.New("Unrecognised log entry type")
+// ErrChecksumFailure means the key/value pair was not the same as expected
+var ErrChecksumFailure = errors.New("Checksum failure")
+
+// CorruptionError records the offset at which a file could not be parsed along with
+// the underlying reason, giving enough information to locate and fix the bad data
+type CorruptionError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupt entry at offset %d: %s", e.Offset, e.Err.Error())
+}
+
+// Unwrap - allow errors.Is / errors.As to see the underlying error
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
 
 const (
 	// KeyWritten means the key has been written to the file / is present
@@ -49,57 +71,192 @@ const (
 	KeyNotPresent
 )
 
+const (
+	// ChecksumNone means the record version doesn't carry a checksum
+	ChecksumNone = iota
+	// ChecksumValid means the checksum was present and matched the key/value
+	ChecksumValid
+	// ChecksumInvalid means the checksum was present but didn't match the key/value
+	ChecksumInvalid
+)
+
+// Record is a single entry as laid out in a log file
+type Record struct {
+	Offset      int64
+	Length      int64
+	Version     int
+	EntryType   int
+	Key         string
+	ValueLength int
+	Value       []byte
+	Meta        Meta // only filled in along with Value
+	Checksum    int
+	Stamp
+}
+
+// Stamp - when a record was committed. Seq is the store wide sequence number given to every write
+// and delete, which only ever goes up. Records written before version 5 have a zero Stamp
+type Stamp struct {
+	Seq  uint64
+	Time time.Time
+}
+
 // KvFile is an individual Key Value file allowing append only operations
 // It contains a map pointing to the given position in a file for any given keys
 // todo: Need to remove all of the debug statements
 type KvFile struct {
-	file           *os.File
+	file           gkfs.File
+	header         *Header
 	fileWriteMutex sync.Mutex
 	fileMap        map[string]int64
 	fileMapMutex   sync.RWMutex
+	tornAt         int64
+	hintErr        error
+	lastSeq        uint64 // guarded by fileMapMutex
 }
 
-// Open - open the specified file
-// Currently also creates the file if it doesn't pre-exist. Possibly pass the creation
-// up a level when we get to multiple files per store?
-func Open(fileName string) (kvFile *KvFile, err error) {
+// Open - open the specified existing file
+// Files without a header (written before headers existed) are still read. Use Create for new files.
+// A record left half written at the end of the file by a crash is cut off
+func Open(fsys gkfs.FS, fileName string) (kvFile *KvFile, err error) {
 	// We want an append only file but still allow concurrent reads. Pass the respobnsibility for this the OS as per:
 	// https://stackoverflow.com/questions/37628873/golang-simultaneous-read-write-to-the-file-without-explicit-file-lock
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	return open(fsys, fileName, os.O_RDWR|os.O_APPEND)
+}
+
+// OpenReadOnly - open the specified existing file for reading only. A half written record at the
+// end of the file is ignored rather than cut off
+func OpenReadOnly(fsys gkfs.FS, fileName string) (kvFile *KvFile, err error) {
+	return open(fsys, fileName, os.O_RDONLY)
+}
+
+func open(fsys gkfs.FS, fileName string, flag int) (kvFile *KvFile, err error) {
+	file, err := fsys.OpenFile(fileName, flag, 0644)
 	if err != nil {
 		return
 	}
-	fileMap, err := initialiseFileMap(file)
+	size, err := file.Size()
 	if err != nil {
+		file.Close()
+		return
+	}
+	header, _, err := ReadHeader(file, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// A segment with a hint file doesn't need reading through
+	var tornAt int64 = -1
+	fileMap, lastSeq, hintErr := readHints(fsys, fileName, header, size)
+	if hintErr != nil {
+		if gkfs.IsNotExist(hintErr) {
+			hintErr = nil
+		}
+		fileMap, lastSeq, tornAt, err = initialiseFileMap(file, size, flag != os.O_RDONLY)
+	}
+	if err != nil {
+		file.Close()
 		return
 	}
 	kvFile = &KvFile{
 		file:    file,
+		header:  header,
 		fileMap: fileMap,
+		tornAt:  tornAt,
+		hintErr: hintErr,
+		lastSeq: lastSeq,
+	}
+	return
+}
+
+// Create - create a new file starting with the given header. Fails if the file already exists
+func Create(fsys gkfs.FS, fileName string, header Header) (kvFile *KvFile, err error) {
+	encoded, err := encodeHeader(header)
+	if err != nil {
+		return
+	}
+	file, err := fsys.OpenFile(fileName, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(encoded); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return
+	}
+
+	header.Version = currentHeaderVsn
+	header.Length = int64(len(encoded))
+	kvFile = &KvFile{
+		file:    file,
+		header:  &header,
+		fileMap: make(map[string]int64),
+		tornAt:  -1,
 	}
 	return
 }
 
-// Close - tbc
-func Close() {
+// Close - flush the file to disk and close it. The KvFile can't be used afterwards
+func (kvFile *KvFile) Close() (err error) {
+	kvFile.fileWriteMutex.Lock()
+	defer kvFile.fileWriteMutex.Unlock()
+
+	if err = kvFile.file.Sync(); err != nil {
+		kvFile.file.Close()
+		return
+	}
+	return kvFile.file.Close()
+}
+
+// Sync - commit everything written so far to stable storage
+func (kvFile *KvFile) Sync() (err error) {
+	kvFile.fileWriteMutex.Lock()
+	defer kvFile.fileWriteMutex.Unlock()
+	return kvFile.file.Sync()
+}
+
+// Header - the header the file was created with. nil for files that pre-date headers
+func (kvFile *KvFile) Header() *Header {
+	return kvFile.header
+}
+
+// TornAt - the offset of the half written record found at the end of the file when it was opened,
+// which Open cut off and OpenReadOnly ignored. -1 if the file ended with a complete record
+func (kvFile *KvFile) TornAt() int64 {
+	return kvFile.tornAt
+}
+
+// HintError - why the segment's hint file couldn't be used when it was opened, so the file was
+// read through instead. nil if the hints were used or there was no hint file
+func (kvFile *KvFile) HintError() error {
+	return kvFile.hintErr
+}
 
+// LastSeq - the highest Stamp.Seq of any record in the file
+func (kvFile *KvFile) LastSeq() uint64 {
+	kvFile.fileMapMutex.RLock()
+	defer kvFile.fileMapMutex.RUnlock()
+	return kvFile.lastSeq
 }
 
 // Delete - delete a value from the store
 func (kvFile *KvFile) Delete(key string) (err error) {
-	md, _ := newMetadata(currentVsn)
-	writeEntryType(md, KeyDeleted)
-	writeValueMetadata(md, 0)
-	if err = writeKeyMetadata(md, len(key)); err != nil {
+	return kvFile.DeleteStamped(key, Stamp{Time: time.Now()})
+}
+
+// DeleteStamped - delete a value from the store recording stamp against the delete
+func (kvFile *KvFile) DeleteStamped(key string, stamp Stamp) (err error) {
+	record, err := encodeRecord(KeyDeleted, key, nil, nil, stamp)
+	if err != nil {
 		return
 	}
 
 	// Write to the buffer
-	writer := bufio.NewWriterSize(kvFile.file, len(md)+len(key))
-	if _, err = writer.Write(md); err != nil {
-		return
-	}
-	if _, err = writer.WriteString(key); err != nil {
+	writer := bufio.NewWriterSize(kvFile.file, len(record))
+	if _, err = writer.Write(record); err != nil {
 		return
 	}
 
@@ -111,6 +268,9 @@ func (kvFile *KvFile) Delete(key string) (err error) {
 
 	kvFile.fileMapMutex.Lock()
 	kvFile.fileMap[key] = location
+	if stamp.Seq > kvFile.lastSeq {
+		kvFile.lastSeq = stamp.Seq
+	}
 	kvFile.fileMapMutex.Unlock()
 	return
 }
@@ -118,58 +278,188 @@ func (kvFile *KvFile) Delete(key string) (err error) {
 // Read - the value for a given key
 // If we pass in a readerat (file) we remove our file dependency and that can sit with the kvFileManager
 func (kvFile *KvFile) Read(key string) (value []byte, flag int, err error) {
+	value, _, flag, err = kvFile.ReadMeta(key)
+	return
+}
+
+// ReadMeta - the value for a given key along with the Meta it was written with
+func (kvFile *KvFile) ReadMeta(key string) (value []byte, meta Meta, flag int, err error) {
+	offset, ok := kvFile.offset(key)
+	return kvFile.readMetaAt(key, offset, ok)
+}
+
+// readMetaAt - ReadMeta for the record at offset, if ok
+func (kvFile *KvFile) readMetaAt(key string, offset int64, ok bool) (value []byte, meta Meta, flag int, err error) {
+	md, flag, err := kvFile.recordAt(offset, ok)
+	if err != nil || flag != KeyWritten {
+		return
+	}
+	value, meta, err = kvFile.readValue(key, offset, md)
+	return
+}
+
+// Result - the outcome of reading one key with ReadMany
+type Result struct {
+	Value []byte
+	Meta  Meta
+	Flag  int
+	Err   error
+	Stamp
+}
+
+// ReadMany - ReadMeta for several keys at once, reading the file in offset order rather than the
+// order the keys were given in. Keys that aren't in the file are left out of the results
+func (kvFile *KvFile) ReadMany(keys []string) (results map[string]Result) {
+	locations := make([]location, 0, len(keys))
 	kvFile.fileMapMutex.RLock()
-	offset, ok := kvFile.fileMap[key]
+	for _, key := range keys {
+		if offset, ok := kvFile.fileMap[key]; ok {
+			locations = append(locations, location{key: key, offset: offset})
+		}
+	}
 	kvFile.fileMapMutex.RUnlock()
-	if !ok {
-		return nil, KeyNotPresent, err
+	return kvFile.readLocations(locations)
+}
+
+// location - where a key's record is
+type location struct {
+	key    string
+	offset int64
+}
+
+// readLocations - the records at locations, read in offset order
+func (kvFile *KvFile) readLocations(locations []location) (results map[string]Result) {
+	sort.Slice(locations, func(i, j int) bool { return locations[i].offset < locations[j].offset })
+
+	results = make(map[string]Result, len(locations))
+	for _, loc := range locations {
+		md, err := readMetadata(kvFile.file, loc.offset)
+		if err != nil {
+			results[loc.key] = Result{Flag: KeyNotPresent, Err: err}
+			continue
+		}
+		result := Result{Flag: metadataEntryType(md), Stamp: metadataStamp(md)}
+		if result.Flag == KeyWritten {
+			result.Value, result.Meta, result.Err = kvFile.readValue(loc.key, loc.offset, md)
+		}
+		results[loc.key] = result
 	}
+	return
+}
 
-	md, err := readMetadata(kvFile.file, offset)
-	if err != nil {
+// readValue - the value and meta of the record for key at offset, whose metadata is md
+func (kvFile *KvFile) readValue(key string, offset int64, md []byte) (value []byte, meta Meta, err error) {
+	// The meta block sits between the key and the value so read both in one go
+	metaLength := metadataMetaLength(md)
+	block := make([]byte, metaLength+metadataValueLength(md))
+	if _, err = kvFile.file.ReadAt(block, offset+int64(len(md)+metdataKeyLength(md))); err != nil {
 		return
 	}
+	encodedMeta, value := block[:metaLength], block[metaLength:]
+	if metadataHasChecksum(md) && !checksumMatches(md, []byte(key), encodedMeta, value) {
+		return nil, nil, &CorruptionError{Offset: offset, Err: ErrChecksumFailure}
+	}
+	if meta, err = decodeMeta(encodedMeta); err != nil {
+		return nil, nil, &CorruptionError{Offset: offset, Err: err}
+	}
+	return
+}
+
+// Head - the Meta and value length for a given key without reading the value. As the value isn't
+// read the record's checksum can't be checked
+func (kvFile *KvFile) Head(key string) (meta Meta, valueLength int, flag int, err error) {
+	offset, ok := kvFile.offset(key)
+	return kvFile.headAt(offset, ok)
+}
 
-	if flag = metadataEntryType(md); flag == KeyDeleted {
-		return nil, KeyDeleted, err
+// headAt - Head for the record at offset, if ok
+func (kvFile *KvFile) headAt(offset int64, ok bool) (meta Meta, valueLength int, flag int, err error) {
+	md, flag, err := kvFile.recordAt(offset, ok)
+	if err != nil || flag != KeyWritten {
+		return
 	}
+	encodedMeta := make([]byte, metadataMetaLength(md))
+	if _, err = kvFile.file.ReadAt(encodedMeta, offset+int64(len(md)+metdataKeyLength(md))); err != nil {
+		return
+	}
+	if meta, err = decodeMeta(encodedMeta); err != nil {
+		return nil, 0, flag, &CorruptionError{Offset: offset, Err: err}
+	}
+	return meta, metadataValueLength(md), flag, nil
+}
 
-	valueOffset := offset + int64(len(md)+metdataKeyLength(md))
-	value = make([]byte, metadataValueLength(md))
-	_, err = kvFile.file.ReadAt(value, valueOffset)
+// offset - where key's latest record is, if it is in the file
+func (kvFile *KvFile) offset(key string) (offset int64, ok bool) {
+	kvFile.fileMapMutex.RLock()
+	defer kvFile.fileMapMutex.RUnlock()
+	offset, ok = kvFile.fileMap[key]
 	return
 }
 
-// Size in bytes of the underlying file
-func (kvFile *KvFile) Size() (size int64, err error) {
-	fs, err := kvFile.file.Stat()
-	if err != nil {
+// recordAt - the metadata of the record at offset, if ok, and whether it is a write or a delete
+func (kvFile *KvFile) recordAt(offset int64, ok bool) (md []byte, flag int, err error) {
+	if !ok {
+		return nil, KeyNotPresent, nil
+	}
+	if md, err = readMetadata(kvFile.file, offset); err != nil {
 		return
 	}
-	return fs.Size(), err
+	return md, metadataEntryType(md), nil
+}
+
+// Keys - every key in the file, including deleted ones. Use Read to tell them apart
+func (kvFile *KvFile) Keys() (keys []string) {
+	kvFile.fileMapMutex.RLock()
+	defer kvFile.fileMapMutex.RUnlock()
+	keys = make([]string, 0, len(kvFile.fileMap))
+	for key := range kvFile.fileMap {
+		keys = append(keys, key)
+	}
+	return
+}
+
+// State - whether key is written, deleted or not present in the file without reading its value
+func (kvFile *KvFile) State(key string) (flag int) {
+	offset, ok := kvFile.offset(key)
+	return kvFile.stateAt(offset, ok)
+}
+
+// stateAt - State for the record at offset, if ok
+func (kvFile *KvFile) stateAt(offset int64, ok bool) (flag int) {
+	_, flag, err := kvFile.recordAt(offset, ok)
+	if err != nil {
+		return KeyNotPresent
+	}
+	return flag
+}
+
+// Size in bytes of the underlying file
+func (kvFile *KvFile) Size() (size int64, err error) {
+	return kvFile.file.Size()
 }
 
 // Write - writes a Key Value pair to the file
 // If we pass in an io.writer then we remove our reliance on a file at this level?
 func (kvFile *KvFile) Write(key string, value []byte) (err error) {
-	md, _ := newMetadata(currentVsn)
-	writeEntryType(md, KeyWritten)
-	if err = writeKeyMetadata(md, len(key)); err != nil {
-		return
-	}
-	if err = writeValueMetadata(md, len(value)); err != nil {
+	return kvFile.WriteMeta(key, value, nil)
+}
+
+// WriteMeta - writes a Key Value pair to the file along with meta, which may be nil
+func (kvFile *KvFile) WriteMeta(key string, value []byte, meta Meta) (err error) {
+	return kvFile.WriteStamped(key, value, meta, Stamp{Time: time.Now()})
+}
+
+// WriteStamped - as WriteMeta recording stamp against the record. Callers handing out sequence
+// numbers must write them in order
+func (kvFile *KvFile) WriteStamped(key string, value []byte, meta Meta, stamp Stamp) (err error) {
+	record, err := encodeRecord(KeyWritten, key, value, meta, stamp)
+	if err != nil {
 		return
 	}
 
 	// Write to the buffer
-	writer := bufio.NewWriterSize(kvFile.file, len(md)+len(key)+len(value))
-	if _, err = writer.Write(md); err != nil {
-		return
-	}
-	if _, err = writer.WriteString(key); err != nil {
-		return
-	}
-	if _, err = writer.Write(value); err != nil {
+	writer := bufio.NewWriterSize(kvFile.file, len(record))
+	if _, err = writer.Write(record); err != nil {
 		return
 	}
 	// Flush buffer to file
@@ -182,6 +472,9 @@ func (kvFile *KvFile) Write(key string, value []byte) (err error) {
 	// https://stackoverflow.com/questions/36167200/how-safe-are-golang-maps-for-concurrent-read-write-operations
 	kvFile.fileMapMutex.Lock()
 	kvFile.fileMap[key] = location
+	if stamp.Seq > kvFile.lastSeq {
+		kvFile.lastSeq = stamp.Seq
+	}
 	kvFile.fileMapMutex.Unlock()
 	return
 }
@@ -190,54 +483,284 @@ func (kvFile *KvFile) Write(key string, value []byte) (err error) {
 // *** Internal functions
 //
 
-func writeToFile(file *os.File, writer *bufio.Writer, mutex *sync.Mutex) (location int64, err error) {
+// encodeRecord - a record as it is laid out in a file: its metadata, key, meta and value. A delete
+// has no meta or value
+func encodeRecord(entryType int, key string, value []byte, meta Meta, stamp Stamp) (record []byte, err error) {
+	encodedMeta, err := encodeMeta(meta)
+	if err != nil {
+		return
+	}
+	md, _ := newMetadata(currentVsn)
+	writeEntryType(md, entryType)
+	if err = writeKeyMetadata(md, len(key)); err != nil {
+		return
+	}
+	if err = writeValueMetadata(md, len(value)); err != nil {
+		return
+	}
+	writeMetaLength(md, len(encodedMeta))
+	writeStamp(md, stamp)
+	writeChecksum(md, []byte(key), encodedMeta, value)
+
+	record = make([]byte, 0, len(md)+len(key)+len(encodedMeta)+len(value))
+	record = append(record, md...)
+	record = append(record, key...)
+	record = append(record, encodedMeta...)
+	return append(record, value...), nil
+}
+
+func writeToFile(file gkfs.File, writer *bufio.Writer, mutex *sync.Mutex) (location int64, err error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	fileStat, err := file.Stat()
+	location, err = file.Size()
 	if err != nil {
 		return 0, err
 	}
 
 	if err = writer.Flush(); err != nil {
+		// Don't leave part of a record behind for the next write to be appended after
+		file.Truncate(location)
 		return 0, err
 	}
 
-	return fileStat.Size(), err
+	return location, err
+}
+
+// initialiseFileMap - build the map of keys to offsets. If the file ends part way through a record
+// (e.g. the process died mid write) and nothing readable follows it, the file is cut back to the
+// last complete record when truncateTorn is set, otherwise the partial record is ignored. Either
+// way tornAt is where the partial record starts, or -1 if there isn't one
+func initialiseFileMap(file gkfs.File, size int64, truncateTorn bool) (fileMap map[string]int64, lastSeq uint64, tornAt int64, err error) {
+	fileMap = make(map[string]int64)
+	tornAt = -1
+
+	err = Scan(file, size, false, func(record Record) error {
+		if record.Checksum == ChecksumInvalid {
+			return &CorruptionError{Offset: record.Offset, Err: ErrChecksumFailure}
+		}
+		// Deletes have to stay in the map so that a read stops at this file rather than
+		// falling through to a value written in an older file
+		fileMap[record.Key] = record.Offset
+		if record.Seq > lastSeq {
+			lastSeq = record.Seq
+		}
+		return nil
+	})
+
+	var corruption *CorruptionError
+	if errors.As(err, &corruption) && isTornTail(file, corruption, size) {
+		if truncateTorn {
+			return fileMap, lastSeq, corruption.Offset, file.Truncate(corruption.Offset)
+		}
+		return fileMap, lastSeq, corruption.Offset, nil
+	}
+	return
+}
+
+// isTornTail - whether the corruption is a record cut short by the end of the file with nothing
+// worth keeping after it
+func isTornTail(r io.ReaderAt, corruption *CorruptionError, size int64) bool {
+	if corruption.Offset == 0 {
+		// Don't treat a damaged header as torn
+		return false
+	}
+	if !errors.Is(corruption.Err, io.ErrUnexpectedEOF) && !errors.Is(corruption.Err, io.EOF) {
+		return false
+	}
+	return resync(r, corruption.Offset+1, size) == size
 }
 
-func initialiseFileMap(file *os.File) (fileMap map[string]int64, err error) {
-	fileStat, err := file.Stat()
+// DataStart - the offset of the first record, just after the header
+func (kvFile *KvFile) DataStart() int64 {
+	if kvFile.header == nil {
+		return 0
+	}
+	return kvFile.header.Length
+}
+
+// ReadRecords - the raw bytes of the whole records starting at offset (or the first record if offset
+// is before it), stopping once at least maxBytes have been read. next is the offset to carry on
+// from, which is the end of the file if nothing was read. A record still being written is left
+// for next time
+func (kvFile *KvFile) ReadRecords(offset int64, maxBytes int64) (data []byte, next int64, err error) {
+	size, err := kvFile.file.Size()
 	if err != nil {
-		return fileMap, err
+		return
 	}
-	fileMap = make(map[string]int64)
-	fileSize := fileStat.Size()
+	if offset < kvFile.DataStart() {
+		offset = kvFile.DataStart()
+	}
+	next = offset
+	for next < size && next-offset < maxBytes {
+		record, readErr := readRecord(kvFile.file, next, size, false)
+		if readErr == io.ErrUnexpectedEOF || readErr == io.EOF {
+			break
+		}
+		if readErr == nil && record.Checksum == ChecksumInvalid {
+			readErr = ErrChecksumFailure
+		}
+		if readErr != nil {
+			return nil, offset, &CorruptionError{Offset: next, Err: readErr}
+		}
+		next += record.Length
+	}
+	data = make([]byte, next-offset)
+	if len(data) > 0 {
+		if _, err = kvFile.file.ReadAt(data, offset); err != nil {
+			return nil, offset, err
+		}
+	}
+	return
+}
 
-	for position := int64(0); position < fileSize; {
-		md, err := readMetadata(file, position)
+// Scan - walk every record in the file as it stands. See the Scan function
+func (kvFile *KvFile) Scan(readValues bool, fn func(record Record) error) (err error) {
+	size, err := kvFile.file.Size()
+	if err != nil {
+		return
+	}
+	return Scan(kvFile.file, size, readValues, fn)
+}
+
+// Scan - walk every record in r from just after the header up to size calling fn for each one
+// Values are only returned when readValues is set, otherwise Record.Value is left nil.
+// Records carrying a checksum are always verified and the outcome is left in Record.Checksum
+// for the caller to act on. A record that can't be parsed stops the scan with a *CorruptionError. An error returned
+// by fn also stops the scan and is passed straight back
+func Scan(r io.ReaderAt, size int64, readValues bool, fn func(record Record) error) (err error) {
+	_, dataStart, err := ReadHeader(r, size)
+	if err != nil {
+		return &CorruptionError{Offset: 0, Err: err}
+	}
+	return ScanFrom(r, dataStart, size, readValues, fn)
+}
+
+// ScanFrom - as Scan but starting at offset start, which must be the start of a record, rather than
+// after the header. r need not hold a header at all, e.g. the output of ReadRecords
+func ScanFrom(r io.ReaderAt, start int64, size int64, readValues bool, fn func(record Record) error) (err error) {
+	for position := start; position < size; {
+		record, err := readRecord(r, position, size, readValues)
 		if err != nil {
-			return fileMap, err
+			return &CorruptionError{Offset: position, Err: err}
+		}
+		if err = fn(record); err != nil {
+			return err
 		}
-		keyLength := metdataKeyLength(md)
-		valueLength := metadataValueLength(md)
+		position += record.Length
+	}
+	return
+}
+
+func readRecord(r io.ReaderAt, offset int64, size int64, readValue bool) (record Record, err error) {
+	md, err := readMetadata(r, offset)
+	if err != nil {
+		return
+	}
+	record = Record{
+		Offset:      offset,
+		Version:     int(md[0]),
+		EntryType:   metadataEntryType(md),
+		ValueLength: metadataValueLength(md),
+		Checksum:    ChecksumNone,
+		Stamp:       metadataStamp(md),
+	}
+	keyLength := metdataKeyLength(md)
+	metaLength := metadataMetaLength(md)
+	record.Length = int64(len(md) + keyLength + metaLength + record.ValueLength)
+
+	if record.EntryType != KeyWritten && record.EntryType != KeyDeleted {
+		return record, ErrUnrecognisedLogType
+	}
+	if offset+record.Length > size {
+		return record, io.ErrUnexpectedEOF
+	}
 
-		key := make([]byte, int64(keyLength))
-		keyOffset := position + int64(len(md))
-		if _, err := file.ReadAt(key, keyOffset); err != nil {
-			return fileMap, err
+	key := make([]byte, keyLength)
+	if _, err = r.ReadAt(key, offset+int64(len(md))); err != nil {
+		return
+	}
+	record.Key = string(key)
+
+	if !readValue && !metadataHasChecksum(md) {
+		return
+	}
+	// A delete at the very end of r has nothing after its key, and some readers (bytes.Reader)
+	// report EOF even for an empty read there
+	block := make([]byte, metaLength+record.ValueLength)
+	if len(block) > 0 {
+		if _, err = r.ReadAt(block, offset+int64(len(md)+keyLength)); err != nil {
+			return
+		}
+	}
+	encodedMeta, value := block[:metaLength], block[metaLength:]
+	if metadataHasChecksum(md) {
+		record.Checksum = ChecksumInvalid
+		if checksumMatches(md, key, encodedMeta, value) {
+			record.Checksum = ChecksumValid
 		}
+	}
+	if readValue {
+		record.Value = value
+		// A checksum failure is left for the caller to report. Otherwise the meta block has to parse
+		if record.Meta, err = decodeMeta(encodedMeta); err != nil && record.Checksum == ChecksumInvalid {
+			err = nil
+		}
+	}
+	return
+}
 
-		switch metadataEntryType(md) {
-		case KeyWritten:
-			fileMap[string(key)] = position
-		case KeyDeleted:
-			delete(fileMap, string(key))
-		default:
-			return fileMap, ErrUnrecognisedLogType
+// Salvage - walk r in the same way as Scan but carry on past anything that can't be parsed.
+// Each unreadable byte range (including records that fail their checksum) is passed to bad
+// and scanning resumes at the next offset that looks like the start of a good record
+func Salvage(r io.ReaderAt, size int64, readValues bool, fn func(record Record) error, bad func(start int64, end int64, err error) error) (err error) {
+	position := int64(0)
+	if _, dataStart, err := ReadHeader(r, size); err == nil {
+		position = dataStart
+	}
+	for position < size {
+		record, err := readRecord(r, position, size, readValues)
+		if err == nil && record.Checksum == ChecksumInvalid {
+			err = ErrChecksumFailure
+		}
+		if err != nil {
+			next := resync(r, position+1, size)
+			if err = bad(position, next, err); err != nil {
+				return err
+			}
+			position = next
+			continue
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+		position += record.Length
+	}
+	return
+}
+
+// resync - find the first offset from start that holds a good record which is either the
+// last in the file or followed by another good record. Without a checksum a single record
+// is too easy to match by chance, hence looking one record further
+func resync(r io.ReaderAt, start int64, size int64) int64 {
+	for position := start; position < size; position++ {
+		if goodRecordAt(r, position, size) == nil {
+			return position
+		}
+	}
+	return size
+}
+
+func goodRecordAt(r io.ReaderAt, offset int64, size int64) (err error) {
+	for i := 0; i < 2 && offset < size; i++ {
+		record, err := readRecord(r, offset, size, false)
+		if err != nil {
+			return err
 		}
-		position += int64(len(md) + keyLength + valueLength)
-		fmt.Printf("\tKey: %s read at: %d\n", string(key), position)
+		if record.Checksum == ChecksumInvalid {
+			return ErrChecksumFailure
+		}
+		offset += record.Length
 	}
 	return
 }
@@ -253,20 +776,46 @@ Metadata layouts:
 		// byte 1		keyLength
 		// byte 2-5		valueLength
 		// byte 6		recordType
+	version 3
+		// byte 0		version
+		// byte 1		keyLength
+		// byte 2-5		valueLength
+		// byte 6		recordType
+		// byte 7-10	checksum (crc32 IEEE of key followed by value)
+	version 4
+		// byte 0		version
+		// byte 1		keyLength
+		// byte 2-5		valueLength
+		// byte 6		recordType
+		// byte 7-10	checksum (crc32 IEEE of key, meta block and value in that order)
+		// byte 11-12	metaLength
+		// The meta block (see encodeMeta) follows the key and comes before the value
+	version 5
+		// byte 0		version
+		// byte 1		keyLength
+		// byte 2-5		valueLength
+		// byte 6		recordType
+		// byte 7-10	checksum (crc32 IEEE of key, meta block, value and then bytes 13-28)
+		// byte 11-12	metaLength
+		// byte 13-20	seq
+		// byte 21-28	time (unix nanoseconds)
 */
 
 const (
 	v1 = iota + 1
 	v2
+	v3
+	v4
+	v5
 )
-const currentVsn = v2
+const currentVsn = v5
 const maxKeyLength = 255
 const maxValueLength = 2147483647
 
-func readMetadata(file *os.File, offset int64) (md []byte, err error) {
+func readMetadata(r io.ReaderAt, offset int64) (md []byte, err error) {
 	// Read the version - always the first byte
 	vsn := make([]byte, 1)
-	if _, err = file.ReadAt(vsn, offset); err != nil {
+	if _, err = r.ReadAt(vsn, offset); err != nil {
 		return md, err
 	}
 	// Make a byte slice of the correct size based on the version
@@ -274,7 +823,7 @@ func readMetadata(file *os.File, offset int64) (md []byte, err error) {
 	if err != nil {
 		return md, err
 	}
-	_, err = file.ReadAt(md, offset)
+	_, err = r.ReadAt(md, offset)
 	return
 }
 
@@ -284,6 +833,12 @@ func newMetadata(version byte) (md []byte, err error) {
 		md = make([]byte, 6)
 	case v2:
 		md = make([]byte, 7)
+	case v3:
+		md = make([]byte, 11)
+	case v4:
+		md = make([]byte, 13)
+	case v5:
+		md = make([]byte, 29)
 	default:
 		return md, ErrUnrecognisedMetadataVsn
 	}
@@ -293,7 +848,7 @@ func newMetadata(version byte) (md []byte, err error) {
 
 func metdataKeyLength(md []byte) (keyLength int) {
 	switch int(md[0]) {
-	case v1, v2:
+	case v1, v2, v3, v4, v5:
 		keyLength = int(md[1])
 	default:
 		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
@@ -304,7 +859,7 @@ func metdataKeyLength(md []byte) (keyLength int) {
 func metadataValueLength(md []byte) (valueLength int) {
 	// https://play.golang.org/p/xXzANmB6PJU bitwise operators
 	switch int(md[0]) {
-	case v1, v2:
+	case v1, v2, v3, v4, v5:
 		valueLength = int(md[2]) +
 			int(md[3])<<8 +
 			int(md[4])<<16 +
@@ -320,7 +875,7 @@ func metadataEntryType(md []byte) (entryType int) {
 	case v1:
 		// Default v1 entries to added as there was no delete
 		entryType = KeyWritten
-	case v2:
+	case v2, v3, v4, v5:
 		entryType = int(md[6])
 	default:
 		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
@@ -334,7 +889,7 @@ func writeKeyMetadata(md []byte, length int) (err error) {
 	}
 
 	switch int(md[0]) {
-	case v1, v2:
+	case v1, v2, v3, v4, v5:
 		md[1] = byte(length)
 	default:
 		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
@@ -348,7 +903,7 @@ func writeValueMetadata(md []byte, length int) (err error) {
 	}
 	// https://play.golang.org/p/xXzANmB6PJU bitwise operators
 	switch int(md[0]) {
-	case v1, v2:
+	case v1, v2, v3, v4, v5:
 		md[2] = byte(length)
 		md[3] = byte(length >> 8)
 		md[4] = byte(length >> 16)
@@ -361,9 +916,88 @@ func writeValueMetadata(md []byte, length int) (err error) {
 
 func writeEntryType(md []byte, entryType int) {
 	switch int(md[0]) {
-	case v2:
+	case v2, v3, v4, v5:
 		md[6] = byte(entryType)
 	default:
 		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
 	}
 }
+
+func metadataHasChecksum(md []byte) bool {
+	return int(md[0]) >= v3
+}
+
+// checksumMatches - encodedMeta is always empty before v4 which leaves the checksum as it was
+func checksumMatches(md []byte, key []byte, encodedMeta []byte, value []byte) bool {
+	checksum := uint32(md[7]) |
+		uint32(md[8])<<8 |
+		uint32(md[9])<<16 |
+		uint32(md[10])<<24
+	return checksum == computeChecksum(md, key, encodedMeta, value)
+}
+
+// computeChecksum - from v5 the stamp is covered too so a damaged seq can't go unnoticed
+func computeChecksum(md []byte, key []byte, encodedMeta []byte, value []byte) uint32 {
+	checksum := crc32.Update(crc32.ChecksumIEEE(key), crc32.IEEETable, encodedMeta)
+	checksum = crc32.Update(checksum, crc32.IEEETable, value)
+	if int(md[0]) >= v5 {
+		checksum = crc32.Update(checksum, crc32.IEEETable, md[13:29])
+	}
+	return checksum
+}
+
+// writeChecksum - the stamp has to be written first
+func writeChecksum(md []byte, key []byte, encodedMeta []byte, value []byte) {
+	switch int(md[0]) {
+	case v3, v4, v5:
+		checksum := computeChecksum(md, key, encodedMeta, value)
+		md[7] = byte(checksum)
+		md[8] = byte(checksum >> 8)
+		md[9] = byte(checksum >> 16)
+		md[10] = byte(checksum >> 24)
+	default:
+		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
+	}
+}
+
+func metadataMetaLength(md []byte) (metaLength int) {
+	if int(md[0]) < v4 {
+		return 0
+	}
+	return int(md[11]) | int(md[12])<<8
+}
+
+func writeMetaLength(md []byte, length int) {
+	switch int(md[0]) {
+	case v4, v5:
+		md[11] = byte(length)
+		md[12] = byte(length >> 8)
+	default:
+		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
+	}
+}
+
+func metadataStamp(md []byte) (stamp Stamp) {
+	if int(md[0]) < v5 {
+		return
+	}
+	stamp.Seq = binary.LittleEndian.Uint64(md[13:21])
+	if nanos := int64(binary.LittleEndian.Uint64(md[21:29])); nanos != 0 {
+		stamp.Time = time.Unix(0, nanos).UTC()
+	}
+	return
+}
+
+func writeStamp(md []byte, stamp Stamp) {
+	switch int(md[0]) {
+	case v5:
+		binary.LittleEndian.PutUint64(md[13:21], stamp.Seq)
+		var nanos int64
+		if !stamp.Time.IsZero() {
+			nanos = stamp.Time.UnixNano()
+		}
+		binary.LittleEndian.PutUint64(md[21:29], uint64(nanos))
+	default:
+		log.Fatal(ErrUnrecognisedMetadataVsn.Error())
+	}
+}
@@ -0,0 +1,272 @@
+package gklogfile
+
+import (
+	"bytes"
+	"errors"
+	"gokave/gkfs"
+	"io"
+	"testing"
+	"time"
+)
+
+// newTestFile - a new segment of the store s on an in memory file system
+func newTestFile(t *testing.T) (fsys *gkfs.MemFS, kvFile *KvFile) {
+	t.Helper()
+	fsys = gkfs.NewMem()
+	if err := fsys.MkdirAll("/s", 0755); err != nil {
+		t.Fatal(err)
+	}
+	kvFile, err := Create(fsys, "/s/1.gkv", Header{Created: time.Unix(0, 1), Sequence: 1, StoreName: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// fileBytes - the whole of a file as it stands
+func fileBytes(t *testing.T, fsys gkfs.FS, name string) []byte {
+	t.Helper()
+	data, err := gkfs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encodeOldRecord - a record as written by an older version, with no meta
+func encodeOldRecord(t *testing.T, version byte, entryType int, key string, value string) []byte {
+	t.Helper()
+	md, err := newMetadata(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version > v1 {
+		writeEntryType(md, entryType)
+	}
+	if err = writeKeyMetadata(md, len(key)); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeValueMetadata(md, len(value)); err != nil {
+		t.Fatal(err)
+	}
+	if version >= v3 {
+		writeChecksum(md, []byte(key), nil, []byte(value))
+	}
+	return append(append(md, key...), value...)
+}
+
+func TestScan(t *testing.T) {
+	fsys, kvFile := newTestFile(t)
+	defer kvFile.Close()
+	if err := kvFile.Write("a", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvFile.Write("b", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvFile.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := fileBytes(t, fsys, "/s/1.gkv")
+	var records []Record
+	err := Scan(bytes.NewReader(data), int64(len(data)), true, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Records: %d, expected 3", len(records))
+	}
+	offset := kvFile.Header().Length
+	for i, record := range records {
+		if record.Offset != offset || record.Version != currentVsn {
+			t.Errorf("Record %d: %+v", i, record)
+		}
+		offset += record.Length
+	}
+	if offset != int64(len(data)) {
+		t.Errorf("Records end at %d, file is %d bytes", offset, len(data))
+	}
+	if records[0].Key != "a" || string(records[0].Value) != "one" || records[0].EntryType != KeyWritten {
+		t.Errorf("First record: %+v", records[0])
+	}
+	if records[2].Key != "a" || records[2].EntryType != KeyDeleted || records[2].ValueLength != 0 {
+		t.Errorf("Delete record: %+v", records[2])
+	}
+
+	// Without values only the layout is read
+	err = Scan(bytes.NewReader(data), int64(len(data)), false, func(record Record) error {
+		if record.Value != nil {
+			t.Errorf("Record without value: %+v", record)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanStopsAtCorruption(t *testing.T) {
+	fsys, kvFile := newTestFile(t)
+	defer kvFile.Close()
+	for _, key := range []string{"a", "b"} {
+		if err := kvFile.Write(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := fileBytes(t, fsys, "/s/1.gkv")
+	cut := data[:len(data)-2]
+
+	var keys []string
+	err := Scan(bytes.NewReader(cut), int64(len(cut)), false, func(record Record) error {
+		keys = append(keys, record.Key)
+		return nil
+	})
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected a corruption error, got: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("Keys before the corruption: %v", keys)
+	}
+
+	// An error from fn is passed straight back
+	stop := errors.New("stop")
+	if err = Scan(bytes.NewReader(data), int64(len(data)), false, func(Record) error { return stop }); err != stop {
+		t.Errorf("Expected fn's error, got: %v", err)
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	fsys, kvFile := newTestFile(t)
+	defer kvFile.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := kvFile.Write(key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := fileBytes(t, fsys, "/s/1.gkv")
+	var records []Record
+	if err := Scan(bytes.NewReader(data), int64(len(data)), false, func(record Record) error {
+		records = append(records, record)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Damage the value of b so its checksum fails
+	damaged := records[1]
+	data[damaged.Offset+damaged.Length-1] ^= 0xff
+
+	var keys []string
+	var badStart, badEnd int64 = -1, -1
+	err := Salvage(bytes.NewReader(data), int64(len(data)), true, func(record Record) error {
+		keys = append(keys, record.Key)
+		return nil
+	}, func(start int64, end int64, err error) error {
+		if !errors.Is(err, ErrChecksumFailure) {
+			t.Errorf("Bad range error: %v", err)
+		}
+		badStart, badEnd = start, end
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Errorf("Salvaged keys: %v", keys)
+	}
+	if badStart != damaged.Offset || badEnd != damaged.Offset+damaged.Length {
+		t.Errorf("Bad range: %d-%d, expected %d-%d", badStart, badEnd, damaged.Offset, damaged.Offset+damaged.Length)
+	}
+}
+
+func TestTornTailTruncatedOnReopen(t *testing.T) {
+	mem := gkfs.NewMem()
+	if err := mem.MkdirAll("/s", 0755); err != nil {
+		t.Fatal(err)
+	}
+	faulty := gkfs.NewFaulty(mem)
+	kvFile, err := Create(faulty, "/s/1.gkv", Header{Created: time.Unix(0, 1), StoreName: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kvFile.Write("a", []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	goodSize, _ := kvFile.Size()
+	if kvFile.TornAt() != -1 {
+		t.Errorf("Torn at in a new file: %d", kvFile.TornAt())
+	}
+	// The process dies part way through the next record, leaving it half written
+	faulty.CrashAt(faulty.Written() + 10)
+	if err = kvFile.Write("b", []byte("torn")); err != gkfs.ErrCrashed {
+		t.Fatalf("Write at the crash: %v", err)
+	}
+	kvFile.Close()
+	if data := fileBytes(t, mem, "/s/1.gkv"); int64(len(data)) != goodSize+10 {
+		t.Fatalf("Size after the crash: %d, expected %d", len(data), goodSize+10)
+	}
+
+	// A read only open leaves the file alone
+	readOnly, err := OpenReadOnly(mem, "/s/1.gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := readOnly.Size(); size != goodSize+10 || readOnly.TornAt() != goodSize {
+		t.Errorf("Size open read only: %d, torn at %d", size, readOnly.TornAt())
+	}
+	readOnly.Close()
+
+	kvFile, err = Open(mem, "/s/1.gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kvFile.Close()
+	if size, _ := kvFile.Size(); size != goodSize || kvFile.TornAt() != goodSize {
+		t.Errorf("Size after reopen: %d, torn at %d. Expected the torn record cut off at %d", size, kvFile.TornAt(), goodSize)
+	}
+	if value, flag, err := kvFile.Read("a"); err != nil || flag != KeyWritten || string(value) != "kept" {
+		t.Errorf("Read a: %q %d %v", value, flag, err)
+	}
+	if _, flag, _ := kvFile.Read("b"); flag != KeyNotPresent {
+		t.Errorf("Read b: flag %d, expected KeyNotPresent", flag)
+	}
+	// Writes carry on from the end of the last good record
+	if err = kvFile.Write("b", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := kvFile.Read("b"); string(value) != "again" {
+		t.Errorf("Read b after rewrite: %q", value)
+	}
+}
+
+func TestFailedSyncReported(t *testing.T) {
+	mem := gkfs.NewMem()
+	if err := mem.MkdirAll("/s", 0755); err != nil {
+		t.Fatal(err)
+	}
+	faulty := gkfs.NewFaulty(mem)
+	faulty.FailSync(gkfs.ErrInjected)
+	if _, err := Create(faulty, "/s/1.gkv", Header{StoreName: "s"}); err != gkfs.ErrInjected {
+		t.Errorf("Create with a failing sync: %v", err)
+	}
+
+	faulty.FailSync(nil)
+	kvFile, err := Create(faulty, "/s/2.gkv", Header{StoreName: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kvFile.Write("a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	faulty.FailSync(gkfs.ErrInjected)
+	if err = kvFile.Sync(); err != gkfs.ErrInjected {
+		t.Errorf("Sync: %v", err)
+	}
+	if err = kvFile.Close(); err != gkfs.ErrInjected {
+		t.Errorf("Close: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package gklogfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+Header layout (version 1):
+	// byte 0-3		magic "GKVS"
+	// byte 4		header version
+	// byte 5-6		header length (including the magic)
+	// byte 7-14	creation time (unix nanoseconds)
+	// byte 15-22	segment sequence number
+	// byte 23-24	flags - per file settings such as compression or encryption
+	// byte 25		store name length
+	// byte 26-		store name
+
+Files written before the header was introduced start straight away with a record. The first byte
+of a record is its version which can never be 'G' so the two can't be confused.
+All multi-byte values are little endian to match the record metadata.
+*/
+
+var headerMagic = []byte("GKVS")
+
+const (
+	headerV1         = 1
+	currentHeaderVsn = headerV1
+	headerFixedSize  = 26
+)
+
+// ErrNotSegmentFile means the file neither starts with a segment header nor a record we recognise
+// so it is most likely something that has been misplaced in the store directory
+var ErrNotSegmentFile = errors.New("Not a gokave segment file")
+
+// ErrUnrecognisedHeaderVsn means the segment header was written by a newer version of gokave
+var ErrUnrecognisedHeaderVsn = errors.New("Unrecognised segment header version")
+
+// Header - the descriptive information written at the start of every segment file
+// Length is the number of bytes taken up by the header on disk and is filled in when reading
+type Header struct {
+	Version   int
+	Length    int64
+	Created   time.Time
+	Sequence  uint64
+	Flags     uint16
+	StoreName string
+}
+
+// ReadHeader - read the header from the start of a segment. Legacy files without a header return a
+// nil header and a dataStart of 0. Otherwise dataStart is the offset of the first record
+func ReadHeader(r io.ReaderAt, size int64) (header *Header, dataStart int64, err error) {
+	if size == 0 {
+		return nil, 0, nil
+	}
+
+	prefix := make([]byte, len(headerMagic))
+	n, err := r.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if !bytes.Equal(prefix[:n], headerMagic) {
+		// A legacy file should start with a record version
+		switch int(prefix[0]) {
+		case v1, v2, v3:
+			return nil, 0, nil
+		}
+		return nil, 0, ErrNotSegmentFile
+	}
+
+	if size < headerFixedSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	fixed := make([]byte, headerFixedSize)
+	if _, err = r.ReadAt(fixed, 0); err != nil {
+		return nil, 0, err
+	}
+	if int(fixed[4]) != headerV1 {
+		return nil, 0, ErrUnrecognisedHeaderVsn
+	}
+
+	header = &Header{
+		Version:  int(fixed[4]),
+		Length:   int64(binary.LittleEndian.Uint16(fixed[5:7])),
+		Created:  time.Unix(0, int64(binary.LittleEndian.Uint64(fixed[7:15]))).UTC(),
+		Sequence: binary.LittleEndian.Uint64(fixed[15:23]),
+		Flags:    binary.LittleEndian.Uint16(fixed[23:25]),
+	}
+	nameLength := int64(fixed[25])
+	if header.Length < headerFixedSize+nameLength || header.Length > size {
+		return nil, 0, fmt.Errorf("Bad segment header length: %d", header.Length)
+	}
+
+	name := make([]byte, nameLength)
+	if _, err = r.ReadAt(name, headerFixedSize); err != nil {
+		return nil, 0, err
+	}
+	header.StoreName = string(name)
+	return header, header.Length, nil
+}
+
+// encodeHeader - the on disk form of the header. Version and Length are always set from the
+// current layout
+func encodeHeader(header Header) (encoded []byte, err error) {
+	if len(header.StoreName) > 255 {
+		return nil, fmt.Errorf("Store name too long for segment header. Max length: %d %d", 255, len(header.StoreName))
+	}
+
+	encoded = make([]byte, headerFixedSize+len(header.StoreName))
+	copy(encoded, headerMagic)
+	encoded[4] = currentHeaderVsn
+	binary.LittleEndian.PutUint16(encoded[5:7], uint16(len(encoded)))
+	binary.LittleEndian.PutUint64(encoded[7:15], uint64(header.Created.UnixNano()))
+	binary.LittleEndian.PutUint64(encoded[15:23], header.Sequence)
+	binary.LittleEndian.PutUint16(encoded[23:25], header.Flags)
+	encoded[25] = byte(len(header.StoreName))
+	copy(encoded[headerFixedSize:], header.StoreName)
+	return
+}
@@ -0,0 +1,49 @@
+package gklogfile
+
+import (
+	"bytes"
+	"gokave/gkfs"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	fsys, kvFile := newTestFile(t)
+	kvFile.Close()
+
+	// A file from before headers is a run of records from before record meta
+	legacy := "/s/2.gkv"
+	records := append(encodeOldRecord(t, v3, KeyWritten, "a", "one"), encodeOldRecord(t, v3, KeyWritten, "b", "two")...)
+	if err := gkfs.WriteFile(fsys, legacy, records); err != nil {
+		t.Fatal(err)
+	}
+	header, dataStart, err := ReadHeader(bytes.NewReader(records), int64(len(records)))
+	if header != nil || dataStart != 0 || err != nil {
+		t.Fatalf("Legacy header: %+v data start %d, err %v", header, dataStart, err)
+	}
+
+	legacyFile, err := Open(fsys, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacyFile.Close()
+	if legacyFile.Header() != nil {
+		t.Errorf("Header of a legacy file: %+v", legacyFile.Header())
+	}
+	for key, expected := range map[string]string{"a": "one", "b": "two"} {
+		if value, flag, err := legacyFile.Read(key); err != nil || flag != KeyWritten || string(value) != expected {
+			t.Errorf("Read %s: %q %d %v", key, value, flag, err)
+		}
+	}
+	// New records still go on the end of a legacy file
+	if err = legacyFile.Write("c", []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := legacyFile.Read("c"); err != nil || string(value) != "three" {
+		t.Errorf("Read c: %q %v", value, err)
+	}
+
+	// An empty file is taken as a legacy file with no records yet
+	if header, dataStart, err = ReadHeader(bytes.NewReader(nil), 0); header != nil || dataStart != 0 || err != nil {
+		t.Errorf("Empty file header: %+v data start %d, err %v", header, dataStart, err)
+	}
+}
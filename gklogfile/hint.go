@@ -0,0 +1,139 @@
+package gklogfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gokave/gkfs"
+	"hash/crc32"
+	"sort"
+)
+
+/*
+Hint file layout (version 1). A hint file sits next to a segment that is no longer written to and
+says where each key's record is, so that opening the segment doesn't have to read every record:
+	// byte 0-3		magic "GKVH"
+	// byte 4		hint version
+	// byte 5-12	the size of the segment it describes
+	// byte 13-20	the segment's creation time from its header (unix nanoseconds)
+	// byte 21-28	the highest record sequence number in the segment
+	// byte 29-32	the number of entries
+	// then each entry: key length (1 byte), key, record offset (8 bytes)
+	// then a crc32 of everything before it (4 bytes)
+
+A hint that doesn't match its segment's size and creation time is out of date (e.g. the segment
+was repaired) and is ignored. All multi-byte values are little endian.
+*/
+
+var hintMagic = []byte("GKVH")
+
+const (
+	hintV1          = 1
+	hintFixedSize   = 33
+	hintEntryFixed  = 9
+	hintChecksumLen = 4
+)
+
+// HintSuffix is added to a segment's file name for the name of its hint file
+const HintSuffix = ".hint"
+
+// errBadHints means a hint file can't be used and the segment has to be read instead
+var errBadHints = errors.New("Bad hint file")
+
+// HintFileName - the hint file of the segment fileName
+func HintFileName(fileName string) string {
+	return fileName + HintSuffix
+}
+
+// writeHints - write the hint file for the segment fileName, which has to be complete. It is written
+// to a temporary file first so a hint file is never seen half written
+func writeHints(fsys gkfs.FS, fileName string, header *Header, size int64, lastSeq uint64, fileMap map[string]int64) (err error) {
+	keys := make([]string, 0, len(fileMap))
+	length := hintFixedSize + hintChecksumLen
+	for key := range fileMap {
+		keys = append(keys, key)
+		length += hintEntryFixed + len(key)
+	}
+	sort.Strings(keys)
+
+	encoded := make([]byte, hintFixedSize, length)
+	copy(encoded, hintMagic)
+	encoded[4] = hintV1
+	binary.LittleEndian.PutUint64(encoded[5:13], uint64(size))
+	binary.LittleEndian.PutUint64(encoded[13:21], uint64(hintCreated(header)))
+	binary.LittleEndian.PutUint64(encoded[21:29], lastSeq)
+	binary.LittleEndian.PutUint32(encoded[29:33], uint32(len(keys)))
+	var offset [8]byte
+	for _, key := range keys {
+		if len(key) > maxKeyLength {
+			return fmt.Errorf("Key too long for hint file: %d", len(key))
+		}
+		encoded = append(encoded, byte(len(key)))
+		encoded = append(encoded, key...)
+		binary.LittleEndian.PutUint64(offset[:], uint64(fileMap[key]))
+		encoded = append(encoded, offset[:]...)
+	}
+	var checksum [hintChecksumLen]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(encoded))
+	encoded = append(encoded, checksum[:]...)
+
+	hintName := HintFileName(fileName)
+	if err = gkfs.WriteFile(fsys, hintName+".tmp", encoded); err != nil {
+		return
+	}
+	return fsys.Rename(hintName+".tmp", hintName)
+}
+
+// readHints - the key offsets and highest sequence number of the segment fileName from its hint
+// file. Fails with errBadHints if the hint file can't be used, or the error reading it (e.g. it
+// doesn't exist)
+func readHints(fsys gkfs.FS, fileName string, header *Header, size int64) (fileMap map[string]int64, lastSeq uint64, err error) {
+	encoded, err := gkfs.ReadFile(fsys, HintFileName(fileName))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(encoded) < hintFixedSize+hintChecksumLen || !bytes.Equal(encoded[:4], hintMagic) || encoded[4] != hintV1 {
+		return nil, 0, fmt.Errorf("%w: unrecognised", errBadHints)
+	}
+	body := encoded[:len(encoded)-hintChecksumLen]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(encoded[len(body):]) {
+		return nil, 0, fmt.Errorf("%w: %s", errBadHints, ErrChecksumFailure)
+	}
+	if int64(binary.LittleEndian.Uint64(body[5:13])) != size || int64(binary.LittleEndian.Uint64(body[13:21])) != hintCreated(header) {
+		return nil, 0, fmt.Errorf("%w: out of date", errBadHints)
+	}
+	lastSeq = binary.LittleEndian.Uint64(body[21:29])
+	count := int(binary.LittleEndian.Uint32(body[29:33]))
+
+	fileMap = make(map[string]int64, count)
+	position := hintFixedSize
+	for i := 0; i < count; i++ {
+		if position >= len(body) {
+			return nil, 0, fmt.Errorf("%w: entry %d missing", errBadHints, i)
+		}
+		keyLength := int(body[position])
+		if position+1+keyLength+8 > len(body) {
+			return nil, 0, fmt.Errorf("%w: entry %d cut short", errBadHints, i)
+		}
+		key := string(body[position+1 : position+1+keyLength])
+		offset := int64(binary.LittleEndian.Uint64(body[position+1+keyLength:]))
+		if offset < 0 || offset >= size {
+			return nil, 0, fmt.Errorf("%w: offset %d of %s is outside the segment", errBadHints, offset, key)
+		}
+		fileMap[key] = offset
+		position += 1 + keyLength + 8
+	}
+	if position != len(body) {
+		return nil, 0, fmt.Errorf("%w: %d bytes left over", errBadHints, len(body)-position)
+	}
+	return
+}
+
+// hintCreated - what ties a hint file to its segment along with the size. Legacy segments have no header
+func hintCreated(header *Header) int64 {
+	if header == nil {
+		return 0
+	}
+	return header.Created.UnixNano()
+}
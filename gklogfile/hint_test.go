@@ -0,0 +1,148 @@
+package gklogfile
+
+import (
+	"bytes"
+	"errors"
+	"gokave/gkfs"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestSegment - a complete segment with a hint file, written by a SegmentWriter
+func newTestSegment(t *testing.T) (fsys *gkfs.MemFS, header *Header, size int64) {
+	t.Helper()
+	fsys = gkfs.NewMem()
+	if err := fsys.MkdirAll("/s", 0755); err != nil {
+		t.Fatal(err)
+	}
+	segmentWriter, err := CreateSegment(fsys, "/s/1.gkv", Header{Created: time.Unix(0, 1), Sequence: 1, StoreName: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(100, 0).UTC()
+	for seq, key := range []string{"a", "b", "a"} {
+		if err = segmentWriter.WriteStamped(key, []byte(key+"-value"), nil, Stamp{Seq: uint64(seq + 1), Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = segmentWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := fileBytes(t, fsys, "/s/1.gkv")
+	header, _, err = ReadHeader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, header, int64(len(data))
+}
+
+// expectSegmentReads - check the segment opens with the values newTestSegment wrote, and whether
+// its hint file was bad
+func expectSegmentReads(t *testing.T, fsys gkfs.FS, badHints bool) {
+	t.Helper()
+	kvFile, err := Open(fsys, "/s/1.gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kvFile.Close()
+	if hintErr := kvFile.HintError(); errors.Is(hintErr, errBadHints) != badHints || (hintErr != nil) != badHints {
+		t.Errorf("HintError: %v, expected bad hints %t", hintErr, badHints)
+	}
+	for _, key := range []string{"a", "b"} {
+		if value, flag, err := kvFile.Read(key); err != nil || flag != KeyWritten || string(value) != key+"-value" {
+			t.Errorf("Read %s: %q %d %v", key, value, flag, err)
+		}
+	}
+	if kvFile.LastSeq() != 3 {
+		t.Errorf("Last seq: %d, expected 3", kvFile.LastSeq())
+	}
+}
+
+func TestHints(t *testing.T) {
+	fsys, header, size := newTestSegment(t)
+	fileMap, lastSeq, err := readHints(fsys, "/s/1.gkv", header, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hints say what reading through the segment would
+	file, err := fsys.OpenFile("/s/1.gkv", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanned, scannedSeq, _, err := initialiseFileMap(file, size, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastSeq != scannedSeq || len(fileMap) != len(scanned) {
+		t.Errorf("Hints: %v last seq %d, read through: %v last seq %d", fileMap, lastSeq, scanned, scannedSeq)
+	}
+	for key, offset := range scanned {
+		if fileMap[key] != offset {
+			t.Errorf("Hint for %s: %d, expected %d", key, fileMap[key], offset)
+		}
+	}
+	expectSegmentReads(t, fsys, false)
+}
+
+func TestBadHintsIgnored(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt func(t *testing.T, fsys *gkfs.MemFS, header *Header, size int64)
+	}{
+		{"flipped byte", func(t *testing.T, fsys *gkfs.MemFS, header *Header, size int64) {
+			hints := fileBytes(t, fsys, "/s/1.gkv.hint")
+			hints[hintFixedSize+1] ^= 0xff
+			writeTestFile(t, fsys, "/s/1.gkv.hint", hints)
+		}},
+		{"cut short", func(t *testing.T, fsys *gkfs.MemFS, header *Header, size int64) {
+			hints := fileBytes(t, fsys, "/s/1.gkv.hint")
+			writeTestFile(t, fsys, "/s/1.gkv.hint", hints[:hintFixedSize])
+		}},
+		{"not a hint file", func(t *testing.T, fsys *gkfs.MemFS, header *Header, size int64) {
+			hints := fileBytes(t, fsys, "/s/1.gkv.hint")
+			copy(hints, "GKVX")
+			writeTestFile(t, fsys, "/s/1.gkv.hint", hints)
+		}},
+		{"segment size changed", func(t *testing.T, fsys *gkfs.MemFS, header *Header, size int64) {
+			if err := writeHints(fsys, "/s/1.gkv", header, size-1, 3, map[string]int64{"a": header.Length}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"offset outside the segment", func(t *testing.T, fsys *gkfs.MemFS, header *Header, size int64) {
+			if err := writeHints(fsys, "/s/1.gkv", header, size, 3, map[string]int64{"a": size + 10}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		fsys, header, size := newTestSegment(t)
+		test.corrupt(t, fsys, header, size)
+		if _, _, err := readHints(fsys, "/s/1.gkv", header, size); !errors.Is(err, errBadHints) {
+			t.Errorf("%s: %v, expected errBadHints", test.name, err)
+		}
+		// The segment is read through instead
+		expectSegmentReads(t, fsys, true)
+	}
+
+	fsys, header, size := newTestSegment(t)
+	if err := fsys.Remove("/s/1.gkv.hint"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readHints(fsys, "/s/1.gkv", header, size); !gkfs.IsNotExist(err) {
+		t.Errorf("No hint file: %v, expected not found", err)
+	}
+	expectSegmentReads(t, fsys, false)
+}
+
+// writeTestFile - replace the file name with data
+func writeTestFile(t *testing.T, fsys gkfs.FS, name string, data []byte) {
+	t.Helper()
+	if err := fsys.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := gkfs.WriteFile(fsys, name, data); err != nil {
+		t.Fatal(err)
+	}
+}
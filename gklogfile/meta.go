@@ -0,0 +1,77 @@
+package gklogfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Meta - small named strings stored alongside a value, such as its content type. Not to be
+// confused with the record metadata (md) that describes the layout of each record
+type Meta map[string]string
+
+// ErrMetaTooLarge means a Meta doesn't fit in a record's meta block
+var ErrMetaTooLarge = errors.New("Meta too large")
+
+const maxMetaLength = 65535
+const maxMetaNameLength = 255
+
+/*
+Meta block layout, repeated for each name in name order:
+	// byte 0		nameLength
+	// ...			name
+	// 2 bytes		valueLength
+	// ...			value
+*/
+
+// encodeMeta - an empty meta encodes to nothing so costs no space in the record
+func encodeMeta(meta Meta) (encoded []byte, err error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := meta[name]
+		if len(name) == 0 || len(name) > maxMetaNameLength || len(value) > maxMetaLength {
+			return nil, fmt.Errorf("%w: %s", ErrMetaTooLarge, name)
+		}
+		encoded = append(encoded, byte(len(name)))
+		encoded = append(encoded, name...)
+		encoded = append(encoded, byte(len(value)), byte(len(value)>>8))
+		encoded = append(encoded, value...)
+	}
+	if len(encoded) > maxMetaLength {
+		return nil, fmt.Errorf("%w: %d bytes. Max length: %d", ErrMetaTooLarge, len(encoded), maxMetaLength)
+	}
+	return
+}
+
+func decodeMeta(encoded []byte) (meta Meta, err error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	meta = make(Meta)
+	for position := 0; position < len(encoded); {
+		nameLength := int(encoded[position])
+		position++
+		if position+nameLength+2 > len(encoded) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		name := string(encoded[position : position+nameLength])
+		position += nameLength
+		valueLength := int(encoded[position]) | int(encoded[position+1])<<8
+		position += 2
+		if position+valueLength > len(encoded) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		meta[name] = string(encoded[position : position+valueLength])
+		position += valueLength
+	}
+	return
+}
@@ -0,0 +1,157 @@
+package gklogfile
+
+import (
+	"bytes"
+	"errors"
+	"gokave/gkfs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetaRoundTrip(t *testing.T) {
+	fsys, kvFile := newTestFile(t)
+	meta := Meta{"Content-Type": "application/json", "Owner": "ops", "Empty": ""}
+	if err := kvFile.WriteMeta("a", []byte(`{"n":1}`), meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvFile.Write("b", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvFile.WriteMeta("c", nil, Meta{"Owner": "deleted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvFile.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kvFile, err := Open(fsys, "/s/1.gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kvFile.Close()
+	value, got, flag, err := kvFile.ReadMeta("a")
+	if err != nil || flag != KeyWritten || string(value) != `{"n":1}` || !reflect.DeepEqual(got, meta) {
+		t.Errorf("ReadMeta a: %q %v %d, err %v", value, got, flag, err)
+	}
+	got, valueLength, flag, err := kvFile.Head("a")
+	if err != nil || flag != KeyWritten || valueLength != 7 || !reflect.DeepEqual(got, meta) {
+		t.Errorf("Head a: %v %d %d, err %v", got, valueLength, flag, err)
+	}
+	// A value written without meta costs nothing extra and reads back with none
+	if value, got, _, err = kvFile.ReadMeta("b"); err != nil || string(value) != "plain" || got != nil {
+		t.Errorf("ReadMeta b: %q %v, err %v", value, got, err)
+	}
+	if got, _, flag, err = kvFile.Head("c"); err != nil || flag != KeyDeleted || got != nil {
+		t.Errorf("Head of a deleted key: %v %d, err %v", got, flag, err)
+	}
+
+	// Scan reads the meta along with the value and checks it is covered by the checksum
+	data := fileBytes(t, fsys, "/s/1.gkv")
+	var records []Record
+	err = Scan(bytes.NewReader(data), int64(len(data)), true, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil || len(records) != 4 {
+		t.Fatalf("Scan: %d records, err %v", len(records), err)
+	}
+	if records[0].Version != currentVsn || records[0].Checksum != ChecksumValid || !reflect.DeepEqual(records[0].Meta, meta) {
+		t.Errorf("Scanned record: %+v", records[0])
+	}
+	metaAt := bytes.Index(data, []byte("ops"))
+	data[metaAt] = 'x'
+	var damaged Record
+	err = Scan(bytes.NewReader(data), int64(len(data)), true, func(record Record) error {
+		if record.Offset == records[0].Offset {
+			damaged = record
+		}
+		return nil
+	})
+	if err != nil || damaged.Checksum != ChecksumInvalid {
+		t.Errorf("Scan with damaged meta: %+v, err %v", damaged, err)
+	}
+}
+
+func TestReadOlderRecordVersions(t *testing.T) {
+	fsys := gkfs.NewMem()
+	if err := fsys.MkdirAll("/s", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A headerless file written by successive versions, which only ever appended
+	var records []byte
+	records = append(records, encodeOldRecord(t, v1, KeyWritten, "one", "v1 value")...)
+	records = append(records, encodeOldRecord(t, v2, KeyWritten, "two", "v2 value")...)
+	records = append(records, encodeOldRecord(t, v2, KeyDeleted, "one", "")...)
+	records = append(records, encodeOldRecord(t, v3, KeyWritten, "three", "v3 value")...)
+	if err := gkfs.WriteFile(fsys, "/s/1.gkv", records); err != nil {
+		t.Fatal(err)
+	}
+
+	kvFile, err := Open(fsys, "/s/1.gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kvFile.WriteMeta("four", []byte("v4 value"), Meta{"Content-Type": "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = kvFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kvFile, err = Open(fsys, "/s/1.gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kvFile.Close()
+	if value, meta, flag, err := kvFile.ReadMeta("one"); err != nil || flag != KeyDeleted || value != nil || meta != nil {
+		t.Errorf("ReadMeta of a v2 delete: %q %v %d, err %v", value, meta, flag, err)
+	}
+	for _, key := range []string{"two", "three"} {
+		value, meta, flag, err := kvFile.ReadMeta(key)
+		if err != nil || flag != KeyWritten || !strings.HasSuffix(string(value), "value") || meta != nil {
+			t.Errorf("ReadMeta %s: %q %v %d, err %v", key, value, meta, flag, err)
+		}
+		if meta, valueLength, _, err := kvFile.Head(key); err != nil || valueLength != len(value) || meta != nil {
+			t.Errorf("Head %s: %v %d, err %v", key, meta, valueLength, err)
+		}
+	}
+	if value, meta, _, err := kvFile.ReadMeta("four"); err != nil || string(value) != "v4 value" || meta["Content-Type"] != "text/plain" {
+		t.Errorf("ReadMeta of the current record: %q %v, err %v", value, meta, err)
+	}
+
+	data := fileBytes(t, fsys, "/s/1.gkv")
+	var versions []int
+	err = Scan(bytes.NewReader(data), int64(len(data)), true, func(record Record) error {
+		versions = append(versions, record.Version)
+		if record.Version >= v3 && record.Checksum != ChecksumValid {
+			t.Errorf("Checksum of %s: %d", record.Key, record.Checksum)
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(versions, []int{v1, v2, v2, v3, currentVsn}) {
+		t.Errorf("Scanned versions: %v, err %v", versions, err)
+	}
+}
+
+func TestMetaTooLarge(t *testing.T) {
+	_, kvFile := newTestFile(t)
+	defer kvFile.Close()
+	for _, meta := range []Meta{
+		{"": "no name"},
+		{strings.Repeat("n", maxMetaNameLength+1): "v"},
+		{"Big": strings.Repeat("v", maxMetaLength+1)},
+		// Each value fits but the whole block doesn't
+		{"A": strings.Repeat("v", maxMetaLength/2), "B": strings.Repeat("v", maxMetaLength/2)},
+	} {
+		if err := kvFile.WriteMeta("k", []byte("v"), meta); !errors.Is(err, ErrMetaTooLarge) {
+			t.Errorf("WriteMeta: %v, expected ErrMetaTooLarge", err)
+		}
+	}
+	if _, flag, _ := kvFile.Read("k"); flag != KeyNotPresent {
+		t.Errorf("A rejected write was written: %d", flag)
+	}
+}
@@ -0,0 +1,65 @@
+package gklogfile
+
+// FileView - a KvFile as it was when View was called. Records written to the file afterwards aren't
+// seen, so reads through the view don't change while the file carries on being written to. The
+// view reads through the KvFile so it can't be used once the file is closed
+type FileView struct {
+	kvFile  *KvFile
+	fileMap map[string]int64
+	lastSeq uint64
+}
+
+// View - the file as it is now. The key offsets are copied, which is cheap for the active segment
+// of a store as it is kept small
+func (kvFile *KvFile) View() *FileView {
+	kvFile.fileMapMutex.RLock()
+	defer kvFile.fileMapMutex.RUnlock()
+	fileMap := make(map[string]int64, len(kvFile.fileMap))
+	for key, offset := range kvFile.fileMap {
+		fileMap[key] = offset
+	}
+	return &FileView{kvFile: kvFile, fileMap: fileMap, lastSeq: kvFile.lastSeq}
+}
+
+// LastSeq - the highest Stamp.Seq of any record in the view
+func (view *FileView) LastSeq() uint64 {
+	return view.lastSeq
+}
+
+// ReadMeta - as KvFile.ReadMeta
+func (view *FileView) ReadMeta(key string) (value []byte, meta Meta, flag int, err error) {
+	offset, ok := view.fileMap[key]
+	return view.kvFile.readMetaAt(key, offset, ok)
+}
+
+// ReadMany - as KvFile.ReadMany
+func (view *FileView) ReadMany(keys []string) (results map[string]Result) {
+	locations := make([]location, 0, len(keys))
+	for _, key := range keys {
+		if offset, ok := view.fileMap[key]; ok {
+			locations = append(locations, location{key: key, offset: offset})
+		}
+	}
+	return view.kvFile.readLocations(locations)
+}
+
+// Head - as KvFile.Head
+func (view *FileView) Head(key string) (meta Meta, valueLength int, flag int, err error) {
+	offset, ok := view.fileMap[key]
+	return view.kvFile.headAt(offset, ok)
+}
+
+// Keys - as KvFile.Keys
+func (view *FileView) Keys() (keys []string) {
+	keys = make([]string, 0, len(view.fileMap))
+	for key := range view.fileMap {
+		keys = append(keys, key)
+	}
+	return
+}
+
+// State - as KvFile.State
+func (view *FileView) State(key string) (flag int) {
+	offset, ok := view.fileMap[key]
+	return view.kvFile.stateAt(offset, ok)
+}
@@ -0,0 +1,116 @@
+package gklogfile
+
+import (
+	"bufio"
+	"gokave/gkfs"
+	"os"
+)
+
+// SegmentWriter writes a new segment from start to finish without it being open as a KvFile, e.g. to
+// load data in bulk. Records go through a single buffer rather than being flushed one at a time and
+// a hint file is written alongside the segment when it is closed, so opening it is quick
+type SegmentWriter struct {
+	fsys     gkfs.FS
+	fileName string
+	file     gkfs.File
+	writer   *bufio.Writer
+	header   *Header
+	offset   int64
+	fileMap  map[string]int64
+	lastSeq  uint64
+}
+
+// segmentWriterBuffer - how much a SegmentWriter buffers before writing to the file
+const segmentWriterBuffer = 1 << 20
+
+// CreateSegment - create a new segment starting with header to write with a SegmentWriter. Fails if
+// the file already exists
+func CreateSegment(fsys gkfs.FS, fileName string, header Header) (segmentWriter *SegmentWriter, err error) {
+	encoded, err := encodeHeader(header)
+	if err != nil {
+		return
+	}
+	file, err := fsys.OpenFile(fileName, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+
+	header.Version = currentHeaderVsn
+	header.Length = int64(len(encoded))
+	segmentWriter = &SegmentWriter{
+		fsys:     fsys,
+		fileName: fileName,
+		file:     file,
+		writer:   bufio.NewWriterSize(file, segmentWriterBuffer),
+		header:   &header,
+		fileMap:  make(map[string]int64),
+	}
+	if err = segmentWriter.write(encoded); err != nil {
+		segmentWriter.Abort()
+		return nil, err
+	}
+	return
+}
+
+// WriteStamped - add a record for key to the segment. A later record for the same key replaces it
+func (segmentWriter *SegmentWriter) WriteStamped(key string, value []byte, meta Meta, stamp Stamp) (err error) {
+	record, err := encodeRecord(KeyWritten, key, value, meta, stamp)
+	if err != nil {
+		return
+	}
+	location := segmentWriter.offset
+	if err = segmentWriter.write(record); err != nil {
+		return
+	}
+	segmentWriter.fileMap[key] = location
+	if stamp.Seq > segmentWriter.lastSeq {
+		segmentWriter.lastSeq = stamp.Seq
+	}
+	return
+}
+
+// Size - how big the segment is so far, including anything still buffered
+func (segmentWriter *SegmentWriter) Size() int64 {
+	return segmentWriter.offset
+}
+
+// LastSeq - the highest Stamp.Seq written to the segment
+func (segmentWriter *SegmentWriter) LastSeq() uint64 {
+	return segmentWriter.lastSeq
+}
+
+// FileName - the segment's file name
+func (segmentWriter *SegmentWriter) FileName() string {
+	return segmentWriter.fileName
+}
+
+// Close - write out anything buffered, sync the segment to disk and write its hint file. Nothing
+// can be written afterwards
+func (segmentWriter *SegmentWriter) Close() (err error) {
+	if err = segmentWriter.writer.Flush(); err != nil {
+		segmentWriter.file.Close()
+		return
+	}
+	if err = segmentWriter.file.Sync(); err != nil {
+		segmentWriter.file.Close()
+		return
+	}
+	if err = segmentWriter.file.Close(); err != nil {
+		return
+	}
+	return writeHints(segmentWriter.fsys, segmentWriter.fileName, segmentWriter.header, segmentWriter.offset, segmentWriter.lastSeq, segmentWriter.fileMap)
+}
+
+// Abort - give up on the segment, removing it and any hint file. Safe to call after Close
+func (segmentWriter *SegmentWriter) Abort() {
+	segmentWriter.file.Close()
+	segmentWriter.fsys.Remove(segmentWriter.fileName)
+	segmentWriter.fsys.Remove(HintFileName(segmentWriter.fileName))
+	segmentWriter.fsys.Remove(HintFileName(segmentWriter.fileName) + ".tmp")
+}
+
+func (segmentWriter *SegmentWriter) write(data []byte) (err error) {
+	n, err := segmentWriter.writer.Write(data)
+	segmentWriter.offset += int64(n)
+	return
+}
@@ -0,0 +1,309 @@
+// Package gkmerkle finds and repairs differences between the copies of a store on two gokave
+// servers, such as a replica that has drifted from its primary after an outage.
+//
+// Each store can build a Merkle tree over its keys and values (see gkstore.KvStore.MerkleTree).
+// Comparing starts at the roots of the two trees and only goes down into the children whose hashes
+// differ, so two copies that mostly agree are compared in a handful of requests. The leaves that
+// differ hold the keys to repair. Repairing copies the other server's value, and its stamp, for
+// each such key, and deletes the keys the other server doesn't have.
+package gkmerkle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkclient"
+	"gokave/gklogfile"
+	"gokave/gkstore"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// reportKeys - the most keys listed in a StoreReport
+const reportKeys = 100
+
+// repairBatch - how many values are fetched from the other server at a time. The most _mget allows
+const repairBatch = 1000
+
+// Report - how the stores on this server compare with those on another
+type Report struct {
+	With   string        `json:"with"`
+	InSync bool          `json:"inSync"`
+	Stores []StoreReport `json:"stores"`
+}
+
+// StoreReport - how a store compares with its copy on another server. MissingHere counts keys
+// only the other server has, MissingThere keys only this one has and Differing keys whose values
+// or meta differ. Buckets is the number of Merkle tree leaves they are in
+type StoreReport struct {
+	Store        string   `json:"store"`
+	InSync       bool     `json:"inSync"`
+	LocalSeq     uint64   `json:"localSeq"`
+	RemoteSeq    uint64   `json:"remoteSeq"`
+	Buckets      int      `json:"buckets"`
+	MissingHere  int      `json:"missingHere"`
+	MissingThere int      `json:"missingThere"`
+	Differing    int      `json:"differing"`
+	Keys         []string `json:"keys,omitempty"` // some of the keys that differ
+	// Repaired is how many keys a repair wrote or deleted. Skipped keys changed on the other server
+	// while the repair ran or, on a replica, are newer than it has got to and are left to replication
+	Repaired int    `json:"repaired,omitempty"`
+	Skipped  int    `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// diff - the entries that differ between two copies of a store. missingHere and differing hold the
+// other server's entries, missingThere this server's
+type diff struct {
+	missingHere  []gkstore.MerkleEntry
+	missingThere []gkstore.MerkleEntry
+	differing    []gkstore.MerkleEntry
+}
+
+// Compare - compare the stores here with those on the server at with. An empty storeName compares
+// every store either server has
+func Compare(ctx context.Context, db *gokave.DB, with string, storeName string) (report Report, err error) {
+	return run(ctx, db, with, storeName, false)
+}
+
+// Repair - make the stores here match those on the server at from, creating any that only it has.
+// Stores that only this server has are left alone. An empty storeName repairs every store.
+// Repairing a replica is allowed, and only touches the changes it has already been sent
+func Repair(ctx context.Context, db *gokave.DB, from string, storeName string) (report Report, err error) {
+	return run(ctx, db, from, storeName, true)
+}
+
+func run(ctx context.Context, db *gokave.DB, with string, storeName string, repair bool) (report Report, err error) {
+	remote, err := gkclient.New(with)
+	if err != nil {
+		return
+	}
+	storeNames := []string{storeName}
+	if storeName == "" {
+		if storeNames, err = allStores(ctx, db, remote); err != nil {
+			return
+		}
+	}
+
+	report = Report{With: with, InSync: true, Stores: []StoreReport{}}
+	for _, storeName := range storeNames {
+		storeReport, err := compareStore(ctx, db, remote, storeName, repair)
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, err
+			}
+			storeReport.Error = err.Error()
+		}
+		report.InSync = report.InSync && storeReport.InSync
+		report.Stores = append(report.Stores, storeReport)
+	}
+	return
+}
+
+// allStores - the stores on either server
+func allStores(ctx context.Context, db *gokave.DB, remote *gkclient.Client) (storeNames []string, err error) {
+	local, err := db.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	other, err := remote.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, storeName := range append(local, other...) {
+		if !seen[storeName] {
+			seen[storeName] = true
+			storeNames = append(storeNames, storeName)
+		}
+	}
+	sort.Strings(storeNames)
+	return
+}
+
+func compareStore(ctx context.Context, db *gokave.DB, remote *gkclient.Client, storeName string, repair bool) (report StoreReport, err error) {
+	report.Store = storeName
+	store, err := db.OpenStore(ctx, storeName)
+	if errors.Is(err, gokave.ErrStoreNotFound) && repair {
+		if store, err = createStore(ctx, db, remote, storeName); err != nil {
+			return
+		}
+	}
+	if errors.Is(err, gokave.ErrStoreNotFound) {
+		return report, fmt.Errorf("Store not found here")
+	}
+	if err != nil {
+		return
+	}
+	tree, err := store.MerkleTree(ctx)
+	if err != nil {
+		return
+	}
+	report.LocalSeq = tree.Seq
+
+	var d diff
+	if err = walk(ctx, remote, storeName, tree, "", &report, &d); err != nil {
+		if errors.Is(err, gkclient.ErrNotFound) {
+			err = fmt.Errorf("Store not found on the other server")
+		}
+		return
+	}
+	report.MissingHere, report.MissingThere, report.Differing = len(d.missingHere), len(d.missingThere), len(d.differing)
+	report.InSync = report.Buckets == 0
+	for _, entries := range [][]gkstore.MerkleEntry{d.differing, d.missingHere, d.missingThere} {
+		for _, entry := range entries {
+			if len(report.Keys) < reportKeys {
+				report.Keys = append(report.Keys, entry.Key)
+			}
+		}
+	}
+	if repair && !report.InSync {
+		err = repairStore(ctx, db, remote, storeName, tree.Seq, d, &report)
+	}
+	return
+}
+
+// createStore - create a store only the other server has, with the same settings
+func createStore(ctx context.Context, db *gokave.DB, remote *gkclient.Client, storeName string) (store *gokave.Store, err error) {
+	remoteConfig, err := remote.DescribeStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Repair: creating store %s\n", storeName)
+	storeConfig := gokave.StoreConfig{Name: remoteConfig.Name, Codec: remoteConfig.Codec, KeyCase: remoteConfig.KeyCase}
+	if err = db.Replication().EnsureStore(ctx, storeConfig); err != nil {
+		return
+	}
+	return db.OpenStore(ctx, storeName)
+}
+
+// walk - compare the node at path with the other server's, going down into the children that
+// differ and collecting the entries of the leaves that do
+func walk(ctx context.Context, remote *gkclient.Client, storeName string, tree *gkstore.MerkleTree, path string, report *StoreReport, d *diff) (err error) {
+	local, err := tree.Node(path)
+	if err != nil {
+		return
+	}
+	other, err := remote.MerkleNode(ctx, storeName, path)
+	if err != nil {
+		return
+	}
+	if path == "" {
+		report.RemoteSeq = other.Seq
+	}
+	if local.Hash == other.Hash {
+		return
+	}
+	if len(path) == gkstore.MerkleDepth {
+		report.Buckets++
+		diffEntries(local.Entries, other.Entries, d)
+		return
+	}
+	if len(other.Children) != len(local.Children) {
+		return fmt.Errorf("Merkle tree node %q has %d children on the other server, %d here", path, len(other.Children), len(local.Children))
+	}
+	for i, child := range local.Children {
+		if child != other.Children[i] {
+			if err = walk(ctx, remote, storeName, tree, path+strconv.FormatInt(int64(i), gkstore.MerkleFanout), report, d); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func diffEntries(local []gkstore.MerkleEntry, other []gkstore.MerkleEntry, d *diff) {
+	here := make(map[string]gkstore.MerkleEntry, len(local))
+	for _, entry := range local {
+		here[entry.Key] = entry
+	}
+	for _, entry := range other {
+		localEntry, ok := here[entry.Key]
+		switch {
+		case !ok:
+			d.missingHere = append(d.missingHere, entry)
+		case localEntry.Digest != entry.Digest:
+			d.differing = append(d.differing, entry)
+		}
+		delete(here, entry.Key)
+	}
+	for _, entry := range local {
+		if _, ok := here[entry.Key]; ok {
+			d.missingThere = append(d.missingThere, entry)
+		}
+	}
+}
+
+// repairStore - copy the other server's values for the keys that differ, and delete the keys it
+// doesn't have. A replica keeps the other server's stamps so that its sequence numbers still match
+// its primary's, and leaves the changes after lastSeq, the last it has been sent, to replication.
+// Anywhere else the repairs are new changes, so the server's own replicas and watches see them
+func repairStore(ctx context.Context, db *gokave.DB, remote *gkclient.Client, storeName string, lastSeq uint64, d diff, report *StoreReport) (err error) {
+	replica := db.IsReplica()
+	var records []gklogfile.Record
+	var fetch []gkstore.MerkleEntry
+	for _, entry := range append(append([]gkstore.MerkleEntry(nil), d.missingHere...), d.differing...) {
+		if replica && entry.Seq > lastSeq {
+			report.Skipped++
+			continue
+		}
+		fetch = append(fetch, entry)
+	}
+	for start := 0; start < len(fetch); start += repairBatch {
+		batch := fetch[start:min(start+repairBatch, len(fetch))]
+		keys := make([]string, len(batch))
+		for i, entry := range batch {
+			keys[i] = entry.Key
+		}
+		results, err := remote.GetMany(ctx, storeName, keys)
+		if err != nil {
+			return err
+		}
+		for _, entry := range batch {
+			result := results[entry.Key]
+			if result.Status != gkclient.ResultFound {
+				report.Skipped++
+				continue
+			}
+			meta := gokave.Meta(result.Meta)
+			if result.ContentType != "" {
+				if meta == nil {
+					meta = make(gokave.Meta)
+				}
+				meta[gokave.MetaContentType] = result.ContentType
+			}
+			records = append(records, gklogfile.Record{
+				EntryType: gklogfile.KeyWritten,
+				Key:       entry.Key,
+				Value:     result.Value,
+				Meta:      meta,
+				Stamp:     gklogfile.Stamp{Seq: entry.Seq, Time: entry.Time},
+			})
+		}
+	}
+	// A replica's deletes take the sequence number of the record they replace
+	for _, entry := range d.missingThere {
+		records = append(records, gklogfile.Record{EntryType: gklogfile.KeyDeleted, Key: entry.Key, Stamp: gklogfile.Stamp{Seq: entry.Seq, Time: time.Now().UTC()}})
+	}
+	if !replica {
+		for i := range records {
+			records[i].Stamp = gklogfile.Stamp{}
+		}
+	}
+
+	fmt.Printf("Repair: store %s: %d keys to write or delete\n", storeName, len(records))
+	if err = db.Replication().Repair(ctx, storeName, records); err != nil {
+		return
+	}
+	report.Repaired = len(records)
+	return
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
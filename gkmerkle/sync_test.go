@@ -0,0 +1,45 @@
+package gkmerkle
+
+import (
+	"gokave/gkstore"
+	"testing"
+)
+
+// keysOf - the keys of entries, in order
+func keysOf(entries []gkstore.MerkleEntry) (keys []string) {
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return
+}
+
+func TestDiffEntries(t *testing.T) {
+	local := []gkstore.MerkleEntry{{Key: "a", Digest: "1"}, {Key: "b", Digest: "2"}, {Key: "c", Digest: "3"}, {Key: "e", Digest: "5"}}
+	other := []gkstore.MerkleEntry{{Key: "a", Digest: "1"}, {Key: "b", Digest: "changed"}, {Key: "d", Digest: "4"}, {Key: "e", Digest: "5"}}
+	var d diff
+	diffEntries(local, other, &d)
+
+	for _, test := range []struct {
+		name     string
+		entries  []gkstore.MerkleEntry
+		expected string
+	}{
+		{"missing here", d.missingHere, "d"},
+		{"missing there", d.missingThere, "c"},
+		{"differing", d.differing, "b"},
+	} {
+		if keys := keysOf(test.entries); len(keys) != 1 || keys[0] != test.expected {
+			t.Errorf("%s: %v, expected [%s]", test.name, keys, test.expected)
+		}
+	}
+	// The other server's entry is kept for a differing key, as that is the one repaired from
+	if d.differing[0].Digest != "changed" {
+		t.Errorf("Differing entry: %+v", d.differing[0])
+	}
+
+	d = diff{}
+	diffEntries(local, local, &d)
+	if d.missingHere != nil || d.missingThere != nil || d.differing != nil {
+		t.Errorf("Matching entries: %+v", d)
+	}
+}
@@ -0,0 +1,143 @@
+package gkraft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// RPCPath - where HTTPHandler is served on each member, below the member's address
+const RPCPath = "/v1/raft/"
+
+// The requests HTTPHandler serves, below RPCPath
+const (
+	rpcVote     = "vote"
+	rpcAppend   = "append"
+	rpcSnapshot = "snapshot"
+)
+
+// HTTPTransport - a Transport that POSTs JSON requests to RPCPath at each member's address, e.g.
+// http://localhost:8081/v1/raft/append
+type HTTPTransport struct {
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// RequestVote - see Transport
+func (transport *HTTPTransport) RequestVote(ctx context.Context, member Member, request *VoteRequest) (response *VoteResponse, err error) {
+	response = &VoteResponse{}
+	return response, transport.call(ctx, member, rpcVote, request, response)
+}
+
+// AppendEntries - see Transport
+func (transport *HTTPTransport) AppendEntries(ctx context.Context, member Member, request *AppendRequest) (response *AppendResponse, err error) {
+	response = &AppendResponse{}
+	return response, transport.call(ctx, member, rpcAppend, request, response)
+}
+
+// InstallSnapshot - see Transport
+func (transport *HTTPTransport) InstallSnapshot(ctx context.Context, member Member, request *SnapshotRequest) (response *SnapshotResponse, err error) {
+	response = &SnapshotResponse{}
+	return response, transport.call(ctx, member, rpcSnapshot, request, response)
+}
+
+func (transport *HTTPTransport) call(ctx context.Context, member Member, rpc string, request interface{}, response interface{}) (err error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(member.Addr, "/")+RPCPath+rpc, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("Content-Type", "application/json")
+	client := transport.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnreachable, err)
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnreachable, err)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s %s", member.ID, rpc, httpResponse.Status, strings.TrimSpace(string(responseBody)))
+	}
+	return json.Unmarshal(responseBody, response)
+}
+
+// HTTPHandler - serve requests from an HTTPTransport to node. It expects the paths below RPCPath
+func HTTPHandler(node *Node) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, httpRequest *http.Request) {
+		if httpRequest.Method != http.MethodPost {
+			http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var response interface{}
+		var err error
+		switch rpc := httpRequest.URL.Path[strings.LastIndex(httpRequest.URL.Path, "/")+1:]; rpc {
+		case rpcVote:
+			request := &VoteRequest{}
+			if err = decodeRequest(httpRequest, request); err == nil {
+				response, err = node.HandleVote(request)
+			}
+		case rpcAppend:
+			request := &AppendRequest{}
+			if err = decodeRequest(httpRequest, request); err == nil {
+				response, err = node.HandleAppend(request)
+			}
+		case rpcSnapshot:
+			request := &SnapshotRequest{}
+			if err = decodeRequest(httpRequest, request); err == nil {
+				response, err = node.HandleSnapshot(request)
+			}
+		default:
+			http.Error(responseWriter, fmt.Sprintf("Unknown raft request: %s", rpc), http.StatusNotFound)
+			return
+		}
+
+		var badRequest *badRequestError
+		switch {
+		case errors.As(err, &badRequest):
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrStopped):
+			http.Error(responseWriter, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(body)
+	})
+}
+
+type badRequestError struct {
+	err error
+}
+
+func (e *badRequestError) Error() string {
+	return fmt.Sprintf("Bad raft request: %s", e.err)
+}
+
+func decodeRequest(httpRequest *http.Request, request interface{}) error {
+	if err := json.NewDecoder(httpRequest.Body).Decode(request); err != nil {
+		return &badRequestError{err: err}
+	}
+	return nil
+}
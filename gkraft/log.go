@@ -0,0 +1,228 @@
+package gkraft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrCompacted means log entries asked for have been folded into a snapshot and discarded
+var ErrCompacted = errors.New("Log entries compacted")
+
+// ErrUnavailable means log entries asked for haven't been written yet
+var ErrUnavailable = errors.New("Log entries unavailable")
+
+// EntryType - what a log entry holds
+type EntryType uint8
+
+// Entry types
+const (
+	EntryCommand    EntryType = iota + 1 // a command for the StateMachine
+	EntryNoop                            // written by a new leader to commit the entries of earlier terms
+	EntryMembership                      // a Membership, which takes effect as soon as it is in the log
+)
+
+// Entry - one entry in the replicated log
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Member - a node in the cluster. Addr is whatever the Transport needs to reach it, for the HTTP
+// transport the base URL of its gokave server
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// Membership - the nodes that vote in elections and count towards a majority
+type Membership struct {
+	Members []Member `json:"members"`
+}
+
+// Contains - whether id is a member
+func (membership Membership) Contains(id string) bool {
+	_, ok := membership.Lookup(id)
+	return ok
+}
+
+// Lookup - the member called id
+func (membership Membership) Lookup(id string) (member Member, ok bool) {
+	for _, member := range membership.Members {
+		if member.ID == id {
+			return member, true
+		}
+	}
+	return
+}
+
+// with - the membership with member added, or its address updated
+func (membership Membership) with(member Member) Membership {
+	updated := Membership{}
+	for _, m := range membership.Members {
+		if m.ID != member.ID {
+			updated.Members = append(updated.Members, m)
+		}
+	}
+	updated.Members = append(updated.Members, member)
+	return updated
+}
+
+// without - the membership with the member called id removed
+func (membership Membership) without(id string) Membership {
+	updated := Membership{}
+	for _, m := range membership.Members {
+		if m.ID != id {
+			updated.Members = append(updated.Members, m)
+		}
+	}
+	return updated
+}
+
+func decodeMembership(data []byte) (membership Membership, err error) {
+	if err = json.Unmarshal(data, &membership); err != nil {
+		return membership, fmt.Errorf("Bad membership entry: %s", err)
+	}
+	return
+}
+
+// HardState - what a node has to remember across restarts besides its log
+type HardState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// SnapshotMeta - where a snapshot leaves off in the log and the membership at that point
+type SnapshotMeta struct {
+	Index      uint64
+	Term       uint64
+	Membership Membership
+}
+
+// Storage - where a node keeps its log, hard state and latest snapshot. Every change has to be
+// durable before the method returns. A Node serialises its calls so implementations needn't be safe
+// for concurrent use
+type Storage interface {
+	HardState() (HardState, error)
+	SetHardState(hardState HardState) error
+	// FirstIndex is the index of the first entry still in the log, one after the snapshot
+	FirstIndex() uint64
+	// LastIndex is the index of the last entry, or of the snapshot if the log is empty
+	LastIndex() uint64
+	// Term is the term of the entry at index, which may be the last one in the snapshot
+	Term(index uint64) (uint64, error)
+	// Entries are those from lo up to but not including hi
+	Entries(lo uint64, hi uint64) ([]Entry, error)
+	// Append adds entries to the log. Any entries already at or after the first one's index are
+	// replaced
+	Append(entries []Entry) error
+	Snapshot() (SnapshotMeta, []byte, error)
+	// SaveSnapshot replaces the snapshot and discards the entries it covers. If the log doesn't
+	// hold the snapshot's last entry the whole log is discarded
+	SaveSnapshot(meta SnapshotMeta, data []byte) error
+}
+
+// MemoryStorage - Storage that only lasts as long as the process. For trying clusters out in-process
+type MemoryStorage struct {
+	hardState    HardState
+	snapshotMeta SnapshotMeta
+	snapshotData []byte
+	entries      []Entry // following snapshotMeta.Index
+}
+
+// NewMemoryStorage - an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// HardState - see Storage
+func (storage *MemoryStorage) HardState() (HardState, error) {
+	return storage.hardState, nil
+}
+
+// SetHardState - see Storage
+func (storage *MemoryStorage) SetHardState(hardState HardState) error {
+	storage.hardState = hardState
+	return nil
+}
+
+// FirstIndex - see Storage
+func (storage *MemoryStorage) FirstIndex() uint64 {
+	return storage.snapshotMeta.Index + 1
+}
+
+// LastIndex - see Storage
+func (storage *MemoryStorage) LastIndex() uint64 {
+	return storage.snapshotMeta.Index + uint64(len(storage.entries))
+}
+
+// Term - see Storage
+func (storage *MemoryStorage) Term(index uint64) (uint64, error) {
+	switch {
+	case index == storage.snapshotMeta.Index:
+		return storage.snapshotMeta.Term, nil
+	case index < storage.snapshotMeta.Index:
+		return 0, ErrCompacted
+	case index > storage.LastIndex():
+		return 0, ErrUnavailable
+	}
+	return storage.entries[index-storage.FirstIndex()].Term, nil
+}
+
+// Entries - see Storage
+func (storage *MemoryStorage) Entries(lo uint64, hi uint64) ([]Entry, error) {
+	if lo < storage.FirstIndex() {
+		return nil, ErrCompacted
+	}
+	if hi > storage.LastIndex()+1 {
+		return nil, ErrUnavailable
+	}
+	if lo >= hi {
+		return nil, nil
+	}
+	return append([]Entry(nil), storage.entries[lo-storage.FirstIndex():hi-storage.FirstIndex()]...), nil
+}
+
+// Append - see Storage
+func (storage *MemoryStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	keep, err := storage.keep(entries[0].Index)
+	if err != nil {
+		return err
+	}
+	storage.entries = append(storage.entries[:keep], entries...)
+	return nil
+}
+
+// keep - how many entries to keep when appending entries starting at index
+func (storage *MemoryStorage) keep(index uint64) (int, error) {
+	if index < storage.FirstIndex() || index > storage.LastIndex()+1 {
+		return 0, fmt.Errorf("Can't append entry %d to a log holding %d to %d", index, storage.FirstIndex(), storage.LastIndex())
+	}
+	return int(index - storage.FirstIndex()), nil
+}
+
+// Snapshot - see Storage
+func (storage *MemoryStorage) Snapshot() (SnapshotMeta, []byte, error) {
+	return storage.snapshotMeta, storage.snapshotData, nil
+}
+
+// SaveSnapshot - see Storage
+func (storage *MemoryStorage) SaveSnapshot(meta SnapshotMeta, data []byte) error {
+	storage.entries = storage.remaining(meta)
+	storage.snapshotMeta, storage.snapshotData = meta, data
+	return nil
+}
+
+// remaining - the entries left after a snapshot to meta.Index
+func (storage *MemoryStorage) remaining(meta SnapshotMeta) []Entry {
+	term, err := storage.Term(meta.Index)
+	if err != nil || term != meta.Term {
+		return nil
+	}
+	return append([]Entry(nil), storage.entries[meta.Index-storage.snapshotMeta.Index:]...)
+}
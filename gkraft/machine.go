@@ -0,0 +1,201 @@
+package gkraft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gokave"
+	"gokave/gklogfile"
+)
+
+// Command operations
+const (
+	OpPut            = "put"
+	OpDelete         = "delete"
+	OpCreateStore    = "createStore"
+	OpDeleteStore    = "deleteStore"
+	OpMigrateKeyCase = "migrateKeyCase"
+)
+
+// snapshotReadBytes - how much of a segment is read at a time when taking a snapshot
+const snapshotReadBytes = 1 << 20
+
+// applyBatch - how many records are applied at a time when restoring a snapshot
+const applyBatch = 1024
+
+// Command - a change to a gokave.DB, as held in the log. The migrateKeyCase result is the number
+// of keys rewritten
+type Command struct {
+	Op      string      `json:"op"`
+	Store   string      `json:"store"`
+	Key     string      `json:"key,omitempty"`
+	Value   []byte      `json:"value,omitempty"`
+	Meta    gokave.Meta `json:"meta,omitempty"`
+	Codec   string      `json:"codec,omitempty"`
+	KeyCase string      `json:"keyCase,omitempty"`
+}
+
+// ProposeCommand - propose command to node and wait for the DBMachine to apply it. See Node.Propose
+func ProposeCommand(ctx context.Context, node *Node, command Command) (result interface{}, err error) {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return
+	}
+	return node.Propose(ctx, data)
+}
+
+// DBMachine - a StateMachine applying Commands to a DB. Nothing else should write to the DB.
+// Snapshots hold each store's records as they stand after compaction
+type DBMachine struct {
+	db *gokave.DB
+}
+
+// NewDBMachine - a DBMachine for db
+func NewDBMachine(db *gokave.DB) *DBMachine {
+	return &DBMachine{db: db}
+}
+
+// Apply - see StateMachine
+func (machine *DBMachine) Apply(data []byte) (result interface{}, err error) {
+	var command Command
+	if err = json.Unmarshal(data, &command); err != nil {
+		return nil, fmt.Errorf("Bad command: %s", err)
+	}
+	ctx := context.Background()
+	db := machine.db
+	switch command.Op {
+	case OpPut:
+		err = db.WriteMeta(ctx, command.Store, command.Key, command.Value, command.Meta)
+	case OpDelete:
+		err = db.Delete(ctx, command.Store, command.Key)
+	case OpCreateStore:
+		var opts []gokave.StoreOption
+		if command.Codec != "" {
+			opts = append(opts, gokave.WithCodecName(command.Codec))
+		}
+		if command.KeyCase != "" {
+			opts = append(opts, gokave.WithKeyCase(command.KeyCase))
+		}
+		_, err = db.CreateStore(ctx, command.Store, opts...)
+	case OpDeleteStore:
+		err = db.DeleteStore(ctx, command.Store)
+	case OpMigrateKeyCase:
+		result, err = db.MigrateKeyCase(ctx, command.Store, command.KeyCase)
+	default:
+		err = fmt.Errorf("Unknown command: %s", command.Op)
+	}
+	return
+}
+
+// dbSnapshot - what DBMachine.Snapshot returns, as JSON
+type dbSnapshot struct {
+	Stores []storeSnapshot
+}
+
+type storeSnapshot struct {
+	Config gokave.StoreConfig
+	// Records are the store's segments one after another, oldest first, without their headers
+	Records []byte
+}
+
+// Snapshot - see StateMachine. Each store is compacted first so the snapshot holds little more
+// than the latest value of each key
+func (machine *DBMachine) Snapshot() (data []byte, err error) {
+	ctx := context.Background()
+	db := machine.db
+	storeNames, err := db.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	snapshot := dbSnapshot{Stores: []storeSnapshot{}}
+	for _, storeName := range storeNames {
+		store, err := db.OpenStore(ctx, storeName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = store.Compact(ctx); err != nil {
+			return nil, err
+		}
+		records, err := machine.storeRecords(ctx, storeName)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Stores = append(snapshot.Stores, storeSnapshot{Config: store.Config(), Records: records})
+	}
+	return json.Marshal(snapshot)
+}
+
+// storeRecords - the raw records in every segment of a store, oldest first
+func (machine *DBMachine) storeRecords(ctx context.Context, storeName string) (records []byte, err error) {
+	replication := machine.db.Replication()
+	segment, offset := "", int64(0)
+	for {
+		read, err := replication.ReadSegment(ctx, storeName, segment, offset, snapshotReadBytes)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, read.Data...)
+		switch {
+		case read.NextSegment != "":
+			segment, offset = read.NextSegment, 0
+		case len(read.Data) > 0:
+			segment, offset = read.Segment, read.Next
+		default:
+			return records, nil
+		}
+	}
+}
+
+// Restore - see StateMachine. Stores that aren't in the snapshot are deleted and the rest emptied
+// and filled from it, keeping the sequence numbers of their records
+func (machine *DBMachine) Restore(data []byte) (err error) {
+	var snapshot dbSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("Bad snapshot: %s", err)
+	}
+	ctx := context.Background()
+	db := machine.db
+	replication := db.Replication()
+
+	inSnapshot := make(map[string]bool, len(snapshot.Stores))
+	for _, store := range snapshot.Stores {
+		inSnapshot[store.Config.Name] = true
+	}
+	storeNames, err := db.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	for _, storeName := range storeNames {
+		if !inSnapshot[storeName] {
+			if err = replication.DeleteStore(ctx, storeName); err != nil {
+				return
+			}
+		}
+	}
+
+	for _, store := range snapshot.Stores {
+		storeName := store.Config.Name
+		if err = replication.EnsureStore(ctx, store.Config); err != nil {
+			return
+		}
+		if err = replication.ResetStore(ctx, storeName); err != nil {
+			return
+		}
+		var batch []gklogfile.Record
+		err = gklogfile.ScanFrom(bytes.NewReader(store.Records), 0, int64(len(store.Records)), true, func(record gklogfile.Record) (err error) {
+			if batch = append(batch, record); len(batch) == applyBatch {
+				_, err = replication.Apply(ctx, storeName, batch)
+				batch = batch[:0]
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		if _, err = replication.Apply(ctx, storeName, batch); err != nil {
+			return
+		}
+	}
+	return
+}
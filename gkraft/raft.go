@@ -0,0 +1,1170 @@
+// Package gkraft keeps several gokave nodes in agreement using the Raft consensus algorithm
+// (https://raft.github.io/raft.pdf).
+//
+// Every change is proposed to the leader as a command, appended to the replicated log and applied to
+// each node's StateMachine once a majority of the members have it. A node catching up from far
+// behind is sent a snapshot of the state machine rather than the whole log. Members are added and
+// removed one at a time through the log. ReadBarrier makes a read on the leader linearizable by
+// checking that it is still the leader before the read goes ahead.
+//
+// Nodes talk to each other through a Transport, either in-process (Network) or over HTTP
+// (HTTPTransport and HTTPHandler). DBMachine makes a gokave.DB the state machine.
+package gkraft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotLeader means the node isn't the leader. Node.Leader says who is, if anyone
+var ErrNotLeader = errors.New("Not the leader")
+
+// ErrLeadershipLost means the node stopped being the leader before a proposal was committed. It
+// may or may not have been applied
+var ErrLeadershipLost = errors.New("Leadership lost before the entry was committed")
+
+// ErrStopped means the node has been stopped
+var ErrStopped = errors.New("Raft node stopped")
+
+// ErrMembershipChangePending means a membership change was asked for before the last one was committed
+var ErrMembershipChangePending = errors.New("A membership change is already in progress")
+
+// ErrNotMember means a member to be removed isn't in the cluster
+var ErrNotMember = errors.New("Not a member")
+
+// Default timings, suited to nodes on a local network
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultElectionTimeout   = time.Second
+	DefaultSnapshotThreshold = 4096
+	DefaultMaxEntries        = 256
+)
+
+// State - a node's role
+type State int
+
+// States
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (state State) String() string {
+	switch state {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// StateMachine - what the log's commands are applied to. Apply is only ever called for one command
+// at a time, in log order, and never at the same time as Snapshot or Restore. Applying the same
+// commands again from an earlier point has to end in the same state, as after a restart the log is
+// applied again from the last snapshot
+type StateMachine interface {
+	// Apply - apply a committed command. The result and error go back to Propose on the node where
+	// the command was proposed
+	Apply(command []byte) (result interface{}, err error)
+	// Snapshot - the whole state, for Restore
+	Snapshot() ([]byte, error)
+	// Restore - replace the whole state with a snapshot
+	Restore(snapshot []byte) error
+}
+
+// Config - the settings for a Node
+type Config struct {
+	ID        string
+	Storage   Storage
+	Transport Transport
+	Machine   StateMachine
+	// Bootstrap is the membership of a new cluster. It is only used when Storage is empty. A node
+	// joining an existing cluster starts without it and is added by the leader (Node.AddMember)
+	Bootstrap         []Member
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long a follower waits to hear from a leader before standing for
+	// election itself. The actual wait is randomised between it and twice it
+	ElectionTimeout time.Duration
+	// SnapshotThreshold is how many entries are applied between snapshots
+	SnapshotThreshold uint64
+	// MaxEntries is the most entries sent in one AppendRequest
+	MaxEntries int
+	// Logger is told of elections, snapshots and failures to reach other members. Nothing is
+	// logged without it
+	Logger *log.Logger
+}
+
+// Node - a member of a Raft cluster
+type Node struct {
+	config Config
+	mutex  sync.Mutex // guards everything below and calls to config.Storage
+
+	state           State
+	term            uint64
+	votedFor        string
+	leader          string
+	commitIndex     uint64
+	lastApplied     uint64
+	membership      Membership // the latest in the log, which is the one in effect
+	membershipIndex uint64     // where membership came from in the log
+	lastContact     time.Time  // when the leader was last heard from
+	electionTime    time.Time  // when to stand for election if the leader hasn't been heard from
+
+	peers   map[string]*peer // leader only, every member but this one
+	pending map[uint64]*proposal
+
+	changed chan struct{} // closed and replaced whenever anything waited for changes. See notify
+	stop    chan struct{}
+	stopped bool
+	group   sync.WaitGroup
+	ctx     context.Context // cancelled by Stop, for requests to other members
+	cancel  context.CancelFunc
+}
+
+// peer - the leader's view of another member
+type peer struct {
+	member     Member
+	nextIndex  uint64
+	matchIndex uint64
+	lastAck    time.Time // when the last request the member answered as a follower was sent
+	trigger    chan struct{}
+	stop       chan struct{}
+}
+
+type proposal struct {
+	term uint64
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	result interface{}
+	err    error
+}
+
+// Status - a node's view of the cluster
+type Status struct {
+	ID            string                `json:"id"`
+	State         string                `json:"state"`
+	Term          uint64                `json:"term"`
+	Leader        string                `json:"leader,omitempty"`
+	LeaderAddr    string                `json:"leaderAddr,omitempty"`
+	CommitIndex   uint64                `json:"commitIndex"`
+	LastApplied   uint64                `json:"lastApplied"`
+	LastIndex     uint64                `json:"lastIndex"`
+	SnapshotIndex uint64                `json:"snapshotIndex"`
+	Members       []Member              `json:"members"`
+	Peers         map[string]PeerStatus `json:"peers,omitempty"`
+}
+
+// PeerStatus - how far the leader has got replicating to another member
+type PeerStatus struct {
+	MatchIndex uint64 `json:"matchIndex"`
+	NextIndex  uint64 `json:"nextIndex"`
+}
+
+// NewNode - start a node. It carries on from whatever is in config.Storage, replaying the log from
+// the last snapshot into config.Machine
+func NewNode(config Config) (node *Node, err error) {
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if config.MaxEntries == 0 {
+		config.MaxEntries = DefaultMaxEntries
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	node = &Node{
+		config:  config,
+		pending: make(map[uint64]*proposal),
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	node.ctx, node.cancel = context.WithCancel(context.Background())
+	storage := config.Storage
+	hardState, err := storage.HardState()
+	if err != nil {
+		return nil, err
+	}
+	node.term, node.votedFor = hardState.Term, hardState.VotedFor
+	snapshotMeta, _, err := storage.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	node.commitIndex = snapshotMeta.Index
+
+	if storage.LastIndex() == 0 && len(config.Bootstrap) > 0 {
+		// Every node of a new cluster starts with the same first entry so their logs agree
+		data, err := json.Marshal(Membership{Members: config.Bootstrap})
+		if err != nil {
+			return nil, err
+		}
+		if err = storage.Append([]Entry{{Index: 1, Term: 1, Type: EntryMembership, Data: data}}); err != nil {
+			return nil, err
+		}
+		if node.term == 0 {
+			node.term = 1
+			if err = node.persist(); err != nil {
+				return nil, err
+			}
+		}
+		node.commitIndex = 1
+	}
+	if err = node.loadMembership(); err != nil {
+		return nil, err
+	}
+
+	node.lastContact = time.Now()
+	node.resetElectionTime()
+	node.logf("starting at term %d with log %d-%d", node.term, storage.FirstIndex(), storage.LastIndex())
+	node.group.Add(2)
+	go node.run()
+	go node.applyCommitted()
+	return
+}
+
+// Stop - stop taking part in the cluster. Waits for the command being applied, if any
+func (node *Node) Stop() {
+	node.mutex.Lock()
+	if node.stopped {
+		node.mutex.Unlock()
+		return
+	}
+	node.stopped = true
+	close(node.stop)
+	node.cancel()
+	node.stopPeers()
+	node.mutex.Unlock()
+	node.group.Wait()
+	node.logf("stopped")
+}
+
+// ID - the node's member ID
+func (node *Node) ID() string {
+	return node.config.ID
+}
+
+// IsLeader - whether the node thinks it is the leader. Only ReadBarrier can be sure
+func (node *Node) IsLeader() bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.state == Leader
+}
+
+// Leader - the leader as far as the node knows
+func (node *Node) Leader() (leader Member, ok bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.leader == "" {
+		return
+	}
+	return node.membership.Lookup(node.leader)
+}
+
+// Status - see Status
+func (node *Node) Status() Status {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	status := Status{
+		ID:            node.config.ID,
+		State:         node.state.String(),
+		Term:          node.term,
+		Leader:        node.leader,
+		CommitIndex:   node.commitIndex,
+		LastApplied:   node.lastApplied,
+		LastIndex:     node.config.Storage.LastIndex(),
+		SnapshotIndex: node.config.Storage.FirstIndex() - 1,
+		Members:       append([]Member{}, node.membership.Members...),
+	}
+	if leader, ok := node.membership.Lookup(node.leader); ok {
+		status.LeaderAddr = leader.Addr
+	}
+	if node.state == Leader {
+		status.Peers = make(map[string]PeerStatus, len(node.peers))
+		for id, p := range node.peers {
+			status.Peers[id] = PeerStatus{MatchIndex: p.matchIndex, NextIndex: p.nextIndex}
+		}
+	}
+	return status
+}
+
+// Propose - append a command to the log and wait for it to be applied. Returns what the state
+// machine returned. Only the leader takes proposals, the rest fail with ErrNotLeader
+func (node *Node) Propose(ctx context.Context, command []byte) (result interface{}, err error) {
+	node.mutex.Lock()
+	if node.stopped {
+		node.mutex.Unlock()
+		return nil, ErrStopped
+	}
+	if node.state != Leader {
+		node.mutex.Unlock()
+		return nil, ErrNotLeader
+	}
+	index, err := node.appendEntry(EntryCommand, command)
+	if err != nil {
+		node.mutex.Unlock()
+		return
+	}
+	p := &proposal{term: node.term, done: make(chan proposalResult, 1)}
+	node.pending[index] = p
+	node.mutex.Unlock()
+
+	select {
+	case r := <-p.done:
+		return r.result, r.err
+	case <-ctx.Done():
+		node.mutex.Lock()
+		delete(node.pending, index)
+		node.mutex.Unlock()
+		return nil, ctx.Err()
+	case <-node.stop:
+		return nil, ErrStopped
+	}
+}
+
+// ReadBarrier - wait until a read of the state machine will see every command committed before
+// ReadBarrier was called, which makes the read linearizable. Only the leader can do this: it
+// checks with a majority that it is still the leader and then waits for what it had committed to
+// be applied
+func (node *Node) ReadBarrier(ctx context.Context) (err error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.state != Leader {
+		return ErrNotLeader
+	}
+	term := node.term
+
+	// A new leader only knows what has been committed once an entry of its own term has been
+	if err = node.waitFor(ctx, func() (bool, error) {
+		if node.state != Leader || node.term != term {
+			return false, ErrLeadershipLost
+		}
+		commitTerm, err := node.config.Storage.Term(node.commitIndex)
+		return err == nil && commitTerm == term, nil
+	}); err != nil {
+		return
+	}
+	readIndex := node.commitIndex
+
+	round := time.Now()
+	node.triggerPeers()
+	if err = node.waitFor(ctx, func() (bool, error) {
+		if node.state != Leader || node.term != term {
+			return false, ErrLeadershipLost
+		}
+		return node.acknowledged(round), nil
+	}); err != nil {
+		return
+	}
+
+	return node.waitFor(ctx, func() (bool, error) {
+		return node.lastApplied >= readIndex, nil
+	})
+}
+
+// AddMember - add a member to the cluster, or change its address. Returns once the change is
+// committed. Only the leader can do this and only one change can be in progress at a time
+func (node *Node) AddMember(ctx context.Context, member Member) error {
+	if member.ID == "" || member.Addr == "" {
+		return errors.New("A member needs an ID and an address")
+	}
+	return node.changeMembership(ctx, func(membership Membership) (Membership, error) {
+		return membership.with(member), nil
+	})
+}
+
+// RemoveMember - remove a member from the cluster. A leader removing itself steps down once the
+// change is committed
+func (node *Node) RemoveMember(ctx context.Context, id string) error {
+	return node.changeMembership(ctx, func(membership Membership) (Membership, error) {
+		if !membership.Contains(id) {
+			return membership, ErrNotMember
+		}
+		return membership.without(id), nil
+	})
+}
+
+func (node *Node) changeMembership(ctx context.Context, change func(membership Membership) (Membership, error)) (err error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.state != Leader {
+		return ErrNotLeader
+	}
+	term := node.term
+	// Changes go one at a time, and not until the leader has committed an entry of its own term
+	commitTerm, err := node.config.Storage.Term(node.commitIndex)
+	if node.membershipIndex > node.commitIndex || err != nil || commitTerm != term {
+		return ErrMembershipChangePending
+	}
+	membership, err := change(node.membership)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(membership)
+	if err != nil {
+		return
+	}
+	index, err := node.appendEntry(EntryMembership, data)
+	if err != nil {
+		return
+	}
+	return node.waitFor(ctx, func() (bool, error) {
+		if node.commitIndex >= index {
+			if entryTerm, err := node.config.Storage.Term(index); err == nil && entryTerm != term {
+				return false, ErrLeadershipLost
+			}
+			return true, nil
+		}
+		if node.term != term {
+			return false, ErrLeadershipLost
+		}
+		return false, nil
+	})
+}
+
+// HandleVote - answer a VoteRequest from another member
+func (node *Node) HandleVote(request *VoteRequest) (response *VoteResponse, err error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.stopped {
+		return nil, ErrStopped
+	}
+	// While a leader is being heard from a candidate is ignored, so a removed member that no
+	// longer hears from the leader can't force elections on the rest
+	if request.Term > node.term && (node.state == Leader || (node.leader != "" && time.Since(node.lastContact) < node.config.ElectionTimeout)) {
+		return &VoteResponse{Term: node.term}, nil
+	}
+	if request.Term > node.term {
+		if err = node.becomeFollower(request.Term, ""); err != nil {
+			return
+		}
+	}
+	response = &VoteResponse{Term: node.term}
+	if request.Term < node.term || (node.votedFor != "" && node.votedFor != request.Candidate) {
+		return
+	}
+	storage := node.config.Storage
+	lastIndex := storage.LastIndex()
+	lastTerm, err := storage.Term(lastIndex)
+	if err != nil {
+		return
+	}
+	if request.LastLogTerm < lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex < lastIndex) {
+		return
+	}
+	node.votedFor = request.Candidate
+	if err = node.persist(); err != nil {
+		return nil, err
+	}
+	node.resetElectionTime()
+	response.Granted = true
+	return
+}
+
+// HandleAppend - take log entries, or a heartbeat, from the leader
+func (node *Node) HandleAppend(request *AppendRequest) (response *AppendResponse, err error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.stopped {
+		return nil, ErrStopped
+	}
+	storage := node.config.Storage
+	response = &AppendResponse{Term: node.term, LastIndex: storage.LastIndex()}
+	if request.Term < node.term {
+		return
+	}
+	if err = node.heardFromLeader(request.Term, request.Leader); err != nil {
+		return nil, err
+	}
+	response.Term = node.term
+
+	if request.PrevLogIndex > storage.LastIndex() {
+		return
+	}
+	snapshotIndex := storage.FirstIndex() - 1
+	if request.PrevLogIndex > snapshotIndex {
+		if prevTerm, err := storage.Term(request.PrevLogIndex); err != nil || prevTerm != request.PrevLogTerm {
+			response.LastIndex = request.PrevLogIndex - 1
+			return response, nil
+		}
+	}
+
+	// Skip what the log already has, then replace whatever disagrees with the leader
+	entries := request.Entries
+	for len(entries) > 0 {
+		entry := entries[0]
+		if entry.Index > snapshotIndex {
+			if entry.Index > storage.LastIndex() {
+				break
+			}
+			if term, err := storage.Term(entry.Index); err != nil || term != entry.Term {
+				break
+			}
+		}
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if entries[0].Index <= node.commitIndex {
+			return nil, fmt.Errorf("Leader %s would replace committed entry %d", request.Leader, entries[0].Index)
+		}
+		replacing := entries[0].Index <= storage.LastIndex()
+		if err = storage.Append(entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type == EntryMembership {
+				replacing = true
+			}
+		}
+		if replacing {
+			if err = node.loadMembership(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	lastNew := request.PrevLogIndex + uint64(len(request.Entries))
+	if commitIndex := min(request.LeaderCommit, lastNew); commitIndex > node.commitIndex {
+		node.commitIndex = commitIndex
+		node.notify()
+	}
+	response.Success, response.LastIndex = true, storage.LastIndex()
+	return
+}
+
+// HandleSnapshot - take a snapshot from the leader in place of the log it covers
+func (node *Node) HandleSnapshot(request *SnapshotRequest) (response *SnapshotResponse, err error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.stopped {
+		return nil, ErrStopped
+	}
+	if request.Term < node.term {
+		return &SnapshotResponse{Term: node.term}, nil
+	}
+	if err = node.heardFromLeader(request.Term, request.Leader); err != nil {
+		return
+	}
+	response = &SnapshotResponse{Term: node.term}
+	storage := node.config.Storage
+	if request.Meta.Index <= storage.FirstIndex()-1 || request.Meta.Index <= node.commitIndex {
+		// Already has everything the snapshot holds
+		return
+	}
+	node.logf("installing snapshot to %d from %s", request.Meta.Index, request.Leader)
+	if err = storage.SaveSnapshot(request.Meta, request.Data); err != nil {
+		return nil, err
+	}
+	if err = node.loadMembership(); err != nil {
+		return nil, err
+	}
+	// applyCommitted restores the snapshot as lastApplied is now behind it
+	node.commitIndex = request.Meta.Index
+	node.notify()
+	return
+}
+
+// heardFromLeader - a request from the leader of term has arrived
+func (node *Node) heardFromLeader(term uint64, leader string) (err error) {
+	if term > node.term || node.state != Follower || node.leader != leader {
+		if err = node.becomeFollower(term, leader); err != nil {
+			return
+		}
+	}
+	node.lastContact = time.Now()
+	node.resetElectionTime()
+	return
+}
+
+// run - stand for election when the leader goes quiet, and step down as leader when the
+// followers do
+func (node *Node) run() {
+	defer node.group.Done()
+	ticker := time.NewTicker(node.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.stop:
+			return
+		case <-ticker.C:
+		}
+
+		node.mutex.Lock()
+		now := time.Now()
+		switch {
+		case node.state == Leader:
+			if !node.acknowledged(now.Add(-node.config.ElectionTimeout)) {
+				node.logf("lost contact with the majority, stepping down")
+				if err := node.becomeFollower(node.term, ""); err != nil {
+					node.logf("%s", err)
+				}
+			}
+		case now.After(node.electionTime) && node.membership.Contains(node.config.ID):
+			if err := node.campaign(); err != nil {
+				node.logf("%s", err)
+			}
+		}
+		node.mutex.Unlock()
+	}
+}
+
+// campaign - stand for election in the next term
+func (node *Node) campaign() (err error) {
+	node.state = Candidate
+	node.term++
+	node.votedFor = node.config.ID
+	node.leader = ""
+	if err = node.persist(); err != nil {
+		return
+	}
+	node.resetElectionTime()
+	node.notify()
+	node.logf("standing for election in term %d", node.term)
+
+	storage := node.config.Storage
+	lastIndex := storage.LastIndex()
+	lastTerm, err := storage.Term(lastIndex)
+	if err != nil {
+		return
+	}
+	request := &VoteRequest{Term: node.term, Candidate: node.config.ID, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	term, votes := node.term, 1
+	if votes >= node.majority() {
+		return node.becomeLeader()
+	}
+	for _, member := range node.membership.Members {
+		if member.ID == node.config.ID {
+			continue
+		}
+		go func(member Member) {
+			ctx, cancel := context.WithTimeout(node.ctx, node.config.ElectionTimeout)
+			response, err := node.config.Transport.RequestVote(ctx, member, request)
+			cancel()
+			if err != nil {
+				return
+			}
+			node.mutex.Lock()
+			defer node.mutex.Unlock()
+			if node.stopped || node.term != term {
+				return
+			}
+			if response.Term > node.term {
+				node.becomeFollower(response.Term, "")
+				return
+			}
+			if node.state != Candidate || !response.Granted {
+				return
+			}
+			if votes++; votes == node.majority() {
+				if err := node.becomeLeader(); err != nil {
+					node.logf("%s", err)
+				}
+			}
+		}(member)
+	}
+	return
+}
+
+func (node *Node) becomeLeader() (err error) {
+	node.logf("leader for term %d", node.term)
+	node.state = Leader
+	node.leader = node.config.ID
+	node.peers = make(map[string]*peer)
+	node.syncPeers()
+	// Committing an entry of its own term also commits everything before it
+	if _, err = node.appendEntry(EntryNoop, nil); err != nil {
+		return
+	}
+	node.notify()
+	return
+}
+
+// becomeFollower - stop being a candidate or leader, moving on to term if it is newer
+func (node *Node) becomeFollower(term uint64, leader string) (err error) {
+	if term > node.term {
+		node.term, node.votedFor = term, ""
+		if err = node.persist(); err != nil {
+			return
+		}
+	}
+	if node.state == Leader {
+		node.stopPeers()
+	}
+	if node.state != Follower || node.leader != leader {
+		if leader != "" {
+			node.logf("following %s in term %d", leader, node.term)
+		}
+	}
+	node.state, node.leader = Follower, leader
+	node.notify()
+	return
+}
+
+// appendEntry - append an entry to the leader's log and send it on
+func (node *Node) appendEntry(entryType EntryType, data []byte) (index uint64, err error) {
+	storage := node.config.Storage
+	index = storage.LastIndex() + 1
+	if err = storage.Append([]Entry{{Index: index, Term: node.term, Type: entryType, Data: data}}); err != nil {
+		return
+	}
+	if entryType == EntryMembership {
+		if err = node.loadMembership(); err != nil {
+			return
+		}
+	}
+	node.triggerPeers()
+	// A leader on its own commits straight away
+	node.advanceCommit()
+	return
+}
+
+// syncPeers - start replicating to new members and stop replicating to removed ones
+func (node *Node) syncPeers() {
+	if node.state != Leader {
+		return
+	}
+	for id, p := range node.peers {
+		if !node.membership.Contains(id) {
+			close(p.stop)
+			delete(node.peers, id)
+		}
+	}
+	for _, member := range node.membership.Members {
+		if member.ID == node.config.ID {
+			continue
+		}
+		if p, ok := node.peers[member.ID]; ok {
+			p.member = member
+			continue
+		}
+		p := &peer{
+			member:    member,
+			nextIndex: node.config.Storage.LastIndex() + 1,
+			lastAck:   time.Now(),
+			trigger:   make(chan struct{}, 1),
+			stop:      make(chan struct{}),
+		}
+		node.peers[member.ID] = p
+		node.group.Add(1)
+		go node.replicate(p, node.term)
+	}
+}
+
+func (node *Node) stopPeers() {
+	for id, p := range node.peers {
+		close(p.stop)
+		delete(node.peers, id)
+	}
+}
+
+func (node *Node) triggerPeers() {
+	for _, p := range node.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate - keep a member's log in step with the leader's for as long as the node leads term
+func (node *Node) replicate(p *peer, term uint64) {
+	defer node.group.Done()
+	for {
+		node.mutex.Lock()
+		if node.state != Leader || node.term != term {
+			node.mutex.Unlock()
+			return
+		}
+		select {
+		case <-p.stop:
+			node.mutex.Unlock()
+			return
+		default:
+		}
+		more, err := node.sendTo(p, term)
+		if err != nil && !errors.Is(err, ErrUnreachable) && !errors.Is(err, context.DeadlineExceeded) {
+			node.logf("replicating to %s: %s", p.member.ID, err)
+		}
+		node.mutex.Unlock()
+		if err == nil && more {
+			continue
+		}
+
+		timer := time.NewTimer(node.config.HeartbeatInterval)
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return
+		case <-p.trigger:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendTo - send the member the entries it is missing, a snapshot if they have gone from the log, or
+// just a heartbeat. Called with the mutex held, which is let go while the request is out. more is
+// set if there is more to send straight away
+func (node *Node) sendTo(p *peer, term uint64) (more bool, err error) {
+	storage := node.config.Storage
+	member, sent := p.member, time.Now()
+	if p.nextIndex < storage.FirstIndex() {
+		meta, data, err := storage.Snapshot()
+		if err != nil {
+			return false, err
+		}
+		request := &SnapshotRequest{Term: term, Leader: node.config.ID, Meta: meta, Data: data}
+		node.mutex.Unlock()
+		ctx, cancel := context.WithTimeout(node.ctx, 10*node.config.ElectionTimeout)
+		response, err := node.config.Transport.InstallSnapshot(ctx, member, request)
+		cancel()
+		node.mutex.Lock()
+		if err != nil {
+			return false, err
+		}
+		if !node.stillLeading(term, response.Term) {
+			return false, nil
+		}
+		node.logf("sent snapshot to %d to %s", meta.Index, member.ID)
+		p.lastAck = sent
+		p.matchIndex = max(p.matchIndex, meta.Index)
+		p.nextIndex = meta.Index + 1
+		node.advanceCommit()
+		node.notify()
+		return p.nextIndex <= storage.LastIndex(), nil
+	}
+
+	prevIndex := p.nextIndex - 1
+	prevTerm, err := storage.Term(prevIndex)
+	if err != nil {
+		return
+	}
+	entries, err := storage.Entries(p.nextIndex, min(storage.LastIndex()+1, p.nextIndex+uint64(node.config.MaxEntries)))
+	if err != nil {
+		return
+	}
+	request := &AppendRequest{Term: term, Leader: node.config.ID, PrevLogIndex: prevIndex, PrevLogTerm: prevTerm, Entries: entries, LeaderCommit: node.commitIndex}
+	node.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(node.ctx, node.config.ElectionTimeout)
+	response, err := node.config.Transport.AppendEntries(ctx, member, request)
+	cancel()
+	node.mutex.Lock()
+	if err != nil {
+		return
+	}
+	if !node.stillLeading(term, response.Term) {
+		return
+	}
+	p.lastAck = sent
+	if response.Success {
+		p.matchIndex = max(p.matchIndex, prevIndex+uint64(len(entries)))
+		p.nextIndex = max(p.nextIndex, prevIndex+uint64(len(entries))+1)
+		node.advanceCommit()
+	} else {
+		// Walk back to where the logs might agree
+		p.nextIndex = max(1, min(p.nextIndex-1, response.LastIndex+1))
+	}
+	node.notify()
+	return !response.Success || p.nextIndex <= storage.LastIndex(), nil
+}
+
+// stillLeading - whether the node is still leading term after an answer from a member in
+// responseTerm. Steps down if the member has moved on
+func (node *Node) stillLeading(term uint64, responseTerm uint64) bool {
+	if responseTerm > node.term {
+		node.becomeFollower(responseTerm, "")
+		return false
+	}
+	return node.state == Leader && node.term == term
+}
+
+// acknowledged - whether a majority (counting the leader) have answered requests sent since since
+func (node *Node) acknowledged(since time.Time) bool {
+	acks := 0
+	for _, member := range node.membership.Members {
+		if member.ID == node.config.ID {
+			acks++
+		} else if p, ok := node.peers[member.ID]; ok && !p.lastAck.Before(since) {
+			acks++
+		}
+	}
+	return acks >= node.majority()
+}
+
+// advanceCommit - commit whatever a majority have in their logs. Only entries of the leader's own
+// term are committed by counting, earlier ones follow on behind them
+func (node *Node) advanceCommit() {
+	if node.state != Leader {
+		return
+	}
+	storage := node.config.Storage
+	var matches []uint64
+	for _, member := range node.membership.Members {
+		if member.ID == node.config.ID {
+			matches = append(matches, storage.LastIndex())
+		} else if p, ok := node.peers[member.ID]; ok {
+			matches = append(matches, p.matchIndex)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[node.majority()-1]
+	if index <= node.commitIndex {
+		return
+	}
+	if term, err := storage.Term(index); err != nil || term != node.term {
+		return
+	}
+	node.commitIndex = index
+	node.notify()
+	node.triggerPeers()
+
+	if !node.membership.Contains(node.config.ID) && node.commitIndex >= node.membershipIndex {
+		node.logf("removed from the cluster, stepping down")
+		node.becomeFollower(node.term, "")
+	}
+}
+
+// applyCommitted - apply committed entries to the state machine as they come, restoring the
+// latest snapshot first when the log no longer reaches back to what has been applied
+func (node *Node) applyCommitted() {
+	defer node.group.Done()
+	for {
+		node.mutex.Lock()
+		storage := node.config.Storage
+		for node.lastApplied >= node.commitIndex && node.lastApplied >= storage.FirstIndex()-1 {
+			changed := node.changed
+			node.mutex.Unlock()
+			select {
+			case <-node.stop:
+				return
+			case <-changed:
+			}
+			node.mutex.Lock()
+		}
+
+		if node.lastApplied < storage.FirstIndex()-1 {
+			meta, data, err := storage.Snapshot()
+			node.mutex.Unlock()
+			if err == nil {
+				node.logf("restoring snapshot to %d", meta.Index)
+				err = node.config.Machine.Restore(data)
+			}
+			if err != nil {
+				node.logf("restoring snapshot: %s", err)
+				if node.pause() {
+					return
+				}
+				continue
+			}
+			node.mutex.Lock()
+			node.lastApplied = meta.Index
+			for index, p := range node.pending {
+				if index <= meta.Index {
+					p.done <- proposalResult{err: ErrLeadershipLost}
+					delete(node.pending, index)
+				}
+			}
+			node.notify()
+			node.mutex.Unlock()
+			continue
+		}
+
+		entries, err := storage.Entries(node.lastApplied+1, min(node.commitIndex, node.lastApplied+uint64(node.config.MaxEntries))+1)
+		node.mutex.Unlock()
+		if err != nil {
+			// Most likely a snapshot arrived in between, which the next pass restores
+			continue
+		}
+		for _, entry := range entries {
+			var result proposalResult
+			if entry.Type == EntryCommand {
+				result.result, result.err = node.config.Machine.Apply(entry.Data)
+			}
+			node.mutex.Lock()
+			if node.lastApplied+1 == entry.Index {
+				node.lastApplied = entry.Index
+			}
+			if p, ok := node.pending[entry.Index]; ok {
+				if p.term != entry.Term {
+					result = proposalResult{err: ErrLeadershipLost}
+				}
+				p.done <- result
+				delete(node.pending, entry.Index)
+			}
+			node.notify()
+			node.mutex.Unlock()
+		}
+		node.snapshotIfDue()
+	}
+}
+
+// pause - wait a moment before trying again. Returns true if the node is stopped meanwhile
+func (node *Node) pause() bool {
+	select {
+	case <-node.stop:
+		return true
+	case <-time.After(node.config.ElectionTimeout):
+		return false
+	}
+}
+
+// snapshotIfDue - take a snapshot once enough entries have been applied since the last one. Only
+// called between applying entries so the state machine is exactly at lastApplied
+func (node *Node) snapshotIfDue() {
+	node.mutex.Lock()
+	storage := node.config.Storage
+	index := node.lastApplied
+	if index < storage.FirstIndex()-1+node.config.SnapshotThreshold {
+		node.mutex.Unlock()
+		return
+	}
+	term, err := storage.Term(index)
+	if err != nil {
+		node.mutex.Unlock()
+		return
+	}
+	membership, err := node.membershipAt(index)
+	node.mutex.Unlock()
+	if err != nil {
+		node.logf("snapshot: %s", err)
+		return
+	}
+
+	data, err := node.config.Machine.Snapshot()
+	if err != nil {
+		node.logf("snapshot: %s", err)
+		return
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if index <= storage.FirstIndex()-1 {
+		return
+	}
+	if err = storage.SaveSnapshot(SnapshotMeta{Index: index, Term: term, Membership: membership}, data); err != nil {
+		node.logf("snapshot: %s", err)
+		return
+	}
+	node.logf("snapshot taken at %d (%d bytes)", index, len(data))
+}
+
+// loadMembership - take the membership from the last membership entry in the log, or the snapshot
+func (node *Node) loadMembership() (err error) {
+	storage := node.config.Storage
+	node.membership, err = node.membershipAt(storage.LastIndex())
+	if err != nil {
+		return
+	}
+	node.membershipIndex = 0
+	for index := storage.LastIndex(); index >= storage.FirstIndex(); index-- {
+		entries, err := storage.Entries(index, index+1)
+		if err != nil {
+			return err
+		}
+		if entries[0].Type == EntryMembership {
+			node.membershipIndex = index
+			break
+		}
+	}
+	node.syncPeers()
+	return
+}
+
+// membershipAt - the membership in effect once the log up to index had been appended
+func (node *Node) membershipAt(index uint64) (membership Membership, err error) {
+	storage := node.config.Storage
+	for ; index >= storage.FirstIndex(); index-- {
+		entries, err := storage.Entries(index, index+1)
+		if err != nil {
+			return membership, err
+		}
+		if entries[0].Type == EntryMembership {
+			return decodeMembership(entries[0].Data)
+		}
+	}
+	meta, _, err := storage.Snapshot()
+	return meta.Membership, err
+}
+
+func (node *Node) majority() int {
+	return len(node.membership.Members)/2 + 1
+}
+
+func (node *Node) persist() error {
+	return node.config.Storage.SetHardState(HardState{Term: node.term, VotedFor: node.votedFor})
+}
+
+func (node *Node) resetElectionTime() {
+	timeout := node.config.ElectionTimeout
+	node.electionTime = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// notify - wake everything waiting for the node's state to change
+func (node *Node) notify() {
+	close(node.changed)
+	node.changed = make(chan struct{})
+}
+
+// waitFor - wait, with the mutex held on entry and return, until done says so
+func (node *Node) waitFor(ctx context.Context, done func() (bool, error)) error {
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if node.stopped {
+			return ErrStopped
+		}
+		changed := node.changed
+		node.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		case <-node.stop:
+		}
+		node.mutex.Lock()
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func min(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a uint64, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// logf - log to config.Logger as this node
+func (node *Node) logf(format string, args ...interface{}) {
+	node.config.Logger.Printf("Raft %s: "+format, append([]interface{}{node.config.ID}, args...)...)
+}
@@ -0,0 +1,530 @@
+package gkraft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gokave"
+	"gokave/gkfs"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Timings short enough for the tests to run quickly
+const (
+	testHeartbeat         = 20 * time.Millisecond
+	testElectionTimeout   = 200 * time.Millisecond
+	testSnapshotThreshold = 30
+	testWait              = 10 * time.Second
+)
+
+// testMember - a node with its DB and storage on its own in memory file system, which outlives
+// the node so it can be restarted
+type testMember struct {
+	fs      *gkfs.MemFS
+	db      *gokave.DB
+	storage *FileStorage
+	node    *Node
+}
+
+// testCluster - members talking over a Network
+type testCluster struct {
+	t            *testing.T
+	network      *Network
+	members      map[string]*testMember
+	disconnected map[string]bool
+}
+
+func addr(id string) string {
+	return "addr-" + id
+}
+
+// newTestCluster - a cluster of the members ids, all started
+func newTestCluster(t *testing.T, ids ...string) (cluster *testCluster) {
+	cluster = &testCluster{t: t, network: NewNetwork(), members: make(map[string]*testMember), disconnected: make(map[string]bool)}
+	var bootstrap []Member
+	for _, id := range ids {
+		bootstrap = append(bootstrap, Member{ID: id, Addr: addr(id)})
+	}
+	for _, id := range ids {
+		cluster.start(id, bootstrap)
+	}
+	return
+}
+
+// start - start the member id, from whatever it had stored if it has run before
+func (cluster *testCluster) start(id string, bootstrap []Member) (member *testMember) {
+	t := cluster.t
+	t.Helper()
+	member = cluster.members[id]
+	if member == nil {
+		member = &testMember{fs: gkfs.NewMem()}
+		cluster.members[id] = member
+	}
+	var err error
+	if member.db, err = gokave.Open(gokave.WithFS(member.fs), gokave.WithDataDirectory("/data"), gokave.WithConfigFile("/config.json")); err != nil {
+		t.Fatal(err)
+	}
+	if member.storage, err = OpenFileStorage(member.fs, "/raft"); err != nil {
+		t.Fatal(err)
+	}
+	member.node, err = NewNode(Config{
+		ID: id, Storage: member.storage, Transport: cluster.network.Transport(addr(id)), Machine: NewDBMachine(member.db),
+		Bootstrap: bootstrap, HeartbeatInterval: testHeartbeat, ElectionTimeout: testElectionTimeout, SnapshotThreshold: testSnapshotThreshold,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.network.Attach(addr(id), member.node)
+	return
+}
+
+// stop - stop the member id, keeping its file system
+func (cluster *testCluster) stop(id string) {
+	member := cluster.members[id]
+	if member.node == nil {
+		return
+	}
+	cluster.network.Detach(addr(id))
+	member.node.Stop()
+	member.storage.Close()
+	member.db.Close()
+	member.node = nil
+}
+
+func (cluster *testCluster) stopAll() {
+	for id := range cluster.members {
+		cluster.stop(id)
+	}
+}
+
+// disconnect - cut the member id off from the rest. It may go on thinking it leads
+func (cluster *testCluster) disconnect(id string) {
+	cluster.network.Disconnect(addr(id))
+	cluster.disconnected[id] = true
+}
+
+func (cluster *testCluster) reconnect(id string) {
+	cluster.network.Reconnect(addr(id))
+	delete(cluster.disconnected, id)
+}
+
+// leader - wait for a running, connected member other than those in not to be the leader
+func (cluster *testCluster) leader(not ...string) (id string) {
+	t := cluster.t
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for time.Now().Before(deadline) {
+	members:
+		for id, member := range cluster.members {
+			for _, other := range not {
+				if id == other {
+					continue members
+				}
+			}
+			if member.node != nil && !cluster.disconnected[id] && member.node.IsLeader() {
+				return id
+			}
+		}
+		time.Sleep(testHeartbeat)
+	}
+	t.Fatal("No leader elected")
+	return
+}
+
+// other - a member other than those in not
+func (cluster *testCluster) other(not ...string) string {
+members:
+	for id := range cluster.members {
+		for _, other := range not {
+			if id == other {
+				continue members
+			}
+		}
+		return id
+	}
+	return ""
+}
+
+// propose - propose command to the leader, retrying while leadership changes hands
+func (cluster *testCluster) propose(command Command) {
+	t := cluster.t
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := ProposeCommand(ctx, cluster.members[cluster.leader()].node, command)
+		cancel()
+		if err == nil {
+			return
+		}
+		if err != ErrNotLeader && err != ErrLeadershipLost && err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+		time.Sleep(testHeartbeat)
+	}
+	t.Fatalf("Proposal of %+v never committed", command)
+}
+
+func (cluster *testCluster) put(key string, value string) {
+	cluster.t.Helper()
+	cluster.propose(Command{Op: OpPut, Store: "s", Key: key, Value: []byte(value)})
+}
+
+// expect - wait for the member id to hold value for key, or to not have key if value is ""
+func (cluster *testCluster) expect(id string, key string, value string) {
+	t := cluster.t
+	t.Helper()
+	member := cluster.members[id]
+	deadline := time.Now().Add(testWait)
+	for {
+		got, err := member.db.Read(context.Background(), "s", key)
+		if (err == nil && string(got) == value) || (value == "" && err != nil) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s is %q %v, expected %q. Status %+v", id, key, got, err, value, member.node.Status())
+		}
+		time.Sleep(testHeartbeat)
+	}
+}
+
+func TestElection(t *testing.T) {
+	cluster := newTestCluster(t, "n1", "n2", "n3")
+	defer cluster.stopAll()
+	leader := cluster.leader()
+	cluster.propose(Command{Op: OpCreateStore, Store: "s"})
+	cluster.put("a", "1")
+
+	// Once the leader's heartbeats have gone round everyone agrees who it is
+	deadline := time.Now().Add(testWait)
+	for id, member := range cluster.members {
+		for member.node.Status().Leader != leader && time.Now().Before(deadline) {
+			time.Sleep(testHeartbeat)
+		}
+		if status := member.node.Status(); status.Leader != leader || (id != leader && status.State == Leader.String()) {
+			t.Errorf("%s: %+v, expected %s to be the only leader", id, status, leader)
+		}
+		cluster.expect(id, "a", "1")
+	}
+	if _, err := ProposeCommand(context.Background(), cluster.members[cluster.other(leader)].node, Command{Op: OpDelete, Store: "s", Key: "a"}); err != ErrNotLeader {
+		t.Errorf("Proposal to a follower: %v, expected ErrNotLeader", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	fsys := gkfs.NewMem()
+	storage, err := OpenFileStorage(fsys, "/raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	var logged bytes.Buffer
+	node, err := NewNode(Config{
+		ID: "n1", Storage: storage, Transport: NewNetwork().Transport(addr("n1")), Machine: NewDBMachine(nil),
+		Bootstrap: []Member{{ID: "n1", Addr: addr("n1")}}, HeartbeatInterval: testHeartbeat, ElectionTimeout: testElectionTimeout,
+		Logger: log.New(&logged, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testWait)
+	for node.Status().State != Leader.String() && time.Now().Before(deadline) {
+		time.Sleep(testHeartbeat)
+	}
+	node.Stop()
+
+	for _, expected := range []string{"Raft n1: starting at term 1", "Raft n1: leader for term", "Raft n1: stopped"} {
+		if !strings.Contains(logged.String(), expected) {
+			t.Errorf("Log %q doesn't have %q", logged.String(), expected)
+		}
+	}
+}
+
+func TestTornLog(t *testing.T) {
+	fsys := gkfs.NewMem()
+	storage, err := OpenFileStorage(fsys, "/raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.TornAt() != -1 {
+		t.Errorf("Torn at in a new log: %d", storage.TornAt())
+	}
+	if err = storage.Append([]Entry{{Index: 1, Term: 1, Type: EntryNoop}, {Index: 2, Term: 1, Type: EntryNoop}}); err != nil {
+		t.Fatal(err)
+	}
+	goodSize := storage.size
+	storage.Close()
+
+	// A crash part way through appending an entry
+	logFile, err := fsys.OpenFile(filepath.Join("/raft", LogFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = logFile.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+
+	if storage, err = OpenFileStorage(fsys, "/raft"); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if storage.TornAt() != goodSize || storage.LastIndex() != 2 {
+		t.Errorf("Reopened: torn at %d, last index %d. Expected the entry at %d cut off", storage.TornAt(), storage.LastIndex(), goodSize)
+	}
+	if size, _ := storage.log.Size(); size != goodSize {
+		t.Errorf("Log size: %d, expected %d", size, goodSize)
+	}
+}
+
+func TestMinorityPartition(t *testing.T) {
+	cluster := newTestCluster(t, "n1", "n2", "n3")
+	defer cluster.stopAll()
+	cluster.propose(Command{Op: OpCreateStore, Store: "s"})
+	cluster.put("a", "1")
+
+	// The old leader is cut off on its own and can't commit anything
+	old := cluster.leader()
+	cluster.disconnect(old)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*testHeartbeat)
+	if _, err := ProposeCommand(ctx, cluster.members[old].node, Command{Op: OpPut, Store: "s", Key: "lost", Value: []byte("x")}); err == nil {
+		t.Error("Proposal committed by a leader without a majority")
+	}
+	cancel()
+
+	// The majority elects a new leader and carries on
+	leader := cluster.leader()
+	for i := 0; i < 10; i++ {
+		cluster.put(fmt.Sprintf("p%d", i), "y")
+	}
+
+	// Once healed the old leader follows the new one and the entry it couldn't commit is replaced
+	cluster.reconnect(old)
+	cluster.expect(old, "p9", "y")
+	cluster.expect(old, "lost", "")
+	if status := cluster.members[old].node.Status(); status.State == Leader.String() || status.Leader != leader {
+		t.Errorf("Old leader after healing: %+v", status)
+	}
+}
+
+func TestRestartFromStorage(t *testing.T) {
+	cluster := newTestCluster(t, "n1", "n2", "n3")
+	defer cluster.stopAll()
+	cluster.propose(Command{Op: OpCreateStore, Store: "s"})
+	cluster.put("a", "1")
+	cluster.put("b", "2")
+	cluster.propose(Command{Op: OpDelete, Store: "s", Key: "a"})
+
+	follower := cluster.other(cluster.leader())
+	cluster.expect(follower, "b", "2")
+	before := cluster.members[follower].node.Status()
+	cluster.stop(follower)
+	cluster.put("c", "3")
+
+	// Without a bootstrap the member comes back from its term, log and snapshot on disk
+	cluster.start(follower, nil)
+	if status := cluster.members[follower].node.Status(); status.Term < before.Term || status.LastIndex < before.LastIndex || len(status.Members) != 3 {
+		t.Errorf("Restarted: %+v, before the restart %+v", status, before)
+	}
+	cluster.expect(follower, "a", "")
+	cluster.expect(follower, "b", "2")
+	cluster.expect(follower, "c", "3")
+
+	// A whole cluster restart loses nothing that was committed
+	for id := range cluster.members {
+		cluster.stop(id)
+	}
+	for id := range cluster.members {
+		cluster.start(id, nil)
+	}
+	cluster.leader()
+	for id := range cluster.members {
+		cluster.expect(id, "c", "3")
+	}
+}
+
+func TestJoinFromSnapshot(t *testing.T) {
+	cluster := newTestCluster(t, "n1", "n2", "n3")
+	defer cluster.stopAll()
+	cluster.propose(Command{Op: OpCreateStore, Store: "s"})
+	for i := 0; i < testSnapshotThreshold+10; i++ {
+		cluster.put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	cluster.propose(Command{Op: OpDelete, Store: "s", Key: "k3"})
+	leader := cluster.leader()
+	if status := cluster.members[leader].node.Status(); status.SnapshotIndex == 0 {
+		t.Fatalf("No snapshot taken: %+v", status)
+	}
+
+	// The log the new member needs has been snapshotted away so it is sent the snapshot
+	cluster.start("n4", nil)
+	if err := cluster.members[leader].node.AddMember(context.Background(), Member{ID: "n4", Addr: addr("n4")}); err != nil {
+		t.Fatal(err)
+	}
+	cluster.expect("n4", "k39", "v39")
+	cluster.expect("n4", "k3", "")
+	cluster.expect("n4", "k0", "v0")
+	if status := cluster.members["n4"].node.Status(); status.SnapshotIndex == 0 || len(status.Members) != 4 {
+		t.Errorf("n4 after joining: %+v", status)
+	}
+
+	// The snapshot's records keep their sequence numbers
+	joined, err := cluster.members["n4"].db.OpenStore(context.Background(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := cluster.members[leader].db.OpenStore(context.Background(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.LastSeq() != original.LastSeq() {
+		t.Errorf("Last seq of n4: %d, leader has %d", joined.LastSeq(), original.LastSeq())
+	}
+}
+
+func TestRemoveLeader(t *testing.T) {
+	cluster := newTestCluster(t, "n1", "n2", "n3")
+	defer cluster.stopAll()
+	cluster.propose(Command{Op: OpCreateStore, Store: "s"})
+	old := cluster.leader()
+	if err := cluster.members[old].node.RemoveMember(context.Background(), "missing"); err != ErrNotMember {
+		t.Errorf("Remove of a missing member: %v, expected ErrNotMember", err)
+	}
+	if err := cluster.members[old].node.RemoveMember(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other two elect a leader between them and carry on without the old one
+	leader := cluster.leader(old)
+	if cluster.members[old].node.IsLeader() {
+		t.Errorf("%s is still leading after removing itself", old)
+	}
+	cluster.stop(old)
+	cluster.put("after", "removed")
+	for id := range cluster.members {
+		if id != old {
+			cluster.expect(id, "after", "removed")
+		}
+	}
+	status := cluster.members[leader].node.Status()
+	if len(status.Members) != 2 {
+		t.Errorf("Members after the leader removed itself: %+v", status.Members)
+	}
+	for _, member := range status.Members {
+		if member.ID == old {
+			t.Errorf("%s is still a member: %+v", old, status.Members)
+		}
+	}
+}
+
+func TestReadAfterLeaderChange(t *testing.T) {
+	cluster := newTestCluster(t, "n1", "n2", "n3")
+	defer cluster.stopAll()
+	cluster.propose(Command{Op: OpCreateStore, Store: "s"})
+	cluster.put("a", "1")
+
+	old := cluster.leader()
+	if err := cluster.members[old].node.ReadBarrier(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cluster.disconnect(old)
+	leader := cluster.leader()
+	cluster.put("a", "2")
+
+	// The new leader's reads see the write made since the change. The old leader still thinks it
+	// leads but can't confirm it, so it won't serve a stale read
+	if err := cluster.members[leader].node.ReadBarrier(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := cluster.members[leader].db.Read(context.Background(), "s", "a"); err != nil || string(value) != "2" {
+		t.Errorf("Read on the new leader: %q %v", value, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*testHeartbeat)
+	defer cancel()
+	if err := cluster.members[old].node.ReadBarrier(ctx); err == nil {
+		t.Error("Read barrier passed on a leader cut off from the majority")
+	}
+	follower := cluster.other(old, leader)
+	if err := cluster.members[follower].node.ReadBarrier(context.Background()); err != ErrNotLeader {
+		t.Errorf("Read barrier on follower %s: %v, expected ErrNotLeader", follower, err)
+	}
+	cluster.reconnect(old)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	servers := make(map[string]*httptest.Server)
+	var bootstrap []Member
+	for _, id := range ids {
+		// Unstarted servers are already listening on 127.0.0.1:0, so each member's address is known
+		// before its node is made
+		server := httptest.NewUnstartedServer(nil)
+		servers[id] = server
+		bootstrap = append(bootstrap, Member{ID: id, Addr: "http://" + server.Listener.Addr().String()})
+	}
+
+	nodes := make(map[string]*Node)
+	dbs := make(map[string]*gokave.DB)
+	for _, id := range ids {
+		fsys := gkfs.NewMem()
+		db, err := gokave.Open(gokave.WithFS(fsys), gokave.WithDataDirectory("/data"), gokave.WithConfigFile("/config.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		storage, err := OpenFileStorage(fsys, "/raft")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		node, err := NewNode(Config{
+			ID: id, Storage: storage, Transport: &HTTPTransport{}, Machine: NewDBMachine(db),
+			Bootstrap: bootstrap, HeartbeatInterval: testHeartbeat, ElectionTimeout: testElectionTimeout,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+		nodes[id], dbs[id] = node, db
+		servers[id].Config.Handler = HTTPHandler(node)
+		servers[id].Start()
+		defer servers[id].Close()
+	}
+
+	var leader *Node
+	deadline := time.Now().Add(testWait)
+	for leader == nil && time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				leader = node
+			}
+		}
+		time.Sleep(testHeartbeat)
+	}
+	if leader == nil {
+		t.Fatal("No leader elected over HTTP")
+	}
+	for _, command := range []Command{{Op: OpCreateStore, Store: "s"}, {Op: OpPut, Store: "s", Key: "a", Value: []byte("over http")}} {
+		if _, err := ProposeCommand(context.Background(), leader, command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range ids {
+		var value []byte
+		var err error
+		for deadline = time.Now().Add(testWait); time.Now().Before(deadline); time.Sleep(testHeartbeat) {
+			if value, err = dbs[id].Read(context.Background(), "s", "a"); err == nil {
+				break
+			}
+		}
+		if string(value) != "over http" {
+			t.Errorf("%s: %q %v", id, value, err)
+		}
+	}
+}
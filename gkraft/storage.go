@@ -0,0 +1,277 @@
+package gkraft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave/gkfs"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files in a FileStorage directory
+const (
+	StateFileName    = "STATE"
+	LogFileName      = "LOG"
+	SnapshotFileName = "SNAPSHOT"
+	lockFileName     = "LOCK"
+)
+
+// entryHeaderLength - the length, CRC32, index, term and type in front of each entry in the log file
+const entryHeaderLength = 4 + 4 + 8 + 8 + 1
+
+// errBadEntry - an entry in the log file failed its checksum
+var errBadEntry = errors.New("Bad log entry")
+
+// FileStorage - Storage in a directory. The log is a file of entries appended as they arrive and
+// cut back when a new leader replaces some of them. The log is also held in memory
+type FileStorage struct {
+	MemoryStorage
+	fs        gkfs.FS
+	directory string
+	lock      io.Closer
+	log       gkfs.File
+	offsets   []int64 // where each entry in MemoryStorage.entries starts in the log file
+	size      int64
+	tornAt    int64
+}
+
+// OpenFileStorage - open the storage in directory, creating it if needed. Only one FileStorage can
+// have a directory open at once
+func OpenFileStorage(fsys gkfs.FS, directory string) (storage *FileStorage, err error) {
+	if err = fsys.MkdirAll(directory, 0755); err != nil {
+		return
+	}
+	lock, err := fsys.Lock(filepath.Join(directory, lockFileName), true)
+	if err != nil {
+		return nil, fmt.Errorf("Raft storage %s: %w", directory, err)
+	}
+	storage = &FileStorage{fs: fsys, directory: directory, lock: lock, tornAt: -1}
+	if err = storage.load(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return
+}
+
+// Close - close the log file and release the directory
+func (storage *FileStorage) Close() (err error) {
+	if storage.log != nil {
+		err = storage.log.Close()
+	}
+	if lockErr := storage.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return
+}
+
+// TornAt - the offset of the half written entry found at the end of the log when it was opened,
+// which was cut off. -1 if the log ended with a complete entry
+func (storage *FileStorage) TornAt() int64 {
+	return storage.tornAt
+}
+
+func (storage *FileStorage) load() (err error) {
+	stateBytes, err := gkfs.ReadFile(storage.fs, filepath.Join(storage.directory, StateFileName))
+	if err == nil {
+		if err = json.Unmarshal(stateBytes, &storage.hardState); err != nil {
+			return fmt.Errorf("Bad raft state: %s", err)
+		}
+	} else if !gkfs.IsNotExist(err) {
+		return
+	}
+
+	snapshotBytes, err := gkfs.ReadFile(storage.fs, filepath.Join(storage.directory, SnapshotFileName))
+	if err == nil {
+		if storage.snapshotMeta, storage.snapshotData, err = decodeSnapshot(snapshotBytes); err != nil {
+			return
+		}
+	} else if !gkfs.IsNotExist(err) {
+		return
+	}
+
+	if storage.log, err = storage.fs.OpenFile(filepath.Join(storage.directory, LogFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	size, err := storage.log.Size()
+	if err != nil {
+		return
+	}
+	for storage.size < size {
+		entry, length, readErr := readEntry(storage.log, storage.size, size)
+		if readErr != nil {
+			// Left half written by a crash. Nothing after it can have been acknowledged
+			storage.tornAt = storage.size
+			if err = storage.log.Truncate(storage.size); err != nil {
+				return
+			}
+			break
+		}
+		// Entries from before the snapshot are left over from a log rewrite that didn't finish
+		if entry.Index > storage.snapshotMeta.Index {
+			if entry.Index != storage.LastIndex()+1 {
+				return fmt.Errorf("Raft log %s: entry %d follows %d", storage.directory, entry.Index, storage.LastIndex())
+			}
+			storage.entries = append(storage.entries, entry)
+			storage.offsets = append(storage.offsets, storage.size)
+		}
+		storage.size += length
+	}
+	return
+}
+
+// SetHardState - see Storage
+func (storage *FileStorage) SetHardState(hardState HardState) (err error) {
+	stateBytes, err := json.Marshal(hardState)
+	if err != nil {
+		return
+	}
+	if err = storage.replaceFile(StateFileName, stateBytes); err != nil {
+		return
+	}
+	return storage.MemoryStorage.SetHardState(hardState)
+}
+
+// Append - see Storage
+func (storage *FileStorage) Append(entries []Entry) (err error) {
+	if len(entries) == 0 {
+		return
+	}
+	keep, err := storage.keep(entries[0].Index)
+	if err != nil {
+		return
+	}
+	if keep < len(storage.entries) {
+		if err = storage.log.Truncate(storage.offsets[keep]); err != nil {
+			return
+		}
+		storage.size = storage.offsets[keep]
+		storage.offsets = storage.offsets[:keep]
+	}
+
+	var buffer []byte
+	offsets := storage.offsets
+	for _, entry := range entries {
+		offsets = append(offsets, storage.size+int64(len(buffer)))
+		buffer = appendEntry(buffer, entry)
+	}
+	if _, err = storage.log.Write(buffer); err != nil {
+		return
+	}
+	if err = storage.log.Sync(); err != nil {
+		return
+	}
+	storage.offsets, storage.size = offsets, storage.size+int64(len(buffer))
+	return storage.MemoryStorage.Append(entries)
+}
+
+// SaveSnapshot - see Storage. The log file is rewritten without the entries the snapshot covers
+func (storage *FileStorage) SaveSnapshot(meta SnapshotMeta, data []byte) (err error) {
+	snapshotBytes, err := encodeSnapshot(meta, data)
+	if err != nil {
+		return
+	}
+	if err = storage.replaceFile(SnapshotFileName, snapshotBytes); err != nil {
+		return
+	}
+
+	remaining := storage.remaining(meta)
+	var buffer []byte
+	offsets := make([]int64, 0, len(remaining))
+	for _, entry := range remaining {
+		offsets = append(offsets, int64(len(buffer)))
+		buffer = appendEntry(buffer, entry)
+	}
+	if err = storage.replaceFile(LogFileName, buffer); err != nil {
+		return
+	}
+	storage.log.Close()
+	if storage.log, err = storage.fs.OpenFile(filepath.Join(storage.directory, LogFileName), os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	storage.offsets, storage.size = offsets, int64(len(buffer))
+	return storage.MemoryStorage.SaveSnapshot(meta, data)
+}
+
+// replaceFile - write a file in the directory atomically
+func (storage *FileStorage) replaceFile(fileName string, data []byte) (err error) {
+	tempName := filepath.Join(storage.directory, fileName+".tmp")
+	if err = gkfs.WriteFile(storage.fs, tempName, data); err != nil {
+		return
+	}
+	if err = storage.fs.Rename(tempName, filepath.Join(storage.directory, fileName)); err != nil {
+		return
+	}
+	return storage.fs.SyncDir(storage.directory)
+}
+
+func appendEntry(buffer []byte, entry Entry) []byte {
+	header := make([]byte, entryHeaderLength)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(entryHeaderLength-8+len(entry.Data)))
+	binary.LittleEndian.PutUint64(header[8:16], entry.Index)
+	binary.LittleEndian.PutUint64(header[16:24], entry.Term)
+	header[24] = byte(entry.Type)
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[8:])
+	checksum.Write(entry.Data)
+	binary.LittleEndian.PutUint32(header[4:8], checksum.Sum32())
+	return append(append(buffer, header...), entry.Data...)
+}
+
+func readEntry(r io.ReaderAt, offset int64, size int64) (entry Entry, length int64, err error) {
+	if offset+entryHeaderLength > size {
+		return entry, 0, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, entryHeaderLength)
+	if _, err = r.ReadAt(header, offset); err != nil {
+		return
+	}
+	length = 8 + int64(binary.LittleEndian.Uint32(header[0:4]))
+	if length < entryHeaderLength || offset+length > size {
+		return entry, 0, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length-entryHeaderLength)
+	if len(data) > 0 {
+		if _, err = r.ReadAt(data, offset+entryHeaderLength); err != nil {
+			return
+		}
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[8:])
+	checksum.Write(data)
+	if checksum.Sum32() != binary.LittleEndian.Uint32(header[4:8]) {
+		return entry, 0, errBadEntry
+	}
+	entry = Entry{
+		Index: binary.LittleEndian.Uint64(header[8:16]),
+		Term:  binary.LittleEndian.Uint64(header[16:24]),
+		Type:  EntryType(header[24]),
+		Data:  data,
+	}
+	return
+}
+
+// encodeSnapshot - a snapshot file: the length of the JSON meta, the meta and then the data
+func encodeSnapshot(meta SnapshotMeta, data []byte) (snapshotBytes []byte, err error) {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	snapshotBytes = make([]byte, 4, 4+len(metaBytes)+len(data))
+	binary.LittleEndian.PutUint32(snapshotBytes, uint32(len(metaBytes)))
+	return append(append(snapshotBytes, metaBytes...), data...), nil
+}
+
+func decodeSnapshot(snapshotBytes []byte) (meta SnapshotMeta, data []byte, err error) {
+	if len(snapshotBytes) < 4 || int(binary.LittleEndian.Uint32(snapshotBytes))+4 > len(snapshotBytes) {
+		return meta, nil, errors.New("Bad snapshot file")
+	}
+	metaLength := int(binary.LittleEndian.Uint32(snapshotBytes))
+	if err = json.Unmarshal(snapshotBytes[4:4+metaLength], &meta); err != nil {
+		return meta, nil, fmt.Errorf("Bad snapshot file: %s", err)
+	}
+	return meta, snapshotBytes[4+metaLength:], nil
+}
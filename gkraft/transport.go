@@ -0,0 +1,152 @@
+package gkraft
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrUnreachable means a Transport couldn't get a message to a member
+var ErrUnreachable = errors.New("Member unreachable")
+
+// VoteRequest - a candidate asking for a vote
+type VoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// VoteResponse - the answer to a VoteRequest
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendRequest - a leader sending log entries, or just a heartbeat when there aren't any
+type AppendRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendResponse - the answer to an AppendRequest. On failure LastIndex is where the follower's log
+// ends, to save the leader walking back one entry at a time
+type AppendResponse struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64
+}
+
+// SnapshotRequest - a leader sending a snapshot to a follower too far behind for the log
+type SnapshotRequest struct {
+	Term   uint64
+	Leader string
+	Meta   SnapshotMeta
+	Data   []byte
+}
+
+// SnapshotResponse - the answer to a SnapshotRequest
+type SnapshotResponse struct {
+	Term uint64
+}
+
+// Transport - how a node sends requests to the other members
+type Transport interface {
+	RequestVote(ctx context.Context, member Member, request *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, member Member, request *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, member Member, request *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// Network - an in-process Transport connecting nodes by address. Nodes can be cut off and
+// reconnected to try out elections and catching up
+type Network struct {
+	mutex        sync.RWMutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+// NewNetwork - an empty Network
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*Node), disconnected: make(map[string]bool)}
+}
+
+// Attach - deliver requests for addr to node
+func (network *Network) Attach(addr string, node *Node) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.nodes[addr] = node
+}
+
+// Detach - stop delivering requests for addr
+func (network *Network) Detach(addr string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	delete(network.nodes, addr)
+}
+
+// Disconnect - drop every request to or from addr
+func (network *Network) Disconnect(addr string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.disconnected[addr] = true
+}
+
+// Reconnect - undo Disconnect
+func (network *Network) Reconnect(addr string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	delete(network.disconnected, addr)
+}
+
+// Transport - the Transport for the node at addr
+func (network *Network) Transport(addr string) Transport {
+	return &networkTransport{network: network, from: addr}
+}
+
+type networkTransport struct {
+	network *Network
+	from    string
+}
+
+// node - the node a request to member goes to, if the request can get there
+func (transport *networkTransport) node(ctx context.Context, member Member) (*Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	network := transport.network
+	network.mutex.RLock()
+	defer network.mutex.RUnlock()
+	node := network.nodes[member.Addr]
+	if node == nil || network.disconnected[transport.from] || network.disconnected[member.Addr] {
+		return nil, ErrUnreachable
+	}
+	return node, nil
+}
+
+func (transport *networkTransport) RequestVote(ctx context.Context, member Member, request *VoteRequest) (*VoteResponse, error) {
+	node, err := transport.node(ctx, member)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleVote(request)
+}
+
+func (transport *networkTransport) AppendEntries(ctx context.Context, member Member, request *AppendRequest) (*AppendResponse, error) {
+	node, err := transport.node(ctx, member)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppend(request)
+}
+
+func (transport *networkTransport) InstallSnapshot(ctx context.Context, member Member, request *SnapshotRequest) (*SnapshotResponse, error) {
+	node, err := transport.node(ctx, member)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleSnapshot(request)
+}
@@ -0,0 +1,356 @@
+// Package gkreplica keeps a replica gokave.DB in step with a primary gokave server.
+//
+// A Follower copies every store on the primary. For each store it pulls the records appended to
+// the primary's segments, starting from a (segment, offset) cursor, and applies them to the
+// replica's store keeping their sequence numbers. The cursor is saved in the replica's store
+// directory after each batch so a restarted replica carries on where it left off. If the primary
+// compacts away the segment the cursor points into, the follower starts again from the primary's
+// oldest segment, skipping the records it already has, or empties the store and copies it afresh
+// if compaction has dropped changes it hasn't seen.
+package gkreplica
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkclient"
+	"gokave/gklogfile"
+	"gokave/gkstore"
+	"sync"
+	"time"
+)
+
+// Roles reported by Status
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// ErrNotReplica means a Follower was asked to follow into a DB that wasn't opened with gokave.WithReplica
+var ErrNotReplica = errors.New("DB is not a replica")
+
+// pollWait - how long the primary holds on to a request for records when there aren't any yet
+const pollWait = 10 * time.Second
+
+// storesInterval - how often the list of stores on the primary is checked
+const storesInterval = 5 * time.Second
+
+const minRetry = time.Second
+const maxRetry = 30 * time.Second
+
+// Status - how replication stands. A primary only reports the latest sequence number of each store
+type Status struct {
+	Role    string                 `json:"role"`
+	Primary string                 `json:"primary,omitempty"`
+	Error   string                 `json:"error,omitempty"` // the last failure to list the primary's stores
+	Stores  map[string]StoreStatus `json:"stores"`
+}
+
+// StoreStatus - how far a replica store has got. Lag is the number of changes the replica was
+// behind the primary when they last spoke
+type StoreStatus struct {
+	LastSeq        uint64     `json:"lastSeq"`
+	PrimaryLastSeq uint64     `json:"primaryLastSeq,omitempty"`
+	Lag            uint64     `json:"lag"`
+	Segment        string     `json:"segment,omitempty"`
+	Offset         int64      `json:"offset,omitempty"`
+	LastContact    *time.Time `json:"lastContact,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// Follower - keeps a replica DB in step with a primary server
+type Follower struct {
+	db      *gokave.DB
+	client  *gkclient.Client
+	primary string
+	mutex   sync.Mutex // guards stores and err
+	stores  map[string]*storeFollower
+	err     error
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+type storeFollower struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	status StoreStatus
+}
+
+// New - a Follower copying the server at primary (e.g. http://localhost:8080) into db, which has to
+// have been opened with gokave.WithReplica. Nothing happens until Start
+func New(db *gokave.DB, primary string, opts ...gkclient.Option) (follower *Follower, err error) {
+	if !db.IsReplica() {
+		return nil, ErrNotReplica
+	}
+	client, err := gkclient.New(primary, opts...)
+	if err != nil {
+		return
+	}
+	return &Follower{db: db, client: client, primary: primary, stores: make(map[string]*storeFollower)}, nil
+}
+
+// Start - start following in the background
+func (follower *Follower) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	follower.cancel = cancel
+	follower.done = make(chan struct{})
+	fmt.Printf("Replicating from: %s\n", follower.primary)
+	go follower.run(ctx)
+}
+
+// Stop - stop following and wait for the records being applied to finish. The replica stays a replica
+func (follower *Follower) Stop() {
+	if follower.cancel == nil {
+		return
+	}
+	follower.cancel()
+	<-follower.done
+}
+
+// Promote - stop following and make the replica DB accept writes
+func (follower *Follower) Promote() {
+	follower.Stop()
+	follower.db.Promote()
+}
+
+// Primary - the URL of the server being followed
+func (follower *Follower) Primary() string {
+	return follower.primary
+}
+
+// Status - how far each store has got
+func (follower *Follower) Status() Status {
+	follower.mutex.Lock()
+	defer follower.mutex.Unlock()
+	status := Status{Role: RoleReplica, Primary: follower.primary, Stores: make(map[string]StoreStatus, len(follower.stores))}
+	if follower.err != nil {
+		status.Error = follower.err.Error()
+	}
+	for storeName, s := range follower.stores {
+		status.Stores[storeName] = s.status
+	}
+	return status
+}
+
+// PrimaryStatus - the Status of a DB that isn't following anything
+func PrimaryStatus(ctx context.Context, db *gokave.DB) (status Status, err error) {
+	storeNames, err := db.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	status = Status{Role: RolePrimary, Stores: make(map[string]StoreStatus, len(storeNames))}
+	for _, storeName := range storeNames {
+		store, err := db.OpenStore(ctx, storeName)
+		if err != nil {
+			// Deleted since it was listed
+			continue
+		}
+		status.Stores[storeName] = StoreStatus{LastSeq: store.LastSeq()}
+	}
+	return
+}
+
+func (follower *Follower) run(ctx context.Context) {
+	defer close(follower.done)
+	for {
+		err := follower.syncStores(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Println("Replication:", err)
+		}
+		follower.mutex.Lock()
+		follower.err = err
+		follower.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			follower.mutex.Lock()
+			var stores []*storeFollower
+			for _, s := range follower.stores {
+				stores = append(stores, s)
+			}
+			follower.mutex.Unlock()
+			for _, s := range stores {
+				<-s.done
+			}
+			return
+		case <-time.After(storesInterval):
+		}
+	}
+}
+
+// syncStores - create, update and remove stores to match the primary and follow any new ones
+func (follower *Follower) syncStores(ctx context.Context) (err error) {
+	storeNames, err := follower.client.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	onPrimary := make(map[string]bool, len(storeNames))
+	for _, storeName := range storeNames {
+		onPrimary[storeName] = true
+		config, err := follower.client.DescribeStore(ctx, storeName)
+		if errors.Is(err, gkclient.ErrNotFound) {
+			// Deleted since it was listed
+			onPrimary[storeName] = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// A store from before the key case setting folds its keys
+		if config.KeyCase == "" {
+			config.KeyCase = gokave.KeyCaseFold
+		}
+		if err = follower.db.Replication().EnsureStore(ctx, gokave.StoreConfig{Name: config.Name, Codec: config.Codec, KeyCase: config.KeyCase}); err != nil {
+			return err
+		}
+		follower.follow(ctx, storeName)
+	}
+
+	localNames, err := follower.db.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	for _, storeName := range localNames {
+		if onPrimary[storeName] {
+			continue
+		}
+		follower.unfollow(storeName)
+		fmt.Printf("Store %s has gone from the primary\n", storeName)
+		if err = follower.db.Replication().DeleteStore(ctx, storeName); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// follow - start following storeName if it isn't already. It is followed until ctx is done
+func (follower *Follower) follow(ctx context.Context, storeName string) {
+	follower.mutex.Lock()
+	defer follower.mutex.Unlock()
+	if _, ok := follower.stores[storeName]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &storeFollower{cancel: cancel, done: make(chan struct{})}
+	follower.stores[storeName] = s
+	go func() {
+		defer close(s.done)
+		follower.followStore(ctx, storeName)
+	}()
+}
+
+func (follower *Follower) unfollow(storeName string) {
+	follower.mutex.Lock()
+	s, ok := follower.stores[storeName]
+	delete(follower.stores, storeName)
+	follower.mutex.Unlock()
+	if ok {
+		s.cancel()
+		<-s.done
+	}
+}
+
+// followStore - pull and apply the primary's records for a store until ctx is done, backing off
+// when something goes wrong
+func (follower *Follower) followStore(ctx context.Context, storeName string) {
+	retry := minRetry
+	for {
+		err := follower.pull(ctx, storeName)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("Replication of %s: %s\n", storeName, err)
+		follower.update(storeName, func(status *StoreStatus) {
+			status.Error = err.Error()
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > maxRetry {
+			retry = maxRetry
+		}
+	}
+}
+
+// pull - apply batches of records from the primary until something fails
+func (follower *Follower) pull(ctx context.Context, storeName string) (err error) {
+	replication := follower.db.Replication()
+	cursor, err := replication.Cursor(ctx, storeName)
+	if err != nil {
+		return
+	}
+	if cursor.Primary != follower.primary {
+		cursor = gkstore.ReplicaCursor{Primary: follower.primary}
+	}
+
+	for {
+		records, err := follower.client.ReadRecords(ctx, storeName, cursor.Segment, cursor.Offset, pollWait)
+		if errors.Is(err, gkclient.ErrGone) {
+			fmt.Printf("Segment %s of %s has gone from the primary. Starting again from the oldest\n", cursor.Segment, storeName)
+			cursor = gkstore.ReplicaCursor{Primary: follower.primary}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		store, err := follower.db.OpenStore(ctx, storeName)
+		if err != nil {
+			return err
+		}
+
+		// Starting from the oldest segment only works if the store hasn't missed changes that
+		// compaction has since dropped and isn't ahead of the primary, e.g. because the primary's
+		// store was deleted and created again
+		if cursor.Segment == "" {
+			if last := store.LastSeq(); last > 0 && (last < records.CompactedSeq || last > records.LastSeq) {
+				if err = replication.ResetStore(ctx, storeName); err != nil {
+					return err
+				}
+			}
+		}
+
+		var batch []gklogfile.Record
+		err = gklogfile.ScanFrom(bytes.NewReader(records.Data), 0, int64(len(records.Data)), true, func(record gklogfile.Record) error {
+			batch = append(batch, record)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = replication.Apply(ctx, storeName, batch); err != nil {
+			return err
+		}
+
+		next := gkstore.ReplicaCursor{Primary: follower.primary, Segment: records.Segment, Offset: records.Next}
+		if records.NextSegment != "" {
+			next.Segment, next.Offset = records.NextSegment, 0
+		}
+		if next != cursor {
+			if err = replication.SetCursor(ctx, storeName, next); err != nil {
+				return err
+			}
+			cursor = next
+		}
+
+		now := time.Now().UTC()
+		last := store.LastSeq()
+		follower.update(storeName, func(status *StoreStatus) {
+			*status = StoreStatus{LastSeq: last, PrimaryLastSeq: records.LastSeq, Segment: cursor.Segment, Offset: cursor.Offset, LastContact: &now}
+			if records.LastSeq > last {
+				status.Lag = records.LastSeq - last
+			}
+		})
+	}
+}
+
+func (follower *Follower) update(storeName string, fn func(status *StoreStatus)) {
+	follower.mutex.Lock()
+	defer follower.mutex.Unlock()
+	if s, ok := follower.stores[storeName]; ok {
+		fn(&s.status)
+	}
+}
@@ -0,0 +1,105 @@
+package gkserver
+
+import (
+	"fmt"
+	"gokave"
+	"gokave/gkmerkle"
+	"net/http"
+	"strings"
+)
+
+// handleMerkleNode - the node of the store's Merkle tree at ?path=, as a gkstore.MerkleNode. The
+// root's hashes lead on to the nodes below it, down to the leaves holding the keys
+func handleMerkleNode(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	tree, err := store.MerkleTree(httpRequest.Context())
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	node, err := tree.Node(httpRequest.URL.Query().Get("path"))
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, node)
+}
+
+// WithPeers - the servers, by base URL, that anti-entropy may compare with and repair from. A
+// replica can always use its primary. Without peers ?with= and ?from= are refused, as otherwise
+// anyone who can reach the server could have it fetch from any URL
+func WithPeers(urls ...string) Option {
+	return func(server *Server) {
+		for _, u := range urls {
+			server.peers = append(server.peers, strings.TrimSuffix(u, "/"))
+		}
+	}
+}
+
+// isPeer - whether u is one of the servers given to WithPeers, or the primary being followed
+func (server *Server) isPeer(u string) bool {
+	u = strings.TrimSuffix(u, "/")
+	if server.follower != nil && u == strings.TrimSuffix(server.follower.Primary(), "/") {
+		return true
+	}
+	for _, peer := range server.peers {
+		if u == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCompare - a gkmerkle.Report comparing the stores, or just ?store=, with the server at ?with=,
+// which has to be a peer (see WithPeers)
+func (server *Server) handleCompare(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	if query.Get("with") == "" {
+		http.Error(responseWriter, "No server to compare with: ?with= is needed", http.StatusBadRequest)
+		return
+	}
+	if !server.isPeer(query.Get("with")) {
+		http.Error(responseWriter, fmt.Sprintf("Not a peer: %s", query.Get("with")), http.StatusForbidden)
+		return
+	}
+	fmt.Printf("Compare with %s: store: %s\n", query.Get("with"), query.Get("store"))
+	report, err := gkmerkle.Compare(httpRequest.Context(), db, query.Get("with"), query.Get("store"))
+	writeSyncReport(responseWriter, httpRequest, report, err)
+}
+
+// handleRepair - make the stores, or just ?store=, match those on the server at ?from=, which has to
+// be a peer (see WithPeers), returning the gkmerkle.Report of what was repaired
+func (server *Server) handleRepair(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	if query.Get("from") == "" {
+		http.Error(responseWriter, "No server to repair from: ?from= is needed", http.StatusBadRequest)
+		return
+	}
+	if !server.isPeer(query.Get("from")) {
+		http.Error(responseWriter, fmt.Sprintf("Not a peer: %s", query.Get("from")), http.StatusForbidden)
+		return
+	}
+	fmt.Printf("Repair from %s: store: %s\n", query.Get("from"), query.Get("store"))
+	report, err := gkmerkle.Repair(httpRequest.Context(), db, query.Get("from"), query.Get("store"))
+	writeSyncReport(responseWriter, httpRequest, report, err)
+}
+
+// handleRepairUnsupported - a repair writes to the local copy of a store behind the back of a Raft
+// cluster or sharded deployment, which keep their members' copies in step themselves
+func handleRepairUnsupported(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	http.Error(responseWriter, "Repair isn't supported by a cluster member or shard node", http.StatusNotImplemented)
+}
+
+// writeSyncReport - a failure to reach the other server is a 502. Failures with a single store are
+// in the report
+func writeSyncReport(responseWriter http.ResponseWriter, httpRequest *http.Request, report gkmerkle.Report, err error) {
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, report)
+}
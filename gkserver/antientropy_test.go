@@ -0,0 +1,57 @@
+package gkserver
+
+import (
+	"context"
+	"gokave/gkmerkle"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRepairOnlyFromPeers(t *testing.T) {
+	ctx := context.Background()
+	other := openTestDB(t)
+	otherServer, stopOther := startTestServer(other)
+	defer stopOther()
+	if err := other.Write(ctx, "s", "a", []byte("from the peer")); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	httpServer, stop := startTestServer(db, WithPeers(otherServer.URL+"/"))
+	defer stop()
+
+	for _, request := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/antientropy?with="},
+		{http.MethodPost, "/v1/antientropy/_repair?from="},
+	} {
+		if response := doJSON(t, request.method, httpServer.URL+request.path+url.QueryEscape("http://169.254.169.254"), nil); response.StatusCode != http.StatusForbidden {
+			t.Errorf("%s a server that isn't a peer: %d, expected 403", request.path, response.StatusCode)
+		}
+		if response := doJSON(t, request.method, httpServer.URL+request.path, nil); response.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s no server: %d, expected 400", request.path, response.StatusCode)
+		}
+	}
+
+	var report gkmerkle.Report
+	if response := doJSON(t, http.MethodGet, httpServer.URL+"/v1/antientropy?with="+url.QueryEscape(otherServer.URL), &report); response.StatusCode != http.StatusOK || report.InSync {
+		t.Fatalf("Compare with a peer: %d %+v", response.StatusCode, report)
+	}
+	if response := doJSON(t, http.MethodPost, httpServer.URL+"/v1/antientropy/_repair?store=s&from="+url.QueryEscape(otherServer.URL), &report); response.StatusCode != http.StatusOK {
+		t.Fatalf("Repair from a peer: %d", response.StatusCode)
+	}
+	if value, err := db.Read(ctx, "s", "a"); err != nil || string(value) != "from the peer" {
+		t.Errorf("After repair: %q %v", value, err)
+	}
+}
+
+func TestRepairUnsupportedInCluster(t *testing.T) {
+	db := openTestDB(t)
+	node := newTestNode(t, db)
+	defer node.Stop()
+	httpServer, stop := startTestServer(db, WithCluster(node), WithPeers("http://peer"))
+	defer stop()
+
+	if response := doJSON(t, http.MethodPost, httpServer.URL+"/v1/antientropy/_repair?from=http://peer", nil); response.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Repair on a cluster member: %d, expected 501", response.StatusCode)
+	}
+}
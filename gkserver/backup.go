@@ -0,0 +1,232 @@
+package gkserver
+
+import (
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkstore"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoBackupDirectory means ?dir= or ?basedir= was given to a server without WithBackupDirectory
+var errNoBackupDirectory = errors.New("Backups to directories on the server aren't enabled")
+
+// errBadBackupDirectory means ?dir= or ?basedir= was absolute or reached outside the backup directory
+var errBadBackupDirectory = errors.New("Backup directories have to be relative to the server's backup directory, without ..")
+
+// WithBackupDirectory - the directory that ?dir= and ?basedir= of _backup and _restore are taken
+// relative to. Without it backups can only be streamed over HTTP
+func WithBackupDirectory(directory string) Option {
+	return func(server *Server) {
+		server.backupDirectory = directory
+	}
+}
+
+// backupPath - where the backup directory dir, as given in a request, is on the server. dir has to
+// stay inside the backup directory, even once any symlinks in it are followed
+func (server *Server) backupPath(dir string) (path string, err error) {
+	if server.backupDirectory == "" {
+		return "", errNoBackupDirectory
+	}
+	if filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" || strings.HasPrefix(filepath.ToSlash(dir), "/") {
+		return "", fmt.Errorf("%w: %s", errBadBackupDirectory, dir)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(dir), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %s", errBadBackupDirectory, dir)
+		}
+	}
+	if dir = filepath.Clean(dir); dir == "." {
+		return "", fmt.Errorf("%w: %s", errBadBackupDirectory, dir)
+	}
+	path = filepath.Join(server.backupDirectory, dir)
+
+	root, err := evalSymlinks(server.backupDirectory)
+	if err != nil {
+		return
+	}
+	resolved, err := evalSymlinks(path)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", errBadBackupDirectory, dir)
+	}
+	return
+}
+
+// evalSymlinks - path with any symlinks followed. A backup directory may not have been made yet, so
+// the parts of path that don't exist are kept as they are
+func evalSymlinks(path string) (resolved string, err error) {
+	resolved, err = filepath.EvalSymlinks(path)
+	if !os.IsNotExist(err) {
+		return
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	if resolved, err = evalSymlinks(parent); err != nil {
+		return
+	}
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+// handleBackup - a backup of the store as a tar stream (see gokave.Store.Backup), which
+// POST /v1/stores/{store}/_restore takes back. The store stays in use while it is sent. With the ID
+// and Cursor of an earlier backup, as ?base=&generation=&segment=&offset=, it is an incremental
+// backup of what was added after that one. A failure part way through cuts the response short so
+// the client can't mistake it for a whole backup
+func handleBackup(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	base, err := backupBase(httpRequest.URL.Query())
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	fmt.Printf("Backup store: %s\n", store.Name())
+	if base != nil {
+		// Before anything is sent, so an incremental backup that can't be taken gets an error status
+		if err = store.CheckBackupBase(*base); err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+	}
+	header := responseWriter.Header()
+	header.Set("Content-Type", "application/x-tar")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", store.Name()+".tar"))
+	info, err := store.Backup(httpRequest.Context(), responseWriter, base)
+	if err != nil {
+		fmt.Println(err)
+		panic(http.ErrAbortHandler)
+	}
+	fmt.Printf("Backup store: %s: %d files, %d bytes up to seq %d\n", store.Name(), len(info.Files), info.Bytes, info.LastSeq)
+}
+
+// handleBackupToDirectory - back the store up into ?dir= in the backup directory (see
+// WithBackupDirectory), which mustn't hold anything already, returning a gkstore.BackupInfo.
+// ?basedir=, an earlier backup directory there, or the base parameters of handleBackup make it an
+// incremental backup
+func (server *Server) handleBackupToDirectory(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	if query.Get("dir") == "" {
+		http.Error(responseWriter, "No directory to back up to: ?dir= is needed", http.StatusBadRequest)
+		return
+	}
+	directory, err := server.backupPath(query.Get("dir"))
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	base, err := backupBase(query)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Get("basedir") != "" {
+		baseDirectory, err := server.backupPath(query.Get("basedir"))
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		info, err := db.ReadBackupInfo(baseDirectory)
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		base = &info
+	}
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	fmt.Printf("Backup store: %s to %s\n", store.Name(), query.Get("dir"))
+	info, err := store.BackupToDirectory(httpRequest.Context(), directory, base)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, info)
+}
+
+// backupBase - the base backup from ?base=&generation=&segment=&offset=, nil without ?base=
+func backupBase(query url.Values) (base *gkstore.BackupInfo, err error) {
+	if query.Get("base") == "" {
+		return
+	}
+	base = &gkstore.BackupInfo{ID: query.Get("base")}
+	base.Cursor.Segment = query.Get("segment")
+	if base.Cursor.Generation, err = strconv.ParseUint(query.Get("generation"), 10, 64); err != nil {
+		return nil, fmt.Errorf("Bad generation: %s", query.Get("generation"))
+	}
+	if base.Cursor.Offset, err = strconv.ParseInt(query.Get("offset"), 10, 64); err != nil || base.Cursor.Offset < 0 {
+		return nil, fmt.Errorf("Bad offset: %s", query.Get("offset"))
+	}
+	return
+}
+
+// handleRestore - create the store from the backup tar streams in the body or, with ?dir=, the backup
+// directories in the backup directory (see WithBackupDirectory). Either is a full backup followed by
+// any incremental backups taken on from it, in order: the tar streams one after the other and ?dir=
+// once for each. ?seq= and ?time= (RFC 3339) stop the restore at that change, returning a
+// gkstore.RestoreStats. The store mustn't exist already
+func (server *Server) handleRestore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	var until gkstore.RestorePoint
+	if seq := query.Get("seq"); seq != "" {
+		var err error
+		if until.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil || until.Seq == 0 {
+			http.Error(responseWriter, fmt.Sprintf("Bad seq: %s", seq), http.StatusBadRequest)
+			return
+		}
+	}
+	if at := query.Get("time"); at != "" {
+		var err error
+		if until.Time, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			http.Error(responseWriter, fmt.Sprintf("Bad time: %s", at), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var directories []string
+	for _, dir := range query["dir"] {
+		directory, err := server.backupPath(dir)
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		directories = append(directories, directory)
+	}
+
+	storeName := params["store"]
+	fmt.Printf("Restore store: %s\n", storeName)
+	var stats gkstore.RestoreStats
+	var err error
+	if len(directories) > 0 {
+		stats, err = db.RestoreStoreFromDirectories(httpRequest.Context(), storeName, directories, until)
+	} else {
+		stats, err = db.RestoreStore(httpRequest.Context(), storeName, httpRequest.Body, until)
+	}
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, stats)
+}
+
+// handleRestoreUnsupported - a restore creates the store on this node alone, which a member of a Raft
+// cluster or a node of a sharded deployment mustn't do as the others wouldn't have it
+func handleRestoreUnsupported(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	http.Error(responseWriter, "Restore isn't supported by a cluster member or shard node", http.StatusNotImplemented)
+}
@@ -0,0 +1,129 @@
+package gkserver
+
+import (
+	"context"
+	"errors"
+	"gokave"
+	"gokave/gkfs"
+	"gokave/gkstore"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupDirectories(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, gokave.WithFS(fsys))
+	httpServer, stop := startTestServer(db, WithBackupDirectory("/backups"))
+	defer stop()
+	storeURL := httpServer.URL + "/v1/stores/s"
+	if err := db.Write(ctx, "s", "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var info gkstore.BackupInfo
+	if response := doJSON(t, http.MethodPost, storeURL+"/_backup?dir=full", &info); response.StatusCode != http.StatusOK {
+		t.Fatalf("Backup: %d", response.StatusCode)
+	}
+	if _, err := gkstore.ReadBackupInfo(fsys, "/backups/full"); err != nil {
+		t.Errorf("Backup isn't in the backup directory: %v", err)
+	}
+	if err := db.Write(ctx, "s", "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if response := doJSON(t, http.MethodPost, storeURL+"/_backup?dir=later/incremental&basedir=full", &info); response.StatusCode != http.StatusOK || info.Base == "" {
+		t.Fatalf("Incremental backup: %d %+v", response.StatusCode, info)
+	}
+
+	// Nothing outside the backup directory can be written or read
+	for _, query := range []string{
+		"/_backup?dir=" + url.QueryEscape("/tmp/x"),
+		"/_backup?dir=" + url.QueryEscape("../x"),
+		"/_backup?dir=" + url.QueryEscape("a/../../x"),
+		"/_backup?dir=.",
+		"/_backup?dir=x&basedir=" + url.QueryEscape("../full"),
+		"/_restore?dir=" + url.QueryEscape("/backups/full"),
+		"/_restore?dir=full&dir=" + url.QueryEscape("../later/incremental"),
+	} {
+		if response := doJSON(t, http.MethodPost, storeURL+query, nil); response.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %d, expected 400", query, response.StatusCode)
+		}
+	}
+
+	var stats gkstore.RestoreStats
+	restoreURL := httpServer.URL + "/v1/stores/r/_restore?dir=full&dir=" + url.QueryEscape("later/incremental")
+	if response := doJSON(t, http.MethodPost, restoreURL, &stats); response.StatusCode != http.StatusOK {
+		t.Fatalf("Restore: %d", response.StatusCode)
+	}
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := db.Read(ctx, "r", key); err != nil || string(got) != value {
+			t.Errorf("Restored %s: %q %v", key, got, err)
+		}
+	}
+}
+
+func TestBackupDirectorySymlinks(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "gkbackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDirectory)
+	root := filepath.Join(tempDirectory, "backups")
+	outside := filepath.Join(tempDirectory, "outside")
+	for _, directory := range []string{root, outside} {
+		if err = os.Mkdir(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link inside the backup directory to one outside it, and one to another place inside it
+	if err = os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skip("Symlinks not supported:", err)
+	}
+	if err = os.Mkdir(filepath.Join(root, "nightly"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(filepath.Join(root, "nightly"), filepath.Join(root, "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(nil, WithBackupDirectory(root))
+	for _, dir := range []string{"escape", "escape/full", "escape/a/b"} {
+		if _, err := server.backupPath(dir); !errors.Is(err, errBadBackupDirectory) {
+			t.Errorf("backupPath(%q): %v, expected errBadBackupDirectory", dir, err)
+		}
+	}
+	for _, dir := range []string{"full", "latest/full", "new/full"} {
+		if path, err := server.backupPath(dir); err != nil || path != filepath.Join(root, dir) {
+			t.Errorf("backupPath(%q): %q, err %v", dir, path, err)
+		}
+	}
+}
+
+func TestBackupDirectoryNeeded(t *testing.T) {
+	db := openTestDB(t)
+	httpServer, stop := startTestServer(db)
+	defer stop()
+	if response := doJSON(t, http.MethodPost, httpServer.URL+"/v1/stores/s/_backup?dir=full", nil); response.StatusCode != http.StatusForbidden {
+		t.Errorf("Backup without a backup directory: %d, expected 403", response.StatusCode)
+	}
+	if response := doJSON(t, http.MethodPost, httpServer.URL+"/v1/stores/r/_restore?dir=full", nil); response.StatusCode != http.StatusForbidden {
+		t.Errorf("Restore without a backup directory: %d, expected 403", response.StatusCode)
+	}
+}
+
+func TestRestoreUnsupportedInCluster(t *testing.T) {
+	db := openTestDB(t)
+	node := newTestNode(t, db)
+	defer node.Stop()
+	httpServer, stop := startTestServer(db, WithCluster(node), WithBackupDirectory("/backups"))
+	defer stop()
+	for _, path := range []string{"/v1/stores/r/_restore?dir=full", "/store/admin/r/_restore"} {
+		if response := doJSON(t, http.MethodPost, httpServer.URL+path, nil); response.StatusCode != http.StatusNotImplemented {
+			t.Errorf("%s on a cluster member: %d, expected 501", path, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package gkserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkraft"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WithCluster - make the server a member of a Raft cluster. Writes go through node so that every
+// member applies them, and only the leader takes them: the others redirect them to it with 307
+// Temporary Redirect. Reads are served from the local DB unless ?linearizable=true asks for one
+// that sees every write committed before it, which only the leader can serve
+func WithCluster(node *gkraft.Node) Option {
+	return func(server *Server) {
+		server.node = node
+	}
+}
+
+// handleClusterWrite - handleWrite through the cluster
+func (server *Server) handleClusterWrite(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName, key := params["store"], params["key"]
+	if err := gokave.ValidateKey(key); err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	value, err := ioutil.ReadAll(httpRequest.Body)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("Post %s to store: %s\n", key, storeName)
+	server.propose(responseWriter, httpRequest, gkraft.Command{Op: gkraft.OpPut, Store: storeName, Key: key, Value: value, Meta: requestMeta(httpRequest)})
+}
+
+// handleClusterDelete - handleDelete through the cluster
+func (server *Server) handleClusterDelete(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName, key := params["store"], params["key"]
+	fmt.Printf("Delete %s from store: %s\n", key, storeName)
+	server.propose(responseWriter, httpRequest, gkraft.Command{Op: gkraft.OpDelete, Store: storeName, Key: key})
+}
+
+// handleClusterCreateStore - handleCreateStore through the cluster
+func (server *Server) handleClusterCreateStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	if err := gokave.ValidateStoreName(params["store"]); err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	query := httpRequest.URL.Query()
+	fmt.Printf("Create store: %s:\n", params["store"])
+	command := gkraft.Command{Op: gkraft.OpCreateStore, Store: params["store"], Codec: query.Get("codec"), KeyCase: query.Get("keycase")}
+	if _, ok := server.propose(responseWriter, httpRequest, command); ok {
+		responseWriter.WriteHeader(http.StatusCreated)
+	}
+}
+
+// handleClusterDeleteStore - handleDeleteStore through the cluster
+func (server *Server) handleClusterDeleteStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Printf("Remove store: %s:\n", params["store"])
+	server.propose(responseWriter, httpRequest, gkraft.Command{Op: gkraft.OpDeleteStore, Store: params["store"]})
+}
+
+// handleClusterMigrateStore - handleMigrateStore through the cluster
+func (server *Server) handleClusterMigrateStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	keyCase := httpRequest.URL.Query().Get("keycase")
+	fmt.Printf("Migrate store: %s: key case %s\n", params["store"], keyCase)
+	result, ok := server.propose(responseWriter, httpRequest, gkraft.Command{Op: gkraft.OpMigrateKeyCase, Store: params["store"], KeyCase: keyCase})
+	if ok {
+		rewritten, _ := result.(int)
+		writeJSON(responseWriter, httpRequest, migrateResult{Store: params["store"], KeyCase: keyCase, KeysRewritten: rewritten})
+	}
+}
+
+// propose - propose command and wait for it to be applied. Anything but success has been written
+// to responseWriter when ok is false
+func (server *Server) propose(responseWriter http.ResponseWriter, httpRequest *http.Request, command gkraft.Command) (result interface{}, ok bool) {
+	result, err := gkraft.ProposeCommand(httpRequest.Context(), server.node, command)
+	if errors.Is(err, gkraft.ErrNotLeader) {
+		server.redirectToLeader(responseWriter, httpRequest)
+		return nil, false
+	}
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return nil, false
+	}
+	return result, true
+}
+
+// linearizable - handler, after a read barrier if ?linearizable=true. Followers redirect such reads
+// to the leader
+func (server *Server) linearizable(handler handlerFunc) handlerFunc {
+	return func(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+		if linearizable, _ := strconv.ParseBool(httpRequest.URL.Query().Get("linearizable")); linearizable {
+			err := server.node.ReadBarrier(httpRequest.Context())
+			if errors.Is(err, gkraft.ErrNotLeader) {
+				server.redirectToLeader(responseWriter, httpRequest)
+				return
+			}
+			if err != nil {
+				writeError(responseWriter, httpRequest, err)
+				return
+			}
+		}
+		handler(db, responseWriter, httpRequest, params)
+	}
+}
+
+// redirectToLeader - send the request on to the leader, or 503 if there isn't one just now
+func (server *Server) redirectToLeader(responseWriter http.ResponseWriter, httpRequest *http.Request) {
+	leader, ok := server.node.Leader()
+	if !ok || leader.ID == server.node.ID() {
+		http.Error(responseWriter, "No leader", http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(responseWriter, httpRequest, strings.TrimSuffix(leader.Addr, "/")+httpRequest.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// handleClusterStatus - the node's gkraft.Status
+func (server *Server) handleClusterStatus(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	writeJSON(responseWriter, httpRequest, server.node.Status())
+}
+
+// handleAddMember - add a member, or change its address: {"id": "n4", "addr": "http://host:8083"}
+func (server *Server) handleAddMember(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	var member gkraft.Member
+	if err := json.NewDecoder(httpRequest.Body).Decode(&member); err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Bad member: %s", err), http.StatusBadRequest)
+		return
+	}
+	if member.ID == "" || member.Addr == "" {
+		http.Error(responseWriter, "A member needs an id and an addr", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("Add cluster member: %s at %s\n", member.ID, member.Addr)
+	server.changeMembership(responseWriter, httpRequest, server.node.AddMember(httpRequest.Context(), member))
+}
+
+func (server *Server) handleRemoveMember(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Printf("Remove cluster member: %s\n", params["id"])
+	server.changeMembership(responseWriter, httpRequest, server.node.RemoveMember(httpRequest.Context(), params["id"]))
+}
+
+func (server *Server) changeMembership(responseWriter http.ResponseWriter, httpRequest *http.Request, err error) {
+	if errors.Is(err, gkraft.ErrNotLeader) {
+		server.redirectToLeader(responseWriter, httpRequest)
+		return
+	}
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	server.handleClusterStatus(nil, responseWriter, httpRequest, nil)
+}
+
+// handleRaft - requests from the other members' gkraft.HTTPTransport
+func (server *Server) handleRaft(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	server.raftHandler.ServeHTTP(responseWriter, httpRequest)
+}
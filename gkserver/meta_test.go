@@ -0,0 +1,65 @@
+package gkserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetaHeaders(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	url := httpServer.URL + "/v1/stores/s/keys/doc"
+
+	request, err := http.NewRequest(http.MethodPut, url, strings.NewReader(`{"n":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(MetaHeaderPrefix+"Owner", "ops")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Put: %d", response.StatusCode)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		status, header, body := doRequest(t, method, url, "")
+		if status != http.StatusOK || header.Get("Content-Type") != "application/json" ||
+			header.Get(MetaHeaderPrefix+"Owner") != "ops" || header.Get("Content-Length") != "7" {
+			t.Errorf("%s: %d %v", method, status, header)
+		}
+		expected := `{"n":1}`
+		if method == http.MethodHead {
+			expected = ""
+		}
+		if body != expected {
+			t.Errorf("%s body: %q, expected %q", method, body, expected)
+		}
+	}
+
+	// HEAD never sends a body, even one the handler tried to write
+	response, err = http.Head(httpServer.URL + "/v1/stores/s/keys/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound || len(body) != 0 {
+		t.Errorf("HEAD of a missing key: %d %q", response.StatusCode, body)
+	}
+
+	// A value written through the legacy route without any meta headers has none to send back
+	expectStatus(t, http.MethodPost, httpServer.URL+"/store/s/plain", "text", http.StatusOK)
+	status, header, _ := doRequest(t, http.MethodHead, httpServer.URL+"/store/s/plain", "")
+	if status != http.StatusOK || header.Get(MetaHeaderPrefix+"Owner") != "" || header.Get("Content-Length") != "4" {
+		t.Errorf("HEAD of a value without meta: %d %v", status, header)
+	}
+}
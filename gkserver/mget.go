@@ -0,0 +1,147 @@
+package gkserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxMGetKeys - the most keys a single _mget can ask for
+const maxMGetKeys = 1000
+
+// Statuses of the keys in an _mget response
+const (
+	MGetFound   = "found"
+	MGetMissing = "missing"
+	MGetDeleted = "deleted"
+	MGetError   = "error"
+)
+
+// mgetRequest - the body of an _mget: {"keys": ["a", "b"]}
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// mgetResult - one key of a JSON _mget response. Values are base64 encoded
+type mgetResult struct {
+	Status      string            `json:"status"`
+	Value       []byte            `json:"value,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// handleMGet - read many keys in one request. The response is a JSON object keyed by key unless
+// the Accept header asks for multipart/mixed, in which case there is a part per key in the order
+// asked for, each with X-Gokave-Key (escaped as in a URL path) and X-Gokave-Status headers
+func handleMGet(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	request, ok := readMGetRequest(responseWriter, httpRequest)
+	if !ok {
+		return
+	}
+
+	results, err := db.ReadMany(httpRequest.Context(), params["store"], request.Keys)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeMGet(responseWriter, httpRequest, request.Keys, results)
+}
+
+// readMGetRequest - the body of an _mget. Anything wrong with it has been written to
+// responseWriter when ok is false
+func readMGetRequest(responseWriter http.ResponseWriter, httpRequest *http.Request) (request mgetRequest, ok bool) {
+	if err := json.NewDecoder(httpRequest.Body).Decode(&request); err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Bad _mget body: %s", err), http.StatusBadRequest)
+		return request, false
+	}
+	if len(request.Keys) > maxMGetKeys {
+		http.Error(responseWriter, fmt.Sprintf("Too many keys: %d. Max: %d", len(request.Keys), maxMGetKeys), http.StatusBadRequest)
+		return request, false
+	}
+	return request, true
+}
+
+// writeMGet - the _mget response for results, in the form the request asked for
+func writeMGet(responseWriter http.ResponseWriter, httpRequest *http.Request, keys []string, results map[string]gokave.ReadResult) {
+	if strings.Contains(httpRequest.Header.Get("Accept"), "multipart/mixed") {
+		writeMGetMultipart(responseWriter, keys, results)
+		return
+	}
+	response := make(map[string]mgetResult, len(results))
+	for key, result := range results {
+		r := mgetResult{Status: mgetStatus(result.Err), Value: result.Value}
+		if r.Status == MGetError {
+			r.Error = result.Err.Error()
+		}
+		for name, value := range result.Meta {
+			if name == gokave.MetaContentType {
+				r.ContentType = value
+				continue
+			}
+			if r.Meta == nil {
+				r.Meta = make(map[string]string)
+			}
+			r.Meta[name] = value
+		}
+		response[key] = r
+	}
+	writeJSON(responseWriter, httpRequest, response)
+}
+
+func writeMGetMultipart(responseWriter http.ResponseWriter, keys []string, results map[string]gokave.ReadResult) {
+	writer := multipart.NewWriter(responseWriter)
+	responseWriter.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	responseWriter.WriteHeader(http.StatusOK)
+
+	written := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if written[key] {
+			continue
+		}
+		written[key] = true
+		result := results[key]
+
+		header := make(textproto.MIMEHeader)
+		header.Set("X-Gokave-Key", url.PathEscape(key))
+		header.Set("X-Gokave-Status", mgetStatus(result.Err))
+		if result.Err == nil {
+			header.Set("Content-Type", "application/octet-stream")
+			for name, value := range result.Meta {
+				if name == gokave.MetaContentType {
+					header.Set("Content-Type", value)
+					continue
+				}
+				header.Set(MetaHeaderPrefix+name, value)
+			}
+			header.Set("Content-Length", strconv.Itoa(len(result.Value)))
+		}
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			// The status has gone so all we can do is stop
+			fmt.Println("MGet:", err)
+			return
+		}
+		part.Write(result.Value)
+	}
+	writer.Close()
+}
+
+func mgetStatus(err error) string {
+	switch {
+	case err == nil:
+		return MGetFound
+	case errors.Is(err, gokave.ErrKeyDeleted):
+		return MGetDeleted
+	case errors.Is(err, gokave.ErrKeyNotFound):
+		return MGetMissing
+	}
+	return MGetError
+}
@@ -0,0 +1,170 @@
+package gkserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// mgetTestServer - a server whose store s holds a (with meta), b/c and the deleted gone
+func mgetTestServer(t *testing.T) (httpServer *httptest.Server, stop func()) {
+	t.Helper()
+	ctx := context.Background()
+	db := openTestDB(t)
+	if err := db.WriteMeta(ctx, "s", "a", []byte("one"), map[string]string{"Content-Type": "text/plain", "Owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(ctx, "s", "b/c", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(ctx, "s", "gone", []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ctx, "s", "gone"); err != nil {
+		t.Fatal(err)
+	}
+	httpServer = httptest.NewServer(New(db))
+	return httpServer, func() {
+		httpServer.Close()
+		db.Close()
+	}
+}
+
+// postMGet - post keys to _mget at url with the Accept header accept
+func postMGet(t *testing.T, url string, accept string, keys ...string) (response *http.Response) {
+	t.Helper()
+	body, err := json.Marshal(mgetRequest{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, url, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	if response, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestMGetJSON(t *testing.T) {
+	httpServer, stop := mgetTestServer(t)
+	defer stop()
+
+	for _, path := range []string{"/v1/stores/s/_mget", "/store/s/_mget"} {
+		response := postMGet(t, httpServer.URL+path, "", "a", "b/c", "missing", "gone", "a", strings.Repeat("k", 256))
+		var results map[string]mgetResult
+		err := json.NewDecoder(response.Body).Decode(&results)
+		response.Body.Close()
+		if err != nil || response.StatusCode != http.StatusOK || !strings.HasPrefix(response.Header.Get("Content-Type"), "application/json") {
+			t.Fatalf("%s: %d %s, err %v", path, response.StatusCode, response.Header.Get("Content-Type"), err)
+		}
+
+		// One entry per distinct key
+		if len(results) != 5 {
+			t.Errorf("%s: %d results, expected 5", path, len(results))
+		}
+		if a := results["a"]; a.Status != MGetFound || string(a.Value) != "one" || a.ContentType != "text/plain" || a.Meta["Owner"] != "ops" {
+			t.Errorf("%s a: %+v", path, a)
+		}
+		if bc := results["b/c"]; bc.Status != MGetFound || string(bc.Value) != "two" || bc.ContentType != "" || bc.Meta != nil {
+			t.Errorf("%s b/c: %+v", path, bc)
+		}
+		if missing := results["missing"]; missing.Status != MGetMissing || missing.Value != nil {
+			t.Errorf("%s missing: %+v", path, missing)
+		}
+		if gone := results["gone"]; gone.Status != MGetDeleted || gone.Value != nil {
+			t.Errorf("%s gone: %+v", path, gone)
+		}
+		if invalid := results[strings.Repeat("k", 256)]; invalid.Status != MGetError || invalid.Error == "" {
+			t.Errorf("%s invalid key: %+v", path, invalid)
+		}
+	}
+}
+
+func TestMGetMultipart(t *testing.T) {
+	httpServer, stop := mgetTestServer(t)
+	defer stop()
+
+	response := postMGet(t, httpServer.URL+"/v1/stores/s/_mget", "multipart/mixed, application/json;q=0.5", "gone", "b/c", "a", "missing", "b/c")
+	defer response.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || response.StatusCode != http.StatusOK || mediaType != "multipart/mixed" {
+		t.Fatalf("Response: %d %s, err %v", response.StatusCode, response.Header.Get("Content-Type"), err)
+	}
+
+	// A part per distinct key, in the order asked for
+	type part struct {
+		key, status, contentType, owner, value string
+	}
+	var parts []part
+	reader := multipart.NewReader(response.Body, params["boundary"])
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := url.PathUnescape(p.Header.Get("X-Gokave-Key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part{key, p.Header.Get("X-Gokave-Status"), p.Header.Get("Content-Type"), p.Header.Get(MetaHeaderPrefix + "Owner"), string(value)})
+	}
+	expected := []part{
+		{"gone", MGetDeleted, "", "", ""},
+		{"b/c", MGetFound, "application/octet-stream", "", "two"},
+		{"a", MGetFound, "text/plain", "ops", "one"},
+		{"missing", MGetMissing, "", "", ""},
+	}
+	if len(parts) != len(expected) {
+		t.Fatalf("Parts: %+v, expected %+v", parts, expected)
+	}
+	for i := range expected {
+		if parts[i] != expected[i] {
+			t.Errorf("Part %d: %+v, expected %+v", i, parts[i], expected[i])
+		}
+	}
+}
+
+func TestMGetBadRequests(t *testing.T) {
+	httpServer, stop := mgetTestServer(t)
+	defer stop()
+
+	expectStatus(t, http.MethodPost, httpServer.URL+"/v1/stores/s/_mget", "not json", http.StatusBadRequest)
+	tooMany := make([]string, maxMGetKeys+1)
+	for i := range tooMany {
+		tooMany[i] = "k"
+	}
+	response := postMGet(t, httpServer.URL+"/v1/stores/s/_mget", "", tooMany...)
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Too many keys: %d", response.StatusCode)
+	}
+	response = postMGet(t, httpServer.URL+"/v1/stores/missing/_mget", "", "a")
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing store: %d", response.StatusCode)
+	}
+	// An empty list is answered with an empty object
+	if body := expectStatus(t, http.MethodPost, httpServer.URL+"/v1/stores/s/_mget", `{"keys": []}`, http.StatusOK); body != "{}" {
+		t.Errorf("No keys: %q", body)
+	}
+}
@@ -0,0 +1,121 @@
+package gkserver
+
+import (
+	"context"
+	"fmt"
+	"gokave"
+	"gokave/gkreplica"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRecordsBytes - about the most record data sent in one _records response
+const maxRecordsBytes = 1 << 20
+
+// maxRecordsWait - the longest a _records request can wait for new records
+const maxRecordsWait = time.Minute
+
+// WithFollower - report on and allow promotion of the follower keeping the DB in step with its primary
+func WithFollower(follower *gkreplica.Follower) Option {
+	return func(server *Server) {
+		server.follower = follower
+	}
+}
+
+// handleRecords - the raw records in a segment from ?offset=, as read by a replica. Without
+// ?segment= the oldest segment is read. If there aren't any records yet the request waits up to
+// ?wait= for some. Where the records came from and where to carry on from are in X-Gokave- headers.
+// A segment that has been compacted away gets 410 Gone
+func (server *Server) handleRecords(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if query.Get("offset") == "" {
+		offset, err = 0, nil
+	}
+	if err != nil || offset < 0 {
+		http.Error(responseWriter, fmt.Sprintf("Bad offset: %s", query.Get("offset")), http.StatusBadRequest)
+		return
+	}
+	var wait time.Duration
+	if query.Get("wait") != "" {
+		if wait, err = time.ParseDuration(query.Get("wait")); err != nil || wait < 0 {
+			http.Error(responseWriter, fmt.Sprintf("Bad wait: %s", query.Get("wait")), http.StatusBadRequest)
+			return
+		}
+		if wait > maxRecordsWait {
+			wait = maxRecordsWait
+		}
+	}
+
+	ctx := httpRequest.Context()
+	replication := db.Replication()
+	records, err := replication.ReadSegment(ctx, params["store"], query.Get("segment"), offset, maxRecordsBytes)
+	if err == nil && len(records.Data) == 0 && records.NextSegment == "" && wait > 0 {
+		// Caught up so wait for the next change, or for the server to shut down
+		store, openErr := db.OpenStore(ctx, params["store"])
+		if openErr != nil {
+			writeError(responseWriter, httpRequest, openErr)
+			return
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		go func() {
+			select {
+			case <-server.shutdown:
+				cancel()
+			case <-waitCtx.Done():
+			}
+		}()
+		_, err = store.Poll(waitCtx, records.LastSeq, "", 1)
+		cancel()
+		if err == nil {
+			records, err = replication.ReadSegment(ctx, params["store"], records.Segment, offset, maxRecordsBytes)
+		}
+	}
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+
+	header := responseWriter.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("X-Gokave-Segment", records.Segment)
+	header.Set("X-Gokave-Offset", strconv.FormatInt(records.Offset, 10))
+	header.Set("X-Gokave-Next-Offset", strconv.FormatInt(records.Next, 10))
+	if records.NextSegment != "" {
+		header.Set("X-Gokave-Next-Segment", records.NextSegment)
+	}
+	header.Set("X-Gokave-Last-Seq", strconv.FormatUint(records.LastSeq, 10))
+	header.Set("X-Gokave-Compacted-Seq", strconv.FormatUint(records.CompactedSeq, 10))
+	header.Set("Content-Length", strconv.Itoa(len(records.Data)))
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(records.Data)
+}
+
+// handleReplicationStatus - a gkreplica.Status. A replica reports how far behind its primary each store is
+func (server *Server) handleReplicationStatus(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	if server.follower != nil && db.IsReplica() {
+		writeJSON(responseWriter, httpRequest, server.follower.Status())
+		return
+	}
+	status, err := gkreplica.PrimaryStatus(httpRequest.Context(), db)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, status)
+}
+
+// handlePromote - stop following the primary and start accepting writes. 409 if the server isn't a replica
+func (server *Server) handlePromote(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	if !db.IsReplica() {
+		http.Error(responseWriter, "Not a replica", http.StatusConflict)
+		return
+	}
+	if server.follower != nil {
+		server.follower.Promote()
+	} else {
+		db.Promote()
+	}
+	server.handleReplicationStatus(db, responseWriter, httpRequest, params)
+}
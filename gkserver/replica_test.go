@@ -0,0 +1,186 @@
+package gkserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkfs"
+	"gokave/gkreplica"
+	"gokave/gkstore"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReplica - a replica DB on fsys following primary, served over HTTP
+type testReplica struct {
+	db       *gokave.DB
+	follower *gkreplica.Follower
+	url      string
+	stop     func()
+}
+
+func startTestReplica(t *testing.T, fsys gkfs.FS, primary string) (replica *testReplica) {
+	t.Helper()
+	db, err := gokave.Open(gokave.WithFS(fsys), gokave.WithDataDirectory("/data"), gokave.WithConfigFile("/config.json"), gokave.WithReplica())
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := gkreplica.New(db, primary)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	httpServer, stop := startTestServer(db, WithFollower(follower))
+	follower.Start()
+	return &testReplica{db: db, follower: follower, url: httpServer.URL, stop: func() {
+		follower.Stop()
+		stop()
+	}}
+}
+
+// waitForReplica - wait until the replica's store s has caught up with the primary's, and has
+// reported doing so
+func waitForReplica(t *testing.T, primary *gokave.DB, replica *testReplica) (status gkreplica.StoreStatus) {
+	t.Helper()
+	ctx := context.Background()
+	store, err := primary.OpenStore(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		status = replica.follower.Status().Stores["s"]
+		if status.LastSeq == store.LastSeq() && status.PrimaryLastSeq == store.LastSeq() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Replica didn't catch up: %+v, primary is at %d", status, store.LastSeq())
+	return
+}
+
+// expectReplicated - the replica holds the primary's value for each key, or doesn't have the key
+// when the primary doesn't
+func expectReplicated(t *testing.T, primary *gokave.DB, replica *gokave.DB, keys ...string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, key := range keys {
+		want, wantErr := primary.Read(ctx, "s", key)
+		got, err := replica.Read(ctx, "s", key)
+		if string(got) != string(want) || (err == nil) != (wantErr == nil) {
+			t.Errorf("Replica %s: %q %v, primary has %q %v", key, got, err, want, wantErr)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	// Small segments so that the primary rolls over and compacts while the replica follows
+	previous := gkstore.MaxSegmentSize
+	gkstore.MaxSegmentSize = 100
+	defer func() { gkstore.MaxSegmentSize = previous }()
+	ctx := context.Background()
+	primary := openTestDB(t)
+	primaryServer, stopPrimary := startTestServer(primary)
+	defer stopPrimary()
+	for i := 0; i < 5; i++ {
+		if err := primary.Write(ctx, "s", fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replicaFS := gkfs.NewMem()
+	replica := startTestReplica(t, replicaFS, primaryServer.URL)
+	status := waitForReplica(t, primary, replica)
+	expectReplicated(t, primary, replica.db, "k0", "k1", "k2", "k3", "k4")
+	cursor, err := replica.db.Replication().Cursor(ctx, "s")
+	if err != nil || cursor.Primary != primaryServer.URL || cursor.Segment == "" {
+		t.Fatalf("Cursor: %+v %v", cursor, err)
+	}
+	if status.Segment != cursor.Segment || status.Offset != cursor.Offset || status.Lag != 0 || status.LastContact == nil {
+		t.Errorf("Store status: %+v, cursor %+v", status, cursor)
+	}
+
+	// Writes only go to the primary
+	response := doJSON(t, http.MethodPut, replica.url+"/v1/stores/s/keys/k0", nil)
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Write to the replica: %d, expected 403", response.StatusCode)
+	}
+	var replicationStatus gkreplica.Status
+	doJSON(t, http.MethodGet, replica.url+"/v1/replication", &replicationStatus)
+	if replicationStatus.Role != gkreplica.RoleReplica || replicationStatus.Primary != primaryServer.URL || replicationStatus.Stores["s"].LastSeq != status.LastSeq {
+		t.Errorf("Replica status: %+v", replicationStatus)
+	}
+	doJSON(t, http.MethodGet, primaryServer.URL+"/v1/replication", &replicationStatus)
+	if replicationStatus.Role != gkreplica.RolePrimary || replicationStatus.Stores["s"].LastSeq != status.LastSeq {
+		t.Errorf("Primary status: %+v", replicationStatus)
+	}
+
+	// A restarted replica carries on from its cursor
+	replica.stop()
+	if err = primary.Write(ctx, "s", "k5", []byte("written while the replica was down")); err != nil {
+		t.Fatal(err)
+	}
+	replica = startTestReplica(t, replicaFS, primaryServer.URL)
+	defer func() {
+		replica.stop()
+	}()
+	if restarted, err := replica.db.Replication().Cursor(ctx, "s"); err != nil || restarted != cursor {
+		t.Errorf("Cursor after restart: %+v %v, expected %+v", restarted, err, cursor)
+	}
+	waitForReplica(t, primary, replica)
+	expectReplicated(t, primary, replica.db, "k5")
+
+	// Large values roll the primary over to new segments, which the replica follows
+	for i := 0; i < 5; i++ {
+		if err = primary.Write(ctx, "s", fmt.Sprintf("k%d", i), []byte(strings.Repeat("v", 150))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = primary.Delete(ctx, "s", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, primary, replica)
+	expectReplicated(t, primary, replica.db, "k0", "k1", "k2", "k3", "k4")
+	if cursor, err = replica.db.Replication().Cursor(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction on the primary removes the segment the replica's cursor points into while it is down
+	replica.stop()
+	for i := 0; i < 3; i++ {
+		if err = primary.Write(ctx, "s", fmt.Sprintf("k%d", i), []byte(strings.Repeat("w", 150))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := primary.OpenStore(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = primary.Replication().ReadSegment(ctx, "s", cursor.Segment, cursor.Offset, 1); !errors.Is(err, gokave.ErrSegmentNotFound) {
+		t.Fatalf("Segment %s after compaction: %v, expected ErrSegmentNotFound", cursor.Segment, err)
+	}
+	if err = primary.Write(ctx, "s", "k6", []byte("written after compaction")); err != nil {
+		t.Fatal(err)
+	}
+	replica = startTestReplica(t, replicaFS, primaryServer.URL)
+	waitForReplica(t, primary, replica)
+	expectReplicated(t, primary, replica.db, "k0", "k1", "k2", "k3", "k4", "k5", "k6")
+
+	// A promoted replica stops following and takes writes
+	doJSON(t, http.MethodPost, replica.url+"/v1/replication/_promote", &replicationStatus)
+	if replicationStatus.Role != gkreplica.RolePrimary {
+		t.Errorf("Status after promote: %+v", replicationStatus)
+	}
+	if response = doJSON(t, http.MethodPut, replica.url+"/v1/stores/s/keys/k0", nil); response.StatusCode >= 300 {
+		t.Errorf("Write to the promoted replica: %d", response.StatusCode)
+	}
+	if response = doJSON(t, http.MethodPost, replica.url+"/v1/replication/_promote", nil); response.StatusCode != http.StatusConflict {
+		t.Errorf("Promote of a primary: %d, expected 409", response.StatusCode)
+	}
+}
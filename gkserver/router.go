@@ -0,0 +1,137 @@
+package gkserver
+
+import (
+	"fmt"
+	"gokave"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// handlerFunc - a handler for a route. params holds the decoded path parameters
+type handlerFunc func(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params)
+
+// params - path parameters by name, e.g. "store" for a route pattern containing {store}
+type params map[string]string
+
+// route - a method and a path pattern split into segments. A segment is either literal text, a
+// parameter such as {store} matching exactly one segment or, as the final segment only, a parameter
+// such as {key...} matching the rest of the path including any slashes
+type route struct {
+	method   string
+	segments []string
+	handler  handlerFunc
+}
+
+// router - matches requests against its routes in the order they were added, so more specific
+// routes have to be added before the ones they overlap with
+type router struct {
+	db     *gokave.DB
+	routes []route
+}
+
+// paramValidators - checks applied to path parameters with these names before the handler is called
+var paramValidators = map[string]func(string) error{
+	"store": gokave.ValidateStoreName,
+	"key":   gokave.ValidateKey,
+}
+
+func (router *router) handle(method string, pattern string, handler handlerFunc) {
+	router.routes = append(router.routes, route{
+		method:   method,
+		segments: strings.Split(strings.TrimPrefix(pattern, "/"), "/"),
+		handler:  handler,
+	})
+}
+
+// ServeHTTP - 404 if no route matches the path, 405 if routes match the path but not the method and
+// 400 if a path parameter is invalid
+func (router *router) ServeHTTP(responseWriter http.ResponseWriter, httpRequest *http.Request) {
+	// Split the escaped path so an encoded slash (%2F) stays inside its segment
+	rawSegments := strings.Split(strings.TrimPrefix(httpRequest.URL.EscapedPath(), "/"), "/")
+	segments := make([]string, len(rawSegments))
+	for i, rawSegment := range rawSegments {
+		segment, err := url.PathUnescape(rawSegment)
+		if err != nil {
+			http.Error(responseWriter, fmt.Sprintf("Bad path: %s", err), http.StatusBadRequest)
+			return
+		}
+		segments[i] = segment
+	}
+
+	var allowed []string
+	for _, route := range router.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != httpRequest.Method && !(route.method == http.MethodGet && httpRequest.Method == http.MethodHead) {
+			// Overlapping routes, such as the legacy admin and data routes, can share a method
+			if !containsString(allowed, route.method) {
+				allowed = append(allowed, route.method)
+			}
+			continue
+		}
+		for name, value := range params {
+			if validate, ok := paramValidators[name]; ok {
+				if err := validate(value); err != nil {
+					http.Error(responseWriter, fmt.Sprintf("%s: %s", err, value), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		route.handler(router.db, responseWriter, httpRequest, params)
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		responseWriter.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(responseWriter, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(responseWriter, httpRequest)
+}
+
+// containsString - whether values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// match - the path parameters if segments fit the route's pattern
+func (route route) match(segments []string) (params params, ok bool) {
+	params = make(map[string]string)
+	for i, pattern := range route.segments {
+		if name, isRest := restParam(pattern); isRest && i == len(route.segments)-1 {
+			if i >= len(segments) {
+				return nil, false
+			}
+			params[name] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "}") {
+			params[pattern[1:len(pattern)-1]] = segments[i]
+			continue
+		}
+		if pattern != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(route.segments)
+}
+
+func restParam(pattern string) (name string, ok bool) {
+	if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "...}") {
+		return pattern[1 : len(pattern)-4], true
+	}
+	return "", false
+}
@@ -0,0 +1,184 @@
+package gkserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// doRequest - make a request with body (if not empty) and return the status, headers and body
+func doRequest(t *testing.T, method string, url string, body string) (status int, header http.Header, responseBody string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, response.Header, string(data)
+}
+
+// expectStatus - fail unless the request gets status, returning the body
+func expectStatus(t *testing.T, method string, url string, body string, status int) (responseBody string) {
+	t.Helper()
+	got, _, responseBody := doRequest(t, method, url, body)
+	if got != status {
+		t.Errorf("%s %s: %d %s, expected %d", method, url, got, strings.TrimSpace(responseBody), status)
+	}
+	return
+}
+
+func TestEscapedKeys(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	url := httpServer.URL
+
+	// An encoded slash stays part of the key, and is the same key as one written with a plain slash
+	expectStatus(t, http.MethodPut, url+"/v1/stores/s/keys/a%2Fb", "one", http.StatusOK)
+	if body := expectStatus(t, http.MethodGet, url+"/v1/stores/s/keys/a/b", "", http.StatusOK); body != "one" {
+		t.Errorf("Read with a plain slash: %q", body)
+	}
+	if body := expectStatus(t, http.MethodGet, url+"/store/s/a%2Fb", "", http.StatusOK); body != "one" {
+		t.Errorf("Legacy read with an encoded slash: %q", body)
+	}
+	expectStatus(t, http.MethodPost, url+"/store/s/c/d/e", "two", http.StatusOK)
+	if body := expectStatus(t, http.MethodGet, url+"/v1/stores/s/keys/c%2Fd%2Fe", "", http.StatusOK); body != "two" {
+		t.Errorf("Read of a key written through the legacy route: %q", body)
+	}
+	// Other escapes are decoded too
+	expectStatus(t, http.MethodPut, url+"/v1/stores/s/keys/with%20space%3F", "three", http.StatusOK)
+	if body := expectStatus(t, http.MethodGet, url+"/v1/stores/s/keys", "", http.StatusOK); body != `["a/b","c/d/e","with space?"]` {
+		t.Errorf("Keys: %s", body)
+	}
+}
+
+func TestParamValidation(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	url := httpServer.URL
+
+	for _, storeName := range []string{"bad.name", "_hidden", strings.Repeat("s", 65), "sp%20ace"} {
+		expectStatus(t, http.MethodPost, url+"/v1/stores/"+storeName, "", http.StatusBadRequest)
+		expectStatus(t, http.MethodGet, url+"/v1/stores/"+storeName+"/keys/k", "", http.StatusBadRequest)
+		expectStatus(t, http.MethodPost, url+"/store/admin/"+storeName, "", http.StatusBadRequest)
+	}
+	expectStatus(t, http.MethodPost, url+"/v1/stores/"+strings.Repeat("s", 64), "", http.StatusCreated)
+
+	expectStatus(t, http.MethodPut, url+"/v1/stores/s/keys/"+strings.Repeat("k", 256), "value", http.StatusBadRequest)
+	expectStatus(t, http.MethodPost, url+"/store/s/"+strings.Repeat("k", 256), "value", http.StatusBadRequest)
+	expectStatus(t, http.MethodPut, url+"/v1/stores/s/keys/"+strings.Repeat("k", 255), "value", http.StatusOK)
+	// A key of nothing but a slash is empty once the route has taken it apart
+	expectStatus(t, http.MethodGet, url+"/v1/stores/s/keys/", "", http.StatusBadRequest)
+}
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	url := httpServer.URL
+
+	for _, path := range []string{"/", "/v1", "/v2/stores", "/v1/stores/s/unknown", "/v1/stores/s/_compact/extra", "/store"} {
+		status, header, _ := doRequest(t, http.MethodGet, url+path, "")
+		if status != http.StatusNotFound || header.Get("Allow") != "" {
+			t.Errorf("GET %s: %d Allow %q, expected 404", path, status, header.Get("Allow"))
+		}
+	}
+	// A store or key that doesn't exist is a 404 from the handler rather than the router
+	expectStatus(t, http.MethodGet, url+"/v1/stores/missing", "", http.StatusNotFound)
+	expectStatus(t, http.MethodGet, url+"/v1/stores/s/keys/missing", "", http.StatusNotFound)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodPatch, "/v1/stores/s", "DELETE, GET, POST"},
+		{http.MethodPost, "/v1/stores", "GET"},
+		{http.MethodGet, "/v1/stores/s/_compact", "POST"},
+		{http.MethodDelete, "/v1/stores/s/_verify", "POST"},
+		{http.MethodPatch, "/v1/stores/s/keys/k", "DELETE, GET, HEAD, POST, PUT"},
+		{http.MethodPut, "/store/s/k", "DELETE, GET, HEAD, POST"},
+		{http.MethodPut, "/store/admin/s", "DELETE, GET, HEAD, POST"},
+	} {
+		status, header, _ := doRequest(t, test.method, url+test.path, "")
+		if status != http.StatusMethodNotAllowed || header.Get("Allow") != test.allow {
+			t.Errorf("%s %s: %d Allow %q, expected 405 Allow %q", test.method, test.path, status, header.Get("Allow"), test.allow)
+		}
+	}
+
+	// HEAD is served by the GET route where there isn't a HEAD route of its own
+	expectStatus(t, http.MethodHead, url+"/v1/stores/s", "", http.StatusOK)
+}
+
+func TestLegacyAliases(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	url := httpServer.URL
+
+	// Each pair makes the same request through /v1 and the original routes, and the answers match
+	for _, test := range []struct {
+		method string
+		v1     string
+		legacy string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/v1/stores/a", "/store/admin/b", "", http.StatusCreated},
+		{http.MethodPost, "/v1/stores/a", "/store/admin/a", "", http.StatusConflict},
+		{http.MethodGet, "/v1/stores", "/store/admin/", "", http.StatusOK},
+		{http.MethodGet, "/v1/stores/s", "/store/admin/s", "", http.StatusOK},
+		{http.MethodPost, "/v1/stores/s/keys/k", "/store/s/k", "value", http.StatusOK},
+		{http.MethodGet, "/v1/stores/s/keys/k", "/store/s/k", "", http.StatusOK},
+		{http.MethodGet, "/v1/stores/s/keys?prefix=k", "/store/s/?prefix=k", "", http.StatusOK},
+		{http.MethodPost, "/v1/stores/s/_compact", "/store/admin/s/_compact", "", http.StatusOK},
+		{http.MethodPost, "/v1/stores/missing/_verify", "/store/admin/missing/_verify", "", http.StatusNotFound},
+		{http.MethodDelete, "/v1/stores/s/keys/k", "/store/s/k", "", http.StatusOK},
+		{http.MethodGet, "/v1/stores/s/keys/k", "/store/s/k", "", http.StatusNotFound},
+		{http.MethodDelete, "/v1/stores/a", "/store/admin/b", "", http.StatusOK},
+		{http.MethodGet, "/v1/stores/a", "/store/admin/b", "", http.StatusNotFound},
+	} {
+		v1Status, v1Header, v1Body := doRequest(t, test.method, url+test.v1, test.body)
+		legacyStatus, legacyHeader, legacyBody := doRequest(t, test.method, url+test.legacy, test.body)
+		if v1Status != test.status || legacyStatus != test.status {
+			t.Errorf("%s %s: %d, %s: %d, expected %d", test.method, test.v1, v1Status, test.legacy, legacyStatus, test.status)
+		}
+		// Stores a and b are created and removed side by side so only differ by name
+		renamer := strings.NewReplacer(`"a"`, `"b"`, "store a", "store b")
+		v1Body, legacyBody = renamer.Replace(v1Body), renamer.Replace(legacyBody)
+		if v1Body != legacyBody || v1Header.Get("Content-Type") != legacyHeader.Get("Content-Type") {
+			t.Errorf("%s %s and %s differ: %q (%s), %q (%s)", test.method, test.v1, test.legacy,
+				v1Body, v1Header.Get("Content-Type"), legacyBody, legacyHeader.Get("Content-Type"))
+		}
+	}
+
+	// A verify started through one route can be polled through the other
+	var job VerifyJob
+	response := doJSON(t, http.MethodPost, url+"/store/admin/s/_verify", &job)
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("Legacy verify: %d", response.StatusCode)
+	}
+	expectStatus(t, http.MethodGet, url+"/v1/stores/s/_verify/"+job.ID, "", http.StatusOK)
+
+	// The legacy admin routes hide a data store called admin, which /v1 still reaches
+	expectStatus(t, http.MethodPost, url+"/v1/stores/admin", "", http.StatusCreated)
+	expectStatus(t, http.MethodPut, url+"/v1/stores/admin/keys/k", "value", http.StatusOK)
+	if body := expectStatus(t, http.MethodGet, url+"/store/admin/k", "", http.StatusNotFound); strings.Contains(body, "value") {
+		t.Errorf("Legacy read of the admin store: %q", body)
+	}
+}
@@ -0,0 +1,475 @@
+// Package gkserver is the HTTP API for a gokave.DB
+//
+// Routes:
+//
+//	GET    /v1/stores                              list the stores
+//	POST   /v1/stores/{store}[?codec=][&keycase=]  create a store. keycase is preserve (the default) or fold
+//	GET    /v1/stores/{store}                      the store's settings
+//	DELETE /v1/stores/{store}                      remove a store and its data
+//	POST   /v1/stores/{store}/_verify              start checking the store's files (see handleVerifyStore)
+//	GET    /v1/stores/{store}/_verify/{id}         the state of a verify and its report once done
+//	POST   /v1/stores/{store}/_compact             merge the store's sealed segments
+//	POST   /v1/stores/{store}/_migrate?keycase=    switch the store between case sensitive and folded keys
+//	GET    /v1/stores/{store}/keys[?prefix=][&snapshot=]  list keys
+//	POST   /v1/stores/{store}/_mget[?snapshot=]    read many keys: {"keys": [...]}
+//	POST   /v1/stores/{store}/_snapshot[?ttl=]     pin a view of the store for keys and _mget (see handleCreateSnapshot)
+//	DELETE /v1/stores/{store}/_snapshot/{token}    release a snapshot
+//	GET    /v1/stores/{store}/_watch?since=&prefix=  follow changes, as server-sent events or by long-poll
+//	GET    /v1/stores/{store}/keys/{key}           read a value
+//	HEAD   /v1/stores/{store}/keys/{key}           a value's meta and length without the value
+//	PUT    /v1/stores/{store}/keys/{key}           write a value (POST also accepted)
+//	DELETE /v1/stores/{store}/keys/{key}           delete a value
+//	GET    /v1/stores/{store}/_records?segment=&offset=&wait=  raw records for a replica (see handleRecords)
+//	GET    /v1/stores/{store}/_merkle?path=        a node of the store's Merkle tree, "" for the root
+//	GET    /v1/stores/{store}/_backup[?base=]      a backup of the store as a tar stream (see handleBackup)
+//	POST   /v1/stores/{store}/_backup?dir=[&basedir=]  back the store up into a directory in the backup directory
+//	POST   /v1/stores/{store}/_restore[?dir=...][&seq=][&time=]  create the store from backups (see handleRestore)
+//	GET    /v1/stores/{store}/_export[?prefix=][&meta=true][&versions=true]  the keys and values as JSON lines
+//	POST   /v1/stores/{store}/_import[?mode=][&create=true]  write the JSON lines of an export (see handleImport)
+//	GET    /v1/replication                         primary or replica, and how far behind a replica is
+//	POST   /v1/replication/_promote                turn a replica into a primary
+//	GET    /v1/antientropy?with=[&store=]          compare the stores with a peer's (see gkmerkle and WithPeers)
+//	POST   /v1/antientropy/_repair?from=[&store=]  make the stores match a peer's
+//	GET    /v1/cluster                             a cluster member's view of the cluster (see WithCluster)
+//	POST   /v1/cluster/members                     add a member: {"id": "n4", "addr": "http://host:8083"}
+//	DELETE /v1/cluster/members/{id}                remove a member
+//	GET    /v1/shards                              a shard node's config and partitions (see WithShards)
+//	PUT    /v1/shards                              change the shard nodes: {"Nodes": [{"id": "n1", "addr": "http://host1:8080"}, ...]}
+//	POST   /v1/shards/_rebalance                   move the partitions this node doesn't own to their owners
+//	POST   /v1/stores/{store}/_partitions/{partition}  a partition's records from its previous owner
+//
+// Keys may contain slashes, either as is or encoded as %2F. Whether keys are case sensitive is up to
+// each store (see gokave.KeyCasePreserve).
+//
+// A write's Content-Type and any X-Gokave-Meta-{Name} headers are stored with the value (see
+// gokave.Meta) and sent back as headers by GET and HEAD.
+//
+// Every write and delete is given a sequence number. _watch sends the changes after ?since= as
+// server-sent events if asked for with Accept: text/event-stream, picking up from Last-Event-ID when
+// a client reconnects. Otherwise it waits up to ?timeout= for a change and returns them as JSON.
+// Asking for changes that compaction has thrown away gets 410 Gone.
+//
+// _verify checks a store's files in the background, as it can take a while on a large store. It
+// replies 202 Accepted with a job whose Location is polled until its State is done or failed.
+// Damaged stores are repaired offline, with gokave verify -repair, as repair rewrites segments.
+//
+// A replica (see gkreplica) serves reads and rejects writes with 403 Forbidden.
+//
+// A backup is taken while the store stays in use and holds every change up to a point. An
+// incremental backup holds only what was added after an earlier one, its base. Restoring a full
+// backup and the incremental backups after it replays their changes into a new store, optionally
+// stopping at a sequence number or time. Backing up into or restoring from directories on the
+// server is only allowed inside the directory given to WithBackupDirectory: ?dir= and ?basedir=
+// are relative to it. Restores aren't supported by a member of a Raft cluster or a node of a
+// sharded deployment, and a backup there is of the node's own copy.
+//
+// An export streams a store's live keys and values as JSON lines, with binary values base64
+// encoded, and an import writes them back, to the same or another store. Imports aren't supported
+// by a member of a Raft cluster or a node of a sharded deployment, and an export there is of the
+// node's own copy.
+//
+// A snapshot token makes a series of keys and _mget requests all see the store as it was when the
+// token was handed out, however many writes are made in between. It lasts for ?ttl= and should be
+// released once finished with, as it stops compaction removing segments. Snapshots aren't supported
+// by a node of a sharded deployment, and on a member of a Raft cluster are of the member's own copy.
+//
+// Anti-entropy compares the Merkle trees of this server's stores with another server's to find the
+// keys that differ, and a repair copies them from the other server. It puts right a replica that
+// missed changes, or two copies that were both written to while cut off from each other. The other
+// server has to be one of the peers given to WithPeers, or the primary of a replica, otherwise the
+// request gets 403 Forbidden. Repair isn't supported by a member of a Raft cluster or a node of a
+// sharded deployment.
+//
+// A member of a Raft cluster (see gkraft and WithCluster) sends writes through the cluster and
+// redirects them to the leader if it isn't the leader itself. ?linearizable=true on a read makes it
+// see every write committed before it.
+//
+// A node of a sharded deployment (see gkshard and WithShards) forwards requests for keys it doesn't
+// own to their owner, and makes changes to stores on every node.
+//
+// The original /store/{store}/{key} and /store/admin/{store} routes are still served, along with
+// /store/{store}/_mget, /store/{store}/_watch and /store/admin/{store}/_backup, _restore, _export, _import and _snapshot. Through
+// them a data store called "admin" or a key called "_mget" or "_watch" can't be reached, only
+// through /v1
+package gkserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkraft"
+	"gokave/gkreplica"
+	"gokave/gkshard"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server - the HTTP handlers for a DB. The DB is shared over every request
+type Server struct {
+	router          *router
+	verifyJobs      *verifyJobs
+	follower        *gkreplica.Follower
+	peers           []string
+	backupDirectory string
+	node            *gkraft.Node
+	sharder         *gkshard.Sharder
+	raftHandler     http.Handler
+	snapshots       *snapshots
+	shutdown        chan struct{} // closed by Shutdown
+	shutdownOnce    sync.Once
+}
+
+// Option - a setting for New
+type Option func(*Server)
+
+// New - a Server serving db. The caller still owns db and has to close it
+func New(db *gokave.DB, opts ...Option) *Server {
+	router := &router{db: db}
+	server := &Server{router: router, verifyJobs: newVerifyJobs(), snapshots: newSnapshots(), shutdown: make(chan struct{})}
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	write, del, createStore, deleteStore, migrateStore := handleWrite, handleDelete, handleCreateStore, handleDeleteStore, handleMigrateStore
+	read, head, listKeys, mget, importStore := handleRead, handleHead, handleListKeys, handleMGet, handleImport
+	repair, restore, createSnapshot := server.handleRepair, server.handleRestore, server.handleCreateSnapshot
+	if server.node != nil || server.sharder != nil {
+		repair, restore, importStore = handleRepairUnsupported, handleRestoreUnsupported, handleImportUnsupported
+	}
+	if server.node != nil {
+		write, del, createStore, deleteStore, migrateStore = server.handleClusterWrite, server.handleClusterDelete,
+			server.handleClusterCreateStore, server.handleClusterDeleteStore, server.handleClusterMigrateStore
+		read, head, listKeys, mget = server.linearizable(read), server.linearizable(head), server.linearizable(listKeys), server.linearizable(mget)
+		server.raftHandler = gkraft.HTTPHandler(server.node)
+	}
+	if server.sharder != nil {
+		write, del, read, head = server.sharded(write), server.sharded(del), server.sharded(read), server.sharded(head)
+		createStore, deleteStore, migrateStore = server.everywhere(createStore), server.everywhere(deleteStore), server.everywhere(migrateStore)
+		listKeys, mget = server.handleShardListKeys, server.handleShardMGet
+		createSnapshot = handleSnapshotUnsupported
+	}
+	listKeys, mget = server.atSnapshot(listKeys, handleSnapshotListKeys), server.atSnapshot(mget, handleSnapshotMGet)
+
+	router.handle(http.MethodGet, "/v1/stores", handleListStores)
+	router.handle(http.MethodPost, "/v1/stores/{store}", createStore)
+	router.handle(http.MethodGet, "/v1/stores/{store}", handleDescribeStore)
+	router.handle(http.MethodDelete, "/v1/stores/{store}", deleteStore)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_verify", server.handleVerifyStore)
+	router.handle(http.MethodGet, "/v1/stores/{store}/_verify/{id}", server.handleVerifyJob)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_compact", handleCompactStore)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_migrate", migrateStore)
+	router.handle(http.MethodGet, "/v1/stores/{store}/keys", listKeys)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_mget", mget)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_snapshot", createSnapshot)
+	router.handle(http.MethodDelete, "/v1/stores/{store}/_snapshot/{token}", server.handleDeleteSnapshot)
+	router.handle(http.MethodGet, "/v1/stores/{store}/_watch", server.handleWatch)
+	router.handle(http.MethodGet, "/v1/stores/{store}/_records", server.handleRecords)
+	router.handle(http.MethodHead, "/v1/stores/{store}/keys/{key...}", head)
+	router.handle(http.MethodGet, "/v1/stores/{store}/keys/{key...}", read)
+	router.handle(http.MethodPut, "/v1/stores/{store}/keys/{key...}", write)
+	router.handle(http.MethodPost, "/v1/stores/{store}/keys/{key...}", write)
+	router.handle(http.MethodDelete, "/v1/stores/{store}/keys/{key...}", del)
+	router.handle(http.MethodGet, "/v1/stores/{store}/_merkle", handleMerkleNode)
+	router.handle(http.MethodGet, "/v1/stores/{store}/_backup", handleBackup)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_backup", server.handleBackupToDirectory)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_restore", restore)
+	router.handle(http.MethodGet, "/v1/stores/{store}/_export", handleExport)
+	router.handle(http.MethodPost, "/v1/stores/{store}/_import", importStore)
+	router.handle(http.MethodGet, "/v1/replication", server.handleReplicationStatus)
+	router.handle(http.MethodPost, "/v1/replication/_promote", server.handlePromote)
+	router.handle(http.MethodGet, "/v1/antientropy", server.handleCompare)
+	router.handle(http.MethodPost, "/v1/antientropy/_repair", repair)
+	if server.node != nil {
+		router.handle(http.MethodGet, "/v1/cluster", server.handleClusterStatus)
+		router.handle(http.MethodPost, "/v1/cluster/members", server.handleAddMember)
+		router.handle(http.MethodDelete, "/v1/cluster/members/{id}", server.handleRemoveMember)
+		router.handle(http.MethodPost, gkraft.RPCPath+"{rpc}", server.handleRaft)
+	}
+	if server.sharder != nil {
+		router.handle(http.MethodGet, gkshard.StatusPath, server.handleShardStatus)
+		router.handle(http.MethodPut, gkshard.StatusPath, server.handleSetShardConfig)
+		router.handle(http.MethodPost, gkshard.StatusPath+"/_rebalance", server.handleRebalance)
+		router.handle(http.MethodPost, "/v1/stores/{store}/_partitions/{partition}", server.handleReceivePartition)
+	}
+
+	// Compatibility aliases. The admin routes have to come first as they overlap /store/{store}/{key}
+	router.handle(http.MethodGet, "/store/admin/", handleListStores)
+	router.handle(http.MethodPost, "/store/admin/{store}", createStore)
+	router.handle(http.MethodGet, "/store/admin/{store}", handleDescribeStore)
+	router.handle(http.MethodDelete, "/store/admin/{store}", deleteStore)
+	router.handle(http.MethodPost, "/store/admin/{store}/_verify", server.handleVerifyStore)
+	router.handle(http.MethodGet, "/store/admin/{store}/_verify/{id}", server.handleVerifyJob)
+	router.handle(http.MethodPost, "/store/admin/{store}/_compact", handleCompactStore)
+	router.handle(http.MethodPost, "/store/admin/{store}/_migrate", migrateStore)
+	router.handle(http.MethodGet, "/store/admin/{store}/_backup", handleBackup)
+	router.handle(http.MethodPost, "/store/admin/{store}/_backup", server.handleBackupToDirectory)
+	router.handle(http.MethodPost, "/store/admin/{store}/_restore", restore)
+	router.handle(http.MethodGet, "/store/admin/{store}/_export", handleExport)
+	router.handle(http.MethodPost, "/store/admin/{store}/_import", importStore)
+	router.handle(http.MethodPost, "/store/admin/{store}/_snapshot", createSnapshot)
+	router.handle(http.MethodDelete, "/store/admin/{store}/_snapshot/{token}", server.handleDeleteSnapshot)
+	router.handle(http.MethodGet, "/store/{store}/", listKeys)
+	router.handle(http.MethodPost, "/store/{store}/_mget", mget)
+	router.handle(http.MethodGet, "/store/{store}/_watch", server.handleWatch)
+	router.handle(http.MethodHead, "/store/{store}/{key...}", head)
+	router.handle(http.MethodGet, "/store/{store}/{key...}", read)
+	router.handle(http.MethodPost, "/store/{store}/{key...}", write)
+	router.handle(http.MethodDelete, "/store/{store}/{key...}", del)
+
+	return server
+}
+
+// Shutdown - end the watches in progress, which would otherwise keep http.Server.Shutdown waiting,
+// and release the snapshots handed out. Register it with http.Server.RegisterOnShutdown
+func (server *Server) Shutdown() {
+	server.shutdownOnce.Do(func() {
+		close(server.shutdown)
+		server.snapshots.releaseAll()
+	})
+}
+
+// https://golang.org/pkg/net/http/#Handler
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.router.ServeHTTP(w, r)
+}
+
+func handleWrite(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName, key := params["store"], params["key"]
+	value, err := ioutil.ReadAll(httpRequest.Body)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Post %s to store: %s\n", key, storeName)
+	if err := db.WriteMeta(httpRequest.Context(), storeName, key, value, requestMeta(httpRequest)); err != nil {
+		writeError(responseWriter, httpRequest, err)
+	}
+}
+
+func handleRead(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName, key := params["store"], params["key"]
+	fmt.Printf("Get %s from store: %s\n", key, storeName)
+	bytes, meta, err := db.ReadMeta(httpRequest.Context(), storeName, key)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeMetaHeaders(responseWriter, meta, len(bytes))
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(bytes)
+}
+
+// handleHead - the headers a GET would send without the value
+func handleHead(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName, key := params["store"], params["key"]
+	fmt.Printf("Head %s from store: %s\n", key, storeName)
+	meta, valueLength, err := db.Head(httpRequest.Context(), storeName, key)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeMetaHeaders(responseWriter, meta, valueLength)
+	responseWriter.WriteHeader(http.StatusOK)
+}
+
+// MetaHeaderPrefix - request headers starting with this are stored as meta on writes, named by the
+// rest of the header, and returned the same way on reads
+const MetaHeaderPrefix = "X-Gokave-Meta-"
+
+// requestMeta - the meta to store from a write's headers
+func requestMeta(httpRequest *http.Request) (meta gokave.Meta) {
+	for name, values := range httpRequest.Header {
+		if !strings.HasPrefix(name, MetaHeaderPrefix) || len(name) == len(MetaHeaderPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(gokave.Meta)
+		}
+		meta[name[len(MetaHeaderPrefix):]] = strings.Join(values, ", ")
+	}
+	if contentType := httpRequest.Header.Get("Content-Type"); contentType != "" {
+		if meta == nil {
+			meta = make(gokave.Meta)
+		}
+		meta[gokave.MetaContentType] = contentType
+	}
+	return
+}
+
+// writeMetaHeaders - the headers for a value. Without a stored content type net/http works one out
+// from the value as it always has
+func writeMetaHeaders(responseWriter http.ResponseWriter, meta gokave.Meta, valueLength int) {
+	header := responseWriter.Header()
+	for name, value := range meta {
+		if name == gokave.MetaContentType {
+			header.Set("Content-Type", value)
+			continue
+		}
+		header.Set(MetaHeaderPrefix+name, value)
+	}
+	header.Set("Content-Length", strconv.Itoa(valueLength))
+}
+
+func handleDelete(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName, key := params["store"], params["key"]
+	fmt.Printf("Delete %s from store: %s\n", key, storeName)
+	if err := db.Delete(httpRequest.Context(), storeName, key); err != nil {
+		writeError(responseWriter, httpRequest, err)
+	}
+}
+
+// handleListKeys - the store's keys as a JSON array. ?prefix= limits them to keys starting with it
+func handleListKeys(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeName := params["store"]
+	fmt.Printf("List keys in store: %s\n", storeName)
+	store, err := db.OpenStore(httpRequest.Context(), storeName)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	keys, err := store.Keys(httpRequest.Context(), httpRequest.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(responseWriter, httpRequest, keys)
+}
+
+func handleListStores(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	storeNames, err := db.ListStores(httpRequest.Context())
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, storeNames)
+}
+
+// handleCreateStore - the codec and key case are chosen when the store is created: ?codec=json&keycase=fold
+func handleCreateStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	var opts []gokave.StoreOption
+	if codec := httpRequest.URL.Query().Get("codec"); codec != "" {
+		opts = append(opts, gokave.WithCodecName(codec))
+	}
+	if keyCase := httpRequest.URL.Query().Get("keycase"); keyCase != "" {
+		opts = append(opts, gokave.WithKeyCase(keyCase))
+	}
+
+	fmt.Printf("Create store: %s:\n", params["store"])
+	if _, err := db.CreateStore(httpRequest.Context(), params["store"], opts...); err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusCreated)
+}
+
+func handleDescribeStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Printf("Get store: %s:\n", params["store"])
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, store.Config())
+}
+
+func handleDeleteStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Printf("Remove store: %s:\n", params["store"])
+	if err := db.DeleteStore(httpRequest.Context(), params["store"]); err != nil {
+		writeError(responseWriter, httpRequest, err)
+	}
+}
+
+func handleCompactStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Printf("Compact store: %s:\n", params["store"])
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	stats, err := store.Compact(httpRequest.Context())
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, stats)
+}
+
+// migrateResult - the response to _migrate
+type migrateResult struct {
+	Store         string
+	KeyCase       string
+	KeysRewritten int
+}
+
+func handleMigrateStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	keyCase := httpRequest.URL.Query().Get("keycase")
+	fmt.Printf("Migrate store: %s: key case %s\n", params["store"], keyCase)
+	rewritten, err := db.MigrateKeyCase(httpRequest.Context(), params["store"], keyCase)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, migrateResult{Store: params["store"], KeyCase: keyCase, KeysRewritten: rewritten})
+}
+
+func writeJSON(responseWriter http.ResponseWriter, httpRequest *http.Request, v interface{}) {
+	writeJSONStatus(responseWriter, httpRequest, http.StatusOK, v)
+}
+
+// writeJSONStatus - as writeJSON with a status other than 200 OK
+func writeJSONStatus(responseWriter http.ResponseWriter, httpRequest *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	responseWriter.Write(body)
+}
+
+// writeError - turn an error from the DB into the matching HTTP status
+func writeError(responseWriter http.ResponseWriter, httpRequest *http.Request, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		fmt.Println(err)
+	}
+	http.Error(responseWriter, err.Error(), status)
+}
+
+// errorStatus - the HTTP status for an error from the DB
+func errorStatus(err error) (status int) {
+	status = http.StatusInternalServerError
+	switch {
+	case errors.Is(err, gokave.ErrKeyNotFound), errors.Is(err, gokave.ErrStoreNotFound), errors.Is(err, errVerifyJobNotFound),
+		errors.Is(err, gkraft.ErrNotMember):
+		status = http.StatusNotFound
+	case errors.Is(err, gokave.ErrStoreExists), errors.Is(err, gokave.ErrKeyCaseConflict), errors.Is(err, gkraft.ErrMembershipChangePending),
+		errors.Is(err, gkshard.ErrNotOwner), errors.Is(err, gkshard.ErrStaleConfig), errors.Is(err, gokave.ErrBackupBaseTooOld),
+		errors.Is(err, gokave.ErrKeyExists):
+		status = http.StatusConflict
+	case errors.Is(err, gokave.ErrInvalidKey), errors.Is(err, gokave.ErrInvalidStoreName), errors.Is(err, gokave.ErrUnknownCodec),
+		errors.Is(err, gokave.ErrInvalidKeyCase), errors.Is(err, gokave.ErrMetaTooLarge), errors.Is(err, gkshard.ErrPartitionsChanged),
+		errors.Is(err, gkshard.ErrNoNodes), errors.Is(err, gokave.ErrBadMerklePath),
+		errors.Is(err, gokave.ErrBadBackup), errors.Is(err, errBadBackupDirectory), errors.Is(err, gokave.ErrBadImport):
+		status = http.StatusBadRequest
+	case errors.Is(err, gokave.ErrReadOnly), errors.Is(err, gokave.ErrReplica), errors.Is(err, errNoBackupDirectory):
+		status = http.StatusForbidden
+	case errors.Is(err, gokave.ErrHistoryCompacted), errors.Is(err, gokave.ErrSegmentNotFound), errors.Is(err, errSnapshotNotFound),
+		errors.Is(err, gokave.ErrSnapshotClosed):
+		status = http.StatusGone
+	case errors.Is(err, gokave.ErrClosed), errors.Is(err, gokave.ErrWatchTooSlow), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, gkraft.ErrLeadershipLost), errors.Is(err, gkraft.ErrStopped):
+		status = http.StatusServiceUnavailable
+	}
+	return
+}
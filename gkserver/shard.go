@@ -0,0 +1,424 @@
+package gkserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkshard"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WithShards - make the server one node of a sharded deployment (see gkshard). Requests for a key
+// are forwarded to the node that owns its partition. Creating, deleting and migrating a store is
+// done on every node, and listing keys and _mget gather the keys from every node. Anything else,
+// such as _watch or _compact, is about this node's part of the store only
+func WithShards(sharder *gkshard.Sharder) Option {
+	return func(server *Server) {
+		server.sharder = sharder
+	}
+}
+
+// forwardedBy - the nodes a request has already passed through
+func forwardedBy(httpRequest *http.Request) (ids []string) {
+	if header := httpRequest.Header.Get(gkshard.ForwardedHeader); header != "" {
+		ids = strings.Split(header, ",")
+	}
+	return
+}
+
+// sharded - handler for keys this node owns. Requests for other keys are forwarded to their owner
+func (server *Server) sharded(handler handlerFunc) handlerFunc {
+	return func(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+		// A missing store is left to handler to report
+		_, owner, local, err := server.sharder.Locate(httpRequest.Context(), params["store"], params["key"])
+		if err != nil || local {
+			handler(db, responseWriter, httpRequest, params)
+			return
+		}
+		server.forward(responseWriter, httpRequest, owner)
+	}
+}
+
+// forward - pass the request on to node and its response back. A request that comes back to a
+// node it has already been through means the nodes disagree about the config, which is only
+// until they all have the latest
+func (server *Server) forward(responseWriter http.ResponseWriter, httpRequest *http.Request, node gkshard.Node) {
+	via := forwardedBy(httpRequest)
+	for _, id := range via {
+		if id == server.sharder.Self() {
+			http.Error(responseWriter, fmt.Sprintf("Shard configs disagree: forwarded by %s", strings.Join(via, ", ")), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	target, err := url.Parse(node.Addr)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	httpRequest.Header.Set(gkshard.ForwardedHeader, strings.Join(append(via, server.sharder.Self()), ","))
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = server.sharder.Client().Transport
+	proxy.ErrorHandler = func(responseWriter http.ResponseWriter, httpRequest *http.Request, err error) {
+		http.Error(responseWriter, fmt.Sprintf("Forwarding to %s: %s", node.ID, err), http.StatusBadGateway)
+	}
+	proxy.ServeHTTP(responseWriter, httpRequest)
+}
+
+// nodeResponse - what another node answered to a request sent on by sendToOthers
+type nodeResponse struct {
+	node       gkshard.Node
+	statusCode int
+	body       []byte
+	err        error
+}
+
+// failed - the response as an error, or nil if it succeeded
+func (response nodeResponse) failed() error {
+	if response.err != nil {
+		return fmt.Errorf("%s: %w", response.node.ID, response.err)
+	}
+	if response.statusCode < 200 || response.statusCode > 299 {
+		return fmt.Errorf("%s: %d %s", response.node.ID, response.statusCode, bytes.TrimSpace(response.body))
+	}
+	return nil
+}
+
+// sendToOthers - make the same request of every other node at once, marked as forwarded so that
+// they only act on it themselves
+func (server *Server) sendToOthers(ctx context.Context, httpRequest *http.Request, body []byte) (responses []nodeResponse) {
+	var nodes []gkshard.Node
+	for _, node := range server.sharder.Ring().Nodes() {
+		if node.ID != server.sharder.Self() {
+			nodes = append(nodes, node)
+		}
+	}
+	responses = make([]nodeResponse, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node gkshard.Node) {
+			defer wg.Done()
+			responses[i] = server.sendTo(ctx, node, httpRequest.Method, httpRequest.URL.RequestURI(), httpRequest.Header, body)
+		}(i, node)
+	}
+	wg.Wait()
+	return
+}
+
+func (server *Server) sendTo(ctx context.Context, node gkshard.Node, method string, requestURI string, header http.Header, body []byte) (response nodeResponse) {
+	response.node = node
+	request, err := http.NewRequest(method, strings.TrimSuffix(node.Addr, "/")+requestURI, bytes.NewReader(body))
+	if err != nil {
+		response.err = err
+		return
+	}
+	request = request.WithContext(ctx)
+	for _, name := range []string{"Content-Type", "Accept"} {
+		if value := header.Get(name); value != "" {
+			request.Header.Set(name, value)
+		}
+	}
+	request.Header.Set(gkshard.ForwardedHeader, server.sharder.Self())
+	httpResponse, err := server.sharder.Client().Do(request)
+	if err != nil {
+		response.err = err
+		return
+	}
+	defer httpResponse.Body.Close()
+	response.statusCode = httpResponse.StatusCode
+	response.body, response.err = ioutil.ReadAll(httpResponse.Body)
+	return
+}
+
+// everywhere - handler here and then on every other node, for changes to a store. This node's
+// response is sent back unless another node failed. A store that already exists or has already
+// gone here is still created or deleted on the others, so that trying again after a node failed
+// puts things right
+func (server *Server) everywhere(handler handlerFunc) handlerFunc {
+	return func(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+		if len(forwardedBy(httpRequest)) > 0 {
+			handler(db, responseWriter, httpRequest, params)
+			return
+		}
+		body, err := ioutil.ReadAll(httpRequest.Body)
+		if err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+		recorder := newResponseRecorder()
+		handler(db, recorder, httpRequest, params)
+		if recorder.statusCode >= 300 && recorder.statusCode != http.StatusNotFound && recorder.statusCode != http.StatusConflict {
+			recorder.replay(responseWriter)
+			return
+		}
+
+		var failures []string
+		for _, response := range server.sendToOthers(httpRequest.Context(), httpRequest, body) {
+			if err := response.failed(); err != nil && response.statusCode != http.StatusNotFound && response.statusCode != http.StatusConflict {
+				failures = append(failures, err.Error())
+			}
+		}
+		if len(failures) > 0 {
+			http.Error(responseWriter, fmt.Sprintf("Not done on every node: %s", strings.Join(failures, "; ")), http.StatusBadGateway)
+			return
+		}
+		recorder.replay(responseWriter)
+	}
+}
+
+// responseRecorder - holds on to a handler's response so it can be sent later, or not at all
+type responseRecorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (recorder *responseRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *responseRecorder) Write(b []byte) (int, error) {
+	return recorder.body.Write(b)
+}
+
+func (recorder *responseRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+}
+
+func (recorder *responseRecorder) replay(responseWriter http.ResponseWriter) {
+	for name, values := range recorder.header {
+		responseWriter.Header()[name] = values
+	}
+	responseWriter.WriteHeader(recorder.statusCode)
+	responseWriter.Write(recorder.body.Bytes())
+}
+
+// handleShardListKeys - the keys held here along with those held by every other node
+func (server *Server) handleShardListKeys(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	if len(forwardedBy(httpRequest)) > 0 {
+		handleListKeys(db, responseWriter, httpRequest, params)
+		return
+	}
+	storeName := params["store"]
+	store, err := db.OpenStore(httpRequest.Context(), storeName)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	keys, err := store.Keys(httpRequest.Context(), httpRequest.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	for _, response := range server.sendToOthers(httpRequest.Context(), httpRequest, nil) {
+		if err := response.failed(); err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusBadGateway)
+			return
+		}
+		var nodeKeys []string
+		if err := json.Unmarshal(response.body, &nodeKeys); err != nil {
+			http.Error(responseWriter, fmt.Sprintf("%s: %s", response.node.ID, err), http.StatusBadGateway)
+			return
+		}
+		keys = append(keys, nodeKeys...)
+	}
+
+	// While partitions are moving a key can be on both the old owner and the new
+	sort.Strings(keys)
+	merged := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			merged = append(merged, key)
+		}
+	}
+	writeJSON(responseWriter, httpRequest, merged)
+}
+
+// handleShardMGet - read the keys held here and ask their owners for the rest
+func (server *Server) handleShardMGet(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	if len(forwardedBy(httpRequest)) > 0 {
+		handleMGet(db, responseWriter, httpRequest, params)
+		return
+	}
+	request, ok := readMGetRequest(responseWriter, httpRequest)
+	if !ok {
+		return
+	}
+	storeName := params["store"]
+
+	var local []string
+	remote := make(map[gkshard.Node][]string)
+	for _, key := range request.Keys {
+		_, owner, isLocal, err := server.sharder.Locate(httpRequest.Context(), storeName, key)
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		if isLocal {
+			local = append(local, key)
+			continue
+		}
+		remote[owner] = append(remote[owner], key)
+	}
+
+	results, err := db.ReadMany(httpRequest.Context(), storeName, local)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	for node, keys := range remote {
+		body, err := json.Marshal(mgetRequest{Keys: keys})
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		response := server.sendTo(httpRequest.Context(), node, http.MethodPost, "/v1/stores/"+url.PathEscape(storeName)+"/_mget",
+			http.Header{"Content-Type": {"application/json"}}, body)
+		if err := response.failed(); err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusBadGateway)
+			return
+		}
+		var nodeResults map[string]mgetResult
+		if err := json.Unmarshal(response.body, &nodeResults); err != nil {
+			http.Error(responseWriter, fmt.Sprintf("%s: %s", node.ID, err), http.StatusBadGateway)
+			return
+		}
+		for key, result := range nodeResults {
+			results[key] = readResult(result)
+		}
+	}
+	writeMGet(responseWriter, httpRequest, request.Keys, results)
+}
+
+// readResult - an _mget result from another node as if it had been read here
+func readResult(result mgetResult) (readResult gokave.ReadResult) {
+	switch result.Status {
+	case MGetFound:
+		readResult.Value = result.Value
+		if result.ContentType != "" || len(result.Meta) > 0 {
+			readResult.Meta = make(gokave.Meta)
+			for name, value := range result.Meta {
+				readResult.Meta[name] = value
+			}
+			if result.ContentType != "" {
+				readResult.Meta[gokave.MetaContentType] = result.ContentType
+			}
+		}
+	case MGetDeleted:
+		readResult.Err = gokave.ErrKeyDeleted
+	case MGetMissing:
+		readResult.Err = gokave.ErrKeyNotFound
+	default:
+		readResult.Err = errors.New(result.Error)
+	}
+	return
+}
+
+// handleShardStatus - this node's gkshard.Status
+func (server *Server) handleShardStatus(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	writeJSON(responseWriter, httpRequest, server.sharder.Status())
+}
+
+// handleSetShardConfig - change the nodes: {"Nodes": [{"id": "n1", "addr": "http://host1:8080"}, ...]}.
+// The new config is given the next version and sent to every node in the old config or the new,
+// each of which then moves the partitions it has lost to their new owners. A node that can't be
+// reached picks the config up from the others later
+func (server *Server) handleSetShardConfig(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	var config gkshard.Config
+	if err := json.NewDecoder(httpRequest.Body).Decode(&config); err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Bad shard config: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(forwardedBy(httpRequest)) > 0 {
+		if _, err := server.sharder.SetConfig(config); err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		server.handleShardStatus(db, responseWriter, httpRequest, params)
+		return
+	}
+
+	current := server.sharder.Config()
+	if config.Partitions == 0 {
+		config.Partitions = current.Partitions
+	}
+	if config.VirtualNodes == 0 {
+		config.VirtualNodes = current.VirtualNodes
+	}
+	if config.Version <= current.Version {
+		config.Version = current.Version + 1
+	}
+	fmt.Printf("Set shard config version %d\n", config.Version)
+	if _, err := server.sharder.SetConfig(config); err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	nodes := append(append([]gkshard.Node(nil), current.Nodes...), config.Nodes...)
+	sent := map[string]bool{server.sharder.Self(): true}
+	var failures []string
+	for _, node := range nodes {
+		if sent[node.ID] {
+			continue
+		}
+		sent[node.ID] = true
+		response := server.sendTo(httpRequest.Context(), node, http.MethodPut, gkshard.StatusPath, http.Header{"Content-Type": {"application/json"}}, body)
+		if err := response.failed(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		http.Error(responseWriter, fmt.Sprintf("Shard config version %d not yet on every node: %s", config.Version, strings.Join(failures, "; ")), http.StatusBadGateway)
+		return
+	}
+	server.handleShardStatus(db, responseWriter, httpRequest, params)
+}
+
+// handleRebalance - start moving the partitions this node doesn't own to their owners. Progress is
+// in the status
+func (server *Server) handleRebalance(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Println("Rebalance requested")
+	server.sharder.Rebalance()
+	server.handleShardStatus(db, responseWriter, httpRequest, params)
+}
+
+// handleReceivePartition - the records of a partition sent by its previous owner
+func (server *Server) handleReceivePartition(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	partition, err := strconv.Atoi(params["partition"])
+	if err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Bad partition: %s", params["partition"]), http.StatusBadRequest)
+		return
+	}
+	var storeConfig gokave.StoreConfig
+	if err := json.Unmarshal([]byte(httpRequest.Header.Get(gkshard.StoreConfigHeader)), &storeConfig); err != nil || storeConfig.Name != params["store"] {
+		http.Error(responseWriter, fmt.Sprintf("Bad %s header", gkshard.StoreConfigHeader), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("Receive store %s partition %d from %s\n", storeConfig.Name, partition, httpRequest.Header.Get(gkshard.ForwardedHeader))
+	stats, err := server.sharder.Receive(httpRequest.Context(), storeConfig, partition, httpRequest.Body)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, stats)
+}
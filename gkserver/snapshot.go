@@ -0,0 +1,228 @@
+package gkserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gokave"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long a snapshot token can be used for. ?ttl= on the _snapshot request chooses up to maxSnapshotTTL
+const (
+	defaultSnapshotTTL = time.Minute
+	maxSnapshotTTL     = 10 * time.Minute
+)
+
+// maxSnapshots - the most snapshots a server holds open at once, as each keeps segments from being
+// removed by compaction
+const maxSnapshots = 100
+
+// errSnapshotNotFound means a snapshot token has expired, been released or was never handed out
+var errSnapshotNotFound = errors.New("Snapshot not found or expired")
+
+// snapshotResponse - the body of a _snapshot response
+type snapshotResponse struct {
+	Token   string
+	Store   string
+	Seq     uint64
+	Expires time.Time
+}
+
+// snapshotEntry - a snapshot handed out over HTTP, closed when its time is up
+type snapshotEntry struct {
+	snapshot *gokave.Snapshot
+	expires  time.Time
+	timer    *time.Timer
+}
+
+// snapshots - the snapshots handed out by a server, by token
+type snapshots struct {
+	mutex   sync.Mutex
+	entries map[string]*snapshotEntry
+}
+
+func newSnapshots() *snapshots {
+	return &snapshots{entries: make(map[string]*snapshotEntry)}
+}
+
+// add - hand out a token for snapshot, which is closed after ttl
+func (snapshots *snapshots) add(snapshot *gokave.Snapshot, ttl time.Duration) (token string, expires time.Time, err error) {
+	if token, err = newToken(); err != nil {
+		return
+	}
+
+	snapshots.mutex.Lock()
+	defer snapshots.mutex.Unlock()
+	if len(snapshots.entries) >= maxSnapshots {
+		return "", expires, fmt.Errorf("Too many snapshots. Max: %d", maxSnapshots)
+	}
+	expires = time.Now().Add(ttl).UTC()
+	snapshots.entries[token] = &snapshotEntry{
+		snapshot: snapshot,
+		expires:  expires,
+		timer:    time.AfterFunc(ttl, func() { snapshots.release(token) }),
+	}
+	return
+}
+
+// get - the snapshot of storeName for token, if it is still live
+func (snapshots *snapshots) get(token string, storeName string) (snapshot *gokave.Snapshot, err error) {
+	snapshots.mutex.Lock()
+	defer snapshots.mutex.Unlock()
+	entry, ok := snapshots.entries[token]
+	if !ok || entry.snapshot.Store().Name() != storeName || time.Now().After(entry.expires) {
+		return nil, errSnapshotNotFound
+	}
+	return entry.snapshot, nil
+}
+
+// release - close the snapshot for token. Returns false if there isn't one
+func (snapshots *snapshots) release(token string) bool {
+	snapshots.mutex.Lock()
+	entry, ok := snapshots.entries[token]
+	delete(snapshots.entries, token)
+	snapshots.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	entry.timer.Stop()
+	if err := entry.snapshot.Close(); err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
+
+// releaseAll - close every snapshot, e.g. when the server is shut down
+func (snapshots *snapshots) releaseAll() {
+	snapshots.mutex.Lock()
+	tokens := make([]string, 0, len(snapshots.entries))
+	for token := range snapshots.entries {
+		tokens = append(tokens, token)
+	}
+	snapshots.mutex.Unlock()
+	for _, token := range tokens {
+		snapshots.release(token)
+	}
+}
+
+// newToken - a random id that can't be guessed, for snapshots and jobs
+func newToken() (token string, err error) {
+	tokenBytes := make([]byte, 16)
+	if _, err = rand.Read(tokenBytes); err != nil {
+		return
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// handleCreateSnapshot - pin a view of the store at its latest change and return a token for it. Until
+// ?ttl= (default 1m, at most 10m) is up, or it is released, ?snapshot={token} on the store's keys
+// and _mget reads from the view rather than the store as it is now
+func (server *Server) handleCreateSnapshot(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	ttl := defaultSnapshotTTL
+	if ttlParam := httpRequest.URL.Query().Get("ttl"); ttlParam != "" {
+		var err error
+		if ttl, err = time.ParseDuration(ttlParam); err != nil || ttl <= 0 || ttl > maxSnapshotTTL {
+			http.Error(responseWriter, fmt.Sprintf("Bad ttl: %s. Max: %s", ttlParam, maxSnapshotTTL), http.StatusBadRequest)
+			return
+		}
+	}
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	snapshot, err := store.Snapshot(httpRequest.Context())
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	token, expires, err := server.snapshots.add(snapshot, ttl)
+	if err != nil {
+		snapshot.Close()
+		http.Error(responseWriter, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Printf("Snapshot of store: %s at seq %d until %s\n", store.Name(), snapshot.Seq(), expires.Format(time.RFC3339))
+	writeJSON(responseWriter, httpRequest, snapshotResponse{Token: token, Store: store.Name(), Seq: snapshot.Seq(), Expires: expires})
+}
+
+// handleDeleteSnapshot - release a snapshot before its time is up
+func (server *Server) handleDeleteSnapshot(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	if _, err = server.snapshots.get(params["token"], store.Name()); err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	server.snapshots.release(params["token"])
+	fmt.Printf("Released snapshot of store: %s\n", store.Name())
+}
+
+// handleSnapshotUnsupported - a snapshot is of one node's copy of a store, which doesn't hold all
+// of a sharded store's keys
+func handleSnapshotUnsupported(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	http.Error(responseWriter, "Snapshots aren't supported by a shard node", http.StatusNotImplemented)
+}
+
+// atSnapshot - handler, unless the request has ?snapshot= in which case the snapshot is handed to
+// snapshotHandler instead
+func (server *Server) atSnapshot(handler handlerFunc, snapshotHandler func(snapshot *gokave.Snapshot, responseWriter http.ResponseWriter, httpRequest *http.Request)) handlerFunc {
+	return func(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+		token := httpRequest.URL.Query().Get("snapshot")
+		if token == "" {
+			handler(db, responseWriter, httpRequest, params)
+			return
+		}
+		if server.sharder != nil {
+			handleSnapshotUnsupported(db, responseWriter, httpRequest, params)
+			return
+		}
+		store, err := db.OpenStore(httpRequest.Context(), params["store"])
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		snapshot, err := server.snapshots.get(token, store.Name())
+		if err != nil {
+			writeError(responseWriter, httpRequest, err)
+			return
+		}
+		snapshotHandler(snapshot, responseWriter, httpRequest)
+	}
+}
+
+// handleSnapshotListKeys - handleListKeys at a snapshot
+func handleSnapshotListKeys(snapshot *gokave.Snapshot, responseWriter http.ResponseWriter, httpRequest *http.Request) {
+	fmt.Printf("List keys in store: %s at seq %d\n", snapshot.Store().Name(), snapshot.Seq())
+	keys, err := snapshot.Keys(httpRequest.Context(), httpRequest.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(responseWriter, httpRequest, keys)
+}
+
+// handleSnapshotMGet - handleMGet at a snapshot
+func handleSnapshotMGet(snapshot *gokave.Snapshot, responseWriter http.ResponseWriter, httpRequest *http.Request) {
+	request, ok := readMGetRequest(responseWriter, httpRequest)
+	if !ok {
+		return
+	}
+	fmt.Printf("MGet %d keys from store: %s at seq %d\n", len(request.Keys), snapshot.Store().Name(), snapshot.Seq())
+	results, err := snapshot.ReadMany(httpRequest.Context(), request.Keys)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeMGet(responseWriter, httpRequest, request.Keys, results)
+}
@@ -0,0 +1,71 @@
+package gkserver
+
+import (
+	"errors"
+	"fmt"
+	"gokave"
+	"net/http"
+)
+
+// handleExport - every live key and value in the store as JSON lines of gokave.ExportRecord, in key
+// order. ?prefix= limits the keys, ?meta=true adds each value's meta and ?versions=true its version
+// and the time it was written. A failure part way through cuts the response short
+func handleExport(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	opts := gokave.ExportOptions{Prefix: query.Get("prefix"), Meta: query.Get("meta") == "true", Versions: query.Get("versions") == "true"}
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	fmt.Printf("Export store: %s prefix: %s\n", store.Name(), opts.Prefix)
+	responseWriter.Header().Set("Content-Type", "application/x-ndjson")
+	stats, err := store.Export(httpRequest.Context(), responseWriter, opts)
+	if err != nil {
+		fmt.Println(err)
+		panic(http.ErrAbortHandler)
+	}
+	fmt.Printf("Export store: %s: %d keys\n", store.Name(), stats.Exported)
+}
+
+// handleImport - write the JSON lines of an export in the body to the store, returning a
+// gokave.ImportStats. ?mode= is overwrite (the default), skip or fail for keys the store already
+// has (see gokave.ImportMode). With ?create=true a store that doesn't exist is created first, with
+// ?codec= and ?keycase= as for POST /v1/stores/{store}. A failure part way through leaves the lines
+// before it written, and says how many there were
+func handleImport(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if errors.Is(err, gokave.ErrStoreNotFound) && query.Get("create") == "true" {
+		var opts []gokave.StoreOption
+		if codec := query.Get("codec"); codec != "" {
+			opts = append(opts, gokave.WithCodecName(codec))
+		}
+		if keyCase := query.Get("keycase"); keyCase != "" {
+			opts = append(opts, gokave.WithKeyCase(keyCase))
+		}
+		fmt.Printf("Create store: %s:\n", params["store"])
+		store, err = db.CreateStore(httpRequest.Context(), params["store"], opts...)
+	}
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	fmt.Printf("Import store: %s mode: %s\n", store.Name(), query.Get("mode"))
+	stats, err := store.Import(httpRequest.Context(), httpRequest.Body, gokave.ImportMode(query.Get("mode")))
+	if err != nil {
+		if stats.Imported > 0 || stats.Skipped > 0 {
+			err = fmt.Errorf("%w (after %d keys imported, %d skipped)", err, stats.Imported, stats.Skipped)
+		}
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	fmt.Printf("Import store: %s: %d keys, %d skipped\n", store.Name(), stats.Imported, stats.Skipped)
+	writeJSON(responseWriter, httpRequest, stats)
+}
+
+// handleImportUnsupported - imports write to the local copy of a store, which a member of a Raft
+// cluster or a node of a sharded deployment mustn't do. Keys are written one at a time instead
+func handleImportUnsupported(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	http.Error(responseWriter, "Import isn't supported by a cluster member or shard node: write the keys instead", http.StatusNotImplemented)
+}
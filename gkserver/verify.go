@@ -0,0 +1,139 @@
+package gkserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkstore"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// verifyJobTTL - how long the outcome of a verify can be fetched for once it has finished
+const verifyJobTTL = 10 * time.Minute
+
+// maxVerifyJobs - the most verifies, running or finished, a server keeps track of
+const maxVerifyJobs = 100
+
+// Verify job states
+const (
+	VerifyRunning = "running"
+	VerifyDone    = "done"
+	VerifyFailed  = "failed"
+)
+
+// errVerifyJobNotFound means a verify job id was never handed out or its outcome has been dropped
+var errVerifyJobNotFound = errors.New("Verify job not found or expired")
+
+// VerifyJob - a verify of a store's files running in the background. Report is filled in once
+// State is VerifyDone, Error if it is VerifyFailed
+type VerifyJob struct {
+	ID       string
+	Store    string
+	State    string
+	Started  time.Time
+	Finished time.Time             `json:",omitempty"`
+	Report   *gkstore.VerifyReport `json:",omitempty"`
+	Error    string                `json:",omitempty"`
+}
+
+// verifyJobs - the verifies started by a server, by id
+type verifyJobs struct {
+	mutex sync.Mutex
+	jobs  map[string]*VerifyJob
+}
+
+func newVerifyJobs() *verifyJobs {
+	return &verifyJobs{jobs: make(map[string]*VerifyJob)}
+}
+
+// start - verify store in the background. A verify already running for the store is handed back
+// rather than starting another, as a second would only wait for the first
+func (verifyJobs *verifyJobs) start(store *gokave.Store) (job VerifyJob, err error) {
+	verifyJobs.mutex.Lock()
+	defer verifyJobs.mutex.Unlock()
+	for _, running := range verifyJobs.jobs {
+		if running.Store == store.Name() && running.State == VerifyRunning {
+			return *running, nil
+		}
+	}
+	if len(verifyJobs.jobs) >= maxVerifyJobs {
+		return job, fmt.Errorf("Too many verify jobs. Max: %d", maxVerifyJobs)
+	}
+	id, err := newToken()
+	if err != nil {
+		return
+	}
+	started := &VerifyJob{ID: id, Store: store.Name(), State: VerifyRunning, Started: time.Now().UTC()}
+	verifyJobs.jobs[id] = started
+	go verifyJobs.run(started.ID, store)
+	return *started, nil
+}
+
+// run - verify store and record the outcome against the job, which is dropped after verifyJobTTL
+func (verifyJobs *verifyJobs) run(id string, store *gokave.Store) {
+	report, err := store.Verify(context.Background())
+
+	verifyJobs.mutex.Lock()
+	defer verifyJobs.mutex.Unlock()
+	job := verifyJobs.jobs[id]
+	job.Finished = time.Now().UTC()
+	if err != nil {
+		job.State, job.Error = VerifyFailed, err.Error()
+	} else {
+		job.State, job.Report = VerifyDone, report
+	}
+	fmt.Printf("Verify of store: %s %s\n", job.Store, job.State)
+	time.AfterFunc(verifyJobTTL, func() {
+		verifyJobs.mutex.Lock()
+		defer verifyJobs.mutex.Unlock()
+		delete(verifyJobs.jobs, id)
+	})
+}
+
+// get - the job with id if it is of storeName
+func (verifyJobs *verifyJobs) get(id string, storeName string) (job VerifyJob, err error) {
+	verifyJobs.mutex.Lock()
+	defer verifyJobs.mutex.Unlock()
+	found, ok := verifyJobs.jobs[id]
+	if !ok || found.Store != storeName {
+		return job, errVerifyJobNotFound
+	}
+	return *found, nil
+}
+
+// handleVerifyStore - start checking the store's files and reply 202 Accepted with the job, whose
+// Location is polled for the report. The store can be read and written meanwhile, though writes
+// wait while each file is checked. Repairing a store is done offline with gokave verify -repair
+func (server *Server) handleVerifyStore(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	fmt.Printf("Verify store: %s:\n", params["store"])
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	job, err := server.verifyJobs.start(store)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	responseWriter.Header().Set("Location", httpRequest.URL.Path+"/"+job.ID)
+	writeJSONStatus(responseWriter, httpRequest, http.StatusAccepted, job)
+}
+
+// handleVerifyJob - the state of a verify, with its report once it is done
+func (server *Server) handleVerifyJob(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	job, err := server.verifyJobs.get(params["id"], store.Name())
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	writeJSON(responseWriter, httpRequest, job)
+}
@@ -0,0 +1,114 @@
+package gkserver
+
+import (
+	"context"
+	"encoding/json"
+	"gokave"
+	"gokave/gkfs"
+	"gokave/gkraft"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// openTestDB - a DB on an in memory file system holding the store s
+func openTestDB(t *testing.T, opts ...gokave.Option) (db *gokave.DB) {
+	t.Helper()
+	opts = append([]gokave.Option{gokave.WithFS(gkfs.NewMem()), gokave.WithDataDirectory("/data"), gokave.WithConfigFile("/config.json")}, opts...)
+	db, err := gokave.Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateStore(context.Background(), "s"); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// newTestNode - a Raft cluster of one applying to db
+func newTestNode(t *testing.T, db *gokave.DB) (node *gkraft.Node) {
+	t.Helper()
+	network := gkraft.NewNetwork()
+	node, err := gkraft.NewNode(gkraft.Config{
+		ID: "n1", Storage: gkraft.NewMemoryStorage(), Transport: network.Transport("n1"), Machine: gkraft.NewDBMachine(db),
+		Bootstrap: []gkraft.Member{{ID: "n1", Addr: "n1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.Attach("n1", node)
+	return
+}
+
+// startTestServer - serve db over HTTP until stop is called, which also closes db
+func startTestServer(db *gokave.DB, opts ...Option) (httpServer *httptest.Server, stop func()) {
+	server := New(db, opts...)
+	httpServer = httptest.NewServer(server)
+	return httpServer, func() {
+		server.Shutdown()
+		httpServer.Close()
+		db.Close()
+	}
+}
+
+// doJSON - make a request and decode a JSON response into v, returning the response
+func doJSON(t *testing.T, method string, url string, v interface{}) (response *http.Response) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if v != nil && response.StatusCode < 300 {
+		if err = json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestVerifyJob(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	if err := db.Write(context.Background(), "s", "a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+
+	var job VerifyJob
+	response := doJSON(t, http.MethodPost, httpServer.URL+"/store/admin/s/_verify", &job)
+	if response.StatusCode != http.StatusAccepted || job.ID == "" || job.Store != "s" {
+		t.Fatalf("Start verify: %d %+v", response.StatusCode, job)
+	}
+	location := response.Header.Get("Location")
+	if location != "/store/admin/s/_verify/"+job.ID {
+		t.Errorf("Location: %s", location)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State == VerifyRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if response = doJSON(t, http.MethodGet, httpServer.URL+location, &job); response.StatusCode != http.StatusOK {
+			t.Fatalf("Poll verify: %d", response.StatusCode)
+		}
+	}
+	if job.State != VerifyDone || job.Report == nil || !job.Report.OK || len(job.Report.Files) == 0 {
+		t.Fatalf("Verify job: %+v", job)
+	}
+
+	if response = doJSON(t, http.MethodGet, httpServer.URL+"/store/admin/s/_verify/unknown", nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Unknown job: %d, expected 404", response.StatusCode)
+	}
+	if response = doJSON(t, http.MethodGet, httpServer.URL+"/store/admin/other/_verify/"+job.ID, nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Job of another store: %d, expected 404", response.StatusCode)
+	}
+	if response = doJSON(t, http.MethodPost, httpServer.URL+"/store/admin/other/_verify", nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Verify of an unknown store: %d, expected 404", response.StatusCode)
+	}
+}
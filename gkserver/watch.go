@@ -0,0 +1,216 @@
+package gkserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of change sent by _watch
+const (
+	WatchPut    = "put"
+	WatchDelete = "delete"
+)
+
+const defaultPollTimeout = 30 * time.Second
+const maxPollTimeout = 5 * time.Minute
+const maxPollChanges = 1000
+
+// watchHeartbeat - how often an idle event stream is sent a comment so proxies don't close it
+const watchHeartbeat = 15 * time.Second
+
+// WatchEvent - one change as sent by _watch. Values are base64 encoded
+type WatchEvent struct {
+	Seq         uint64            `json:"seq"`
+	Time        time.Time         `json:"time"`
+	Key         string            `json:"key"`
+	Type        string            `json:"type"`
+	Value       []byte            `json:"value,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// PollResponse - the body of a long-poll _watch. Last is the since to ask for next time
+type PollResponse struct {
+	Changes []WatchEvent `json:"changes"`
+	Last    uint64       `json:"last"`
+}
+
+// handleWatch - the changes to a store after ?since= to keys starting with ?prefix=.
+// If the Accept header asks for text/event-stream the changes already made are sent followed by
+// new ones as they happen, each as an event with the change's seq as its id. A client reconnecting
+// with Last-Event-ID carries on from there. Otherwise this is a long-poll returning a PollResponse
+// as soon as there is at least one change, or an empty one after ?timeout= (default 30s)
+func (server *Server) handleWatch(db *gokave.DB, responseWriter http.ResponseWriter, httpRequest *http.Request, params params) {
+	query := httpRequest.URL.Query()
+	since, err := parseSeq(query.Get("since"))
+	if lastEventID := httpRequest.Header.Get("Last-Event-ID"); lastEventID != "" && err == nil {
+		since, err = parseSeq(lastEventID)
+	}
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, err := db.OpenStore(httpRequest.Context(), params["store"])
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+
+	// Watches can go on for a long time so stop them when the server is shutting down
+	ctx, cancel := context.WithCancel(httpRequest.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-server.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	fmt.Printf("Watch store: %s since: %d prefix: %s\n", store.Name(), since, query.Get("prefix"))
+	if strings.Contains(httpRequest.Header.Get("Accept"), "text/event-stream") {
+		streamChanges(ctx, store, since, query.Get("prefix"), responseWriter)
+		return
+	}
+	pollChanges(ctx, store, since, responseWriter, httpRequest)
+}
+
+func pollChanges(ctx context.Context, store *gokave.Store, since uint64, responseWriter http.ResponseWriter, httpRequest *http.Request) {
+	query := httpRequest.URL.Query()
+	timeout := defaultPollTimeout
+	if query.Get("timeout") != "" {
+		var err error
+		if timeout, err = time.ParseDuration(query.Get("timeout")); err != nil || timeout < 0 {
+			http.Error(responseWriter, fmt.Sprintf("Bad timeout: %s", query.Get("timeout")), http.StatusBadRequest)
+			return
+		}
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+	max := maxPollChanges
+	if query.Get("max") != "" {
+		var err error
+		if max, err = strconv.Atoi(query.Get("max")); err != nil || max < 1 || max > maxPollChanges {
+			http.Error(responseWriter, fmt.Sprintf("Bad max: %s. Must be 1 to %d", query.Get("max"), maxPollChanges), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	changes, err := store.Poll(ctx, since, query.Get("prefix"), max)
+	if err != nil {
+		writeError(responseWriter, httpRequest, err)
+		return
+	}
+	response := PollResponse{Changes: make([]WatchEvent, 0, len(changes)), Last: since}
+	for _, change := range changes {
+		response.Changes = append(response.Changes, watchEvent(change))
+		if change.Seq > response.Last {
+			response.Last = change.Seq
+		}
+	}
+	writeJSON(responseWriter, httpRequest, response)
+}
+
+// streamChanges - send changes as server-sent events until ctx is done. Anything that goes wrong
+// once the stream has started is sent as an "error" event before the stream is ended
+func streamChanges(ctx context.Context, store *gokave.Store, since uint64, prefix string, responseWriter http.ResponseWriter) {
+	flusher, ok := responseWriter.(http.Flusher)
+	if !ok {
+		http.Error(responseWriter, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "text/event-stream")
+	responseWriter.Header().Set("Cache-Control", "no-cache")
+	responseWriter.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The watch runs on its own goroutine so the stream can be kept alive while it waits
+	changes := make(chan gokave.Change)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- store.Watch(ctx, since, prefix, func(change gokave.Change) error {
+			select {
+			case changes <- change:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change := <-changes:
+			event := watchEvent(change)
+			data, err := json.Marshal(event)
+			if err != nil {
+				writeStreamError(responseWriter, err)
+				return
+			}
+			if _, err = fmt.Fprintf(responseWriter, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(responseWriter, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case err := <-watchErr:
+			if ctx.Err() == nil {
+				writeStreamError(responseWriter, err)
+				flusher.Flush()
+			}
+			return
+		}
+	}
+}
+
+// writeStreamError - an "error" event with the HTTP status the error would have had
+func writeStreamError(responseWriter http.ResponseWriter, err error) {
+	data, _ := json.Marshal(struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{Status: errorStatus(err), Error: err.Error()})
+	fmt.Fprintf(responseWriter, "event: error\ndata: %s\n\n", data)
+}
+
+func watchEvent(change gokave.Change) (event WatchEvent) {
+	event = WatchEvent{Seq: change.Seq, Time: change.Time, Key: change.Key, Type: WatchPut, Value: change.Value}
+	if change.Deleted {
+		event.Type = WatchDelete
+	}
+	for name, value := range change.Meta {
+		if name == gokave.MetaContentType {
+			event.ContentType = value
+			continue
+		}
+		if event.Meta == nil {
+			event.Meta = make(map[string]string)
+		}
+		event.Meta[name] = value
+	}
+	return
+}
+
+func parseSeq(text string) (seq uint64, err error) {
+	if text == "" {
+		return 0, nil
+	}
+	if seq, err = strconv.ParseUint(text, 10, 64); err != nil {
+		return 0, errors.New("Bad sequence number: " + text)
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package gkserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gokave/gkstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchPoll(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	url := httpServer.URL + "/v1/stores/s/_watch"
+	expectStatus(t, http.MethodPut, httpServer.URL+"/v1/stores/s/keys/a", "one", http.StatusOK)
+	expectStatus(t, http.MethodDelete, httpServer.URL+"/v1/stores/s/keys/a", "", http.StatusOK)
+
+	var poll PollResponse
+	if response := doJSON(t, http.MethodGet, url+"?since=0", &poll); response.StatusCode != http.StatusOK {
+		t.Fatalf("Poll: %d", response.StatusCode)
+	}
+	if len(poll.Changes) != 2 || poll.Last != 2 || poll.Changes[0].Type != WatchPut || string(poll.Changes[0].Value) != "one" ||
+		poll.Changes[1].Type != WatchDelete || poll.Changes[1].Seq != 2 {
+		t.Errorf("Poll: %+v", poll)
+	}
+	// Nothing new before the timeout is an empty answer for the same since
+	poll = PollResponse{}
+	if response := doJSON(t, http.MethodGet, url+"?since=2&timeout=10ms", &poll); response.StatusCode != http.StatusOK || len(poll.Changes) != 0 || poll.Last != 2 {
+		t.Errorf("Poll with nothing new: %d %+v", response.StatusCode, poll)
+	}
+	expectStatus(t, http.MethodGet, url+"?since=x", "", http.StatusBadRequest)
+	expectStatus(t, http.MethodGet, url+"?timeout=soon", "", http.StatusBadRequest)
+	expectStatus(t, http.MethodGet, url+"?max=0", "", http.StatusBadRequest)
+	expectStatus(t, http.MethodGet, httpServer.URL+"/v1/stores/missing/_watch", "", http.StatusNotFound)
+}
+
+func TestWatchHistoryCompacted(t *testing.T) {
+	previous := gkstore.MaxSegmentSize
+	gkstore.MaxSegmentSize = 100
+	defer func() { gkstore.MaxSegmentSize = previous }()
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	defer httpServer.Close()
+	for i := 0; i < 6; i++ {
+		expectStatus(t, http.MethodPut, fmt.Sprintf("%s/v1/stores/s/keys/key%d", httpServer.URL, i), "value", http.StatusOK)
+	}
+	expectStatus(t, http.MethodPost, httpServer.URL+"/v1/stores/s/_compact", "", http.StatusOK)
+
+	expectStatus(t, http.MethodGet, httpServer.URL+"/v1/stores/s/_watch?since=1&timeout=10ms", "", http.StatusGone)
+	// A stream that is already going when it finds the changes are gone says so in an error event
+	request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/v1/stores/s/_watch?since=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	lines := bufio.NewScanner(response.Body)
+	var event []string
+	for lines.Scan() && lines.Text() != "" {
+		event = append(event, lines.Text())
+	}
+	if len(event) != 2 || event[0] != "event: error" || !strings.Contains(event[1], `"status":410`) {
+		t.Errorf("Stream of compacted changes: %q", event)
+	}
+	// From 0 the current values are sent instead
+	var poll PollResponse
+	if response := doJSON(t, http.MethodGet, httpServer.URL+"/v1/stores/s/_watch?since=0", &poll); response.StatusCode != http.StatusOK || len(poll.Changes) != 6 {
+		t.Errorf("Poll from 0: %d %+v", response.StatusCode, poll)
+	}
+}
+
+func TestWatchStream(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	httpServer := httptest.NewServer(New(db))
+	expectStatus(t, http.MethodPut, httpServer.URL+"/v1/stores/s/keys/a", "one", http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/store/s/_watch?since=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Watch: %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	lines := bufio.NewScanner(response.Body)
+	nextEvent := func() (id string, eventType string, event WatchEvent) {
+		t.Helper()
+		for lines.Scan() && lines.Text() != "" {
+			field := strings.SplitN(lines.Text(), ": ", 2)
+			switch field[0] {
+			case "id":
+				id = field[1]
+			case "event":
+				eventType = field[1]
+			case "data":
+				if err := json.Unmarshal([]byte(field[1]), &event); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return
+	}
+
+	// The change already made, then one made while watching
+	if id, eventType, event := nextEvent(); id != "1" || eventType != WatchPut || event.Key != "a" || string(event.Value) != "one" {
+		t.Errorf("First event: %s %s %+v", id, eventType, event)
+	}
+	expectStatus(t, http.MethodDelete, httpServer.URL+"/v1/stores/s/keys/a", "", http.StatusOK)
+	if id, eventType, event := nextEvent(); id != "2" || eventType != WatchDelete || event.Key != "a" || event.Value != nil {
+		t.Errorf("Second event: %s %s %+v", id, eventType, event)
+	}
+
+	// Once the client goes away the handler finishes, which Close waits for
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		httpServer.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The watch carried on after the client went away")
+	}
+}
@@ -0,0 +1,57 @@
+package gkshard
+
+import (
+	"encoding/json"
+	"gokave/gkfs"
+	"path/filepath"
+)
+
+// Config - the nodes of a sharded deployment, as held in each node's shard config file:
+//
+//	{"Partitions": 64, "Nodes": [{"id": "n1", "addr": "http://host1:8080"}, ...]}
+//
+// Every node needs the same Partitions, VirtualNodes and Nodes. Partitions can't be changed once
+// there is data as every key would move. Version has to go up with each change to the nodes so
+// that nodes can tell a newer config from an older one. gkserver's PUT /v1/shards takes care of it
+type Config struct {
+	Version      uint64
+	Partitions   int `json:",omitempty"`
+	VirtualNodes int `json:",omitempty"`
+	Nodes        []Node
+}
+
+func (config Config) withDefaults() Config {
+	if config.Partitions <= 0 {
+		config.Partitions = DefaultPartitions
+	}
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = DefaultVirtualNodes
+	}
+	return config
+}
+
+// ReadConfig - the config in fileName
+func ReadConfig(fsys gkfs.FS, fileName string) (config Config, err error) {
+	data, err := gkfs.ReadFile(fsys, fileName)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &config)
+	return
+}
+
+// WriteConfig - replace fileName with config. As with the DB's config file a crash can't leave a
+// half written file behind
+func WriteConfig(fsys gkfs.FS, fileName string, config Config) (err error) {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return
+	}
+	if err = gkfs.WriteFile(fsys, fileName+".tmp", data); err != nil {
+		return
+	}
+	if err = fsys.Rename(fileName+".tmp", fileName); err != nil {
+		return
+	}
+	return fsys.SyncDir(filepath.Dir(fileName))
+}
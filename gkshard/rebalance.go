@@ -0,0 +1,298 @@
+package gkshard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusPath - where a node's Status is served, and a new config PUT
+const StatusPath = "/v1/shards"
+
+// PartitionPath - where a partition's records are POSTed to its owner
+func PartitionPath(storeName string, partition int) string {
+	return "/v1/stores/" + url.PathEscape(storeName) + "/_partitions/" + strconv.Itoa(partition)
+}
+
+// Record - one key of a partition as sent between nodes, a line of JSON each
+type Record struct {
+	Key   string      `json:"key"`
+	Value []byte      `json:"value"`
+	Meta  gokave.Meta `json:"meta,omitempty"`
+}
+
+// ReceiveStats - what a node did with the records of a partition sent to it
+type ReceiveStats struct {
+	Received int `json:"received"`
+	Written  int `json:"written"`
+	// Skipped keys had been written or deleted on the new owner since the config changed, which
+	// is newer than what was sent
+	Skipped int `json:"skipped"`
+}
+
+// Status - a node's view of the deployment
+type Status struct {
+	Self      string          `json:"self"`
+	Config    Config          `json:"config"`
+	Owned     []int           `json:"owned"`
+	Rebalance RebalanceStatus `json:"rebalance"`
+}
+
+// Status - see Status
+func (sharder *Sharder) Status() Status {
+	sharder.mutex.RLock()
+	defer sharder.mutex.RUnlock()
+	owned := sharder.ring.Owned(sharder.self)
+	if owned == nil {
+		owned = []int{}
+	}
+	return Status{Self: sharder.self, Config: sharder.config, Owned: owned, Rebalance: sharder.status}
+}
+
+// rebalance - send every partition held here but owned elsewhere to its owner, then delete it here
+func (sharder *Sharder) rebalance(ctx context.Context) {
+	sharder.mutex.Lock()
+	sharder.status = RebalanceStatus{Running: true, Started: time.Now().UTC()}
+	sharder.mutex.Unlock()
+
+	partitions, keys, err := sharder.moveAll(ctx)
+	if err != nil {
+		fmt.Println("Rebalance:", err)
+	}
+	sharder.mutex.Lock()
+	sharder.status.Running, sharder.status.Finished = false, time.Now().UTC()
+	sharder.status.Partitions, sharder.status.Keys = partitions, keys
+	if err != nil {
+		sharder.status.Error = err.Error()
+	}
+	sharder.mutex.Unlock()
+	if partitions > 0 {
+		fmt.Printf("Rebalanced: sent %d partitions, %d keys\n", partitions, keys)
+	}
+}
+
+func (sharder *Sharder) moveAll(ctx context.Context) (partitions int, keys int, err error) {
+	if err = sharder.syncStores(ctx); err != nil {
+		return
+	}
+	ring := sharder.Ring()
+	storeNames, err := sharder.db.ListStores(ctx)
+	if err != nil {
+		return
+	}
+	for _, storeName := range storeNames {
+		store, openErr := sharder.db.OpenStore(ctx, storeName)
+		if errors.Is(openErr, gokave.ErrStoreNotFound) {
+			continue
+		}
+		if openErr != nil {
+			return partitions, keys, openErr
+		}
+		storeKeys, keysErr := store.Keys(ctx, "")
+		if keysErr != nil {
+			return partitions, keys, keysErr
+		}
+		moving := make(map[int][]string)
+		for _, key := range storeKeys {
+			if partition := ring.Partition(key); ring.Owner(partition).ID != sharder.self {
+				moving[partition] = append(moving[partition], key)
+			}
+		}
+		order := make([]int, 0, len(moving))
+		for partition := range moving {
+			order = append(order, partition)
+		}
+		sort.Ints(order)
+		for _, partition := range order {
+			owner := ring.Owner(partition)
+			stats, sendErr := sharder.sendPartition(ctx, owner, store, partition, moving[partition])
+			if sendErr != nil {
+				// Carry on with the partitions going to other nodes and try this one again later
+				if err == nil {
+					err = fmt.Errorf("store %s partition %d to %s: %w", storeName, partition, owner.ID, sendErr)
+				}
+				continue
+			}
+			for _, key := range moving[partition] {
+				if deleteErr := store.Delete(ctx, key); deleteErr != nil {
+					return partitions, keys, deleteErr
+				}
+			}
+			fmt.Printf("Sent store %s partition %d to %s: %d keys, %d skipped\n", storeName, partition, owner.ID, stats.Written, stats.Skipped)
+			partitions++
+			keys += stats.Received
+		}
+	}
+	return
+}
+
+// sendPartition - stream the keys of a partition to its owner
+func (sharder *Sharder) sendPartition(ctx context.Context, owner Node, store *gokave.Store, partition int, keys []string) (stats ReceiveStats, err error) {
+	storeConfig, err := json.Marshal(store.Config())
+	if err != nil {
+		return
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		encoder := json.NewEncoder(writer)
+		for _, key := range keys {
+			value, meta, err := store.ReadMeta(ctx, key)
+			if errors.Is(err, gokave.ErrKeyNotFound) {
+				continue
+			}
+			if err == nil {
+				err = encoder.Encode(Record{Key: key, Value: value, Meta: meta})
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.Close()
+	}()
+	defer reader.Close()
+
+	header := http.Header{StoreConfigHeader: {string(storeConfig)}, "Content-Type": {"application/x-ndjson"}}
+	err = sharder.call(ctx, owner, http.MethodPost, PartitionPath(store.Name(), partition), header, reader, &stats)
+	return
+}
+
+// Receive - write the records of a partition sent by another node. Keys already here, whether
+// live or deleted, are left as they are as they changed after the config did
+func (sharder *Sharder) Receive(ctx context.Context, storeConfig gokave.StoreConfig, partition int, records io.Reader) (stats ReceiveStats, err error) {
+	ring := sharder.Ring()
+	if partition < 0 || partition >= ring.Partitions() {
+		return stats, fmt.Errorf("No partition %d", partition)
+	}
+	if owner := ring.Owner(partition); owner.ID != sharder.self {
+		return stats, fmt.Errorf("%w: partition %d belongs to %s", ErrNotOwner, partition, owner.ID)
+	}
+	store, err := sharder.db.OpenStore(ctx, storeConfig.Name)
+	if errors.Is(err, gokave.ErrStoreNotFound) {
+		if err = sharder.db.Replication().EnsureStore(ctx, storeConfig); err != nil {
+			return
+		}
+		store, err = sharder.db.OpenStore(ctx, storeConfig.Name)
+	}
+	if err != nil {
+		return
+	}
+
+	decoder := json.NewDecoder(records)
+	for {
+		var record Record
+		if err = decoder.Decode(&record); err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("Bad partition record: %w", err)
+		}
+		stats.Received++
+		_, _, err = store.Head(ctx, record.Key)
+		switch {
+		case err == nil, errors.Is(err, gokave.ErrKeyDeleted):
+			stats.Skipped++
+			continue
+		case !errors.Is(err, gokave.ErrKeyNotFound):
+			return
+		}
+		if err = store.WriteMeta(ctx, record.Key, record.Value, record.Meta); err != nil {
+			return
+		}
+		stats.Written++
+	}
+}
+
+// syncConfig - switch to a newer config held by another node, e.g. one changed while this node
+// was down
+func (sharder *Sharder) syncConfig(ctx context.Context) {
+	for _, node := range sharder.Ring().Nodes() {
+		if node.ID == sharder.self {
+			continue
+		}
+		var status Status
+		if err := sharder.call(ctx, node, http.MethodGet, StatusPath, nil, nil, &status); err != nil {
+			continue
+		}
+		if status.Config.Version > sharder.Config().Version {
+			if _, err := sharder.SetConfig(status.Config); err != nil {
+				fmt.Printf("Shard config from %s: %s\n", node.ID, err)
+			}
+		}
+	}
+}
+
+// syncStores - create the stores other nodes have and this one doesn't, which it missed by not
+// being in the deployment when they were created. Nodes that can't be reached are passed over
+func (sharder *Sharder) syncStores(ctx context.Context) (err error) {
+	for _, node := range sharder.Ring().Nodes() {
+		if node.ID == sharder.self {
+			continue
+		}
+		if err = sharder.syncStoresFrom(ctx, node); ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Printf("Stores from %s: %s\n", node.ID, err)
+		}
+	}
+	return nil
+}
+
+func (sharder *Sharder) syncStoresFrom(ctx context.Context, node Node) (err error) {
+	var storeNames []string
+	if err = sharder.call(ctx, node, http.MethodGet, "/v1/stores", nil, nil, &storeNames); err != nil {
+		return
+	}
+	for _, storeName := range storeNames {
+		if _, err = sharder.db.OpenStore(ctx, storeName); !errors.Is(err, gokave.ErrStoreNotFound) {
+			continue
+		}
+		var storeConfig gokave.StoreConfig
+		if err = sharder.call(ctx, node, http.MethodGet, "/v1/stores/"+url.PathEscape(storeName), nil, nil, &storeConfig); err != nil {
+			return
+		}
+		fmt.Printf("Creating store %s held by %s\n", storeName, node.ID)
+		if err = sharder.db.Replication().EnsureStore(ctx, storeConfig); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// call - a request to another node, decoding its JSON response into response
+func (sharder *Sharder) call(ctx context.Context, node Node, method string, path string, header http.Header, body io.Reader, response interface{}) (err error) {
+	httpRequest, err := http.NewRequest(method, strings.TrimSuffix(node.Addr, "/")+path, body)
+	if err != nil {
+		return
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	for name, values := range header {
+		httpRequest.Header[name] = values
+	}
+	httpRequest.Header.Set(ForwardedHeader, sharder.self)
+	httpResponse, err := sharder.client.Do(httpRequest)
+	if err != nil {
+		return
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s %s: %s %s", node.ID, method, path, httpResponse.Status, bytes.TrimSpace(responseBody))
+	}
+	return json.Unmarshal(responseBody, response)
+}
@@ -0,0 +1,141 @@
+// Package gkshard splits stores across several gokave servers. Every store is divided into the same
+// fixed number of partitions by a hash of the key, and the partitions are spread over the nodes by
+// consistent hashing, so adding or removing a node only moves the partitions it gains or loses.
+//
+// Each node holds its own gokave.DB with every store in it, but only the keys of the partitions it
+// owns. gkserver (see gkserver.WithShards) forwards requests for other keys to their owner. When
+// the nodes change a Sharder's rebalancer streams the partitions it no longer owns to their new
+// owners
+package gkshard
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Defaults for a Config that leaves them out
+const (
+	DefaultPartitions   = 64
+	DefaultVirtualNodes = 128
+)
+
+// ErrNoNodes means a ring was asked for without any nodes in it
+var ErrNoNodes = errors.New("No shard nodes")
+
+// Node - a gokave server holding some of the partitions. Addr is its base URL
+type Node struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// Ring - which node owns each partition. A Ring isn't changed once made
+type Ring struct {
+	partitions int
+	nodes      []Node
+	owners     []int // index in nodes by partition
+}
+
+// point - one of a node's places on the hash circle
+type point struct {
+	hash uint64
+	node int
+}
+
+// NewRing - the ring for config. Every node computes the same ring from the same config
+func NewRing(config Config) (ring *Ring, err error) {
+	config = config.withDefaults()
+	if len(config.Nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	ring = &Ring{partitions: config.Partitions, nodes: append([]Node(nil), config.Nodes...)}
+	seen := make(map[string]bool, len(ring.nodes))
+	points := make([]point, 0, len(ring.nodes)*config.VirtualNodes)
+	for i, node := range ring.nodes {
+		if node.ID == "" || node.Addr == "" {
+			return nil, fmt.Errorf("A shard node needs an id and an addr: %+v", node)
+		}
+		if seen[node.ID] {
+			return nil, fmt.Errorf("Duplicate shard node: %s", node.ID)
+		}
+		seen[node.ID] = true
+		for v := 0; v < config.VirtualNodes; v++ {
+			points = append(points, point{hash: hash64(fmt.Sprintf("%s#%d", node.ID, v)), node: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return ring.nodes[points[i].node].ID < ring.nodes[points[j].node].ID
+	})
+
+	// A partition belongs to the first node point at or after its own place on the circle
+	ring.owners = make([]int, ring.partitions)
+	for partition := range ring.owners {
+		h := hash64(fmt.Sprintf("partition#%d", partition))
+		i := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+		if i == len(points) {
+			i = 0
+		}
+		ring.owners[partition] = points[i].node
+	}
+	return
+}
+
+// Partitions - how many partitions the stores are split into
+func (ring *Ring) Partitions() int {
+	return ring.partitions
+}
+
+// Nodes - the nodes in the ring
+func (ring *Ring) Nodes() []Node {
+	return append([]Node(nil), ring.nodes...)
+}
+
+// Node - the node called id
+func (ring *Ring) Node(id string) (node Node, ok bool) {
+	for _, node := range ring.nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return
+}
+
+// Partition - the partition a key falls in. key has to be as the store holds it (see
+// gokave.StoreConfig.StoreKey) so that keys a store treats as the same land together
+func (ring *Ring) Partition(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(ring.partitions))
+}
+
+// Owner - the node holding partition
+func (ring *Ring) Owner(partition int) Node {
+	return ring.nodes[ring.owners[partition]]
+}
+
+// Owned - the partitions held by the node called id, in order
+func (ring *Ring) Owned(id string) (partitions []int) {
+	for partition, owner := range ring.owners {
+		if ring.nodes[owner].ID == id {
+			partitions = append(partitions, partition)
+		}
+	}
+	return
+}
+
+// hash64 - FNV-1a, mixed so that similar strings such as "n1#1" and "n1#2" end up far apart
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,95 @@
+package gkshard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testNodes(ids ...string) (nodes []Node) {
+	for _, id := range ids {
+		nodes = append(nodes, Node{ID: id, Addr: "http://" + id})
+	}
+	return
+}
+
+func newTestRing(t *testing.T, partitions int, ids ...string) (ring *Ring) {
+	t.Helper()
+	ring, err := NewRing(Config{Partitions: partitions, Nodes: testNodes(ids...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRingAddNode(t *testing.T) {
+	const partitions = 256
+	before := newTestRing(t, partitions, "n1", "n2", "n3")
+	after := newTestRing(t, partitions, "n1", "n2", "n3", "n4")
+
+	// Only partitions taken by the new node move
+	moved := 0
+	for partition := 0; partition < partitions; partition++ {
+		if from, to := before.Owner(partition), after.Owner(partition); from != to {
+			if to.ID != "n4" {
+				t.Errorf("Partition %d moved from %s to %s rather than to the new node", partition, from.ID, to.ID)
+			}
+			moved++
+		}
+	}
+	// About a quarter should move. Anywhere near all of them means the ring isn't consistent
+	if moved == 0 || moved > partitions/2 {
+		t.Errorf("%d of %d partitions moved", moved, partitions)
+	}
+	if len(after.Owned("n4")) != moved {
+		t.Errorf("n4 owns %d partitions, %d moved", len(after.Owned("n4")), moved)
+	}
+
+	// Removing the node again gives back the ring it started from
+	removed := newTestRing(t, partitions, "n1", "n2", "n3")
+	for partition := 0; partition < partitions; partition++ {
+		if removed.Owner(partition) != before.Owner(partition) {
+			t.Errorf("Partition %d: %s once n4 was removed, %s before it was added", partition, removed.Owner(partition).ID, before.Owner(partition).ID)
+		}
+	}
+}
+
+func TestRingNodeOrder(t *testing.T) {
+	// Every node has to compute the same ring whatever order it lists the nodes in
+	ring := newTestRing(t, 0, "n1", "n2", "n3")
+	reordered := newTestRing(t, 0, "n3", "n1", "n2")
+	if ring.Partitions() != DefaultPartitions {
+		t.Errorf("Partitions: %d, expected the default %d", ring.Partitions(), DefaultPartitions)
+	}
+	total := 0
+	for _, node := range ring.Nodes() {
+		owned := ring.Owned(node.ID)
+		if fmt.Sprint(owned) != fmt.Sprint(reordered.Owned(node.ID)) {
+			t.Errorf("%s owns %v, or %v with the nodes reordered", node.ID, owned, reordered.Owned(node.ID))
+		}
+		if len(owned) == 0 {
+			t.Errorf("%s owns no partitions", node.ID)
+		}
+		total += len(owned)
+	}
+	if total != DefaultPartitions {
+		t.Errorf("%d partitions owned, expected %d", total, DefaultPartitions)
+	}
+
+	for _, key := range []string{"", "a", "users/1", "users/2"} {
+		if partition := ring.Partition(key); partition < 0 || partition >= ring.Partitions() || partition != reordered.Partition(key) {
+			t.Errorf("Partition of %q: %d", key, partition)
+		}
+	}
+}
+
+func TestRingBadConfig(t *testing.T) {
+	if _, err := NewRing(Config{}); err != ErrNoNodes {
+		t.Errorf("No nodes: %v, expected ErrNoNodes", err)
+	}
+	if _, err := NewRing(Config{Nodes: testNodes("n1", "n1")}); err == nil {
+		t.Error("Duplicate nodes accepted")
+	}
+	if _, err := NewRing(Config{Nodes: []Node{{ID: "n1"}}}); err == nil {
+		t.Error("Node without an addr accepted")
+	}
+}
@@ -0,0 +1,241 @@
+package gkshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gokave"
+	"gokave/gkfs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Errors from a Sharder
+var (
+	// ErrNotOwner means partition records were sent to a node that doesn't own the partition
+	ErrNotOwner = errors.New("Not the owner of the partition")
+	// ErrPartitionsChanged means a new config has a different number of partitions
+	ErrPartitionsChanged = errors.New("The number of partitions can't be changed")
+	// ErrStaleConfig means a config older than the one in use was offered
+	ErrStaleConfig = errors.New("Shard config is older than the one in use")
+)
+
+// ForwardedHeader - set on requests one node makes to another, listing the IDs of the nodes the
+// request has passed through. A node serves a forwarded request itself rather than broadcasting it
+// again, and refuses one that has already been through it
+const ForwardedHeader = "X-Gokave-Forwarded-By"
+
+// StoreConfigHeader - the JSON gokave.StoreConfig of the store partition records are sent for, so
+// that a node that joined after the store was created can create it
+const StoreConfigHeader = "X-Gokave-Store-Config"
+
+// syncInterval - how often the other nodes are asked for a newer config
+const syncInterval = 30 * time.Second
+
+// rebalanceRetry - the wait before a failed rebalance is tried again, doubling each time it fails
+// up to syncInterval
+const rebalanceRetry = time.Second
+
+// Sharder - one node's view of the ring, and the rebalancer that moves the partitions the node no
+// longer owns to their owners
+type Sharder struct {
+	db         *gokave.DB
+	self       string
+	fsys       gkfs.FS
+	configFile string
+	client     *http.Client
+
+	mutex  sync.RWMutex // guards config, ring and status
+	config Config
+	ring   *Ring
+	status RebalanceStatus
+
+	kick chan struct{} // asks for a rebalance. Buffered so a kick while one runs isn't lost
+	stop chan struct{}
+	done chan struct{}
+}
+
+// RebalanceStatus - how the last rebalance went
+type RebalanceStatus struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	// Partitions is how many store partitions were sent, and Keys the keys in them
+	Partitions int    `json:"partitions"`
+	Keys       int    `json:"keys"`
+	Error      string `json:"error,omitempty"`
+}
+
+// New - a Sharder for db as the node called self, with the config in configFile. self doesn't have
+// to be in the config: a node that has been taken out sends all its partitions away
+func New(db *gokave.DB, self string, fsys gkfs.FS, configFile string) (sharder *Sharder, err error) {
+	config, err := ReadConfig(fsys, configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Shard config %s: %w", configFile, err)
+	}
+	config = config.withDefaults()
+	ring, err := NewRing(config)
+	if err != nil {
+		return nil, fmt.Errorf("Shard config %s: %w", configFile, err)
+	}
+	if _, ok := ring.Node(self); !ok {
+		fmt.Printf("Shard node %s isn't in %s so holds no partitions\n", self, configFile)
+	}
+	return &Sharder{
+		db:         db,
+		self:       self,
+		fsys:       fsys,
+		configFile: configFile,
+		client:     &http.Client{},
+		config:     config,
+		ring:       ring,
+		kick:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// Self - the ID of this node
+func (sharder *Sharder) Self() string {
+	return sharder.self
+}
+
+// Config - the config in use
+func (sharder *Sharder) Config() Config {
+	sharder.mutex.RLock()
+	defer sharder.mutex.RUnlock()
+	return sharder.config
+}
+
+// Ring - the ring for the config in use
+func (sharder *Sharder) Ring() *Ring {
+	sharder.mutex.RLock()
+	defer sharder.mutex.RUnlock()
+	return sharder.ring
+}
+
+// Client - the HTTP client for requests to other nodes
+func (sharder *Sharder) Client() *http.Client {
+	return sharder.client
+}
+
+// Locate - the partition of key in a store and the node that owns it. local is true if that's
+// this node
+func (sharder *Sharder) Locate(ctx context.Context, storeName string, key string) (partition int, owner Node, local bool, err error) {
+	store, err := sharder.db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	ring := sharder.Ring()
+	partition = ring.Partition(store.Config().StoreKey(key))
+	owner = ring.Owner(partition)
+	return partition, owner, owner.ID == sharder.self, nil
+}
+
+// SetConfig - switch to config and start moving partitions to their new owners. A config with the
+// Version in use is accepted only if it is the same config, which changes nothing
+func (sharder *Sharder) SetConfig(config Config) (changed bool, err error) {
+	config = config.withDefaults()
+	ring, err := NewRing(config)
+	if err != nil {
+		return
+	}
+
+	sharder.mutex.Lock()
+	defer sharder.mutex.Unlock()
+	current := sharder.config
+	if config.Partitions != current.Partitions {
+		return false, fmt.Errorf("%w: %d to %d", ErrPartitionsChanged, current.Partitions, config.Partitions)
+	}
+	if config.Version < current.Version || config.Version == current.Version && !sameNodes(config, current) {
+		return false, fmt.Errorf("%w: version %d, in use %d", ErrStaleConfig, config.Version, current.Version)
+	}
+	if config.Version == current.Version {
+		return false, nil
+	}
+	if err = WriteConfig(sharder.fsys, sharder.configFile, config); err != nil {
+		return
+	}
+	fmt.Printf("Shard config version %d: %d nodes\n", config.Version, len(config.Nodes))
+	sharder.config, sharder.ring = config, ring
+	sharder.Rebalance()
+	return true, nil
+}
+
+func sameNodes(a Config, b Config) bool {
+	if a.VirtualNodes != b.VirtualNodes || len(a.Nodes) != len(b.Nodes) {
+		return false
+	}
+	for i := range a.Nodes {
+		if a.Nodes[i] != b.Nodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Rebalance - ask for the partitions this node doesn't own to be sent to their owners. It happens
+// in the background, see RebalanceStatus
+func (sharder *Sharder) Rebalance() {
+	select {
+	case sharder.kick <- struct{}{}:
+	default:
+	}
+}
+
+// RebalanceStatus - see RebalanceStatus
+func (sharder *Sharder) RebalanceStatus() RebalanceStatus {
+	sharder.mutex.RLock()
+	defer sharder.mutex.RUnlock()
+	return sharder.status
+}
+
+// Start - start the rebalancer. It rebalances straight away in case the config changed while the
+// node was down
+func (sharder *Sharder) Start() {
+	sharder.Rebalance()
+	go sharder.run()
+}
+
+// Stop - stop the rebalancer, waiting for a rebalance in progress to give up
+func (sharder *Sharder) Stop() {
+	close(sharder.stop)
+	<-sharder.done
+}
+
+func (sharder *Sharder) run() {
+	defer close(sharder.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sharder.stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	var retry <-chan time.Time
+	delay := rebalanceRetry
+	for {
+		select {
+		case <-sharder.stop:
+			return
+		case <-ticker.C:
+			sharder.syncConfig(ctx)
+			continue
+		case <-retry:
+		case <-sharder.kick:
+		}
+
+		// A failure is often a node that hasn't got the new config yet, so try again soon
+		sharder.rebalance(ctx)
+		if sharder.RebalanceStatus().Error == "" {
+			retry, delay = nil, rebalanceRetry
+			continue
+		}
+		retry = time.After(delay)
+		if delay *= 2; delay > syncInterval {
+			delay = syncInterval
+		}
+	}
+}
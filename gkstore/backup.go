@@ -0,0 +1,565 @@
+package gkstore
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// BackupFileName is the file in a backup describing it (see BackupInfo). The backup also holds the
+// pieces of the store's segments it covers and a MANIFEST listing the segments, so a full backup
+// directory is itself a store directory
+const BackupFileName = "BACKUP"
+
+// Errors from backups and restores
+var (
+	// ErrBadBackup means a restore was given something that isn't a backup, or is a damaged one
+	ErrBadBackup = errors.New("Bad backup")
+	// ErrBackupBaseTooOld means an incremental backup's base no longer matches the store's segments,
+	// as the store has been compacted since. A full backup is needed
+	ErrBackupBaseTooOld = errors.New("The store has been compacted since the base backup, a full backup is needed")
+)
+
+// restoreBatch - how many records a restore writes at a time
+const restoreBatch = 1000
+
+// BackupInfo - what a backup holds. A full backup has all of the store's segments and an
+// incremental backup what was added to them after its Base: the rest of the segment that was
+// active then, and the segments started since. LastSeq is the last change in it, with its bases
+type BackupInfo struct {
+	ID           string
+	Base         string `json:",omitempty"` // the ID of the backup this one carries on from
+	Store        string
+	Created      time.Time
+	LastSeq      uint64
+	CompactedSeq uint64   `json:",omitempty"`
+	Segments     []string // all of the store's segments, oldest first
+	Files        []BackupFile
+	Cursor       BackupCursor // where the next incremental backup carries on from
+	Bytes        int64
+}
+
+// BackupFile - a piece of a segment in a backup, held in the file Name. Offset is where the piece
+// starts in the segment, which is where the backups before it stopped
+type BackupFile struct {
+	Name    string
+	Segment string
+	Offset  int64
+	Length  int64
+}
+
+// BackupCursor - how far into a store a backup goes: the segments before Segment and Segment up to
+// Offset. Generation is the manifest's as compaction rewrites the segments
+type BackupCursor struct {
+	Generation uint64
+	Segment    string
+	Offset     int64
+}
+
+// BackupWriter - where a backup's files go
+type BackupWriter interface {
+	WriteFile(name string, size int64, r io.Reader) error
+}
+
+// TarBackup - a BackupWriter writing the files to a tar stream. Close finishes the stream
+type TarBackup struct {
+	tw *tar.Writer
+}
+
+// NewTarBackup - a TarBackup writing to w
+func NewTarBackup(w io.Writer) *TarBackup {
+	return &TarBackup{tw: tar.NewWriter(w)}
+}
+
+// WriteFile - see BackupWriter
+func (backup *TarBackup) WriteFile(name string, size int64, r io.Reader) (err error) {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now().UTC(), Typeflag: tar.TypeReg}
+	if err = backup.tw.WriteHeader(header); err != nil {
+		return
+	}
+	_, err = io.CopyN(backup.tw, r, size)
+	return
+}
+
+// Close - write the end of the tar stream. The underlying writer is left open
+func (backup *TarBackup) Close() error {
+	return backup.tw.Close()
+}
+
+// DirectoryBackup - a BackupWriter copying the files into a directory, which is created if need be
+type DirectoryBackup struct {
+	FS        gkfs.FS
+	Directory string
+}
+
+// WriteFile - see BackupWriter
+func (backup DirectoryBackup) WriteFile(name string, size int64, r io.Reader) (err error) {
+	if err = backup.FS.MkdirAll(backup.Directory, 0755); err != nil {
+		return
+	}
+	return copyToFile(backup.FS, filepath.Join(backup.Directory, name), io.LimitReader(r, size))
+}
+
+// copyToFile - write everything from r to a new file called name and sync it
+func copyToFile(fsys gkfs.FS, name string, r io.Reader) (err error) {
+	file, err := gkfs.Create(fsys, name)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return
+	}
+	return file.Close()
+}
+
+// Backup - copy the store as it is now to w while reads and writes carry on. The active segment is
+// sealed by starting a new one, which leaves every segment in the backup unchanging, and compaction
+// is held off until they have been copied. Given the BackupInfo of an earlier backup as base only
+// what was added after it is copied, failing with ErrBackupBaseTooOld once the store has been
+// compacted since. The backup holds every change up to the returned LastSeq and none after it
+func (kvStore *KvStore) Backup(w BackupWriter, base *BackupInfo) (info BackupInfo, err error) {
+	manifest, info, err := kvStore.startBackup(base)
+	if err != nil {
+		return
+	}
+	defer func() {
+		kvStore.newFileMutex.Lock()
+		if kvStore.backups--; kvStore.backups == 0 {
+			kvStore.backupsDone.Broadcast()
+		}
+		kvStore.newFileMutex.Unlock()
+	}()
+
+	for _, file := range info.Files {
+		if err = kvStore.backupFile(w, file); err != nil {
+			return info, fmt.Errorf("Backup %s: %w", file.Segment, err)
+		}
+		info.Bytes += file.Length
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return
+	}
+	if err = w.WriteFile(ManifestFileName, int64(len(manifestBytes)), bytes.NewReader(manifestBytes)); err != nil {
+		return
+	}
+	infoBytes, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return
+	}
+	err = w.WriteFile(BackupFileName, int64(len(infoBytes)), bytes.NewReader(infoBytes))
+	return
+}
+
+// startBackup - start a new active segment unless the current one is empty, work out the pieces of
+// the sealed segments to copy and count a backup in progress. Nothing is being written while the
+// new file mutex is held so the store's LastSeq is exactly what the sealed segments hold
+func (kvStore *KvStore) startBackup(base *BackupInfo) (manifest Manifest, info BackupInfo, err error) {
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	if kvStore.closed {
+		return manifest, info, ErrClosed
+	}
+
+	// A read only store can't be written to so all of it is sealed already
+	sealed := len(kvStore.files)
+	if !kvStore.readOnly {
+		if len(kvStore.files[len(kvStore.files)-1].Keys()) > 0 {
+			newFile, err := kvStore.createFile()
+			if err != nil {
+				return manifest, info, err
+			}
+			kvStore.files = append(kvStore.files, newFile)
+		}
+		sealed = len(kvStore.files) - 1
+	}
+	manifest = *kvStore.manifest
+	manifest.Version = manifestVsn
+	manifest.Segments = append([]string(nil), kvStore.manifest.Segments[:sealed]...)
+	manifest.Active = ""
+	created := time.Now().UTC()
+	info = BackupInfo{
+		ID:           strconv.FormatInt(created.UnixNano(), 10),
+		Store:        kvStore.storeName,
+		Created:      created,
+		LastSeq:      kvStore.LastSeq(),
+		CompactedSeq: manifest.CompactedSeq,
+		Segments:     manifest.Segments,
+		Files:        []BackupFile{},
+		Cursor:       BackupCursor{Generation: manifest.Generation},
+	}
+
+	// The base holds the segments before its cursor's and that one up to the cursor's offset
+	first, offset := 0, int64(0)
+	if base != nil {
+		info.Base = base.ID
+		if first, err = kvStore.baseSegment(*base); err != nil {
+			return
+		}
+		offset = base.Cursor.Offset
+	}
+	for i := first; i < sealed; i++ {
+		size, err := kvStore.files[i].Size()
+		if err != nil {
+			return manifest, info, err
+		}
+		file := BackupFile{Name: manifest.Segments[i], Segment: manifest.Segments[i], Length: size}
+		if i == first && offset > size {
+			return manifest, info, fmt.Errorf("%w: the base goes to %d in %s, which is %d bytes", ErrBadBackup, offset, manifest.Segments[i], size)
+		}
+		if i == first && offset > 0 {
+			file.Name = fmt.Sprintf("%s.%d", file.Segment, offset)
+			file.Offset, file.Length = offset, size-offset
+		}
+		if file.Length > 0 {
+			info.Files = append(info.Files, file)
+		}
+		// The next backup carries on from the end of the last sealed segment
+		info.Cursor.Segment, info.Cursor.Offset = file.Segment, size
+	}
+	if sealed > 0 {
+		manifest.Active = manifest.Segments[sealed-1]
+	}
+	kvStore.backups++
+	fmt.Printf("Backup of %s: %d segment pieces up to seq %d\n", kvStore.storeName, len(info.Files), info.LastSeq)
+	return
+}
+
+// CheckBackupBase - whether an incremental backup can be taken on from base, failing with
+// ErrBackupBaseTooOld if not
+func (kvStore *KvStore) CheckBackupBase(base BackupInfo) (err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	_, err = kvStore.baseSegment(base)
+	return
+}
+
+// baseSegment - the index of the segment base's cursor is in. Called with the new file mutex held
+func (kvStore *KvStore) baseSegment(base BackupInfo) (index int, err error) {
+	if base.Cursor.Generation == kvStore.manifest.Generation {
+		// A backup of a store with nothing written to it yet
+		if base.Cursor.Segment == "" {
+			return 0, nil
+		}
+		for i, segment := range kvStore.manifest.Segments {
+			if segment == base.Cursor.Segment {
+				return i, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("%w: generation %d, the base's %d", ErrBackupBaseTooOld, kvStore.manifest.Generation, base.Cursor.Generation)
+}
+
+// backupFile - copy a piece of a segment through its own file handle so the store's reads carry on
+func (kvStore *KvStore) backupFile(w BackupWriter, file BackupFile) (err error) {
+	segment, err := gkfs.Open(kvStore.fs, filepath.Join(kvStore.directory, file.Segment))
+	if err != nil {
+		return
+	}
+	defer segment.Close()
+	return w.WriteFile(file.Name, file.Length, io.NewSectionReader(segment, file.Offset, file.Length))
+}
+
+// ReadBackupInfo - the BackupInfo of the backup in directory
+func ReadBackupInfo(fsys gkfs.FS, directory string) (info BackupInfo, err error) {
+	infoBytes, err := gkfs.ReadFile(fsys, filepath.Join(directory, BackupFileName))
+	if gkfs.IsNotExist(err) {
+		return info, fmt.Errorf("%w: no %s in %s", ErrBadBackup, BackupFileName, directory)
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return info, fmt.Errorf("%w: info: %s", ErrBadBackup, err)
+	}
+	return
+}
+
+// ReadTarBackupInfo - the BackupInfo of a backup written by a TarBackup, e.g. to take an
+// incremental backup on from it. The info is the last file so all of r is read
+func ReadTarBackupInfo(r io.Reader) (info BackupInfo, err error) {
+	found := false
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, fmt.Errorf("%w: %s", ErrBadBackup, err)
+		}
+		if header.Name != BackupFileName {
+			continue
+		}
+		if err = json.NewDecoder(tr).Decode(&info); err != nil {
+			return info, fmt.Errorf("%w: info: %s", ErrBadBackup, err)
+		}
+		found = true
+	}
+	if !found {
+		return info, fmt.Errorf("%w: no %s", ErrBadBackup, BackupFileName)
+	}
+	return
+}
+
+// ExtractBackups - unpack the backups written by TarBackups one after the other to r, such as a full
+// backup followed by its incremental backups, into the numbered directories returned, in
+// directory. Only plain files are expected, and their names can't lead outside directory
+func ExtractBackups(fsys gkfs.FS, r io.Reader, directory string) (directories []string, err error) {
+	br := bufio.NewReader(r)
+	for {
+		// A tar stream ends with zero blocks, which may be followed by more zero blocks of padding
+		// rather than another stream. Only a stream with files in it counts
+		if _, err = br.Peek(1); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		backupDirectory := filepath.Join(directory, strconv.Itoa(len(directories)))
+		extracted, err := extractBackup(fsys, br, backupDirectory)
+		if err != nil {
+			return nil, err
+		}
+		if extracted {
+			directories = append(directories, backupDirectory)
+		}
+	}
+	if len(directories) == 0 {
+		return nil, fmt.Errorf("%w: no files", ErrBadBackup)
+	}
+	return directories, nil
+}
+
+// extractBackup - unpack a single tar stream into directory, created when the first file is found
+func extractBackup(fsys gkfs.FS, r io.Reader, directory string) (extracted bool, err error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %s", ErrBadBackup, err)
+		}
+		name := header.Name
+		if header.Typeflag != tar.TypeReg || name != filepath.Base(name) || name == "." || name == ".." {
+			return false, fmt.Errorf("%w: unexpected entry %q", ErrBadBackup, name)
+		}
+		if !extracted {
+			if err = fsys.MkdirAll(directory, 0755); err != nil {
+				return false, err
+			}
+			extracted = true
+		}
+		if err = copyToFile(fsys, filepath.Join(directory, name), tr); err != nil {
+			return false, err
+		}
+	}
+	if !extracted {
+		return
+	}
+	return true, fsys.SyncDir(directory)
+}
+
+// RestorePoint - where a restore stops. A zero Seq or Time doesn't limit it
+type RestorePoint struct {
+	Seq  uint64
+	Time time.Time
+}
+
+// includes - whether the change stamped stamp happened at or before the point. Records from before
+// sequence numbers are always included
+func (point RestorePoint) includes(stamp gklogfile.Stamp) bool {
+	if stamp.Seq == 0 {
+		return true
+	}
+	return (point.Seq == 0 || stamp.Seq <= point.Seq) && (point.Time.IsZero() || !stamp.Time.After(point.Time))
+}
+
+// RestoreStats - what a restore wrote
+type RestoreStats struct {
+	Store    string
+	Backups  int // the backups in the chain
+	Records  int // the changes replayed
+	Skipped  int // the changes after the restore point
+	LastSeq  uint64
+	LastTime time.Time `json:",omitempty"`
+}
+
+// backupPiece - a piece of a segment and the backup directory holding it
+type backupPiece struct {
+	BackupFile
+	directory string
+}
+
+// readBackupChain - the info of the last backup in a chain, a full backup followed by incremental
+// backups each taken on from the one before, and the pieces of each segment in order. The pieces
+// have to follow on from each other without gaps
+func readBackupChain(fsys gkfs.FS, backupDirectories []string) (last BackupInfo, pieces map[string][]backupPiece, err error) {
+	if len(backupDirectories) == 0 {
+		return last, nil, fmt.Errorf("%w: no backups", ErrBadBackup)
+	}
+	pieces = make(map[string][]backupPiece)
+	for i, directory := range backupDirectories {
+		info, err := ReadBackupInfo(fsys, directory)
+		if err != nil {
+			return last, nil, err
+		}
+		if i == 0 && info.Base != "" {
+			return last, nil, fmt.Errorf("%w: %s is an incremental backup, the chain has to start with a full backup", ErrBadBackup, directory)
+		}
+		if i > 0 && info.Base != last.ID {
+			return last, nil, fmt.Errorf("%w: %s was taken on from backup %s, not %s", ErrBadBackup, directory, info.Base, last.ID)
+		}
+		for _, file := range info.Files {
+			segmentPieces := pieces[file.Segment]
+			end := int64(0)
+			if len(segmentPieces) > 0 {
+				end = segmentPieces[len(segmentPieces)-1].Offset + segmentPieces[len(segmentPieces)-1].Length
+			}
+			if file.Offset != end {
+				return last, nil, fmt.Errorf("%w: %s in %s starts at %d rather than %d", ErrBadBackup, file.Segment, directory, file.Offset, end)
+			}
+			pieces[file.Segment] = append(segmentPieces, backupPiece{BackupFile: file, directory: directory})
+		}
+		last = info
+	}
+	return
+}
+
+// Restore - build a new store in config's directory by replaying the changes in a chain of backups,
+// a full backup followed by any of the incremental backups taken on from it in order, up to until.
+// Replaying checks every record so a damaged backup is found before the store is used. The
+// directory mustn't hold a store already and is removed if the restore fails. A restore point
+// inside the history that compaction dropped before the backup fails with ErrHistoryCompacted as
+// the store as it was then can't be rebuilt. For a point in time that is only known when a
+// compacted record turns out to be after it
+func Restore(backupDirectories []string, storeName string, config Config, until RestorePoint) (stats RestoreStats, err error) {
+	config = config.withDefaults(storeName)
+	fsys := config.FS
+	stats.Store, stats.Backups = storeName, len(backupDirectories)
+	last, pieces, err := readBackupChain(fsys, backupDirectories)
+	if err != nil {
+		return
+	}
+	errCompacted := fmt.Errorf("%w: the backup only holds the latest values up to %d", ErrHistoryCompacted, last.CompactedSeq)
+	if until.Seq != 0 && until.Seq < last.CompactedSeq {
+		return stats, errCompacted
+	}
+	existing, err := readManifest(fsys, config.Directory)
+	if err == nil && existing != nil {
+		err = fmt.Errorf("%s already holds a store", config.Directory)
+	}
+	if err != nil {
+		return
+	}
+
+	kvStore, err := CreateWith(storeName, config)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := kvStore.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			gkfs.RemoveAll(fsys, config.Directory)
+		}
+	}()
+
+	var batch []gklogfile.Record
+	flush := func() (err error) {
+		_, err = kvStore.Apply(batch)
+		batch = batch[:0]
+		return
+	}
+	replay := func(record gklogfile.Record) error {
+		if !until.includes(record.Stamp) {
+			if record.Seq <= last.CompactedSeq {
+				return errCompacted
+			}
+			stats.Skipped++
+			return nil
+		}
+		stats.Records++
+		if record.Seq > stats.LastSeq {
+			stats.LastSeq, stats.LastTime = record.Seq, record.Time
+		}
+		if batch = append(batch, record); len(batch) >= restoreBatch {
+			return flush()
+		}
+		return nil
+	}
+	for _, segment := range last.Segments {
+		if len(pieces[segment]) == 0 {
+			return stats, fmt.Errorf("%w: no backup in the chain holds %s", ErrBadBackup, segment)
+		}
+		for _, piece := range pieces[segment] {
+			err = scanBackupPiece(fsys, piece, replay)
+			var corruption *gklogfile.CorruptionError
+			if errors.As(err, &corruption) {
+				return stats, fmt.Errorf("%w: %s: %s", ErrBadBackup, piece.Name, err)
+			}
+			if err != nil {
+				return stats, fmt.Errorf("Restore %s: %w", piece.Name, err)
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return
+	}
+	return stats, kvStore.setCompactedSeq(last.CompactedSeq)
+}
+
+// scanBackupPiece - only the piece at the start of a segment has its header. Every piece starts and
+// ends on a whole record
+func scanBackupPiece(fsys gkfs.FS, piece backupPiece, fn func(record gklogfile.Record) error) (err error) {
+	file, err := gkfs.Open(fsys, filepath.Join(piece.directory, piece.Name))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return
+	}
+	if size != piece.Length {
+		return fmt.Errorf("%w: %s is %d bytes rather than %d", ErrBadBackup, piece.Name, size, piece.Length)
+	}
+	if piece.Offset == 0 {
+		return gklogfile.Scan(file, size, true, fn)
+	}
+	return gklogfile.ScanFrom(file, 0, size, true, fn)
+}
+
+// setCompactedSeq - carry over the CompactedSeq of a restored backup, as the restored history is no
+// more complete than the backup's
+func (kvStore *KvStore) setCompactedSeq(compactedSeq uint64) (err error) {
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	if compactedSeq <= kvStore.manifest.CompactedSeq {
+		return
+	}
+	updated := *kvStore.manifest
+	updated.CompactedSeq = compactedSeq
+	if err = writeManifest(kvStore.fs, kvStore.directory, &updated); err != nil {
+		return
+	}
+	kvStore.manifest = &updated
+	return
+}
@@ -0,0 +1,301 @@
+package gkstore
+
+import (
+	"errors"
+	"gokave/gkfs"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backupTo - back kvStore up into directory, on from base if it isn't nil
+func backupTo(t *testing.T, fsys gkfs.FS, kvStore *KvStore, directory string, base *BackupInfo) (info BackupInfo) {
+	t.Helper()
+	info, err := kvStore.Backup(DirectoryBackup{FS: fsys, Directory: directory}, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// restoreTo - restore the chain of backups into a store in directory, returned open
+func restoreTo(t *testing.T, fsys gkfs.FS, directory string, until RestorePoint, backups ...string) (kvStore *KvStore, stats RestoreStats) {
+	t.Helper()
+	config := Config{FS: fsys, Directory: directory}
+	stats, err := Restore(backups, "r", config, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kvStore, err = OpenWith("r", config); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// blockingBackup - a BackupWriter that holds up the first file until released
+type blockingBackup struct {
+	started  chan struct{}
+	released chan struct{}
+}
+
+func (backup *blockingBackup) WriteFile(name string, size int64, r io.Reader) (err error) {
+	select {
+	case <-backup.started:
+	default:
+		close(backup.started)
+		<-backup.released
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return
+}
+
+func TestBackupSealsActiveSegment(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a", "b")
+	if err := kvStore.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	active := kvStore.manifest.Segments[len(kvStore.manifest.Segments)-1]
+
+	info := backupTo(t, fsys, kvStore, "/backups/full", nil)
+	if len(info.Segments) != 1 || info.Segments[0] != active || info.LastSeq != 3 {
+		t.Fatalf("Backup: %+v, expected the active segment %s sealed at seq 3", info, active)
+	}
+	// Writes after the backup go to a new segment, leaving the backed up one as it was copied
+	if latest := kvStore.manifest.Segments[len(kvStore.manifest.Segments)-1]; latest == active {
+		t.Errorf("Still writing to %s after backing it up", active)
+	}
+	writeKeys(t, kvStore, "c")
+	sealed, err := gkfs.ReadFile(fsys, filepath.Join(testDirectory, active))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := gkfs.ReadFile(fsys, filepath.Join("/backups/full", active))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(copied) != string(sealed) || info.Bytes != int64(len(copied)) {
+		t.Errorf("Backed up %d bytes of %s (info says %d), which now holds %d", len(copied), active, info.Bytes, len(sealed))
+	}
+	if read, err := ReadBackupInfo(fsys, "/backups/full"); err != nil || read.LastSeq != info.LastSeq {
+		t.Errorf("ReadBackupInfo: %+v, err %v", read, err)
+	}
+
+	restored, stats := restoreTo(t, fsys, "/data/r", RestorePoint{}, "/backups/full")
+	defer restored.Close()
+	expectValue(t, restored, "a", "")
+	expectValue(t, restored, "b", "b")
+	expectValue(t, restored, "c", "")
+	if stats.Records != 3 || stats.LastSeq != 3 || restored.LastSeq() != 3 {
+		t.Errorf("Restore: %+v, last seq %d", stats, restored.LastSeq())
+	}
+
+	// Nothing written since: the empty active segment is left alone
+	segments := len(kvStore.manifest.Segments)
+	backupTo(t, fsys, kvStore, "/backups/again", nil)
+	backupTo(t, fsys, kvStore, "/backups/nothing-new", nil)
+	if len(kvStore.manifest.Segments) != segments+1 {
+		t.Errorf("Segments after two backups with one write before them: %d, expected %d", len(kvStore.manifest.Segments), segments+1)
+	}
+}
+
+func TestRestorePoint(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a", "b")
+	_, b := recordOf(t, fsys, "b")
+	time.Sleep(time.Millisecond)
+	if err := kvStore.Write("a", []byte("a2")); err != nil {
+		t.Fatal(err)
+	}
+	backupTo(t, fsys, kvStore, "/backups/full", nil)
+
+	restored, stats := restoreTo(t, fsys, "/data/seq", RestorePoint{Seq: 1}, "/backups/full")
+	expectValue(t, restored, "a", "a")
+	expectValue(t, restored, "b", "")
+	if stats.Records != 1 || stats.Skipped != 2 || stats.LastSeq != 1 {
+		t.Errorf("Restore to seq 1: %+v", stats)
+	}
+	restored.Close()
+
+	restored, stats = restoreTo(t, fsys, "/data/time", RestorePoint{Time: b.Time}, "/backups/full")
+	defer restored.Close()
+	expectValue(t, restored, "a", "a")
+	expectValue(t, restored, "b", "b")
+	if stats.Records != 2 || stats.Skipped != 1 {
+		t.Errorf("Restore to %s: %+v", b.Time, stats)
+	}
+}
+
+func TestCompactWaitsForBackup(t *testing.T) {
+	defer smallSegments()()
+	_, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeSealedHistory(t, kvStore)
+
+	backup := &blockingBackup{started: make(chan struct{}), released: make(chan struct{})}
+	backedUp := make(chan error)
+	go func() {
+		_, err := kvStore.Backup(backup, nil)
+		backedUp <- err
+	}()
+	<-backup.started
+	compacted := make(chan error)
+	go func() {
+		_, err := kvStore.Compact()
+		compacted <- err
+	}()
+
+	// Compaction would remove the segments being copied so it waits its turn
+	select {
+	case err := <-compacted:
+		t.Fatalf("Compacted during a backup: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(backup.released)
+	if err := <-backedUp; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-compacted:
+		if err != nil {
+			t.Errorf("Compact after the backup: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Compaction didn't carry on once the backup finished")
+	}
+	expectValue(t, kvStore, "a", "a2")
+}
+
+func TestCompactWaitingForBackupClosed(t *testing.T) {
+	defer smallSegments()()
+	_, kvStore := createTestStore(t)
+	writeSealedHistory(t, kvStore)
+	backup := &blockingBackup{started: make(chan struct{}), released: make(chan struct{})}
+	go kvStore.Backup(backup, nil)
+	<-backup.started
+	compacted := make(chan error)
+	go func() {
+		_, err := kvStore.Compact()
+		compacted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-compacted:
+		if err != ErrClosed {
+			t.Errorf("Compact when the store closed: %v, expected ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Closing the store didn't end the wait for the backup")
+	}
+	close(backup.released)
+}
+
+func TestRestoreChain(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a", "b")
+	full := backupTo(t, fsys, kvStore, "/backups/full", nil)
+	_, b := recordOf(t, fsys, "b")
+
+	// The changes after the full backup only go in the incremental one
+	time.Sleep(time.Millisecond)
+	writeKeys(t, kvStore, "c")
+	_, c := recordOf(t, fsys, "c")
+	if err := kvStore.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStore.Write("b", []byte(strings.Repeat("b", 120))); err != nil {
+		t.Fatal(err)
+	}
+	incremental := backupTo(t, fsys, kvStore, "/backups/incremental", &full)
+	if incremental.Base != full.ID || incremental.LastSeq != kvStore.LastSeq() {
+		t.Fatalf("Incremental backup: %+v, full backup %+v", incremental, full)
+	}
+	// The segment sealed by the full backup isn't copied again
+	if len(incremental.Files) != 1 || incremental.Files[0].Segment == full.Segments[0] || incremental.Files[0].Offset != 0 {
+		t.Errorf("Incremental backup files: %+v, full backup %v", incremental.Files, full.Segments)
+	}
+	chain := []string{"/backups/full", "/backups/incremental"}
+
+	restored, stats := restoreTo(t, fsys, "/data/latest", RestorePoint{}, chain...)
+	expectValue(t, restored, "a", "")
+	expectValue(t, restored, "b", strings.Repeat("b", 120))
+	expectValue(t, restored, "c", "c")
+	if stats.Backups != 2 || stats.Records != 5 || stats.Skipped != 0 || stats.LastSeq != kvStore.LastSeq() || restored.LastSeq() != kvStore.LastSeq() {
+		t.Errorf("Restore of the whole chain: %+v, last seq %d", stats, restored.LastSeq())
+	}
+	restored.Close()
+
+	// Up to c's sequence number the delete and the rewrite haven't happened
+	restored, stats = restoreTo(t, fsys, "/data/seq", RestorePoint{Seq: c.Seq}, chain...)
+	expectValue(t, restored, "a", "a")
+	expectValue(t, restored, "b", "b")
+	expectValue(t, restored, "c", "c")
+	if stats.Records != 3 || stats.Skipped != 2 || stats.LastSeq != c.Seq {
+		t.Errorf("Restore to seq %d: %+v", c.Seq, stats)
+	}
+	restored.Close()
+
+	// Up to the time of b's first write is the full backup alone
+	restored, stats = restoreTo(t, fsys, "/data/time", RestorePoint{Time: b.Time}, chain...)
+	expectValue(t, restored, "a", "a")
+	expectValue(t, restored, "b", "b")
+	expectValue(t, restored, "c", "")
+	if stats.Records != 2 || stats.Skipped != 3 || stats.LastSeq != b.Seq || !stats.LastTime.Equal(b.Time) {
+		t.Errorf("Restore to %v: %+v", b.Time, stats)
+	}
+	restored.Close()
+
+	// Once compacted, a backup only holds the latest values so can't go back before them
+	if _, err := kvStore.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	compacted := backupTo(t, fsys, kvStore, "/backups/compacted", nil)
+	if compacted.CompactedSeq == 0 {
+		t.Fatalf("Backup after compaction: %+v", compacted)
+	}
+	if _, err := Restore([]string{"/backups/compacted"}, "r", Config{FS: fsys, Directory: "/data/compacted"}, RestorePoint{Seq: c.Seq}); !errors.Is(err, ErrHistoryCompacted) {
+		t.Errorf("Restore to seq %d before %d: %v, expected ErrHistoryCompacted", c.Seq, compacted.CompactedSeq, err)
+	}
+}
+
+func TestRestoreBadChain(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a")
+	full := backupTo(t, fsys, kvStore, "/backups/full", nil)
+	writeKeys(t, kvStore, "b")
+	backupTo(t, fsys, kvStore, "/backups/incremental", &full)
+	backupTo(t, fsys, kvStore, "/backups/other", nil)
+
+	for _, chain := range [][]string{
+		nil,
+		{"/backups/incremental"},
+		{"/backups/other", "/backups/incremental"},
+		{"/backups/missing"},
+	} {
+		if _, err := Restore(chain, "r", Config{FS: fsys, Directory: "/data/r"}, RestorePoint{}); err == nil {
+			t.Errorf("Restore of %v succeeded", chain)
+		} else if chain != nil && chain[0] != "/backups/missing" && !errors.Is(err, ErrBadBackup) {
+			t.Errorf("Restore of %v: %v, expected ErrBadBackup", chain, err)
+		}
+		// Nothing is left behind by a restore that fails
+		if _, err := fsys.ReadDir("/data/r"); !gkfs.IsNotExist(err) {
+			t.Errorf("/data/r after a failed restore of %v: %v", chain, err)
+		}
+	}
+
+	if _, err := Restore([]string{"/backups/full"}, "s", Config{FS: fsys, Directory: testDirectory}, RestorePoint{}); err == nil {
+		t.Error("Restore over an existing store succeeded")
+	}
+	expectValue(t, kvStore, "b", "b")
+}
@@ -0,0 +1,201 @@
+package gkstore
+
+import (
+	"errors"
+	"fmt"
+	"gokave/gklogfile"
+	"path/filepath"
+	"time"
+)
+
+// ErrBulkLoadUnsorted means a bulk load was given a key that doesn't come after the key before it
+var ErrBulkLoadUnsorted = errors.New("Bulk load keys must be in order without duplicates")
+
+// bulkSegmentBytes - how big a bulk loaded segment gets before the next one is started
+const bulkSegmentBytes = 64 << 20
+
+// BulkLoadStats - what a bulk load added to a store
+type BulkLoadStats struct {
+	Keys     int
+	Segments []string // the new segments, oldest first
+	Bytes    int64
+	FirstSeq uint64 `json:",omitempty"`
+	LastSeq  uint64 `json:",omitempty"`
+}
+
+// BulkLoader writes keys and values straight into new segment files, with hint files so they are
+// quick to open, without going through the store's writes one at a time. Nothing is part of the
+// store until Commit lists the new segments in the manifest, so a load that fails or is abandoned
+// leaves the store as it was. The store is held open exclusively for the whole load
+type BulkLoader struct {
+	kvStore *KvStore
+	writer  *gklogfile.SegmentWriter
+	lastKey string
+	nextSeq uint64
+	stats   BulkLoadStats
+	done    bool
+}
+
+// NewBulkLoader - open the store for a bulk load using config. Fails with ErrStoreLocked if the
+// store is open anywhere else, including by a DB in this process
+func NewBulkLoader(storeName string, config Config) (bulkLoader *BulkLoader, err error) {
+	if config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	kvStore, err := OpenWith(storeName, config)
+	if err != nil {
+		return
+	}
+	return &BulkLoader{kvStore: kvStore, nextSeq: kvStore.LastSeq() + 1}, nil
+}
+
+// Add - add key to the store with value and meta, which may be nil. Keys must be added in
+// ascending order without duplicates otherwise it fails with ErrBulkLoadUnsorted. A key the store
+// already has is replaced once the load is committed
+func (bulkLoader *BulkLoader) Add(key string, value []byte, meta gklogfile.Meta) (err error) {
+	if bulkLoader.done {
+		return ErrClosed
+	}
+	if bulkLoader.stats.Keys > 0 && key <= bulkLoader.lastKey {
+		return fmt.Errorf("%w: %q after %q", ErrBulkLoadUnsorted, key, bulkLoader.lastKey)
+	}
+	if bulkLoader.writer != nil && bulkLoader.writer.Size() >= bulkSegmentBytes {
+		if err = bulkLoader.closeSegment(); err != nil {
+			return
+		}
+	}
+	if bulkLoader.writer == nil {
+		if err = bulkLoader.createSegment(); err != nil {
+			return
+		}
+	}
+
+	stamp := gklogfile.Stamp{Seq: bulkLoader.nextSeq, Time: time.Now().UTC()}
+	if err = bulkLoader.writer.WriteStamped(key, value, meta, stamp); err != nil {
+		return
+	}
+	if bulkLoader.stats.FirstSeq == 0 {
+		bulkLoader.stats.FirstSeq = stamp.Seq
+	}
+	bulkLoader.stats.LastSeq = stamp.Seq
+	bulkLoader.stats.Keys++
+	bulkLoader.nextSeq++
+	bulkLoader.lastKey = key
+	return
+}
+
+// Commit - finish the last segment and attach the new segments to the store with a single manifest
+// write. They go after the store's existing segments, followed by a new empty active segment, so the
+// loaded values override older ones. The store is closed afterwards
+func (bulkLoader *BulkLoader) Commit() (stats BulkLoadStats, err error) {
+	if bulkLoader.done {
+		return stats, ErrClosed
+	}
+	bulkLoader.done = true
+	kvStore := bulkLoader.kvStore
+	defer func() {
+		if err != nil {
+			bulkLoader.removeSegments()
+		}
+		if closeErr := kvStore.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if bulkLoader.writer != nil {
+		if err = bulkLoader.closeSegment(); err != nil {
+			return
+		}
+	}
+	if len(bulkLoader.stats.Segments) == 0 {
+		return bulkLoader.stats, nil
+	}
+	if err = kvStore.fs.SyncDir(kvStore.directory); err != nil {
+		return
+	}
+
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	created := time.Now().UTC()
+	activeName := fmt.Sprintf("%d.gkv", created.UnixNano())
+	active, err := gklogfile.Create(kvStore.fs, filepath.Join(kvStore.directory, activeName), gklogfile.Header{
+		Created:   created,
+		Sequence:  kvStore.nextSequence,
+		StoreName: kvStore.storeName,
+	})
+	if err != nil {
+		return
+	}
+	kvStore.nextSequence++
+	kvStore.files = append(kvStore.files, active)
+
+	updated := *kvStore.manifest
+	updated.Segments = append(append([]string(nil), kvStore.manifest.Segments...), bulkLoader.stats.Segments...)
+	updated.Segments = append(updated.Segments, activeName)
+	updated.NextSequence = kvStore.nextSequence
+	if err = writeManifest(kvStore.fs, kvStore.directory, &updated); err != nil {
+		// Not listed so it goes along with the loaded segments
+		kvStore.fs.Remove(filepath.Join(kvStore.directory, activeName))
+		return
+	}
+	kvStore.manifest = &updated
+	fmt.Printf("Bulk loaded %d keys into %s: %d segments\n", bulkLoader.stats.Keys, kvStore.storeName, len(bulkLoader.stats.Segments))
+	return bulkLoader.stats, nil
+}
+
+// Abort - give up on the load, removing the segments written so far, and close the store. Calling
+// it after Commit is harmless
+func (bulkLoader *BulkLoader) Abort() (err error) {
+	if bulkLoader.done {
+		return
+	}
+	bulkLoader.done = true
+	if bulkLoader.writer != nil {
+		bulkLoader.writer.Abort()
+		bulkLoader.writer = nil
+	}
+	bulkLoader.removeSegments()
+	return bulkLoader.kvStore.Close()
+}
+
+// createSegment - start the next segment of the load. Segments are named and numbered as the store
+// names and numbers its own so they sort into place
+func (bulkLoader *BulkLoader) createSegment() (err error) {
+	kvStore := bulkLoader.kvStore
+	created := time.Now().UTC()
+	fileName := fmt.Sprintf("%d.gkv", created.UnixNano())
+	bulkLoader.writer, err = gklogfile.CreateSegment(kvStore.fs, filepath.Join(kvStore.directory, fileName), gklogfile.Header{
+		Created:   created,
+		Sequence:  kvStore.nextSequence,
+		StoreName: kvStore.storeName,
+	})
+	if err != nil {
+		bulkLoader.writer = nil
+		return
+	}
+	kvStore.nextSequence++
+	return
+}
+
+// closeSegment - finish the segment being written along with its hint file
+func (bulkLoader *BulkLoader) closeSegment() (err error) {
+	writer := bulkLoader.writer
+	bulkLoader.writer = nil
+	if err = writer.Close(); err != nil {
+		writer.Abort()
+		return
+	}
+	bulkLoader.stats.Segments = append(bulkLoader.stats.Segments, filepath.Base(writer.FileName()))
+	bulkLoader.stats.Bytes += writer.Size()
+	return
+}
+
+// removeSegments - get rid of finished segments that never made it into the manifest. Anything
+// left behind is removed the next time the store is opened
+func (bulkLoader *BulkLoader) removeSegments() {
+	kvStore := bulkLoader.kvStore
+	for _, segment := range bulkLoader.stats.Segments {
+		kvStore.fs.Remove(filepath.Join(kvStore.directory, segment))
+		kvStore.fs.Remove(filepath.Join(kvStore.directory, gklogfile.HintFileName(segment)))
+	}
+}
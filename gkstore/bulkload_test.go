@@ -0,0 +1,149 @@
+package gkstore
+
+import (
+	"errors"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fileNames - the names of the files in the store's directory, sorted
+func fileNames(t *testing.T, fsys gkfs.FS) (names []string) {
+	t.Helper()
+	fileInfos, err := fsys.ReadDir(testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestBulkLoadCommit(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a", "b", "c")
+	lastSeq := kvStore.LastSeq()
+	if _, err := NewBulkLoader("s", Config{FS: fsys, Directory: testDirectory}); !errors.Is(err, ErrStoreLocked) {
+		t.Errorf("Bulk load of an open store: %v, expected ErrStoreLocked", err)
+	}
+	kvStore.Close()
+
+	bulkLoader, err := NewBulkLoader("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bulkLoader.Add("b", []byte("B"), gklogfile.Meta{"loaded": "yes"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = bulkLoader.Add("d", []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"c", "d"} {
+		if err = bulkLoader.Add(key, []byte(key), nil); !errors.Is(err, ErrBulkLoadUnsorted) {
+			t.Errorf("Add %s after d: %v, expected ErrBulkLoadUnsorted", key, err)
+		}
+	}
+	stats, err := bulkLoader.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 2 || len(stats.Segments) != 1 || stats.FirstSeq != lastSeq+1 || stats.LastSeq != lastSeq+2 {
+		t.Errorf("Commit: %+v, expected 2 keys from seq %d", stats, lastSeq+1)
+	}
+	if err = bulkLoader.Add("e", nil, nil); err != ErrClosed {
+		t.Errorf("Add after commit: %v, expected ErrClosed", err)
+	}
+	if err = bulkLoader.Abort(); err != nil {
+		t.Errorf("Abort after commit: %v", err)
+	}
+
+	// The loaded segment goes after the store's own, with its hint file, and before a new active one
+	manifest, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := manifest.Segments
+	if len(segments) < 3 || segments[len(segments)-2] != stats.Segments[0] {
+		t.Errorf("Segments: %v, expected %s second to last", segments, stats.Segments[0])
+	}
+	if _, err = gkfs.ReadFile(fsys, filepath.Join(testDirectory, gklogfile.HintFileName(stats.Segments[0]))); err != nil {
+		t.Errorf("Hint file of the loaded segment: %v", err)
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	expectValue(t, kvStore, "a", "a")
+	expectValue(t, kvStore, "b", "B")
+	expectValue(t, kvStore, "c", "c")
+	expectValue(t, kvStore, "d", "d")
+	if _, meta, _, err := kvStore.ReadMeta("b"); err != nil || meta["loaded"] != "yes" {
+		t.Errorf("Meta of b: %v %v", meta, err)
+	}
+	if kvStore.LastSeq() != stats.LastSeq {
+		t.Errorf("Last seq: %d, expected %d", kvStore.LastSeq(), stats.LastSeq)
+	}
+	// Writes carry on after the loaded values
+	writeKeys(t, kvStore, "b")
+	expectValue(t, kvStore, "b", "b")
+	if kvStore.LastSeq() != stats.LastSeq+1 {
+		t.Errorf("Last seq after a write: %d, expected %d", kvStore.LastSeq(), stats.LastSeq+1)
+	}
+}
+
+func TestBulkLoadAbort(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a")
+	kvStore.Close()
+	before := fileNames(t, fsys)
+
+	bulkLoader, err := NewBulkLoader("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err = bulkLoader.Add(key, []byte("loaded"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bulkLoader.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bulkLoader.Commit(); err != ErrClosed {
+		t.Errorf("Commit after abort: %v, expected ErrClosed", err)
+	}
+
+	// Nothing of the load is left and the store is no longer held open
+	if after := fileNames(t, fsys); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Errorf("Files after abort: %v, expected %v", after, before)
+	}
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	expectValue(t, kvStore, "a", "a")
+	expectValue(t, kvStore, "b", "")
+}
+
+func TestBulkLoadNothing(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a")
+	kvStore.Close()
+	before := fileNames(t, fsys)
+
+	bulkLoader, err := NewBulkLoader("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := bulkLoader.Commit(); err != nil || stats.Keys != 0 || len(stats.Segments) != 0 {
+		t.Errorf("Commit of an empty load: %+v %v", stats, err)
+	}
+	if after := fileNames(t, fsys); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Errorf("Files after an empty load: %v, expected %v", after, before)
+	}
+	if _, err = NewBulkLoader("s", Config{FS: fsys, Directory: testDirectory, ReadOnly: true}); err != ErrReadOnly {
+		t.Errorf("Read only bulk load: %v, expected ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,208 @@
+package gkstore
+
+import (
+	"fmt"
+	"gokave/gklogfile"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CompactStats - what a compaction did
+type CompactStats struct {
+	Generation      uint64   // the manifest generation after compaction
+	SegmentsRemoved []string // the sealed segments that were merged
+	Segment         string   `json:",omitempty"` // the merged segment. Empty if nothing in the sealed segments was still live
+	KeysWritten     int
+	BytesBefore     int64
+	BytesAfter      int64
+}
+
+// Compact - merge every sealed segment (all but the active one) into a single new segment holding
+// only the latest value (and meta) of each key that hasn't been deleted. The new segment takes the place of the
+// old ones at the front of the manifest so the active segment still overrides it. Reads and writes
+// wait while this runs. It waits for any backup copying the sealed segments to finish first.
+// A crash part way through leaves either the old segments or the new one listed in the manifest and
+// the unlisted files are removed the next time the store is opened
+func (kvStore *KvStore) Compact() (stats CompactStats, err error) {
+	if kvStore.readOnly {
+		return stats, ErrReadOnly
+	}
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	for kvStore.backups > 0 && !kvStore.closed {
+		kvStore.backupsDone.Wait()
+	}
+	if kvStore.closed {
+		return stats, ErrClosed
+	}
+
+	stats.Generation = kvStore.manifest.Generation
+	sealed := kvStore.files[:len(kvStore.files)-1]
+	active := kvStore.files[len(kvStore.files)-1]
+	if len(sealed) == 0 {
+		return
+	}
+	for _, file := range sealed {
+		size, sizeErr := file.Size()
+		if sizeErr != nil {
+			return stats, sizeErr
+		}
+		stats.BytesBefore += size
+	}
+
+	// The newest file holding a key decides its fate. Deleted keys are dropped altogether as there is
+	// nothing older left for the tombstone to hide
+	newest := make(map[string]*gklogfile.KvFile)
+	compactedSeq := kvStore.manifest.CompactedSeq
+	for _, file := range sealed {
+		for _, key := range file.Keys() {
+			newest[key] = file
+		}
+		if file.LastSeq() > compactedSeq {
+			compactedSeq = file.LastSeq()
+		}
+	}
+	keysByFile := make(map[*gklogfile.KvFile][]string)
+	for key, file := range newest {
+		keysByFile[file] = append(keysByFile[file], key)
+	}
+	type entry struct {
+		key    string
+		result gklogfile.Result
+	}
+	var entries []entry
+	for file, keys := range keysByFile {
+		for key, result := range file.ReadMany(keys) {
+			if result.Err != nil {
+				return stats, result.Err
+			}
+			if result.Flag == gklogfile.KeyWritten {
+				entries = append(entries, entry{key: key, result: result})
+			}
+		}
+	}
+	// Records keep their stamps and go in sequence number order so that the changes can still be
+	// replayed by reading the files from front to back. Records from before sequence numbers go first
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].result.Seq != entries[j].result.Seq {
+			return entries[i].result.Seq < entries[j].result.Seq
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	var compacted *gklogfile.KvFile
+	var fileName string
+	defer func() {
+		// Not in the manifest yet so just get rid of it
+		if err != nil && compacted != nil {
+			compacted.Close()
+			kvStore.fs.Remove(filepath.Join(kvStore.directory, fileName))
+		}
+	}()
+
+	for _, entry := range entries {
+		if compacted == nil {
+			created := time.Now().UTC()
+			fileName = fmt.Sprintf("%d.gkv", created.UnixNano())
+			compacted, err = gklogfile.Create(kvStore.fs, filepath.Join(kvStore.directory, fileName), gklogfile.Header{
+				Created:   created,
+				Sequence:  kvStore.nextSequence,
+				StoreName: kvStore.storeName,
+			})
+			if err != nil {
+				compacted = nil
+				return
+			}
+			kvStore.nextSequence++
+		}
+		if err = compacted.WriteStamped(entry.key, entry.result.Value, entry.result.Meta, entry.result.Stamp); err != nil {
+			return
+		}
+		stats.KeysWritten++
+	}
+
+	oldSegments := kvStore.manifest.Segments
+	updated := *kvStore.manifest
+	updated.Segments = nil
+	if compacted != nil {
+		if err = compacted.Sync(); err != nil {
+			return
+		}
+		if stats.BytesAfter, err = compacted.Size(); err != nil {
+			return
+		}
+		updated.Segments = append(updated.Segments, fileName)
+		stats.Segment = fileName
+	}
+	updated.Segments = append(updated.Segments, oldSegments[len(oldSegments)-1])
+	updated.Generation++
+	updated.NextSequence = kvStore.nextSequence
+	updated.CompactedSeq = compactedSeq
+	if err = writeManifest(kvStore.fs, kvStore.directory, &updated); err != nil {
+		return
+	}
+	kvStore.manifest = &updated
+	stats.Generation = updated.Generation
+
+	// The new manifest is on disk so the old segments are no longer part of the store. Failing to
+	// remove them isn't fatal as Open cleans up unlisted files
+	for i, file := range sealed {
+		segment := oldSegments[i]
+		stats.SegmentsRemoved = append(stats.SegmentsRemoved, segment)
+		if kvStore.pins[file] > 0 {
+			// A snapshot still reads it so it goes when the last of them is closed
+			fmt.Printf("Compact: keeping %s for a snapshot\n", segment)
+			kvStore.retired[file] = segment
+			continue
+		}
+		kvStore.removeSegment(file, segment)
+	}
+
+	kvStore.files = nil
+	if compacted != nil {
+		kvStore.files = append(kvStore.files, compacted)
+	}
+	kvStore.files = append(kvStore.files, active)
+	return
+}
+
+// removeSegment - close and remove a segment that is no longer listed in the manifest
+func (kvStore *KvStore) removeSegment(file *gklogfile.KvFile, segment string) {
+	file.Close()
+	if removeErr := kvStore.fs.Remove(filepath.Join(kvStore.directory, segment)); removeErr != nil {
+		fmt.Printf("Compact: unable to remove %s: %s\n", segment, removeErr)
+	}
+	kvStore.fs.Remove(filepath.Join(kvStore.directory, gklogfile.HintFileName(segment)))
+}
+
+// Keys - every live key in the store starting with prefix, in order
+func (kvStore *KvStore) Keys(prefix string) (keys []string, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return nil, ErrClosed
+	}
+	return liveKeys(kvStore.readers(), prefix), nil
+}
+
+// liveKeys - the keys starting with prefix whose newest record in files is a write, in order
+func liveKeys(files []fileReader, prefix string) (keys []string) {
+	// Work back from the newest file so the first sighting of a key is its current state
+	seen := make(map[string]bool)
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+		for _, key := range file.Keys() {
+			if seen[key] || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			seen[key] = true
+			if file.State(key) == gklogfile.KeyWritten {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return
+}
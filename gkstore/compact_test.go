@@ -0,0 +1,288 @@
+package gkstore
+
+import (
+	"bytes"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSealedHistory - overwrite a and delete b in sealed segments, leaving only d in the active one
+func writeSealedHistory(t *testing.T, kvStore *KvStore) {
+	t.Helper()
+	writeKeys(t, kvStore, "a", "b", "c")
+	// A value over MaxSegmentSize seals the segment it is written to
+	if err := kvStore.Write("x", []byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStore.Write("a", []byte("a2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStore.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStore.Write("y", []byte(strings.Repeat("y", 100))); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, kvStore, "d")
+}
+
+// segmentRecords - the records in a segment by key, failing if a key appears twice
+func segmentRecords(t *testing.T, fsys gkfs.FS, segment string) (records map[string]gklogfile.Record) {
+	t.Helper()
+	data, err := gkfs.ReadFile(fsys, filepath.Join(testDirectory, segment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = make(map[string]gklogfile.Record)
+	gklogfile.Scan(bytes.NewReader(data), int64(len(data)), true, func(record gklogfile.Record) error {
+		if _, ok := records[record.Key]; ok {
+			t.Errorf("%s holds %s more than once", segment, record.Key)
+		}
+		records[record.Key] = record
+		return nil
+	})
+	return
+}
+
+// expectCompacted - the values written by writeSealedHistory
+func expectCompacted(t *testing.T, kvStore *KvStore) {
+	t.Helper()
+	expectValue(t, kvStore, "a", "a2")
+	expectValue(t, kvStore, "b", "")
+	expectValue(t, kvStore, "c", "c")
+	expectValue(t, kvStore, "d", "d")
+	expectValue(t, kvStore, "x", strings.Repeat("x", 100))
+	expectValue(t, kvStore, "y", strings.Repeat("y", 100))
+	keys, err := kvStore.Keys("")
+	if err != nil || strings.Join(keys, ",") != "a,c,d,x,y" {
+		t.Errorf("Keys: %v, err %v", keys, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := createTestStore(t)
+	writeSealedHistory(t, kvStore)
+	before, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Segments) < 3 {
+		t.Fatalf("Segments before compaction: %v", before.Segments)
+	}
+
+	stats, err := kvStore.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := before.Segments[:len(before.Segments)-1]
+	if strings.Join(stats.SegmentsRemoved, ",") != strings.Join(sealed, ",") || stats.Segment == "" {
+		t.Errorf("Compacted %v into %s, expected %v", stats.SegmentsRemoved, stats.Segment, sealed)
+	}
+	if stats.KeysWritten != 4 || stats.BytesAfter >= stats.BytesBefore || stats.Generation != before.Generation+1 {
+		t.Errorf("Stats: %+v", stats)
+	}
+
+	after, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(after.Segments, ",") != stats.Segment+","+before.Active || after.Active != before.Active || after.Generation != stats.Generation {
+		t.Errorf("Manifest after compaction: %+v", after)
+	}
+	for _, segment := range sealed {
+		if _, err = gkfs.ReadFile(fsys, filepath.Join(testDirectory, segment)); !gkfs.IsNotExist(err) {
+			t.Errorf("Compacted segment %s still there: %v", segment, err)
+		}
+	}
+
+	// Only the latest value of each live key is kept. b's tombstone has nothing older left to hide
+	records := segmentRecords(t, fsys, stats.Segment)
+	if len(records) != 4 || string(records["a"].Value) != "a2" {
+		t.Errorf("Compacted segment holds: %v", records)
+	}
+	if _, ok := records["b"]; ok {
+		t.Error("The compacted segment holds the deleted key")
+	}
+	expectCompacted(t, kvStore)
+
+	// The active segment still overrides the compacted one
+	if err = kvStore.Write("a", []byte("a3")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, kvStore, "a", "a3")
+	if err = kvStore.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, kvStore, "c", "")
+}
+
+func TestCompactThenReopen(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := createTestStore(t)
+	writeSealedHistory(t, kvStore)
+	stats, err := kvStore.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	if len(kvStore.files) != 2 {
+		t.Errorf("Files open after reopen: %d, expected the compacted and active segments", len(kvStore.files))
+	}
+	expectCompacted(t, kvStore)
+	if report, err := kvStore.Verify(); err != nil || !report.OK {
+		t.Errorf("Verify after compaction: %+v, err %v", report, err)
+	}
+
+	// Compacting again merges the compacted segment with whatever has been sealed since
+	if err = kvStore.Write("z", []byte(strings.Repeat("z", 100))); err != nil {
+		t.Fatal(err)
+	}
+	again, err := kvStore.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.SegmentsRemoved) != 2 || again.SegmentsRemoved[0] != stats.Segment || again.Generation != stats.Generation+1 {
+		t.Errorf("Second compaction: %+v", again)
+	}
+	expectValue(t, kvStore, "z", strings.Repeat("z", 100))
+	expectValue(t, kvStore, "a", "a2")
+}
+
+func TestCompactCrashBeforeManifestRename(t *testing.T) {
+	defer smallSegments()()
+	mem := gkfs.NewMem()
+	fsys := &crashOnRename{FaultyFS: gkfs.NewFaulty(mem), name: ManifestFileName + ".tmp"}
+	kvStore, err := CreateWith("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSealedHistory(t, kvStore)
+	// Everything up to here is on disk
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kvStore = reopenTestStore(t, fsys)
+	before, err := readManifest(mem, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The merged segment is written and synced but the machine goes down before the manifest listing
+	// it replaces the old one
+	fsys.armed = true
+	if _, err = kvStore.Compact(); err != gkfs.ErrCrashed {
+		t.Fatalf("Compact: %v, expected ErrCrashed", err)
+	}
+	mem.Crash()
+
+	after, err := readManifest(mem, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(after.Segments, ",") != strings.Join(before.Segments, ",") || after.Generation != before.Generation {
+		t.Fatalf("Manifest after the crash: %+v, expected %+v", after, before)
+	}
+
+	kvStore = reopenTestStore(t, mem)
+	defer kvStore.Close()
+	fileInfos, err := mem.ReadDir(testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := 0
+	for _, fileInfo := range fileInfos {
+		if isSegmentFileName(fileInfo.Name()) {
+			segments++
+			if !after.listed(fileInfo.Name()) {
+				t.Errorf("Unlisted segment left after reopen: %s", fileInfo.Name())
+			}
+		}
+	}
+	if segments != len(before.Segments) {
+		t.Errorf("Segments after reopen: %d, expected %d", segments, len(before.Segments))
+	}
+	expectCompacted(t, kvStore)
+
+	// The compaction can simply be run again
+	if _, err = kvStore.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	expectCompacted(t, kvStore)
+}
+
+func TestCompactNothingLive(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a", "b")
+	// Deletes alone grow the segments until they are sealed. The first segment sealed may be cut off
+	// between the deletes of a and b but the one after it holds both
+	for i, files := 0, len(kvStore.files); len(kvStore.files) < files+2; i++ {
+		if i == 100 {
+			t.Fatal("Deletes didn't seal the segment")
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := kvStore.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	before, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := kvStore.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segment != "" || stats.KeysWritten != 0 || stats.BytesAfter != 0 {
+		t.Errorf("Stats: %+v", stats)
+	}
+	after, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Segments) != 1 || after.Segments[0] != before.Active {
+		t.Errorf("Manifest after compaction: %+v, expected only %s", after, before.Active)
+	}
+	expectValue(t, kvStore, "a", "")
+	expectValue(t, kvStore, "b", "")
+	if keys, err := kvStore.Keys(""); err != nil || len(keys) != 0 {
+		t.Errorf("Keys: %v, err %v", keys, err)
+	}
+}
+
+func TestKeysPrefix(t *testing.T) {
+	defer smallSegments()()
+	_, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "user/1", "user/2", "order/1")
+	if err := kvStore.Write("user/3", []byte(strings.Repeat("u", 100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStore.Delete("user/2"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kvStore.Keys("user/")
+	if err != nil || strings.Join(keys, ",") != "user/1,user/3" {
+		t.Errorf("Keys with a prefix: %v, err %v", keys, err)
+	}
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kvStore.Keys(""); err != ErrClosed {
+		t.Errorf("Keys after close: %v, expected ErrClosed", err)
+	}
+	if _, err = kvStore.Compact(); err != ErrClosed {
+		t.Errorf("Compact after close: %v, expected ErrClosed", err)
+	}
+}
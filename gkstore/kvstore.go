@@ -1,101 +1,374 @@
 package gkstore
 
 import (
+	"errors"
 	"fmt"
+	"gokave/gkfs"
 	"gokave/gklogfile"
-	"io/ioutil"
-	"log"
+	"io"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ErrClosed means the store has been closed
+var ErrClosed = errors.New("Store is closed")
+
+// DataDirectory is the directory that holds a sub directory per store
+var DataDirectory = "c:\\devwork\\go\\gokave_data"
+
+// MaxSegmentSize is the size a segment can grow to before writes move on to a new one. Starting a
+// segment rewrites the MANIFEST, so it shouldn't be so small that most writes start one
+var MaxSegmentSize int64 = 64 << 20
+
 // KvStore manages a set of KV files comprising a Store
 type KvStore struct {
 	storeName    string
+	fs           gkfs.FS
+	directory    string
 	files        []*gklogfile.KvFile
+	manifest     *Manifest
+	nextSequence uint64
+	lock         io.Closer
+	readOnly     bool
+	closed       bool
 	newFileMutex sync.RWMutex // used as an exclusive lock as we only want to add a new file when the current file isn't being written to
+	commitMutex  sync.Mutex   // held while a write is given its sequence number, written and published. Guards lastSeq and watchers
+	lastSeq      uint64
+	watchers     map[*watcher]bool
+	changes      uint64                       // writes and deletes committed since the store was opened. Guarded by commitMutex
+	merkle       merkleCache                  // guarded by commitMutex
+	backups      int                          // backups copying the sealed segments. Guarded by newFileMutex
+	backupsDone  *sync.Cond                   // on newFileMutex, broadcast when backups drops to 0 and on Close
+	pins         map[*gklogfile.KvFile]int    // how many open snapshots read each file. Guarded by newFileMutex
+	retired      map[*gklogfile.KvFile]string // files compacted away while a snapshot still read them, and their segment names. Guarded by newFileMutex
+}
+
+// StoreDirectory - the directory holding the files for the given store
+func StoreDirectory(storeName string) string {
+	return filepath.Join(DataDirectory, storeName)
+}
+
+// Config - where and how a store is opened. The zero value opens the store read/write from its
+// directory under DataDirectory on the real file system
+type Config struct {
+	// FS holds the store's files. Defaults to gkfs.OS
+	FS gkfs.FS
+	// Directory holding the store's files. Defaults to StoreDirectory(storeName)
+	Directory string
+	// ReadOnly opens the store for reading only. The directory lock is shared with other readers
+	// but not with a process that has the store open for writing. Nothing in the directory is changed
+	ReadOnly bool
+}
+
+// Create - create the directory for a new store and open it
+func Create(storeName string) (store *KvStore, err error) {
+	return CreateWith(storeName, Config{})
+}
+
+// CreateWith - create the directory for a new store and open it using config
+func CreateWith(storeName string, config Config) (store *KvStore, err error) {
+	config = config.withDefaults(storeName)
+	if err = config.FS.MkdirAll(config.Directory, 0755); err != nil {
+		return
+	}
+	return OpenWith(storeName, config)
 }
 
 // Open - temporary pass through
+// The MANIFEST decides which files make up the store. Segment files that aren't listed in it are
+// removed. Stores written before the manifest existed have one built from the files present.
+// The store directory is locked exclusively until Close so only one process can write to it
 func Open(storeName string) (store *KvStore, err error) {
+	return OpenWith(storeName, Config{})
+}
+
+// OpenReadOnly - open a store for reading only. See Config.ReadOnly
+func OpenReadOnly(storeName string) (store *KvStore, err error) {
+	return OpenWith(storeName, Config{ReadOnly: true})
+}
+
+func (config Config) withDefaults(storeName string) Config {
+	if config.FS == nil {
+		config.FS = gkfs.OS
+	}
+	if config.Directory == "" {
+		config.Directory = StoreDirectory(storeName)
+	}
+	return config
+}
+
+// OpenWith - open a store using config. See Open
+func OpenWith(storeName string, config Config) (store *KvStore, err error) {
 	// Todo list:
-	// If we don't find the directory (i.e. this is likely a new store() should we fail and require an initialisation or initialise here?
-	// If we don't find any files.. Same question as above
 	// check if store.files != nil -> should be when we call open or it indicates that we have already opened the store
-	// When we open a data store can we take a lock on the directory (or all of the files?)
+	config = config.withDefaults(storeName)
+	fsys, directory, readOnly := config.FS, config.Directory, config.ReadOnly
 
-	// ReadDir returns files sorted by filename
-	fileInfos, err := ioutil.ReadDir(fmt.Sprintf("c:\\devwork\\go\\gokave_data\\%s", storeName))
+	lock, err := lockStore(fsys, directory, !readOnly)
 	if err != nil {
 		return
 	}
+	// Don't hang on to the lock (or any files) if the store can't be opened
+	var files []*gklogfile.KvFile
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			lock.Close()
+		}
+	}()
 
-	store = &KvStore{storeName: storeName}
+	manifest, err := readManifest(fsys, directory)
+	if err != nil {
+		return
+	}
+	if manifest == nil {
+		if manifest, err = buildManifest(fsys, directory); err != nil {
+			return
+		}
+		if !readOnly {
+			if err = writeManifest(fsys, directory, manifest); err != nil {
+				return
+			}
+		}
+	}
+	if !readOnly {
+		if err = removeUnlisted(fsys, directory, manifest); err != nil {
+			return
+		}
+	}
 
-	for _, fileInfo := range fileInfos {
-		fileParts := strings.Split(fileInfo.Name(), ".")
+	// Compaction may have dropped the records holding the highest sequence numbers
+	store = &KvStore{storeName: storeName, fs: fsys, directory: directory, manifest: manifest, nextSequence: manifest.NextSequence, lastSeq: manifest.CompactedSeq, lock: lock, readOnly: readOnly}
+	store.backupsDone = sync.NewCond(&store.newFileMutex)
 
-		// Validate
-		if len(fileParts) != 2 {
-			// Need to add some kind of logging mechanism to log a warning/info
-			fmt.Printf("Bad filename: %s", fileInfo.Name())
-			continue
+	for _, fileName := range manifest.Segments {
+		var f *gklogfile.KvFile
+		if readOnly {
+			f, err = gklogfile.OpenReadOnly(fsys, filepath.Join(directory, fileName))
+		} else {
+			f, err = gklogfile.Open(fsys, filepath.Join(directory, fileName))
+		}
+		// Not sure that we should be bailing out here.. Maybe report a corruption error or try to fix? - work out later
+		if err != nil {
+			return nil, err
+		}
+		if hintErr := f.HintError(); hintErr != nil {
+			fmt.Printf("\tHints not used for %s: %s\n", fileName, hintErr)
+		}
+		files = append(files, f)
+		if f.LastSeq() > store.lastSeq {
+			store.lastSeq = f.LastSeq()
+		}
+		if header := f.Header(); header != nil && header.Sequence >= store.nextSequence {
+			store.nextSequence = header.Sequence + 1
 		}
 
-		if fileParts[1] != "gkv" {
-			fmt.Printf("Bad filename: %s", fileInfo.Name())
-			continue
+	}
+	// Note: append works on nil slices (which store should be when first passed in to open)
+	store.files = append(store.files, files...)
+
+	// A brand new store (or one whose manifest was built from an empty directory) needs a file to write to
+	if len(store.files) == 0 && !readOnly {
+		var newFile *gklogfile.KvFile
+		if newFile, err = store.createFile(); err != nil {
+			return nil, err
 		}
+		store.files = append(store.files, newFile)
+	}
+	return
+}
 
-		// Need to validate the filename is a numeric in a decent unix nanosecond time range
-		fmt.Printf("KvStore.Open(%s)\n", fmt.Sprintf("c:\\devwork\\go\\gokave_data\\%s\\%s\n", storeName, fileInfo.Name()))
+// Close - wait for in-flight writes, sync and close every file and release the lock on the store
+// directory. Calling Close more than once is harmless
+func (kvStore *KvStore) Close() (err error) {
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
 
-		f, err := gklogfile.Open(fmt.Sprintf("c:\\devwork\\go\\gokave_data\\%s\\%s", storeName, fileInfo.Name()))
-		// Not sure that we should be bailing out here.. Maybe report a corruption error or try to fix? - work out later
-		if err != nil {
-			return store, err
+	if kvStore.closed {
+		return
+	}
+	kvStore.closed = true
+	kvStore.closeWatchers(ErrClosed)
+	kvStore.backupsDone.Broadcast()
+
+	for _, file := range kvStore.files {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
+	}
+	kvStore.files = nil
+	// Segments kept for snapshots are no longer part of the store
+	for file, segment := range kvStore.retired {
+		kvStore.removeSegment(file, segment)
+	}
+	kvStore.retired = nil
 
-		// Note: append works on nil slices (which store should be when first passed in to open)
-		store.files = append(store.files, f)
+	// Only let go of the directory once everything is on disk
+	if releaseErr := kvStore.lock.Close(); releaseErr != nil && err == nil {
+		err = releaseErr
 	}
 	return
 }
 
-// Delete - temporary pass through
-func (kvStore *KvStore) Delete(key string) (err error) {
-	if len(kvStore.files) <= 0 {
-		log.Fatal("No files")
+// buildManifest - create the manifest for a store that pre-dates manifests from the segment files
+// in its directory. ReadDir returns files sorted by filename which is the order they were created
+func buildManifest(fsys gkfs.FS, directory string) (manifest *Manifest, err error) {
+	fileInfos, err := fsys.ReadDir(directory)
+	if err != nil {
+		return
 	}
 
-	// See Write - lots of work to be done here
-	count := len(kvStore.files)
-	err = kvStore.files[count-1].Delete(key)
-	size, _ := kvStore.files[count-1].Size()
-	// Just use 100 for the moment
-	if size > 100 {
-		newFile, err2 := gklogfile.Open(fmt.Sprintf("c:\\devwork\\go\\gokave_data\\%s\\%d.gkv", kvStore.storeName, time.Now().UTC().UnixNano()))
+	manifest = &Manifest{}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || isLockFileName(fileInfo.Name()) || fileInfo.Name() == ReplicaCursorFileName {
+			continue
+		}
+		if !isSegmentFileName(fileInfo.Name()) {
+			// Need to add some kind of logging mechanism to log a warning/info
+			fmt.Printf("Bad filename: %s\n", fileInfo.Name())
+			continue
+		}
+
+		// Weed out anything that has been misplaced in the directory before it becomes part of the store
+		file, err := gkfs.Open(fsys, filepath.Join(directory, fileInfo.Name()))
 		if err != nil {
-			return err2
+			return manifest, err
 		}
-		// This needs to be in a write mutex when we update the current file. All operations apart from this are 'read'
-		kvStore.files = append(kvStore.files, newFile)
+		_, _, err = gklogfile.ReadHeader(file, fileInfo.Size())
+		file.Close()
+		if err == gklogfile.ErrNotSegmentFile {
+			fmt.Printf("Not a segment file: %s\n", fileInfo.Name())
+			continue
+		}
+		manifest.Segments = append(manifest.Segments, fileInfo.Name())
 	}
-	fmt.Printf("File size: %d\n", size)
+	manifest.NextSequence = uint64(len(manifest.Segments))
 	return
 }
 
+// removeUnlisted - clean up segment files that never made it into the manifest. e.g. the output
+// of a compaction that didn't complete or the new file from a rollover that failed. The hint files of
+// unlisted segments and half written hint files go too
+func removeUnlisted(fsys gkfs.FS, directory string, manifest *Manifest) (err error) {
+	fileInfos, err := fsys.ReadDir(directory)
+	if err != nil {
+		return
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || manifest.listed(fileInfo.Name()) {
+			continue
+		}
+		segment, isHint := hintSegment(strings.TrimSuffix(fileInfo.Name(), ".tmp"))
+		if isSegmentFileName(fileInfo.Name()) || fileInfo.Name() == ManifestFileName+".tmp" ||
+			(isHint && (!manifest.listed(segment) || strings.HasSuffix(fileInfo.Name(), ".tmp"))) {
+			fmt.Printf("Removing unlisted file: %s\n", fileInfo.Name())
+			if err = fsys.Remove(filepath.Join(directory, fileInfo.Name())); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Delete - temporary pass through
+func (kvStore *KvStore) Delete(key string) (err error) {
+	return kvStore.commit(Change{Key: key, Deleted: true}, func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error {
+		return file.DeleteStamped(key, stamp)
+	})
+}
+
 // Read - temporary pass through
 // todo: we need to take notice of the flag that is returned to differentiate between not found and deleted
 func (kvStore *KvStore) Read(key string) (value []byte, flag int, err error) {
-	// We need something more elegant than this
-	if len(kvStore.files) <= 0 {
-		log.Fatal("No files")
+	value, _, flag, err = kvStore.ReadMeta(key)
+	return
+}
+
+// ReadMeta - as Read but also returning the meta the value was written with
+func (kvStore *KvStore) ReadMeta(key string) (value []byte, meta gklogfile.Meta, flag int, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return nil, nil, gklogfile.KeyNotPresent, ErrClosed
+	}
+
+	// A store opened read only before it was ever written to has no files
+	flag = gklogfile.KeyNotPresent
+	return readMeta(kvStore.readers(), key)
+}
+
+// readMeta - key from the newest of files that has it
+func readMeta(files []fileReader, key string) (value []byte, meta gklogfile.Meta, flag int, err error) {
+	flag = gklogfile.KeyNotPresent
+	for i := len(files) - 1; i >= 0; i-- {
+		value, meta, flag, err = files[i].ReadMeta(key)
+		if flag == gklogfile.KeyDeleted || flag == gklogfile.KeyWritten {
+			return
+		}
 	}
-	// Need some locking around here when we introduce file purging
-	for i := len(kvStore.files) - 1; i >= 0; i-- {
-		value, flag, err = kvStore.files[i].Read(key)
+	return
+}
+
+// ReadMany - read several keys under a single lock. Each segment is visited once, newest first,
+// for the keys not yet found in a newer one and reads within a segment are made in offset order.
+// Every distinct key gets a result. Keys in no segment have the flag gklogfile.KeyNotPresent
+func (kvStore *KvStore) ReadMany(keys []string) (results map[string]gklogfile.Result, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return nil, ErrClosed
+	}
+	return readMany(kvStore.readers(), keys), nil
+}
+
+// readMany - each of keys from the newest of files that has it
+func readMany(files []fileReader, keys []string) (results map[string]gklogfile.Result) {
+	results = make(map[string]gklogfile.Result, len(keys))
+	remaining := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := results[key]; !ok {
+			results[key] = gklogfile.Result{Flag: gklogfile.KeyNotPresent}
+			remaining = append(remaining, key)
+		}
+	}
+
+	for i := len(files) - 1; i >= 0 && len(remaining) > 0; i-- {
+		found := files[i].ReadMany(remaining)
+		if len(found) == 0 {
+			continue
+		}
+		notFound := remaining[:0]
+		for _, key := range remaining {
+			if result, ok := found[key]; ok {
+				results[key] = result
+				continue
+			}
+			notFound = append(notFound, key)
+		}
+		remaining = notFound
+	}
+	return
+}
+
+// Head - the meta and value length for key without reading the value
+func (kvStore *KvStore) Head(key string) (meta gklogfile.Meta, valueLength int, flag int, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return nil, 0, gklogfile.KeyNotPresent, ErrClosed
+	}
+	return head(kvStore.readers(), key)
+}
+
+// head - the meta and value length of key from the newest of files that has it
+func head(files []fileReader, key string) (meta gklogfile.Meta, valueLength int, flag int, err error) {
+	flag = gklogfile.KeyNotPresent
+	for i := len(files) - 1; i >= 0; i-- {
+		meta, valueLength, flag, err = files[i].Head(key)
 		if flag == gklogfile.KeyDeleted || flag == gklogfile.KeyWritten {
 			return
 		}
@@ -105,25 +378,121 @@ func (kvStore *KvStore) Read(key string) (value []byte, flag int, err error) {
 
 // Write - temporary pass through
 func (kvStore *KvStore) Write(key string, value []byte) (err error) {
+	return kvStore.WriteMeta(key, value, nil)
+}
+
+// WriteMeta - write a value along with meta (which may be nil) describing it
+func (kvStore *KvStore) WriteMeta(key string, value []byte, meta gklogfile.Meta) (err error) {
 	// So here we want to check the size of the file and if it's > max size we should create
 	// a new one
 	// The consideration that we have to think about is that the latest file could already be in the process
 	// of being written to. Could a RWMutex help us here..? As long as we haven't hit a crucial file size we
 	// we can allow as many processes as are needed
 	//
-	count := len(kvStore.files)
-	err = kvStore.files[count-1].Write(key, value)
-	size, _ := kvStore.files[count-1].Size()
-	// Just use 100 for the moment
-	if size > 100 {
-		newFile, err2 := gklogfile.Open(fmt.Sprintf("c:\\devwork\\go\\gokave_data\\%s\\%d.gkv", kvStore.storeName, time.Now().UTC().UnixNano()))
-		if err != nil {
-			return err2
+	return kvStore.commit(Change{Key: key, Value: value, Meta: meta}, func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error {
+		return file.WriteStamped(key, value, meta, stamp)
+	})
+}
+
+// commit - write to the latest file under the next sequence number and pass the change on to the
+// watchers. Sequence numbers are handed out one write at a time so the files hold them in order
+func (kvStore *KvStore) commit(change Change, write func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error) (err error) {
+	_, err = kvStore.commitWith(change, nil, false, write)
+	return
+}
+
+// commitWith - as commit but using stamp, if given, rather than the next sequence number. Nothing is
+// written if the store already has stamp's sequence number unless always is set
+func (kvStore *KvStore) commitWith(change Change, stamp *gklogfile.Stamp, always bool, write func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error) (committed bool, err error) {
+	if kvStore.readOnly {
+		return false, ErrReadOnly
+	}
+	kvStore.newFileMutex.RLock()
+	if kvStore.closed {
+		kvStore.newFileMutex.RUnlock()
+		return false, ErrClosed
+	}
+	kvStore.commitMutex.Lock()
+	current := kvStore.files[len(kvStore.files)-1]
+	next := gklogfile.Stamp{Seq: kvStore.lastSeq + 1, Time: time.Now().UTC()}
+	if stamp != nil {
+		next = *stamp
+	}
+	if stamp == nil || always || next.Seq == 0 || next.Seq > kvStore.lastSeq {
+		if err = write(current, next); err == nil {
+			committed = true
+			kvStore.changes++
+			if next.Seq > kvStore.lastSeq {
+				kvStore.lastSeq = next.Seq
+			}
+			change.Stamp = next
+			kvStore.publish(change)
 		}
-		// This needs to be in a write mutex when we update the current file. All operations apart from this are 'read'
-		kvStore.files = append(kvStore.files, newFile)
 	}
+	kvStore.commitMutex.Unlock()
+	kvStore.newFileMutex.RUnlock()
+	if err != nil || !committed {
+		return
+	}
+	return committed, kvStore.rollover(current)
+}
+
+// rollover - start a new file if current is still the latest file and has grown past the limit
+func (kvStore *KvStore) rollover(current *gklogfile.KvFile) (err error) {
+	size, _ := current.Size()
 	fmt.Printf("File size: %d\n", size)
+	if size <= MaxSegmentSize {
+		return
+	}
+
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+
+	// Another writer may have beaten us to it
+	if kvStore.closed || kvStore.files[len(kvStore.files)-1] != current {
+		return
+	}
+	newFile, err := kvStore.createFile()
+	if err != nil {
+		return
+	}
+	kvStore.files = append(kvStore.files, newFile)
+	return
+}
+
+// addToManifest - record a newly created segment as the active one. Until this succeeds the new
+// file isn't part of the store and will be cleaned up the next time the store is opened
+func (kvStore *KvStore) addToManifest(fileName string) (err error) {
+	updated := *kvStore.manifest
+	updated.Segments = append(append([]string(nil), kvStore.manifest.Segments...), fileName)
+	updated.NextSequence = kvStore.nextSequence
+	if err = writeManifest(kvStore.fs, kvStore.directory, &updated); err != nil {
+		return
+	}
+	kvStore.manifest = &updated
 	return
+}
 
+// createFile - create the next segment file for the store. Legacy stores whose files have no header
+// start their sequence numbers from the count of files already present
+func (kvStore *KvStore) createFile() (newFile *gklogfile.KvFile, err error) {
+	if kvStore.nextSequence < uint64(len(kvStore.files)) {
+		kvStore.nextSequence = uint64(len(kvStore.files))
+	}
+	created := time.Now().UTC()
+	fileName := fmt.Sprintf("%d.gkv", created.UnixNano())
+	newFile, err = gklogfile.Create(kvStore.fs, filepath.Join(kvStore.directory, fileName), gklogfile.Header{
+		Created:   created,
+		Sequence:  kvStore.nextSequence,
+		StoreName: kvStore.storeName,
+	})
+	if err != nil {
+		return
+	}
+	kvStore.nextSequence++
+	if err = kvStore.addToManifest(fileName); err != nil {
+		newFile.Close()
+		return nil, err
+	}
+	return
 }
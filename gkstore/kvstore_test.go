@@ -0,0 +1,239 @@
+package gkstore
+
+import (
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smallSegments - roll segments over at 100 bytes until the returned func is called, so that a
+// few writes are spread over several segments
+func smallSegments() (restore func()) {
+	previous := MaxSegmentSize
+	MaxSegmentSize = 100
+	return func() { MaxSegmentSize = previous }
+}
+
+// crashOnRename - crashes instead of renaming a file called name, once armed
+type crashOnRename struct {
+	*gkfs.FaultyFS
+	name  string
+	armed bool
+}
+
+func (fsys *crashOnRename) Rename(oldName string, newName string) error {
+	if fsys.armed && filepath.Base(oldName) == fsys.name {
+		fsys.Crash()
+		return gkfs.ErrCrashed
+	}
+	return fsys.FaultyFS.Rename(oldName, newName)
+}
+
+func TestRolloverAndReopen(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a", "b", strings.Repeat("c", 100), "d")
+	if err := kvStore.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Segments) < 2 || manifest.Active != manifest.Segments[len(manifest.Segments)-1] {
+		t.Fatalf("Manifest after rollover: %+v", manifest)
+	}
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	if len(kvStore.files) != len(manifest.Segments) {
+		t.Errorf("Files open: %d, manifest lists %d", len(kvStore.files), len(manifest.Segments))
+	}
+	expectValue(t, kvStore, "a", "a")
+	expectValue(t, kvStore, "b", "")
+	expectValue(t, kvStore, strings.Repeat("c", 100), strings.Repeat("c", 100))
+	expectValue(t, kvStore, "d", "d")
+}
+
+func TestNoRolloverBelowMaxSegmentSize(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a", "b", "c", "d", "e")
+	manifest, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Segments) != 1 {
+		t.Errorf("Segments: %v, expected a single segment", manifest.Segments)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a")
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing again does nothing
+	if err := kvStore.Close(); err != nil {
+		t.Errorf("Second close: %v", err)
+	}
+
+	if err := kvStore.Write("b", []byte("b")); err != ErrClosed {
+		t.Errorf("Write after close: %v, expected ErrClosed", err)
+	}
+	if err := kvStore.Delete("a"); err != ErrClosed {
+		t.Errorf("Delete after close: %v, expected ErrClosed", err)
+	}
+	if _, _, err := kvStore.Read("a"); err != ErrClosed {
+		t.Errorf("Read after close: %v, expected ErrClosed", err)
+	}
+
+	// Everything written before the close is on disk and the lock has been let go of
+	reopened := reopenTestStore(t, fsys)
+	defer reopened.Close()
+	expectValue(t, reopened, "a", "a")
+}
+
+func TestCrashBeforeManifestRename(t *testing.T) {
+	defer smallSegments()()
+	mem := gkfs.NewMem()
+	fsys := &crashOnRename{FaultyFS: gkfs.NewFaulty(mem), name: ManifestFileName + ".tmp"}
+	kvStore, err := CreateWith("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, kvStore, "a")
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kvStore = reopenTestStore(t, fsys)
+	before, err := readManifest(mem, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A large value rolls the store over to a new segment, which goes in a new manifest
+	fsys.armed = true
+	if err = kvStore.Write("b", []byte(strings.Repeat("b", 200))); err != gkfs.ErrCrashed {
+		t.Fatalf("Write that rolls over: %v, expected ErrCrashed", err)
+	}
+	if _, err = gkfs.ReadFile(mem, filepath.Join(testDirectory, ManifestFileName+".tmp")); err != nil {
+		t.Fatalf("The new manifest wasn't written: %v", err)
+	}
+	mem.Crash()
+
+	after, err := readManifest(mem, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(after.Segments, ",") != strings.Join(before.Segments, ",") || after.NextSequence != before.NextSequence {
+		t.Fatalf("Manifest after the crash: %+v, expected %+v", after, before)
+	}
+
+	kvStore = reopenTestStore(t, mem)
+	defer kvStore.Close()
+	fileInfos, err := mem.ReadDir(testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Name() == ManifestFileName+".tmp" || (isSegmentFileName(fileInfo.Name()) && !after.listed(fileInfo.Name())) {
+			t.Errorf("Left over after reopen: %s", fileInfo.Name())
+		}
+	}
+	expectValue(t, kvStore, "a", "a")
+	expectValue(t, kvStore, "b", "")
+	writeKeys(t, kvStore, "c")
+	expectValue(t, kvStore, "c", "c")
+}
+
+func TestUnlistedFilesRemovedOnOpen(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a")
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leftovers of a rollover or compaction that didn't finish
+	unlisted := []string{"1792000000000000000.gkv", ManifestFileName + ".tmp"}
+	for _, name := range append(unlisted, "notes.txt") {
+		if err := gkfs.WriteFile(fsys, filepath.Join(testDirectory, name), []byte("junk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	for _, name := range unlisted {
+		if _, err := gkfs.ReadFile(fsys, filepath.Join(testDirectory, name)); !gkfs.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", name, err)
+		}
+	}
+	// Anything that isn't gokave's is left alone
+	if _, err := gkfs.ReadFile(fsys, filepath.Join(testDirectory, "notes.txt")); err != nil {
+		t.Errorf("notes.txt: %v", err)
+	}
+	expectValue(t, kvStore, "a", "a")
+}
+
+func TestCloseReportsFailedSync(t *testing.T) {
+	faulty := gkfs.NewFaulty(gkfs.NewMem())
+	kvStore, err := CreateWith("s", Config{FS: faulty, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, kvStore, "a")
+	faulty.FailSync(gkfs.ErrInjected)
+	if err = kvStore.Close(); err != gkfs.ErrInjected {
+		t.Errorf("Close: %v, expected ErrInjected", err)
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	defer smallSegments()()
+	_, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeSealedHistory(t, kvStore)
+	if err := kvStore.WriteMeta("m", []byte("meta"), gklogfile.Meta{"Owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys spread over every segment, overwritten, deleted, never written and asked for twice
+	results, err := kvStore.ReadMany([]string{"a", "b", "c", "missing", "a", "d", "m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 {
+		t.Errorf("Results: %d, expected one per distinct key", len(results))
+	}
+	for key, expected := range map[string]string{"a": "a2", "c": "c", "d": "d", "m": "meta"} {
+		if result := results[key]; result.Err != nil || result.Flag != gklogfile.KeyWritten || string(result.Value) != expected {
+			t.Errorf("ReadMany %s: %+v, expected %q", key, result, expected)
+		}
+	}
+	if results["m"].Meta["Owner"] != "ops" {
+		t.Errorf("Meta: %v", results["m"].Meta)
+	}
+	if result := results["b"]; result.Flag != gklogfile.KeyDeleted || result.Value != nil {
+		t.Errorf("ReadMany of a deleted key: %+v", result)
+	}
+	if result := results["missing"]; result.Flag != gklogfile.KeyNotPresent || result.Err != nil {
+		t.Errorf("ReadMany of a missing key: %+v", result)
+	}
+
+	if results, err = kvStore.ReadMany(nil); err != nil || len(results) != 0 {
+		t.Errorf("ReadMany of no keys: %v, err %v", results, err)
+	}
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kvStore.ReadMany([]string{"a"}); err != ErrClosed {
+		t.Errorf("ReadMany after close: %v, expected ErrClosed", err)
+	}
+}
@@ -0,0 +1,34 @@
+package gkstore
+
+import (
+	"errors"
+	"gokave/gkfs"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// LockFileName is the file in each store directory used to stop more than one process opening the store
+const LockFileName = "LOCK"
+
+// ErrStoreLocked means another process already has the store open
+var ErrStoreLocked = errors.New("Store is locked by another process")
+
+// ErrReadOnly means a write was attempted on a store opened read only
+var ErrReadOnly = errors.New("Store is open read only")
+
+// lockStore - take the lock for a store directory. Writers take an exclusive lock while readers
+// share the lock with each other. The lock is advisory so only stops other gokave processes
+func lockStore(fsys gkfs.FS, directory string, exclusive bool) (lock io.Closer, err error) {
+	lock, err = fsys.Lock(filepath.Join(directory, LockFileName), exclusive)
+	if err == gkfs.ErrLocked {
+		return nil, ErrStoreLocked
+	}
+	return
+}
+
+// isLockFileName - whether fileName is the lock file, or one of the files shared locks are held by
+// where the platform has no file locking (see gkfs.FS.Lock)
+func isLockFileName(fileName string) bool {
+	return fileName == LockFileName || strings.HasPrefix(fileName, LockFileName+".shared.")
+}
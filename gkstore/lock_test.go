@@ -0,0 +1,39 @@
+package gkstore
+
+import (
+	"testing"
+)
+
+func TestOpenLockedStore(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	if _, err := OpenWith("s", Config{FS: fsys, Directory: testDirectory}); err != ErrStoreLocked {
+		t.Errorf("Second open: %v, expected ErrStoreLocked", err)
+	}
+	if _, err := OpenWith("s", Config{FS: fsys, Directory: testDirectory, ReadOnly: true}); err != ErrStoreLocked {
+		t.Errorf("Read only open of a store open for writing: %v, expected ErrStoreLocked", err)
+	}
+	if _, err := Repair(fsys, testDirectory); err != ErrStoreLocked {
+		t.Errorf("Repair of an open store: %v, expected ErrStoreLocked", err)
+	}
+	writeKeys(t, kvStore, "a")
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := make([]*KvStore, 2)
+	for i := range readers {
+		reader, err := OpenWith("s", Config{FS: fsys, Directory: testDirectory, ReadOnly: true})
+		if err != nil {
+			t.Fatalf("Read only open %d: %v", i, err)
+		}
+		defer reader.Close()
+		readers[i] = reader
+	}
+	expectValue(t, readers[0], "a", "a")
+	if err := readers[1].Write("b", []byte("b")); err != ErrReadOnly {
+		t.Errorf("Write to a read only store: %v, expected ErrReadOnly", err)
+	}
+	if _, err := OpenWith("s", Config{FS: fsys, Directory: testDirectory}); err != ErrStoreLocked {
+		t.Errorf("Open for writing while read only opens are held: %v, expected ErrStoreLocked", err)
+	}
+}
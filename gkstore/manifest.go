@@ -0,0 +1,79 @@
+package gkstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"gokave/gkfs"
+	"path/filepath"
+)
+
+// ManifestFileName is the file in each store directory listing the store's segments
+const ManifestFileName = "MANIFEST"
+
+const manifestVsn = 1
+
+// Manifest - the authoritative list of segments making up a store. Segment files in the store
+// directory that aren't listed here are left overs (e.g. from a compaction that didn't finish)
+type Manifest struct {
+	Version int
+	// Generation is bumped every time existing segments are rewritten (compaction, repair)
+	Generation   uint64
+	Segments     []string // oldest first. The last segment is always the active one
+	Active       string
+	NextSequence uint64
+	// CompactedSeq is the highest record sequence number in segments that have been compacted. The
+	// history of changes up to it is incomplete as overwritten values and deletes were dropped
+	CompactedSeq uint64 `json:",omitempty"`
+}
+
+// readManifest - returns a nil manifest if the store doesn't have one yet
+func readManifest(fsys gkfs.FS, directory string) (manifest *Manifest, err error) {
+	manifestBytes, err := gkfs.ReadFile(fsys, filepath.Join(directory, ManifestFileName))
+	if gkfs.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	manifest = new(Manifest)
+	if err = json.Unmarshal(manifestBytes, manifest); err != nil {
+		return nil, fmt.Errorf("Bad manifest: %s", err)
+	}
+	if manifest.Version != manifestVsn {
+		return nil, fmt.Errorf("Unrecognised manifest version: %d", manifest.Version)
+	}
+	return
+}
+
+// writeManifest - replace the manifest atomically by writing a temporary file and renaming it
+// over the top of the old one
+func writeManifest(fsys gkfs.FS, directory string, manifest *Manifest) (err error) {
+	manifest.Version = manifestVsn
+	if len(manifest.Segments) > 0 {
+		manifest.Active = manifest.Segments[len(manifest.Segments)-1]
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return
+	}
+
+	tempName := filepath.Join(directory, ManifestFileName+".tmp")
+	if err = gkfs.WriteFile(fsys, tempName, manifestBytes); err != nil {
+		return
+	}
+	if err = fsys.Rename(tempName, filepath.Join(directory, ManifestFileName)); err != nil {
+		return
+	}
+	return fsys.SyncDir(directory)
+}
+
+// listed - whether fileName is one of the manifest's segments
+func (manifest *Manifest) listed(fileName string) bool {
+	for _, segment := range manifest.Segments {
+		if segment == fileName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package gkstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gokave/gklogfile"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The shape of a MerkleTree. Keys are spread over MerkleFanout^MerkleDepth buckets by a hash of the
+// key, each bucket a leaf of the tree
+const (
+	MerkleFanout = 16
+	MerkleDepth  = 3
+)
+
+// ErrBadMerklePath means a MerkleTree node was asked for by a path that isn't in the tree
+var ErrBadMerklePath = errors.New("Bad Merkle tree path")
+
+// MerkleTree - a hash tree over the live keys in a store and their values, so that two copies of a
+// store can find where they differ by comparing hashes from the root down. A node is named by its
+// path, a hex digit for the child taken at each level: "" is the root and "a3f" a leaf
+type MerkleTree struct {
+	// Seq is the store's LastSeq when the tree was built
+	Seq     uint64
+	levels  [][][]byte      // node hashes by depth then index. nil for a node with no keys below it
+	buckets [][]MerkleEntry // the entries of each leaf, by key
+}
+
+// MerkleEntry - a live key in a MerkleTree. Digest covers the value and meta only, so copies of a
+// store written at different times still match. Seq and Time are the stamp of the key's record
+type MerkleEntry struct {
+	Key    string    `json:"key"`
+	Digest string    `json:"digest"`
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+}
+
+// MerkleNode - a node of a MerkleTree. A leaf has the Entries in its bucket and any other node the
+// hashes of its Children. Empty hashes are nodes with no keys below them
+type MerkleNode struct {
+	Seq      uint64        `json:"seq"`
+	Path     string        `json:"path"`
+	Hash     string        `json:"hash"`
+	Children []string      `json:"children,omitempty"`
+	Entries  []MerkleEntry `json:"entries,omitempty"`
+}
+
+// MerkleBucket - the path of the leaf key falls in
+func MerkleBucket(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%0*x", MerkleDepth, h.Sum64()>>(64-4*MerkleDepth))
+}
+
+// Node - the node at path
+func (tree *MerkleTree) Node(path string) (node MerkleNode, err error) {
+	depth := len(path)
+	index, err := merkleIndex(path)
+	if err != nil {
+		return
+	}
+	node = MerkleNode{Seq: tree.Seq, Path: path, Hash: hex.EncodeToString(tree.levels[depth][index])}
+	if depth == MerkleDepth {
+		node.Entries = tree.buckets[index]
+		return
+	}
+	node.Children = make([]string, MerkleFanout)
+	for i := range node.Children {
+		node.Children[i] = hex.EncodeToString(tree.levels[depth+1][index*MerkleFanout+i])
+	}
+	return
+}
+
+// merkleIndex - the index of the node at path within its level
+func merkleIndex(path string) (index int, err error) {
+	if len(path) > MerkleDepth {
+		return 0, fmt.Errorf("%w: %q", ErrBadMerklePath, path)
+	}
+	if path == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseUint(path, MerkleFanout, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrBadMerklePath, path)
+	}
+	return int(i), nil
+}
+
+// merkleCache - the last tree built and the changes count it was built at
+type merkleCache struct {
+	tree    *MerkleTree
+	changes uint64
+}
+
+// MerkleTree - the store's MerkleTree. It is built from every live value the first time it is
+// asked for after a change, so it is costly for a large store, and kept until the next change.
+// New segments can't be started while it is built so writes that would start one wait
+func (kvStore *KvStore) MerkleTree() (tree *MerkleTree, err error) {
+	kvStore.newFileMutex.RLock()
+	if kvStore.closed {
+		kvStore.newFileMutex.RUnlock()
+		return nil, ErrClosed
+	}
+	kvStore.commitMutex.Lock()
+	cache, changes := kvStore.merkle, kvStore.changes
+	kvStore.commitMutex.Unlock()
+	if cache.tree != nil && cache.changes == changes {
+		kvStore.newFileMutex.RUnlock()
+		return cache.tree, nil
+	}
+
+	tree = &MerkleTree{Seq: kvStore.LastSeq(), buckets: make([][]MerkleEntry, leafCount())}
+	// Work back from the newest file so the first sighting of a key is its current state
+	seen := make(map[string]bool)
+	for i := len(kvStore.files) - 1; i >= 0 && err == nil; i-- {
+		var keys []string
+		for _, key := range kvStore.files[i].Keys() {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		for key, result := range kvStore.files[i].ReadMany(keys) {
+			if result.Err != nil {
+				err = fmt.Errorf("%s: %w", key, result.Err)
+				break
+			}
+			if result.Flag == gklogfile.KeyWritten {
+				index, _ := merkleIndex(MerkleBucket(key))
+				tree.buckets[index] = append(tree.buckets[index], MerkleEntry{Key: key, Digest: valueDigest(result.Value, result.Meta), Seq: result.Seq, Time: result.Time})
+			}
+		}
+	}
+	kvStore.newFileMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	tree.hash()
+
+	kvStore.commitMutex.Lock()
+	if kvStore.changes == changes {
+		kvStore.merkle = merkleCache{tree: tree, changes: changes}
+	}
+	kvStore.commitMutex.Unlock()
+	return
+}
+
+func leafCount() (count int) {
+	count = 1
+	for i := 0; i < MerkleDepth; i++ {
+		count *= MerkleFanout
+	}
+	return
+}
+
+// hash - fill in the node hashes from the buckets up
+func (tree *MerkleTree) hash() {
+	tree.levels = make([][][]byte, MerkleDepth+1)
+	leaves := make([][]byte, len(tree.buckets))
+	for i, entries := range tree.buckets {
+		if len(entries) == 0 {
+			continue
+		}
+		sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+		h := sha256.New()
+		for _, entry := range entries {
+			h.Write([]byte(entry.Key))
+			h.Write([]byte{0})
+			h.Write([]byte(entry.Digest))
+			h.Write([]byte{0})
+		}
+		leaves[i] = h.Sum(nil)
+	}
+	tree.levels[MerkleDepth] = leaves
+
+	for depth := MerkleDepth - 1; depth >= 0; depth-- {
+		below := tree.levels[depth+1]
+		level := make([][]byte, len(below)/MerkleFanout)
+		for i := range level {
+			children := below[i*MerkleFanout : (i+1)*MerkleFanout]
+			h := sha256.New()
+			empty := true
+			for _, child := range children {
+				empty = empty && child == nil
+				h.Write(child)
+				h.Write([]byte{0})
+			}
+			if !empty {
+				level[i] = h.Sum(nil)
+			}
+		}
+		tree.levels[depth] = level
+	}
+}
+
+// valueDigest - a hash of a value and its meta
+func valueDigest(value []byte, meta gklogfile.Meta) string {
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(name), name, len(meta[name]), meta[name])
+	}
+	h.Write([]byte{0})
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Repair - write records from another copy of the store to make this copy match it. Records keep
+// their stamps and unlike Apply are written even if the store already has their sequence numbers,
+// since a repaired key is by definition one whose record went astray. A record with no sequence
+// number is given the next one, as a local write would be
+func (kvStore *KvStore) Repair(records []gklogfile.Record) (err error) {
+	for _, record := range records {
+		var stamp *gklogfile.Stamp
+		if record.Stamp.Seq != 0 {
+			stamp = &record.Stamp
+		}
+		change, write := recordWrite(record)
+		if _, err = kvStore.commitWith(change, stamp, true, write); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package gkstore
+
+import (
+	"errors"
+	"fmt"
+	"gokave/gklogfile"
+	"strconv"
+	"testing"
+)
+
+// merkleTree - the store's tree, failing the test if it can't be built
+func merkleTree(t *testing.T, kvStore *KvStore) (tree *MerkleTree) {
+	t.Helper()
+	tree, err := kvStore.MerkleTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// rootHash - the hash of the root of the store's tree
+func rootHash(t *testing.T, kvStore *KvStore) string {
+	t.Helper()
+	root, err := merkleTree(t, kvStore).Node("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root.Hash
+}
+
+func TestMerkleTreeMatches(t *testing.T) {
+	defer smallSegments()()
+	_, first := createTestStore(t)
+	defer first.Close()
+	_, second := createTestStore(t)
+	defer second.Close()
+	if rootHash(t, first) != "" {
+		t.Errorf("Root hash of an empty store: %q", rootHash(t, first))
+	}
+
+	// The same values written in a different order, over different segments, with an overwrite
+	writeKeys(t, first, "a", "b", "c", "user/1", "user/2")
+	writeKeys(t, second, "user/2", "c")
+	if err := second.Write("a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, second, "user/1", "b", "a")
+	if rootHash(t, first) == "" || rootHash(t, first) != rootHash(t, second) {
+		t.Errorf("Root hashes of matching stores: %q and %q", rootHash(t, first), rootHash(t, second))
+	}
+	if seq := merkleTree(t, second).Seq; seq != second.LastSeq() {
+		t.Errorf("Tree seq: %d, expected %d", seq, second.LastSeq())
+	}
+
+	// Meta counts as part of the value
+	if err := second.WriteMeta("a", []byte("a"), gklogfile.Meta{"Owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	if rootHash(t, first) == rootHash(t, second) {
+		t.Error("Root hashes match with different meta")
+	}
+}
+
+func TestMerkleTreeFindsDifference(t *testing.T) {
+	_, first := createTestStore(t)
+	defer first.Close()
+	_, second := createTestStore(t)
+	defer second.Close()
+	for i := 0; i < 50; i++ {
+		writeKeys(t, first, fmt.Sprintf("key%d", i))
+		writeKeys(t, second, fmt.Sprintf("key%d", i))
+	}
+	if err := second.Write("key17", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	firstTree, secondTree := merkleTree(t, first), merkleTree(t, second)
+
+	// Follow the one differing child at each level down to the leaf
+	path := ""
+	for len(path) < MerkleDepth {
+		firstNode, err := firstTree.Node(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secondNode, err := secondTree.Node(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if firstNode.Hash == secondNode.Hash || len(firstNode.Children) != MerkleFanout || firstNode.Entries != nil {
+			t.Fatalf("Node %q: %+v and %+v", path, firstNode, secondNode)
+		}
+		var differing []int
+		for i := range firstNode.Children {
+			if firstNode.Children[i] != secondNode.Children[i] {
+				differing = append(differing, i)
+			}
+		}
+		if len(differing) != 1 {
+			t.Fatalf("Node %q: children %v differ, expected one", path, differing)
+		}
+		path += strconv.FormatInt(int64(differing[0]), MerkleFanout)
+	}
+	if path != MerkleBucket("key17") {
+		t.Errorf("Walked to %q, expected key17's bucket %q", path, MerkleBucket("key17"))
+	}
+
+	firstLeaf, err := firstTree.Node(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondLeaf, err := secondTree.Node(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstLeaf.Children != nil || len(firstLeaf.Entries) != len(secondLeaf.Entries) {
+		t.Fatalf("Leaves: %+v and %+v", firstLeaf, secondLeaf)
+	}
+	for i, entry := range firstLeaf.Entries {
+		other := secondLeaf.Entries[i]
+		if entry.Key != other.Key || (entry.Digest != other.Digest) != (entry.Key == "key17") {
+			t.Errorf("Entry %d: %+v and %+v", i, entry, other)
+		}
+	}
+}
+
+func TestMerkleTreeDeletes(t *testing.T) {
+	defer smallSegments()()
+	_, first := createTestStore(t)
+	defer first.Close()
+	_, second := createTestStore(t)
+	defer second.Close()
+	writeKeys(t, first, "a", "b", "gone", "c")
+	if err := first.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, second, "a", "b", "c")
+
+	if rootHash(t, first) != rootHash(t, second) {
+		t.Error("A deleted key changed the root hash")
+	}
+	leaf, err := merkleTree(t, first).Node(MerkleBucket("gone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range leaf.Entries {
+		if entry.Key == "gone" {
+			t.Errorf("Deleted key in its leaf: %+v", leaf)
+		}
+	}
+}
+
+func TestMerkleTreeCache(t *testing.T) {
+	_, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a", "b")
+	tree := merkleTree(t, kvStore)
+	if merkleTree(t, kvStore) != tree {
+		t.Error("Tree built again with no change in between")
+	}
+
+	writeKeys(t, kvStore, "c")
+	rebuilt := merkleTree(t, kvStore)
+	if rebuilt == tree || rebuilt.Seq != kvStore.LastSeq() {
+		t.Errorf("Tree after a write: seq %d, expected a new tree at %d", rebuilt.Seq, kvStore.LastSeq())
+	}
+	before, _ := tree.Node("")
+	after, _ := rebuilt.Node("")
+	if before.Hash == after.Hash {
+		t.Error("Root hash unchanged by a write")
+	}
+	if err := kvStore.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if merkleTree(t, kvStore) == rebuilt || rootHash(t, kvStore) != before.Hash {
+		t.Error("Tree after a delete doesn't match the one before the write")
+	}
+
+	kvStore.Close()
+	if _, err := kvStore.MerkleTree(); err != ErrClosed {
+		t.Errorf("MerkleTree after close: %v, expected ErrClosed", err)
+	}
+}
+
+func TestMerkleIndex(t *testing.T) {
+	for _, test := range []struct {
+		path  string
+		index int
+	}{
+		{"", 0},
+		{"0", 0},
+		{"f", 15},
+		{"10", 16},
+		{"fff", 4095},
+		{"A3F", 0xa3f},
+	} {
+		if index, err := merkleIndex(test.path); err != nil || index != test.index {
+			t.Errorf("merkleIndex(%q): %d, err %v, expected %d", test.path, index, err, test.index)
+		}
+	}
+	for _, path := range []string{"0000", "ffff", "g", "0x1", "-1", "+1", " 1", "1_0"} {
+		if _, err := merkleIndex(path); !errors.Is(err, ErrBadMerklePath) {
+			t.Errorf("merkleIndex(%q): %v, expected ErrBadMerklePath", path, err)
+		}
+	}
+
+	_, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	if _, err := merkleTree(t, kvStore).Node("abcd"); !errors.Is(err, ErrBadMerklePath) {
+		t.Errorf("Node of an over-long path: %v, expected ErrBadMerklePath", err)
+	}
+}
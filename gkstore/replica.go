@@ -0,0 +1,160 @@
+package gkstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"path/filepath"
+)
+
+// ErrSegmentNotFound means a segment asked for by name isn't part of the store, e.g. because it
+// has been compacted away
+var ErrSegmentNotFound = errors.New("Segment not found")
+
+// ReplicaCursorFileName is the file in a replica's store directory recording how far through the
+// primary's segments it has got
+const ReplicaCursorFileName = "REPLICA"
+
+// SegmentRecords - raw records read from one of a store's segments by ReadSegment
+type SegmentRecords struct {
+	Segment string
+	Offset  int64 // where Data starts in Segment
+	Data    []byte
+	Next    int64 // where to carry on from in Segment
+	// NextSegment is the segment to move on to at offset 0 once Segment has been sealed and read to
+	// the end. Empty while there is more to read from Segment or it's still being written to
+	NextSegment  string
+	LastSeq      uint64 // the store's latest sequence number
+	CompactedSeq uint64 // see Manifest.CompactedSeq
+}
+
+// ReplicaCursor - a replica's place in its primary's segments
+type ReplicaCursor struct {
+	Primary string
+	Segment string
+	Offset  int64
+}
+
+// ReadSegment - up to about maxBytes of whole records from segment starting at offset. An empty
+// segment means the oldest one. Fails with ErrSegmentNotFound if segment isn't in the store
+func (kvStore *KvStore) ReadSegment(segment string, offset int64, maxBytes int64) (records SegmentRecords, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return records, ErrClosed
+	}
+
+	segments := kvStore.manifest.Segments
+	index := -1
+	for i, name := range segments {
+		if name == segment || (segment == "" && i == 0) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return records, fmt.Errorf("%w: %s", ErrSegmentNotFound, segment)
+	}
+
+	// Taken before reading so a caller waiting for changes after LastSeq can't miss any
+	file := kvStore.files[index]
+	records = SegmentRecords{Segment: segments[index], LastSeq: kvStore.LastSeq(), CompactedSeq: kvStore.manifest.CompactedSeq}
+	if records.Data, records.Next, err = file.ReadRecords(offset, maxBytes); err != nil {
+		return
+	}
+	records.Offset = records.Next - int64(len(records.Data))
+	// Sealed segments don't change so once the end is reached it's on to the next one
+	if index < len(segments)-1 {
+		size, sizeErr := file.Size()
+		if sizeErr != nil {
+			return records, sizeErr
+		}
+		if records.Next >= size {
+			records.NextSegment = segments[index+1]
+		}
+	}
+	return
+}
+
+// Apply - write records read from another store's segments, keeping their stamps so that sequence
+// numbers match. Records with a sequence number the store already has are skipped which makes
+// applying the same records twice harmless. Only Apply should write to a store kept in step this way
+func (kvStore *KvStore) Apply(records []gklogfile.Record) (applied int, err error) {
+	for _, record := range records {
+		if record.Checksum == gklogfile.ChecksumInvalid {
+			return applied, &gklogfile.CorruptionError{Offset: record.Offset, Err: gklogfile.ErrChecksumFailure}
+		}
+		stamp := record.Stamp
+		change, write := recordWrite(record)
+		committed, err := kvStore.commitWith(change, &stamp, false, write)
+		if err != nil {
+			return applied, err
+		}
+		if committed {
+			applied++
+		}
+	}
+	return
+}
+
+// recordWrite - the change a record makes and how to write it to a file
+func recordWrite(record gklogfile.Record) (change Change, write func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error) {
+	change = Change{Key: record.Key, Deleted: record.EntryType == gklogfile.KeyDeleted}
+	if change.Deleted {
+		return change, func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error {
+			return file.DeleteStamped(record.Key, stamp)
+		}
+	}
+	change.Value, change.Meta = record.Value, record.Meta
+	return change, func(file *gklogfile.KvFile, stamp gklogfile.Stamp) error {
+		return file.WriteStamped(record.Key, record.Value, record.Meta, stamp)
+	}
+}
+
+// ReadReplicaCursor - the cursor last written by WriteReplicaCursor. The zero cursor if there isn't one
+func (kvStore *KvStore) ReadReplicaCursor() (cursor ReplicaCursor, err error) {
+	cursorBytes, err := gkfs.ReadFile(kvStore.fs, filepath.Join(kvStore.directory, ReplicaCursorFileName))
+	if gkfs.IsNotExist(err) {
+		return cursor, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(cursorBytes, &cursor); err != nil {
+		return cursor, fmt.Errorf("Bad replica cursor: %s", err)
+	}
+	return
+}
+
+// WriteReplicaCursor - record cursor, replacing the old one atomically. Records applied before the
+// cursor is written are synced first so the cursor is never ahead of the data
+func (kvStore *KvStore) WriteReplicaCursor(cursor ReplicaCursor) (err error) {
+	if kvStore.readOnly {
+		return ErrReadOnly
+	}
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return ErrClosed
+	}
+	for _, file := range kvStore.files {
+		if err = file.Sync(); err != nil {
+			return
+		}
+	}
+
+	cursorBytes, err := json.MarshalIndent(cursor, "", "\t")
+	if err != nil {
+		return
+	}
+	tempName := filepath.Join(kvStore.directory, ReplicaCursorFileName+".tmp")
+	if err = gkfs.WriteFile(kvStore.fs, tempName, cursorBytes); err != nil {
+		return
+	}
+	if err = kvStore.fs.Rename(tempName, filepath.Join(kvStore.directory, ReplicaCursorFileName)); err != nil {
+		return
+	}
+	return kvStore.fs.SyncDir(kvStore.directory)
+}
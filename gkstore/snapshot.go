@@ -0,0 +1,147 @@
+package gkstore
+
+import (
+	"errors"
+	"gokave/gklogfile"
+)
+
+// ErrSnapshotClosed means a snapshot was read from after it was closed
+var ErrSnapshotClosed = errors.New("Snapshot is closed")
+
+// fileReader - what reads need from a segment. A KvFile, or a view of the active segment for a snapshot
+type fileReader interface {
+	ReadMeta(key string) (value []byte, meta gklogfile.Meta, flag int, err error)
+	ReadMany(keys []string) (results map[string]gklogfile.Result)
+	Head(key string) (meta gklogfile.Meta, valueLength int, flag int, err error)
+	Keys() (keys []string)
+	State(key string) (flag int)
+}
+
+// readers - the store's files for reading. Called with the new file mutex held
+func (kvStore *KvStore) readers() (files []fileReader) {
+	files = make([]fileReader, len(kvStore.files))
+	for i, file := range kvStore.files {
+		files[i] = file
+	}
+	return
+}
+
+// Snapshot - a read only view of a store pinned at the sequence number it was taken at. Writes,
+// deletes and compactions after that aren't seen. The segments it reads are kept until it is
+// closed, even if the store is compacted, so a snapshot should be closed as soon as it is finished
+// with. Sharing a snapshot between goroutines is safe
+type Snapshot struct {
+	kvStore *KvStore
+	seq     uint64
+	files   []fileReader
+	pinned  []*gklogfile.KvFile
+	closed  bool // guarded by the store's new file mutex
+}
+
+// Snapshot - a view of the store as it is now. Sealed segments never change so only the keys of
+// the active segment are copied
+func (kvStore *KvStore) Snapshot() (snapshot *Snapshot, err error) {
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	if kvStore.closed {
+		return nil, ErrClosed
+	}
+	// Holding the new file mutex exclusively keeps writes out, so lastSeq can't move
+	snapshot = &Snapshot{kvStore: kvStore, seq: kvStore.LastSeq(), pinned: append([]*gklogfile.KvFile(nil), kvStore.files...)}
+	for i, file := range kvStore.files {
+		if i == len(kvStore.files)-1 && !kvStore.readOnly {
+			snapshot.files = append(snapshot.files, file.View())
+			continue
+		}
+		snapshot.files = append(snapshot.files, file)
+	}
+
+	if kvStore.pins == nil {
+		kvStore.pins = make(map[*gklogfile.KvFile]int)
+		kvStore.retired = make(map[*gklogfile.KvFile]string)
+	}
+	for _, file := range snapshot.pinned {
+		kvStore.pins[file]++
+	}
+	return
+}
+
+// Seq - the sequence number of the last change the snapshot sees
+func (snapshot *Snapshot) Seq() uint64 {
+	return snapshot.seq
+}
+
+// ReadMeta - as KvStore.ReadMeta at the snapshot
+func (snapshot *Snapshot) ReadMeta(key string) (value []byte, meta gklogfile.Meta, flag int, err error) {
+	if err = snapshot.rLock(); err != nil {
+		return nil, nil, gklogfile.KeyNotPresent, err
+	}
+	defer snapshot.kvStore.newFileMutex.RUnlock()
+	return readMeta(snapshot.files, key)
+}
+
+// ReadMany - as KvStore.ReadMany at the snapshot
+func (snapshot *Snapshot) ReadMany(keys []string) (results map[string]gklogfile.Result, err error) {
+	if err = snapshot.rLock(); err != nil {
+		return
+	}
+	defer snapshot.kvStore.newFileMutex.RUnlock()
+	return readMany(snapshot.files, keys), nil
+}
+
+// Head - as KvStore.Head at the snapshot
+func (snapshot *Snapshot) Head(key string) (meta gklogfile.Meta, valueLength int, flag int, err error) {
+	if err = snapshot.rLock(); err != nil {
+		return nil, 0, gklogfile.KeyNotPresent, err
+	}
+	defer snapshot.kvStore.newFileMutex.RUnlock()
+	return head(snapshot.files, key)
+}
+
+// Keys - as KvStore.Keys at the snapshot
+func (snapshot *Snapshot) Keys(prefix string) (keys []string, err error) {
+	if err = snapshot.rLock(); err != nil {
+		return
+	}
+	defer snapshot.kvStore.newFileMutex.RUnlock()
+	return liveKeys(snapshot.files, prefix), nil
+}
+
+// Close - let go of the snapshot's segments. Segments compacted away while it was open are removed
+// once no snapshot reads them. Calling Close more than once is harmless
+func (snapshot *Snapshot) Close() (err error) {
+	kvStore := snapshot.kvStore
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	if snapshot.closed {
+		return
+	}
+	snapshot.closed = true
+	for _, file := range snapshot.pinned {
+		if kvStore.pins[file]--; kvStore.pins[file] > 0 {
+			continue
+		}
+		delete(kvStore.pins, file)
+		// The store closes them itself when it is closed
+		if segment, ok := kvStore.retired[file]; ok && !kvStore.closed {
+			delete(kvStore.retired, file)
+			kvStore.removeSegment(file, segment)
+		}
+	}
+	snapshot.files, snapshot.pinned = nil, nil
+	return
+}
+
+// rLock - take the store's new file mutex for a read, which keeps the snapshot's files open
+func (snapshot *Snapshot) rLock() error {
+	snapshot.kvStore.newFileMutex.RLock()
+	if snapshot.kvStore.closed {
+		snapshot.kvStore.newFileMutex.RUnlock()
+		return ErrClosed
+	}
+	if snapshot.closed {
+		snapshot.kvStore.newFileMutex.RUnlock()
+		return ErrSnapshotClosed
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package gkstore
+
+import (
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sealedTestStore - a store with keys a to f spread over sealed segments, where a has been deleted
+// and b rewritten as b2
+func sealedTestStore(t *testing.T) (fsys *gkfs.MemFS, kvStore *KvStore) {
+	t.Helper()
+	fsys, kvStore = createTestStore(t)
+	writeKeys(t, kvStore, "a", "b", "c", "d", "e", "f")
+	if err := kvStore.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStore.Write("b", []byte("b2")); err != nil {
+		t.Fatal(err)
+	}
+	if len(kvStore.manifest.Segments) < 3 {
+		t.Fatalf("Segments: %v, expected some sealed ones to compact", kvStore.manifest.Segments)
+	}
+	return
+}
+
+// segmentsExist - fail unless every segment is, or isn't, still on disk
+func segmentsExist(t *testing.T, fsys gkfs.FS, segments []string, exist bool) {
+	t.Helper()
+	for _, segment := range segments {
+		_, err := gkfs.ReadFile(fsys, filepath.Join(testDirectory, segment))
+		if exist && err != nil {
+			t.Errorf("Segment %s: %v, expected it kept", segment, err)
+		} else if !exist && !gkfs.IsNotExist(err) {
+			t.Errorf("Segment %s: %v, expected it removed", segment, err)
+		}
+	}
+}
+
+// expectSnapshotKeys - fail unless the snapshot's keys are as expected, comma separated
+func expectSnapshotKeys(t *testing.T, snapshot *Snapshot, expected string) {
+	t.Helper()
+	keys, err := snapshot.Keys("")
+	if err != nil || strings.Join(keys, ",") != expected {
+		t.Errorf("Snapshot keys: %v %v, expected %s", keys, err, expected)
+	}
+}
+
+func TestCompactWithSnapshots(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := sealedTestStore(t)
+	defer kvStore.Close()
+	first, err := kvStore.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := kvStore.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := kvStore.LastSeq()
+
+	// Neither the changes nor the compaction after the snapshots are seen by them
+	writeKeys(t, kvStore, "g")
+	if err = kvStore.Write("c", []byte("c2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = kvStore.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := kvStore.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.SegmentsRemoved) == 0 {
+		t.Fatalf("Compact: %+v, expected segments removed", stats)
+	}
+	segmentsExist(t, fsys, stats.SegmentsRemoved, true)
+	for _, snapshot := range []*Snapshot{first, second} {
+		if snapshot.Seq() != seq {
+			t.Errorf("Snapshot seq: %d, expected %d", snapshot.Seq(), seq)
+		}
+		expectValue(t, snapshot, "a", "")
+		expectValue(t, snapshot, "b", "b2")
+		expectValue(t, snapshot, "c", "c")
+		expectValue(t, snapshot, "d", "d")
+		expectValue(t, snapshot, "g", "")
+		expectSnapshotKeys(t, snapshot, "b,c,d,e,f")
+	}
+	expectValue(t, kvStore, "c", "c2")
+	expectValue(t, kvStore, "d", "")
+
+	// The compacted segments stay until the last snapshot reading them is closed
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = first.ReadMeta("b"); err != ErrSnapshotClosed {
+		t.Errorf("Read of a closed snapshot: %v, expected ErrSnapshotClosed", err)
+	}
+	segmentsExist(t, fsys, stats.SegmentsRemoved, true)
+	expectValue(t, second, "b", "b2")
+	if err = second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segmentsExist(t, fsys, stats.SegmentsRemoved, false)
+	for _, segment := range stats.SegmentsRemoved {
+		if _, err = gkfs.ReadFile(fsys, filepath.Join(testDirectory, gklogfile.HintFileName(segment))); !gkfs.IsNotExist(err) {
+			t.Errorf("Hint file of %s: %v, expected it removed", segment, err)
+		}
+	}
+	if err = second.Close(); err != nil {
+		t.Errorf("Second close: %v", err)
+	}
+	expectValue(t, kvStore, "b", "b2")
+	expectValue(t, kvStore, "e", "e")
+}
+
+func TestCloseStoreWithSnapshot(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := sealedTestStore(t)
+	snapshot, err := kvStore.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := kvStore.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentsExist(t, fsys, stats.SegmentsRemoved, true)
+
+	// Closing the store lets go of the segments kept for the snapshot, which can't be read any more
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segmentsExist(t, fsys, stats.SegmentsRemoved, false)
+	if _, err = snapshot.Keys(""); err != ErrClosed {
+		t.Errorf("Snapshot keys after the store closed: %v, expected ErrClosed", err)
+	}
+	if err = snapshot.Close(); err != nil {
+		t.Errorf("Snapshot close after the store closed: %v", err)
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	expectValue(t, kvStore, "a", "")
+	expectValue(t, kvStore, "b", "b2")
+	expectValue(t, kvStore, "f", "f")
+}
@@ -0,0 +1,298 @@
+package gkstore
+
+import (
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuarantineDirectory is the sub directory of a store that repair moves bad data into
+const QuarantineDirectory = "quarantine"
+
+// earliestSegmentTime - nothing was written before gokave existed so older file names are suspect
+var earliestSegmentTime = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// VerifyReport - the outcome of verifying every file in a store directory
+type VerifyReport struct {
+	Directory string
+	Files     []FileReport
+	Orphans   []string
+	OK        bool
+}
+
+// FileReport - the outcome of verifying a single segment file
+type FileReport struct {
+	Name        string
+	Size        int64
+	Records     int
+	Problems    []Problem
+	Repaired    bool `json:",omitempty"`
+	Quarantined bool `json:",omitempty"`
+}
+
+// Problem - something wrong with a segment. Offset is -1 when the problem is with the file
+// as a whole (e.g. its name) rather than a byte range within it
+type Problem struct {
+	Offset  int64
+	End     int64
+	Message string
+}
+
+// Verify - check the integrity of every file in a store directory without opening the store.
+// Every segment must parse from start to end, all checksums must match and the file names must be
+// valid timestamps. Anything in the directory that isn't a segment listed in the manifest is reported
+// as an orphan
+func Verify(fsys gkfs.FS, directory string) (report *VerifyReport, err error) {
+	// Readers can share the directory but a process writing to the store would make the check unreliable
+	lock, err := lockStore(fsys, directory, false)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+	return verifyDirectory(fsys, directory, false)
+}
+
+// Repair - verify a store directory and rewrite any damaged segment from the records that can
+// still be read. The original file and each unreadable byte range are moved into the quarantine
+// sub directory, as are any orphaned files. Fails with ErrStoreLocked if the store is open elsewhere
+func Repair(fsys gkfs.FS, directory string) (report *VerifyReport, err error) {
+	lock, err := lockStore(fsys, directory, true)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+	return verifyDirectory(fsys, directory, true)
+}
+
+// Verify - check the integrity of an open store. Writes are held off while the files are checked
+func (kvStore *KvStore) Verify() (report *VerifyReport, err error) {
+	kvStore.newFileMutex.Lock()
+	defer kvStore.newFileMutex.Unlock()
+	// We already hold the directory lock
+	return verifyDirectory(kvStore.fs, kvStore.directory, false)
+}
+
+func verifyDirectory(fsys gkfs.FS, directory string, repair bool) (report *VerifyReport, err error) {
+	fileInfos, err := fsys.ReadDir(directory)
+	if err != nil {
+		return
+	}
+
+	manifest, err := readManifest(fsys, directory)
+	if err != nil {
+		return
+	}
+
+	report = &VerifyReport{Directory: directory, OK: true}
+	present := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		present[fileInfo.Name()] = true
+		if fileInfo.IsDir() && fileInfo.Name() == QuarantineDirectory {
+			continue
+		}
+		if !fileInfo.IsDir() && (fileInfo.Name() == ManifestFileName || isLockFileName(fileInfo.Name()) || fileInfo.Name() == ReplicaCursorFileName) {
+			continue
+		}
+		// A hint file that is out of date is ignored when the segment is opened so isn't a problem
+		if segment, isHint := hintSegment(fileInfo.Name()); isHint && !fileInfo.IsDir() && (manifest == nil || manifest.listed(segment)) {
+			continue
+		}
+		if fileInfo.IsDir() || !isSegmentFileName(fileInfo.Name()) || (manifest != nil && !manifest.listed(fileInfo.Name())) {
+			report.Orphans = append(report.Orphans, fileInfo.Name())
+			report.OK = false
+			continue
+		}
+
+		fileReport, err := verifyFile(fsys, directory, fileInfo.Name(), repair)
+		if err != nil {
+			return report, err
+		}
+		if len(fileReport.Problems) > 0 {
+			report.OK = false
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	if manifest != nil {
+		for _, segment := range manifest.Segments {
+			if !present[segment] {
+				report.Files = append(report.Files, FileReport{Name: segment, Problems: []Problem{{Offset: -1, End: -1, Message: "Segment listed in manifest is missing"}}})
+				report.OK = false
+			}
+		}
+	}
+
+	if repair {
+		for _, orphan := range report.Orphans {
+			if err = quarantine(fsys, directory, orphan); err != nil {
+				return
+			}
+		}
+		if manifest != nil && updateRepairedManifest(manifest, report) {
+			err = writeManifest(fsys, directory, manifest)
+		}
+	}
+	return
+}
+
+// updateRepairedManifest - drop quarantined segments from the manifest and bump the generation
+// if anything was rewritten. Returns whether the manifest changed
+func updateRepairedManifest(manifest *Manifest, report *VerifyReport) (changed bool) {
+	for _, file := range report.Files {
+		if file.Quarantined {
+			for i, segment := range manifest.Segments {
+				if segment == file.Name {
+					manifest.Segments = append(manifest.Segments[:i], manifest.Segments[i+1:]...)
+					break
+				}
+			}
+		}
+		if file.Repaired || file.Quarantined {
+			changed = true
+		}
+	}
+	if changed {
+		manifest.Generation++
+	}
+	return
+}
+
+func verifyFile(fsys gkfs.FS, directory string, fileName string, repair bool) (fileReport FileReport, err error) {
+	fileReport.Name = fileName
+	if _, err := segmentTimestamp(fileName); err != nil {
+		fileReport.Problems = append(fileReport.Problems, Problem{Offset: -1, End: -1, Message: err.Error()})
+	}
+
+	file, err := gkfs.Open(fsys, filepath.Join(directory, fileName))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	if fileReport.Size, err = file.Size(); err != nil {
+		return
+	}
+
+	header, dataStart, err := gklogfile.ReadHeader(file, fileReport.Size)
+	if err == gklogfile.ErrNotSegmentFile {
+		// Nothing to salvage from a foreign file so it is quarantined as a whole
+		fileReport.Problems = append(fileReport.Problems, Problem{Offset: -1, End: -1, Message: err.Error()})
+		if repair {
+			file.Close()
+			err = quarantine(fsys, directory, fileName)
+			fileReport.Quarantined = err == nil
+			return
+		}
+		return fileReport, nil
+	}
+	if header != nil && header.StoreName != filepath.Base(directory) {
+		fileReport.Problems = append(fileReport.Problems, Problem{Offset: -1, End: -1, Message: fmt.Sprintf("Segment belongs to store: %s", header.StoreName)})
+	}
+
+	var badRanges []Problem
+	err = gklogfile.Salvage(file, fileReport.Size, false, func(record gklogfile.Record) error {
+		fileReport.Records++
+		return nil
+	}, func(start int64, end int64, err error) error {
+		badRanges = append(badRanges, Problem{Offset: start, End: end, Message: err.Error()})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	fileReport.Problems = append(fileReport.Problems, badRanges...)
+
+	if repair && len(badRanges) > 0 {
+		if err = repairFile(fsys, directory, fileName, file, dataStart, fileReport.Size, badRanges); err != nil {
+			return
+		}
+		// Windows won't rename a file that is still open
+		file.Close()
+		if err = quarantine(fsys, directory, fileName); err != nil {
+			return
+		}
+		if err = fsys.Rename(filepath.Join(directory, fileName+".repair"), filepath.Join(directory, fileName)); err != nil {
+			return
+		}
+		// The hint file no longer matches the segment. It would be ignored anyway
+		fsys.Remove(filepath.Join(directory, gklogfile.HintFileName(fileName)))
+		fileReport.Repaired = true
+	}
+	return
+}
+
+// repairFile - copy every readable record into a new .repair file which then replaces the original.
+// The new file keeps the original name so the ordering of the store's files is preserved
+func repairFile(fsys gkfs.FS, directory string, fileName string, file gkfs.File, dataStart int64, size int64, badRanges []Problem) (err error) {
+	if err = fsys.MkdirAll(filepath.Join(directory, QuarantineDirectory), 0755); err != nil {
+		return
+	}
+
+	for _, badRange := range badRanges {
+		data := make([]byte, badRange.End-badRange.Offset)
+		if _, err = file.ReadAt(data, badRange.Offset); err != nil && err != io.EOF {
+			return
+		}
+		badName := fmt.Sprintf("%s.%d-%d", fileName, badRange.Offset, badRange.End)
+		if err = gkfs.WriteFile(fsys, filepath.Join(directory, QuarantineDirectory, badName), data); err != nil {
+			return
+		}
+	}
+
+	// Good records are copied byte for byte so they keep their original version and checksum
+	repaired, err := gkfs.Create(fsys, filepath.Join(directory, fileName+".repair"))
+	if err != nil {
+		return
+	}
+	defer repaired.Close()
+
+	if _, err = io.Copy(repaired, io.NewSectionReader(file, 0, dataStart)); err != nil {
+		return
+	}
+	err = gklogfile.Salvage(file, size, false, func(record gklogfile.Record) error {
+		_, err := io.Copy(repaired, io.NewSectionReader(file, record.Offset, record.Length))
+		return err
+	}, func(start int64, end int64, err error) error {
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return repaired.Sync()
+}
+
+func quarantine(fsys gkfs.FS, directory string, fileName string) (err error) {
+	if err = fsys.MkdirAll(filepath.Join(directory, QuarantineDirectory), 0755); err != nil {
+		return
+	}
+	return fsys.Rename(filepath.Join(directory, fileName), filepath.Join(directory, QuarantineDirectory, fileName))
+}
+
+func isSegmentFileName(fileName string) bool {
+	fileParts := strings.Split(fileName, ".")
+	return len(fileParts) == 2 && fileParts[1] == "gkv"
+}
+
+// hintSegment - the segment a hint file (see gklogfile.HintFileName) belongs to
+func hintSegment(fileName string) (segment string, isHint bool) {
+	segment = strings.TrimSuffix(fileName, gklogfile.HintSuffix)
+	return segment, segment != fileName && isSegmentFileName(segment)
+}
+
+// segmentTimestamp - segment files are named after the unix nanosecond time they were created
+func segmentTimestamp(fileName string) (created time.Time, err error) {
+	nanos, err := strconv.ParseInt(strings.TrimSuffix(fileName, ".gkv"), 10, 64)
+	if err != nil {
+		return created, fmt.Errorf("File name is not a timestamp: %s", fileName)
+	}
+	created = time.Unix(0, nanos).UTC()
+	if created.Before(earliestSegmentTime) || created.After(time.Now().Add(24*time.Hour)) {
+		return created, fmt.Errorf("File name timestamp out of range: %s", created.Format(time.RFC3339))
+	}
+	return
+}
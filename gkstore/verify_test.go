@@ -0,0 +1,189 @@
+package gkstore
+
+import (
+	"bytes"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"path/filepath"
+	"testing"
+)
+
+// testDirectory - where test stores are kept on their in memory file system
+const testDirectory = "/data/s"
+
+// createTestStore - a new store on an in memory file system
+func createTestStore(t *testing.T) (fsys *gkfs.MemFS, kvStore *KvStore) {
+	t.Helper()
+	fsys = gkfs.NewMem()
+	kvStore, err := CreateWith("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// reopenTestStore - open the store in testDirectory again
+func reopenTestStore(t *testing.T, fsys gkfs.FS) (kvStore *KvStore) {
+	t.Helper()
+	kvStore, err := OpenWith("s", Config{FS: fsys, Directory: testDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// writeKeys - write each key with its own name as the value
+func writeKeys(t *testing.T, kvStore *KvStore, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if err := kvStore.Write(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectValue - fail unless key reads as value. An empty value means the key shouldn't be readable
+func expectValue(t *testing.T, reader interface {
+	ReadMeta(key string) ([]byte, gklogfile.Meta, int, error)
+}, key string, value string) {
+	t.Helper()
+	got, _, flag, err := reader.ReadMeta(key)
+	if err != nil {
+		t.Fatalf("Read %s: %v", key, err)
+	}
+	if value == "" {
+		if flag == gklogfile.KeyWritten {
+			t.Errorf("Read %s: %q, expected nothing", key, got)
+		}
+		return
+	}
+	if flag != gklogfile.KeyWritten || string(got) != value {
+		t.Errorf("Read %s: %q (flag %d), expected %q", key, got, flag, value)
+	}
+}
+
+// recordOf - the listed segment with a record for key, and that record
+func recordOf(t *testing.T, fsys gkfs.FS, key string) (segment string, record gklogfile.Record) {
+	t.Helper()
+	manifest, err := readManifest(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range manifest.Segments {
+		data, err := gkfs.ReadFile(fsys, filepath.Join(testDirectory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		gklogfile.Scan(bytes.NewReader(data), int64(len(data)), false, func(scanned gklogfile.Record) error {
+			if scanned.Key == key {
+				found, record = true, scanned
+			}
+			return nil
+		})
+		if found {
+			return name, record
+		}
+	}
+	t.Fatalf("No segment holds %s", key)
+	return
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a", "b", "c")
+
+	report, err := kvStore.Verify()
+	if err != nil || !report.OK {
+		t.Fatalf("Verify of an open store: %+v, err %v", report, err)
+	}
+	if err = kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Verify(fsys, testDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK {
+		t.Fatalf("Report of a good store: %+v", report)
+	}
+
+	// Damage the last byte of b's value
+	segment, record := recordOf(t, fsys, "b")
+	damaged := filepath.Join(testDirectory, segment)
+	data, err := gkfs.ReadFile(fsys, damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[record.Offset+record.Length-1] ^= 0xff
+	if err = gkfs.WriteFile(fsys, damaged, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err = Verify(fsys, testDirectory); err != nil {
+		t.Fatal(err)
+	}
+	problems := 0
+	for _, file := range report.Files {
+		problems += len(file.Problems)
+	}
+	if report.OK || problems != 1 {
+		t.Fatalf("Report of a damaged store: %+v", report)
+	}
+
+	if report, err = Repair(fsys, testDirectory); err != nil {
+		t.Fatal(err)
+	}
+	repaired := 0
+	for _, file := range report.Files {
+		if file.Repaired {
+			repaired++
+		}
+	}
+	if repaired != 1 {
+		t.Errorf("Repaired files: %d, expected 1", repaired)
+	}
+	quarantined, err := fsys.ReadDir(filepath.Join(testDirectory, QuarantineDirectory))
+	if err != nil || len(quarantined) != 2 {
+		t.Errorf("Quarantined: %d files, err %v. Expected the original file and its bad range", len(quarantined), err)
+	}
+	if report, err = Verify(fsys, testDirectory); err != nil || !report.OK {
+		t.Fatalf("Report after repair: %+v, err %v", report, err)
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	expectValue(t, kvStore, "a", "a")
+	expectValue(t, kvStore, "b", "")
+	expectValue(t, kvStore, "c", "c")
+}
+
+func TestVerifyOrphans(t *testing.T) {
+	fsys, kvStore := createTestStore(t)
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gkfs.WriteFile(fsys, filepath.Join(testDirectory, "notes.txt"), []byte("stray")); err != nil {
+		t.Fatal(err)
+	}
+	// A segment the manifest doesn't list is as much an orphan as any other file
+	if err := gkfs.WriteFile(fsys, filepath.Join(testDirectory, "123.gkv"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(fsys, testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK || len(report.Orphans) != 2 || report.Orphans[0] != "123.gkv" || report.Orphans[1] != "notes.txt" {
+		t.Fatalf("Orphans: %+v", report)
+	}
+
+	if _, err = Repair(fsys, testDirectory); err != nil {
+		t.Fatal(err)
+	}
+	for _, orphan := range report.Orphans {
+		if _, err = gkfs.ReadFile(fsys, filepath.Join(testDirectory, QuarantineDirectory, orphan)); err != nil {
+			t.Errorf("Orphan not quarantined: %v", err)
+		}
+	}
+}
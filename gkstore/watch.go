@@ -0,0 +1,265 @@
+package gkstore
+
+import (
+	"context"
+	"errors"
+	"gokave/gklogfile"
+	"strings"
+)
+
+// ErrHistoryCompacted means the changes asked for can't be replayed as compaction has thrown some
+// of them away. Watch again from 0 to be sent the current value of every key
+var ErrHistoryCompacted = errors.New("Changes since this sequence number have been compacted")
+
+// ErrWatchTooSlow means a watcher didn't keep up with the writes to the store and was dropped. It
+// can carry on by watching again from the last sequence number it saw
+var ErrWatchTooSlow = errors.New("Watcher fell too far behind")
+
+// errScanDone - stops a scan early
+var errScanDone = errors.New("Scan done")
+
+// errPollFull - stops a replay once Poll has as many changes as it can return
+var errPollFull = errors.New("Poll full")
+
+// watchBuffer - how many changes a watcher can fall behind by before it is dropped
+const watchBuffer = 1024
+
+// Change - a committed write or delete. Value and Meta are only set for writes
+type Change struct {
+	Key     string
+	Deleted bool
+	Value   []byte
+	Meta    gklogfile.Meta
+	gklogfile.Stamp
+}
+
+// watcher - a subscriber to the changes made to a store. err says why changes was closed and
+// can only be read once it has been
+type watcher struct {
+	changes chan Change
+	err     error
+}
+
+// matches - whether change is after since and has a key starting with prefix. Watching from 0 also
+// includes the records from before sequence numbers existed
+func (change Change) matches(since uint64, prefix string) bool {
+	return (change.Seq > since || since == 0) && strings.HasPrefix(change.Key, prefix)
+}
+
+// LastSeq - the sequence number of the latest write or delete
+func (kvStore *KvStore) LastSeq() uint64 {
+	kvStore.commitMutex.Lock()
+	defer kvStore.commitMutex.Unlock()
+	return kvStore.lastSeq
+}
+
+// Watch - call fn for every change after since to a key starting with prefix, in sequence number
+// order. The changes already in the store are replayed from its segments and then Watch waits for
+// new ones until ctx is done, fn returns an error or the watcher is dropped with ErrWatchTooSlow.
+// Since 0 replays everything still in the segments
+func (kvStore *KvStore) Watch(ctx context.Context, since uint64, prefix string, fn func(change Change) error) (err error) {
+	w, last, err := kvStore.subscribe()
+	if err != nil {
+		return
+	}
+	defer kvStore.unsubscribe(w)
+
+	if err = kvStore.replay(since, last, prefix, fn); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change, ok := <-w.changes:
+			if !ok {
+				return w.err
+			}
+			if !change.matches(since, prefix) {
+				continue
+			}
+			if err = fn(change); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Poll - up to max changes after since to keys starting with prefix. If there are none yet Poll
+// waits for the next one, returning no changes and no error if ctx is done first
+func (kvStore *KvStore) Poll(ctx context.Context, since uint64, prefix string, max int) (changes []Change, err error) {
+	w, last, err := kvStore.subscribe()
+	if err != nil {
+		return
+	}
+	defer kvStore.unsubscribe(w)
+
+	err = kvStore.replay(since, last, prefix, func(change Change) error {
+		changes = append(changes, change)
+		if len(changes) == max {
+			return errPollFull
+		}
+		return nil
+	})
+	if err == errPollFull || (err == nil && len(changes) > 0) {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case change, ok := <-w.changes:
+			if !ok {
+				return nil, w.err
+			}
+			if !change.matches(since, prefix) {
+				continue
+			}
+			changes = append(changes, change)
+			// Take whatever else has already arrived
+			for len(changes) < max {
+				select {
+				case change, ok = <-w.changes:
+					if !ok {
+						return changes, nil
+					}
+					if change.matches(since, prefix) {
+						changes = append(changes, change)
+					}
+				default:
+					return changes, nil
+				}
+			}
+			return changes, nil
+		}
+	}
+}
+
+// subscribe - start collecting changes. last is the sequence number of the latest change before
+// the watcher was added, which is where a replay of the segments has to stop
+func (kvStore *KvStore) subscribe() (w *watcher, last uint64, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return nil, 0, ErrClosed
+	}
+	kvStore.commitMutex.Lock()
+	defer kvStore.commitMutex.Unlock()
+	if kvStore.watchers == nil {
+		kvStore.watchers = make(map[*watcher]bool)
+	}
+	w = &watcher{changes: make(chan Change, watchBuffer)}
+	kvStore.watchers[w] = true
+	return w, kvStore.lastSeq, nil
+}
+
+func (kvStore *KvStore) unsubscribe(w *watcher) {
+	kvStore.commitMutex.Lock()
+	defer kvStore.commitMutex.Unlock()
+	if kvStore.watchers[w] {
+		delete(kvStore.watchers, w)
+		close(w.changes)
+	}
+}
+
+// publish - pass change on to every watcher. A watcher that has no room left is dropped rather than
+// holding up writes. Must be called holding commitMutex
+func (kvStore *KvStore) publish(change Change) {
+	for w := range kvStore.watchers {
+		select {
+		case w.changes <- change:
+		default:
+			w.err = ErrWatchTooSlow
+			delete(kvStore.watchers, w)
+			close(w.changes)
+		}
+	}
+}
+
+// closeWatchers - drop every watcher with err
+func (kvStore *KvStore) closeWatchers(err error) {
+	kvStore.commitMutex.Lock()
+	defer kvStore.commitMutex.Unlock()
+	for w := range kvStore.watchers {
+		w.err = err
+		delete(kvStore.watchers, w)
+		close(w.changes)
+	}
+}
+
+// replay - call fn for the changes in the segments after since up to and including until. A
+// segment at a time is read under the lock so that fn can be slow without holding up writes
+func (kvStore *KvStore) replay(since uint64, until uint64, prefix string, fn func(change Change) error) (err error) {
+	kvStore.newFileMutex.RLock()
+	segments := append([]string(nil), kvStore.manifest.Segments...)
+	kvStore.newFileMutex.RUnlock()
+
+	cursor := since
+	for _, segment := range segments {
+		changes, err := kvStore.segmentChanges(segment, since, cursor, until, prefix)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err = fn(change); err != nil {
+				return err
+			}
+			if change.Seq > cursor {
+				cursor = change.Seq
+			}
+		}
+	}
+	return
+}
+
+// segmentChanges - the changes in segment after cursor up to until. Fails with ErrHistoryCompacted
+// if the segment, or any of the changes after cursor, have been compacted away
+func (kvStore *KvStore) segmentChanges(segment string, since uint64, cursor uint64, until uint64, prefix string) (changes []Change, err error) {
+	kvStore.newFileMutex.RLock()
+	defer kvStore.newFileMutex.RUnlock()
+	if kvStore.closed {
+		return nil, ErrClosed
+	}
+	if since > 0 && cursor < kvStore.manifest.CompactedSeq {
+		return nil, ErrHistoryCompacted
+	}
+	index := -1
+	for i, name := range kvStore.manifest.Segments {
+		if name == segment {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, ErrHistoryCompacted
+	}
+	file := kvStore.files[index]
+	if since > 0 && file.LastSeq() <= cursor {
+		return
+	}
+
+	err = file.Scan(true, func(record gklogfile.Record) error {
+		if record.Seq > until {
+			return errScanDone
+		}
+		change := Change{Key: record.Key, Deleted: record.EntryType == gklogfile.KeyDeleted, Stamp: record.Stamp}
+		if (record.Seq <= cursor && since != 0) || !change.matches(since, prefix) {
+			return nil
+		}
+		if record.Checksum == gklogfile.ChecksumInvalid {
+			return &gklogfile.CorruptionError{Offset: record.Offset, Err: gklogfile.ErrChecksumFailure}
+		}
+		if !change.Deleted {
+			change.Value, change.Meta = record.Value, record.Meta
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err == errScanDone {
+		err = nil
+	}
+	return
+}
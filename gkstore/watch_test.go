@@ -0,0 +1,196 @@
+package gkstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeChanges - changes as seq:key or seq:-key for deletes, for comparing in one go
+func describeChanges(changes []Change) string {
+	described := make([]string, len(changes))
+	for i, change := range changes {
+		if change.Deleted {
+			described[i] = fmt.Sprintf("%d:-%s", change.Seq, change.Key)
+			continue
+		}
+		described[i] = fmt.Sprintf("%d:%s", change.Seq, change.Key)
+	}
+	return strings.Join(described, ",")
+}
+
+// pollNow - Poll that doesn't wait for new changes
+func pollNow(t *testing.T, kvStore *KvStore, since uint64, prefix string, max int) (changes []Change, err error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	return kvStore.Poll(ctx, since, prefix, max)
+}
+
+func TestPoll(t *testing.T) {
+	_, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeKeys(t, kvStore, "a", "b", "user/1")
+	if err := kvStore.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, kvStore, "user/2")
+	if kvStore.LastSeq() != 5 {
+		t.Errorf("LastSeq: %d", kvStore.LastSeq())
+	}
+
+	for _, test := range []struct {
+		since    uint64
+		prefix   string
+		max      int
+		expected string
+	}{
+		{0, "", 100, "1:a,2:b,3:user/1,4:-a,5:user/2"},
+		{2, "", 100, "3:user/1,4:-a,5:user/2"},
+		{2, "", 2, "3:user/1,4:-a"},
+		{0, "user/", 100, "3:user/1,5:user/2"},
+		{3, "user/", 100, "5:user/2"},
+	} {
+		changes, err := pollNow(t, kvStore, test.since, test.prefix, test.max)
+		if err != nil || describeChanges(changes) != test.expected {
+			t.Errorf("Poll since %d prefix %q max %d: %s, err %v, expected %s", test.since, test.prefix, test.max, describeChanges(changes), err, test.expected)
+		}
+	}
+	changes, _ := pollNow(t, kvStore, 0, "b", 1)
+	if len(changes) != 1 || string(changes[0].Value) != "b" || changes[0].Time.IsZero() {
+		t.Errorf("Change: %+v", changes)
+	}
+
+	// With nothing after since Poll waits for the next change
+	if changes, err := pollNow(t, kvStore, 5, "", 100); err != nil || len(changes) != 0 {
+		t.Errorf("Poll with nothing new: %s, err %v", describeChanges(changes), err)
+	}
+	polled := make(chan []Change)
+	go func() {
+		changes, err := kvStore.Poll(context.Background(), 5, "user/", 100)
+		if err != nil {
+			t.Error(err)
+		}
+		polled <- changes
+	}()
+	time.Sleep(10 * time.Millisecond)
+	writeKeys(t, kvStore, "c", "user/3")
+	select {
+	case changes := <-polled:
+		if describeChanges(changes) != "7:user/3" {
+			t.Errorf("Poll woken by a write: %s", describeChanges(changes))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Poll wasn't woken by a write")
+	}
+}
+
+func TestWatchResumesAfterReopen(t *testing.T) {
+	defer smallSegments()()
+	fsys, kvStore := createTestStore(t)
+	for i := 0; i < 10; i++ {
+		writeKeys(t, kvStore, fmt.Sprintf("key%d", i))
+	}
+	if len(kvStore.files) < 3 {
+		t.Fatalf("Segments: %d, expected the writes to span several", len(kvStore.files))
+	}
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kvStore = reopenTestStore(t, fsys)
+	defer kvStore.Close()
+	if kvStore.LastSeq() != 10 {
+		t.Errorf("LastSeq after reopen: %d", kvStore.LastSeq())
+	}
+	// Carrying on from part way through an older segment
+	changes, err := pollNow(t, kvStore, 6, "", 100)
+	if err != nil || describeChanges(changes) != "7:key6,8:key7,9:key8,10:key9" {
+		t.Errorf("Poll after reopen: %s, err %v", describeChanges(changes), err)
+	}
+	// New changes carry on the numbering
+	writeKeys(t, kvStore, "new")
+	if changes, err = pollNow(t, kvStore, 10, "", 100); err != nil || describeChanges(changes) != "11:new" {
+		t.Errorf("Poll of a write after reopen: %s, err %v", describeChanges(changes), err)
+	}
+
+	// Watch replays the same way and then follows new writes
+	ctx, cancel := context.WithCancel(context.Background())
+	var watched []Change
+	done := make(chan error)
+	go func() {
+		done <- kvStore.Watch(ctx, 9, "", func(change Change) error {
+			watched = append(watched, change)
+			if len(watched) == 3 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	writeKeys(t, kvStore, "later")
+	select {
+	case err = <-done:
+		if err != context.Canceled || describeChanges(watched) != "10:key9,11:new,12:later" {
+			t.Errorf("Watch: %s, err %v", describeChanges(watched), err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch didn't end")
+	}
+}
+
+func TestWatchHistoryCompacted(t *testing.T) {
+	defer smallSegments()()
+	_, kvStore := createTestStore(t)
+	defer kvStore.Close()
+	writeSealedHistory(t, kvStore)
+	last := kvStore.LastSeq()
+	if _, err := kvStore.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes before the end of the compacted segments are gone
+	if _, err := pollNow(t, kvStore, 1, "", 100); err != ErrHistoryCompacted {
+		t.Errorf("Poll from before the compaction: %v, expected ErrHistoryCompacted", err)
+	}
+	watchErr := kvStore.Watch(context.Background(), 1, "", func(change Change) error { return nil })
+	if !errors.Is(watchErr, ErrHistoryCompacted) {
+		t.Errorf("Watch from before the compaction: %v, expected ErrHistoryCompacted", watchErr)
+	}
+	// Starting again from 0 gets the latest value of every live key
+	changes, err := pollNow(t, kvStore, 0, "", 100)
+	if err != nil || describeChanges(changes) != "3:c,4:x,5:a,7:y,8:d" {
+		t.Errorf("Poll from 0 after compaction: %s, err %v", describeChanges(changes), err)
+	}
+	// Changes after the compacted segments are still there
+	if changes, err = pollNow(t, kvStore, last-1, "", 100); err != nil || describeChanges(changes) != fmt.Sprintf("%d:d", last) {
+		t.Errorf("Poll of the active segment: %s, err %v", describeChanges(changes), err)
+	}
+}
+
+func TestWatchAfterClose(t *testing.T) {
+	_, kvStore := createTestStore(t)
+	writeKeys(t, kvStore, "a")
+	done := make(chan error)
+	go func() {
+		done <- kvStore.Watch(context.Background(), 1, "", func(change Change) error { return nil })
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := kvStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Watch when the store closed: %v, expected ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Closing the store didn't end the watch")
+	}
+	if _, err := kvStore.Poll(context.Background(), 0, "", 1); err != ErrClosed {
+		t.Errorf("Poll after close: %v, expected ErrClosed", err)
+	}
+}
@@ -0,0 +1,173 @@
+package gokave
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Key case settings for StoreConfig.KeyCase
+const (
+	// KeyCaseFold - keys are folded to lower case so "ABC" and "abc" are the same key. This is how
+	// every store behaved before the setting existed so stores without a KeyCase are treated as folding
+	KeyCaseFold = "fold"
+	// KeyCasePreserve - keys are used exactly as given. The default for new stores
+	KeyCasePreserve = "preserve"
+)
+
+// WithKeyCase - choose whether the store's keys are case sensitive. See KeyCaseFold and KeyCasePreserve
+func WithKeyCase(keyCase string) StoreOption {
+	return func(storeConfig *StoreConfig) {
+		storeConfig.KeyCase = keyCase
+	}
+}
+
+// folds - whether keys are folded to lower case. An empty KeyCase is a store from before the setting
+func (storeConfig StoreConfig) folds() bool {
+	return storeConfig.KeyCase == "" || storeConfig.KeyCase == KeyCaseFold
+}
+
+func validateKeyCase(keyCase string) error {
+	if keyCase != KeyCaseFold && keyCase != KeyCasePreserve {
+		return fmt.Errorf("%w: %q", ErrInvalidKeyCase, keyCase)
+	}
+	return nil
+}
+
+// StoreKey - key as a store with these settings holds it, so two keys are the same key if their
+// StoreKeys are equal
+func (storeConfig StoreConfig) StoreKey(key string) string {
+	if storeConfig.folds() {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// storeKey - the key as held in the store. Must be called holding the store's mutex
+func (store *Store) storeKey(key string) string {
+	return store.config.StoreKey(key)
+}
+
+// MigrateKeyCase - change whether a store's keys are case sensitive.
+// Moving to KeyCasePreserve only changes the setting as a folding store's keys are already lower
+// case, so they have to be asked for in lower case from then on.
+// Moving to KeyCaseFold rewrites every key containing upper case letters under its lower case form.
+// It fails with ErrKeyCaseConflict, changing nothing, if two live keys would fold to the same key
+// with different values. A migration that is interrupted can be run again.
+// Operations on the store wait while it runs. Returns the number of keys rewritten
+func (db *DB) MigrateKeyCase(ctx context.Context, storeName string, keyCase string) (rewritten int, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = validateKeyCase(keyCase); err != nil {
+		return 0, newError("migrate key case", storeName, "", err)
+	}
+	if db.IsReplica() {
+		return 0, newError("migrate key case", storeName, "", ErrReplica)
+	}
+
+	db.mutex.RLock()
+	store, err := db.lookup(storeName)
+	db.mutex.RUnlock()
+	if err != nil {
+		return 0, newError("migrate key case", storeName, "", err)
+	}
+
+	// The DB mutex isn't held while keys are rewritten so other stores carry on as normal
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.config.KeyCase == keyCase {
+		return
+	}
+	if keyCase == KeyCaseFold {
+		if rewritten, err = store.foldKeys(); err != nil {
+			return rewritten, newError("migrate key case", store.name, "", err)
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err = db.writable(); err != nil {
+		return rewritten, newError("migrate key case", store.name, "", err)
+	}
+	if db.stores[store.name] != store {
+		return rewritten, newError("migrate key case", store.name, "", ErrStoreNotFound)
+	}
+	updated := Config{Stores: append([]StoreConfig(nil), db.config.Stores...)}
+	updated.store(store.name).KeyCase = keyCase
+	if err = writeConfig(db.options.fs, db.options.configFile, &updated); err != nil {
+		return rewritten, newError("migrate key case", store.name, "", err)
+	}
+	db.config = &updated
+	store.config.KeyCase = keyCase
+	fmt.Printf("Store %s key case now: %s (%d keys rewritten)\n", store.name, keyCase, rewritten)
+	return
+}
+
+// foldKeys - rewrite keys containing upper case letters in lower case. Conflicts are looked for
+// before anything is written. A key whose lower case form already holds the same value is left over
+// from an interrupted migration and is just deleted. Must be called holding the store's mutex
+func (store *Store) foldKeys() (rewritten int, err error) {
+	keys, err := store.kv.Keys("")
+	if err != nil {
+		return
+	}
+	live := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		live[key] = true
+	}
+
+	folded := make(map[string]string)
+	var toFold []string
+	for _, key := range keys {
+		lower := strings.ToLower(key)
+		if lower == key {
+			continue
+		}
+		if err = ValidateKey(lower); err != nil {
+			return 0, fmt.Errorf("%w: %s", err, key)
+		}
+		if other, ok := folded[lower]; ok {
+			return 0, fmt.Errorf("%w: %s and %s", ErrKeyCaseConflict, other, key)
+		}
+		folded[lower] = key
+		if live[lower] {
+			same, sameErr := store.sameValue(key, lower)
+			if sameErr != nil {
+				return 0, sameErr
+			}
+			if !same {
+				return 0, fmt.Errorf("%w: %s and %s", ErrKeyCaseConflict, lower, key)
+			}
+		}
+		toFold = append(toFold, key)
+	}
+
+	for _, key := range toFold {
+		value, meta, _, err := store.kv.ReadMeta(key)
+		if err != nil {
+			return rewritten, err
+		}
+		if err = store.kv.WriteMeta(strings.ToLower(key), value, meta); err != nil {
+			return rewritten, err
+		}
+		if err = store.kv.Delete(key); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return
+}
+
+func (store *Store) sameValue(key string, other string) (same bool, err error) {
+	value, _, err := store.kv.Read(key)
+	if err != nil {
+		return
+	}
+	otherValue, _, err := store.kv.Read(other)
+	if err != nil {
+		return
+	}
+	return bytes.Equal(value, otherValue), nil
+}
@@ -0,0 +1,207 @@
+package gokave
+
+import (
+	"context"
+	"errors"
+	"gokave/gkfs"
+	"strings"
+	"testing"
+)
+
+// expectRead - fail unless key reads as expected, "" meaning not found
+func expectRead(t *testing.T, store *Store, key string, expected string) {
+	t.Helper()
+	value, err := store.Read(context.Background(), key)
+	if expected == "" {
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Read %s: %q, err %v, expected ErrKeyNotFound", key, value, err)
+		}
+		return
+	}
+	if err != nil || string(value) != expected {
+		t.Errorf("Read %s: %q, err %v, expected %q", key, value, err, expected)
+	}
+}
+
+// writeValues - write key value pairs to store
+func writeValues(t *testing.T, store *Store, keyValues ...string) {
+	t.Helper()
+	for i := 0; i < len(keyValues); i += 2 {
+		if err := store.Write(context.Background(), keyValues[i], []byte(keyValues[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLegacyStoreFolds(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	if _, err := db.CreateStore(ctx, "legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(ctx, "legacy", "key", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A config written before KeyCase existed
+	if err := writeConfig(fsys, "/config.json", &Config{Stores: []StoreConfig{{Name: "legacy"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, fsys)
+	defer db.Close()
+	store, err := db.OpenStore(ctx, "LEGACY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Config().KeyCase != "" || !store.Config().folds() {
+		t.Errorf("Legacy config: %+v", store.Config())
+	}
+	expectRead(t, store, "KEY", "v")
+	expectRead(t, store, "Key", "v")
+	writeValues(t, store, "Other", "w")
+	if keys, err := store.Keys(ctx, "O"); err != nil || strings.Join(keys, ",") != "other" {
+		t.Errorf("Keys: %v, err %v", keys, err)
+	}
+	if err = store.Delete(ctx, "KEY"); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, store, "key", "")
+
+	// New stores are case sensitive
+	preserved, err := db.CreateStore(ctx, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeValues(t, preserved, "Key", "v")
+	expectRead(t, preserved, "key", "")
+	if _, err = db.OpenStore(ctx, "NEW"); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("Open of a case sensitive store in upper case: %v, expected ErrStoreNotFound", err)
+	}
+
+	// The store is removed by the same name it is found by
+	if err = db.DeleteStore(ctx, "Legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.OpenStore(ctx, "legacy"); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("Open after delete: %v, expected ErrStoreNotFound", err)
+	}
+}
+
+func TestMigrateKeyCaseConflict(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, gkfs.NewMem())
+	defer db.Close()
+	store, err := db.CreateStore(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeValues(t, store, "Key", "upper", "key", "lower", "Other", "o")
+
+	rewritten, err := db.MigrateKeyCase(ctx, "s", KeyCaseFold)
+	if !errors.Is(err, ErrKeyCaseConflict) || rewritten != 0 {
+		t.Fatalf("Migrate: %d rewritten, err %v, expected ErrKeyCaseConflict", rewritten, err)
+	}
+	if !strings.Contains(err.Error(), "Key") {
+		t.Errorf("The conflict doesn't name the key: %v", err)
+	}
+	// Nothing was changed, even the keys that didn't conflict
+	if store.Config().KeyCase != KeyCasePreserve {
+		t.Errorf("Key case after a conflict: %s", store.Config().KeyCase)
+	}
+	expectRead(t, store, "Key", "upper")
+	expectRead(t, store, "key", "lower")
+	expectRead(t, store, "Other", "o")
+	expectRead(t, store, "other", "")
+
+	// Keys folding to the same value aren't a conflict
+	writeValues(t, store, "Key", "lower")
+	if rewritten, err = db.MigrateKeyCase(ctx, "s", KeyCaseFold); err != nil || rewritten != 2 {
+		t.Fatalf("Migrate: %d rewritten, err %v", rewritten, err)
+	}
+	if keys, err := store.Keys(ctx, ""); err != nil || strings.Join(keys, ",") != "key,other" {
+		t.Errorf("Keys after migrate: %v, err %v", keys, err)
+	}
+
+	if _, err = db.MigrateKeyCase(ctx, "s", "upper"); !errors.Is(err, ErrInvalidKeyCase) {
+		t.Errorf("Migrate to an unknown key case: %v, expected ErrInvalidKeyCase", err)
+	}
+	if _, err = db.MigrateKeyCase(ctx, "t", KeyCaseFold); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("Migrate of a missing store: %v, expected ErrStoreNotFound", err)
+	}
+}
+
+func TestMigrateKeyCase(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	store, err := db.CreateStore(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeValues(t, store, "Key", "v", "UPPER", "u", "lower", "l")
+	if err = store.Delete(ctx, "UPPER"); err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, err := db.MigrateKeyCase(ctx, "s", KeyCaseFold)
+	if err != nil || rewritten != 1 {
+		t.Fatalf("Migrate: %d rewritten, err %v", rewritten, err)
+	}
+	// Running it again does nothing
+	if rewritten, err = db.MigrateKeyCase(ctx, "s", KeyCaseFold); err != nil || rewritten != 0 {
+		t.Errorf("Second migrate: %d rewritten, err %v", rewritten, err)
+	}
+	if store.Config().KeyCase != KeyCaseFold {
+		t.Errorf("Key case: %s", store.Config().KeyCase)
+	}
+
+	// Reads, writes and deletes in any case now reach the folded key
+	expectRead(t, store, "key", "v")
+	expectRead(t, store, "KEY", "v")
+	expectRead(t, store, "Lower", "l")
+	expectRead(t, store, "upper", "")
+	writeValues(t, store, "NEW", "n")
+	expectRead(t, store, "new", "n")
+	if err = store.Delete(ctx, "KeY"); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, store, "key", "")
+	if err = db.Delete(ctx, "s", "LOWER"); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, store, "lower", "")
+	if keys, err := store.Keys(ctx, ""); err != nil || strings.Join(keys, ",") != "new" {
+		t.Errorf("Keys: %v, err %v", keys, err)
+	}
+
+	// The setting is kept in the config
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, fsys)
+	defer db.Close()
+	if store, err = db.OpenStore(ctx, "S"); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, store, "New", "n")
+
+	// Going back to case sensitive keys rewrites nothing, and the keys are lower case from then on
+	if rewritten, err = db.MigrateKeyCase(ctx, "s", KeyCasePreserve); err != nil || rewritten != 0 {
+		t.Fatalf("Migrate back: %d rewritten, err %v", rewritten, err)
+	}
+	expectRead(t, store, "new", "n")
+	expectRead(t, store, "NEW", "")
+	writeValues(t, store, "NEW", "upper")
+	expectRead(t, store, "new", "n")
+	if err = store.Delete(ctx, "New"); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, store, "new", "n")
+	if _, err = db.OpenStore(ctx, "S"); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("Open in upper case after migrating back: %v, expected ErrStoreNotFound", err)
+	}
+}
@@ -0,0 +1,11 @@
+package gokave
+
+import "gokave/gklogfile"
+
+// Meta - small named strings stored alongside a value, e.g. its content type. Names are case
+// sensitive. The whole of a value's meta has to fit in 64KB
+type Meta = gklogfile.Meta
+
+// MetaContentType - the meta name for the media type of a value. The HTTP API stores the
+// Content-Type header of a write under it and returns it on reads
+const MetaContentType = "Content-Type"
@@ -0,0 +1,54 @@
+package gokave
+
+import (
+	"context"
+	"errors"
+	"gokave/gkfs"
+	"reflect"
+	"testing"
+)
+
+func TestMetaAfterReopen(t *testing.T) {
+	ctx := context.Background()
+	fsys := gkfs.NewMem()
+	db := openTestDB(t, fsys)
+	store, err := db.CreateStore(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := Meta{MetaContentType: "application/json", "Owner": "ops"}
+	if err = store.WriteMeta(ctx, "k", []byte(`{"n":1}`), meta); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Write(ctx, "plain", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, fsys)
+	defer db.Close()
+	value, got, err := db.ReadMeta(ctx, "s", "k")
+	if err != nil || string(value) != `{"n":1}` || !reflect.DeepEqual(got, meta) {
+		t.Errorf("ReadMeta: %q %v, err %v", value, got, err)
+	}
+	got, valueLength, err := db.Head(ctx, "s", "k")
+	if err != nil || valueLength != 7 || !reflect.DeepEqual(got, meta) {
+		t.Errorf("Head: %v %d, err %v", got, valueLength, err)
+	}
+	if _, got, err = db.ReadMeta(ctx, "s", "plain"); err != nil || got != nil {
+		t.Errorf("ReadMeta of a value without meta: %v, err %v", got, err)
+	}
+
+	// Overwriting a value replaces its meta too
+	if err = db.Write(ctx, "s", "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err = db.Head(ctx, "s", "k"); err != nil || got != nil {
+		t.Errorf("Meta after an overwrite: %v, err %v", got, err)
+	}
+	if _, _, err = db.Head(ctx, "s", "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Head of a missing key: %v, expected ErrKeyNotFound", err)
+	}
+}
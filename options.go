@@ -0,0 +1,66 @@
+package gokave
+
+import (
+	"gokave/gkfs"
+	"gokave/gkstore"
+)
+
+// DefaultConfigFile is where the list of stores is kept unless WithConfigFile says otherwise
+const DefaultConfigFile = "c:\\devwork\\go\\gokave_config\\store_data.json"
+
+// Option - a setting for Open
+type Option func(*options)
+
+type options struct {
+	dataDirectory string
+	configFile    string
+	fs            gkfs.FS
+	readOnly      bool
+	replica       bool
+}
+
+func defaultOptions() options {
+	return options{
+		dataDirectory: gkstore.DataDirectory,
+		configFile:    DefaultConfigFile,
+		fs:            gkfs.OS,
+	}
+}
+
+// WithDataDirectory - the directory holding a sub directory per store
+func WithDataDirectory(directory string) Option {
+	return func(o *options) {
+		o.dataDirectory = directory
+	}
+}
+
+// WithConfigFile - the JSON file listing the stores
+func WithConfigFile(fileName string) Option {
+	return func(o *options) {
+		o.configFile = fileName
+	}
+}
+
+// WithFS - keep everything on fsys rather than the real file system (e.g. gkfs.NewMem())
+func WithFS(fsys gkfs.FS) Option {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// WithReadOnly - open every store read only. Stores can't be created or deleted and writes fail
+// with ErrReadOnly. Other read only processes can have the stores open at the same time
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithReplica - open the DB as a replica of another DB. Writes, and creating, deleting or migrating
+// stores, fail with ErrReplica until Promote is called. The replica is kept in step with its primary
+// through DB.Replication, e.g. by a gkreplica.Follower
+func WithReplica() Option {
+	return func(o *options) {
+		o.replica = true
+	}
+}
@@ -0,0 +1,172 @@
+package gokave
+
+import (
+	"context"
+	"fmt"
+	"gokave/gkfs"
+	"gokave/gklogfile"
+	"gokave/gkstore"
+	"sync/atomic"
+)
+
+// IsReplica - whether the DB was opened with WithReplica and hasn't been promoted
+func (db *DB) IsReplica() bool {
+	return atomic.LoadInt32(&db.replica) == 1
+}
+
+// Promote - stop being a replica and start accepting writes. Whatever is applying the primary's
+// records has to be stopped first. Promoting a DB that isn't a replica does nothing
+func (db *DB) Promote() {
+	if atomic.CompareAndSwapInt32(&db.replica, 1, 0) {
+		fmt.Println("Promoted from replica")
+	}
+}
+
+// Replication - the operations used to keep a replica in step with its primary, and to read a
+// primary's records. Unlike the DB's own methods they work on a replica
+type Replication struct {
+	db *DB
+}
+
+// Replication - see Replication
+func (db *DB) Replication() *Replication {
+	return &Replication{db: db}
+}
+
+// ReadSegment - raw records from one of a store's segments. See gkstore.KvStore.ReadSegment
+func (replication *Replication) ReadSegment(ctx context.Context, storeName string, segment string, offset int64, maxBytes int64) (records gkstore.SegmentRecords, err error) {
+	store, err := replication.db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	records, err = store.kvStore().ReadSegment(segment, offset, maxBytes)
+	return records, newError("read segment", store.name, "", err)
+}
+
+// EnsureStore - create the store if it doesn't exist, otherwise bring its settings into line with
+// storeConfig. Keys aren't touched when the key case changes as the primary's rewrites will follow
+func (replication *Replication) EnsureStore(ctx context.Context, storeConfig StoreConfig) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	db := replication.db
+	db.mutex.Lock()
+	store := db.stores[storeConfig.Name]
+	if store == nil {
+		_, err = db.createStore(storeConfig)
+		db.mutex.Unlock()
+		return
+	}
+	db.mutex.Unlock()
+
+	// The store's mutex has to be taken before the DB's. See MigrateKeyCase
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.config == storeConfig {
+		return
+	}
+	codec, err := lookupCodec(storeConfig.Codec)
+	if err != nil {
+		return newError("ensure store", store.name, "", err)
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err = db.writable(); err != nil {
+		return newError("ensure store", store.name, "", err)
+	}
+	if db.stores[store.name] != store {
+		return newError("ensure store", store.name, "", ErrStoreNotFound)
+	}
+	updated := Config{Stores: append([]StoreConfig(nil), db.config.Stores...)}
+	*updated.store(store.name) = storeConfig
+	if err = writeConfig(db.options.fs, db.options.configFile, &updated); err != nil {
+		return newError("ensure store", store.name, "", err)
+	}
+	db.config = &updated
+	store.config, store.codec = storeConfig, codec
+	return
+}
+
+// DeleteStore - remove a store that no longer exists on the primary
+func (replication *Replication) DeleteStore(ctx context.Context, storeName string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	replication.db.mutex.Lock()
+	defer replication.db.mutex.Unlock()
+	return replication.db.deleteStore(storeName)
+}
+
+// ResetStore - throw away a store's data, and its replica cursor, leaving it empty. Used when the
+// replica is too far behind to catch up from the primary's segments
+func (replication *Replication) ResetStore(ctx context.Context, storeName string) (err error) {
+	db := replication.db
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	// Operations on the store wait while it is emptied
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if err = db.writable(); err != nil {
+		return newError("reset store", store.name, "", err)
+	}
+	if db.stores[store.name] != store {
+		return newError("reset store", store.name, "", ErrStoreNotFound)
+	}
+
+	fmt.Printf("Resetting store: %s\n", store.name)
+	if err = store.kv.Close(); err != nil {
+		return newError("reset store", store.name, "", err)
+	}
+	if err = gkfs.RemoveAll(db.options.fs, db.storeDirectory(store.name)); err != nil {
+		return newError("reset store", store.name, "", err)
+	}
+	kv, err := gkstore.CreateWith(store.name, db.storeConfig(store.name))
+	if err != nil {
+		return newError("reset store", store.name, "", err)
+	}
+	store.kv = kv
+	return
+}
+
+// Apply - write records read from the primary's segments. See gkstore.KvStore.Apply
+func (replication *Replication) Apply(ctx context.Context, storeName string, records []gklogfile.Record) (applied int, err error) {
+	store, err := replication.db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	applied, err = store.kvStore().Apply(records)
+	return applied, newError("apply", store.name, "", err)
+}
+
+// Repair - write records from another copy of a store to bring this one into line with it. See
+// gkstore.KvStore.Repair
+func (replication *Replication) Repair(ctx context.Context, storeName string, records []gklogfile.Record) (err error) {
+	store, err := replication.db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	return newError("repair", store.name, "", store.kvStore().Repair(records))
+}
+
+// Cursor - how far the replica has got through the primary's segments for a store
+func (replication *Replication) Cursor(ctx context.Context, storeName string) (cursor gkstore.ReplicaCursor, err error) {
+	store, err := replication.db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	cursor, err = store.kvStore().ReadReplicaCursor()
+	return cursor, newError("cursor", store.name, "", err)
+}
+
+// SetCursor - record how far the replica has got. Everything applied so far is synced first
+func (replication *Replication) SetCursor(ctx context.Context, storeName string, cursor gkstore.ReplicaCursor) (err error) {
+	store, err := replication.db.OpenStore(ctx, storeName)
+	if err != nil {
+		return
+	}
+	return newError("set cursor", store.name, "", store.kvStore().WriteReplicaCursor(cursor))
+}
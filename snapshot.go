@@ -0,0 +1,98 @@
+package gokave
+
+import (
+	"context"
+	"gokave/gkstore"
+)
+
+// Snapshot - a read only view of a store as it was when Store.Snapshot was called, so several reads
+// see the same values however many writes are made in between. It holds on to segments the store
+// would otherwise remove when it is compacted, so close it as soon as it is finished with. Sharing
+// a snapshot between goroutines is safe
+type Snapshot struct {
+	store    *Store
+	snapshot *gkstore.Snapshot
+}
+
+// Snapshot - a view of the store pinned at its latest change
+func (store *Store) Snapshot(ctx context.Context) (snapshot *Snapshot, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	kvSnapshot, err := store.kvStore().Snapshot()
+	if err != nil {
+		return nil, newError("snapshot", store.name, "", err)
+	}
+	return &Snapshot{store: store, snapshot: kvSnapshot}, nil
+}
+
+// Store - the store the snapshot is of
+func (snapshot *Snapshot) Store() *Store {
+	return snapshot.store
+}
+
+// Seq - the sequence number of the last change the snapshot sees
+func (snapshot *Snapshot) Seq() uint64 {
+	return snapshot.snapshot.Seq()
+}
+
+// Read - as Store.Read at the snapshot
+func (snapshot *Snapshot) Read(ctx context.Context, key string) (value []byte, err error) {
+	value, _, err = snapshot.ReadMeta(ctx, key)
+	return
+}
+
+// ReadMeta - as Store.ReadMeta at the snapshot
+func (snapshot *Snapshot) ReadMeta(ctx context.Context, key string) (value []byte, meta Meta, err error) {
+	store := snapshot.store
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = store.check(ctx, key); err != nil {
+		return nil, nil, newError("read", store.name, key, err)
+	}
+	value, meta, flag, err := snapshot.snapshot.ReadMeta(store.storeKey(key))
+	if err = flagError(flag, err); err != nil {
+		return nil, nil, newError("read", store.name, key, err)
+	}
+	return
+}
+
+// ReadMany - as Store.ReadMany at the snapshot
+func (snapshot *Snapshot) ReadMany(ctx context.Context, keys []string) (results map[string]ReadResult, err error) {
+	store := snapshot.store
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.readMany(ctx, keys, snapshot.snapshot.ReadMany)
+}
+
+// Head - as Store.Head at the snapshot
+func (snapshot *Snapshot) Head(ctx context.Context, key string) (meta Meta, valueLength int, err error) {
+	store := snapshot.store
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = store.check(ctx, key); err != nil {
+		return nil, 0, newError("head", store.name, key, err)
+	}
+	meta, valueLength, flag, err := snapshot.snapshot.Head(store.storeKey(key))
+	if err = flagError(flag, err); err != nil {
+		return nil, 0, newError("head", store.name, key, err)
+	}
+	return
+}
+
+// Keys - as Store.Keys at the snapshot
+func (snapshot *Snapshot) Keys(ctx context.Context, prefix string) (keys []string, err error) {
+	store := snapshot.store
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	keys, err = snapshot.snapshot.Keys(store.storeKey(prefix))
+	return keys, newError("keys", store.name, "", err)
+}
+
+// Close - let go of the snapshot. Calling Close more than once is harmless
+func (snapshot *Snapshot) Close() error {
+	return newError("close snapshot", snapshot.store.name, "", snapshot.snapshot.Close())
+}
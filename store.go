@@ -0,0 +1,222 @@
+package gokave
+
+import (
+	"context"
+	"gokave/gklogfile"
+	"gokave/gkstore"
+	"sync"
+)
+
+// Store - a single named store within a DB
+type Store struct {
+	db     *DB
+	name   string
+	kv     *gkstore.KvStore
+	config StoreConfig
+	codec  Codec
+	mutex  sync.RWMutex // guards config. Held exclusively while the key case is migrated
+}
+
+// Name - the store's name
+func (store *Store) Name() string {
+	return store.name
+}
+
+// Config - the store's settings
+func (store *Store) Config() StoreConfig {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.config
+}
+
+// Write - write a value, replacing any existing value (and meta) for the key
+func (store *Store) Write(ctx context.Context, key string, value []byte) (err error) {
+	return store.WriteMeta(ctx, key, value, nil)
+}
+
+// WriteMeta - as Write, storing meta alongside the value. meta may be nil
+func (store *Store) WriteMeta(ctx context.Context, key string, value []byte, meta Meta) (err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = store.checkWrite(ctx, key); err != nil {
+		return newError("write", store.name, key, err)
+	}
+	return newError("write", store.name, key, store.kv.WriteMeta(store.storeKey(key), value, meta))
+}
+
+// Read - read the value for a key. Fails with ErrKeyNotFound if the key has never been written and
+// ErrKeyDeleted if it has been deleted (which errors.Is also matches against ErrKeyNotFound)
+func (store *Store) Read(ctx context.Context, key string) (value []byte, err error) {
+	value, _, err = store.ReadMeta(ctx, key)
+	return
+}
+
+// ReadMeta - as Read but also returning the meta the value was written with
+func (store *Store) ReadMeta(ctx context.Context, key string) (value []byte, meta Meta, err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = store.check(ctx, key); err != nil {
+		return nil, nil, newError("read", store.name, key, err)
+	}
+	value, meta, flag, err := store.kv.ReadMeta(store.storeKey(key))
+	if err = flagError(flag, err); err != nil {
+		return nil, nil, newError("read", store.name, key, err)
+	}
+	return
+}
+
+// ReadResult - the outcome for one key of ReadMany. Err is nil if the key was found, otherwise it
+// matches ErrKeyNotFound, ErrKeyDeleted, ErrInvalidKey or is the error reading the value
+type ReadResult struct {
+	Value []byte
+	Meta  Meta
+	Err   error
+}
+
+// ReadMany - read several keys together, which is much cheaper than reading them one at a time.
+// There is a result for every distinct key asked for. The error is only set if nothing could be read
+func (store *Store) ReadMany(ctx context.Context, keys []string) (results map[string]ReadResult, err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.readMany(ctx, keys, store.kv.ReadMany)
+}
+
+// readMany - ReadMany reading the keys as held in the store with read. Must be called holding the
+// store's mutex
+func (store *Store) readMany(ctx context.Context, keys []string, read func(keys []string) (map[string]gklogfile.Result, error)) (results map[string]ReadResult, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, newError("read many", store.name, "", err)
+	}
+
+	// A store that folds keys can be asked for the same stored key more than once
+	results = make(map[string]ReadResult, len(keys))
+	requested := make(map[string][]string, len(keys))
+	storeKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		storeKey := store.storeKey(key)
+		if err := ValidateKey(storeKey); err != nil {
+			results[key] = ReadResult{Err: newError("read", store.name, key, err)}
+			continue
+		}
+		results[key] = ReadResult{}
+		if _, ok := requested[storeKey]; !ok {
+			storeKeys = append(storeKeys, storeKey)
+		}
+		requested[storeKey] = append(requested[storeKey], key)
+	}
+
+	found, err := read(storeKeys)
+	if err != nil {
+		return nil, newError("read many", store.name, "", err)
+	}
+	for storeKey, requestedKeys := range requested {
+		result := found[storeKey]
+		for _, key := range requestedKeys {
+			results[key] = ReadResult{Value: result.Value, Meta: result.Meta, Err: newError("read", store.name, key, flagError(result.Flag, result.Err))}
+		}
+	}
+	return
+}
+
+// Head - the meta and length of the value for a key without reading the value
+func (store *Store) Head(ctx context.Context, key string) (meta Meta, valueLength int, err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = store.check(ctx, key); err != nil {
+		return nil, 0, newError("head", store.name, key, err)
+	}
+	meta, valueLength, flag, err := store.kv.Head(store.storeKey(key))
+	if err = flagError(flag, err); err != nil {
+		return nil, 0, newError("head", store.name, key, err)
+	}
+	return
+}
+
+// flagError - the error for a read that found a deleted or missing key
+func flagError(flag int, err error) error {
+	if err != nil {
+		return err
+	}
+	switch flag {
+	case gklogfile.KeyDeleted:
+		return ErrKeyDeleted
+	case gklogfile.KeyNotPresent:
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Delete - delete the value for a key. Deleting a key that isn't present isn't an error
+func (store *Store) Delete(ctx context.Context, key string) (err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = store.checkWrite(ctx, key); err != nil {
+		return newError("delete", store.name, key, err)
+	}
+	return newError("delete", store.name, key, store.kv.Delete(store.storeKey(key)))
+}
+
+// Verify - check the integrity of the store's files. Writes wait while this runs
+func (store *Store) Verify(ctx context.Context) (report *gkstore.VerifyReport, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	report, err = store.kvStore().Verify()
+	return report, newError("verify", store.name, "", err)
+}
+
+// Compact - merge the store's sealed segments, dropping overwritten and deleted values. Reads and
+// writes wait while this runs
+func (store *Store) Compact(ctx context.Context) (stats gkstore.CompactStats, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	stats, err = store.kvStore().Compact()
+	return stats, newError("compact", store.name, "", err)
+}
+
+// MerkleTree - a hash tree over the store's keys and values for comparing it with another copy.
+// See gkstore.KvStore.MerkleTree
+func (store *Store) MerkleTree(ctx context.Context) (tree *gkstore.MerkleTree, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	tree, err = store.kvStore().MerkleTree()
+	return tree, newError("merkle tree", store.name, "", err)
+}
+
+// Keys - the keys in the store starting with prefix, in order. Deleted keys aren't included
+func (store *Store) Keys(ctx context.Context, prefix string) (keys []string, err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	keys, err = store.kv.Keys(store.storeKey(prefix))
+	return keys, newError("keys", store.name, "", err)
+}
+
+func (store *Store) check(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ValidateKey(store.storeKey(key))
+}
+
+// checkWrite - as check, also refusing writes to a replica
+func (store *Store) checkWrite(ctx context.Context, key string) error {
+	if store.db.IsReplica() {
+		return ErrReplica
+	}
+	return store.check(ctx, key)
+}
+
+// kvStore - the store's KvStore, which is only replaced while the store's mutex is held exclusively
+func (store *Store) kvStore() *gkstore.KvStore {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.kv
+}
@@ -0,0 +1,62 @@
+package gokave
+
+import (
+	"context"
+	"gokave/gkstore"
+)
+
+// Change - a committed write or delete of a key. Seq numbers every change to a store in the order
+// they were made. Keys are as held in the store, so lower case for a store that folds keys
+type Change = gkstore.Change
+
+// Watch - call fn for each change to a key starting with prefix made after the change numbered since,
+// in order, and then for each new change as it is made. Returns when ctx is done or fn fails.
+// A watcher that falls too far behind is stopped with ErrWatchTooSlow and can pick up again from the
+// last Seq it saw. Since 0 replays every change still held by the store. Fails with
+// ErrHistoryCompacted if changes after since have been compacted away
+func (store *Store) Watch(ctx context.Context, since uint64, prefix string, fn func(change Change) error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	// Don't hold the store's mutex for the life of the watch or a key case migration would never get in
+	store.mutex.RLock()
+	prefix, kv := store.storeKey(prefix), store.kv
+	store.mutex.RUnlock()
+	return newError("watch", store.name, "", kv.Watch(ctx, since, prefix, fn))
+}
+
+// Poll - up to max changes to keys starting with prefix made after the change numbered since. If
+// there are none Poll waits for the next one, returning nothing if ctx is done first. See Watch
+func (store *Store) Poll(ctx context.Context, since uint64, prefix string, max int) (changes []Change, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	store.mutex.RLock()
+	prefix, kv := store.storeKey(prefix), store.kv
+	store.mutex.RUnlock()
+	changes, err = kv.Poll(ctx, since, prefix, max)
+	return changes, newError("poll", store.name, "", err)
+}
+
+// LastSeq - the Seq of the latest change to the store
+func (store *Store) LastSeq() uint64 {
+	return store.kvStore().LastSeq()
+}
+
+// Watch - follow the changes to a store. See Store.Watch
+func (db *DB) Watch(ctx context.Context, storeName string, since uint64, prefix string, fn func(change Change) error) error {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return err
+	}
+	return store.Watch(ctx, since, prefix, fn)
+}
+
+// Poll - wait for changes to a store. See Store.Poll
+func (db *DB) Poll(ctx context.Context, storeName string, since uint64, prefix string, max int) ([]Change, error) {
+	store, err := db.OpenStore(ctx, storeName)
+	if err != nil {
+		return nil, err
+	}
+	return store.Poll(ctx, since, prefix, max)
+}